@@ -0,0 +1,348 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Transfers sent with require_accept, or above TRANSFER_ACCEPT_THRESHOLD,
+// wait for the recipient. The sender's points move to HeldPoints when the
+// transfer is created (so they count against the balance and daily limit
+// straight away) and the transaction stays pending with AcceptRequired set
+// until the recipient accepts it, completing it, or declines it. Transfers
+// nobody acts on expire after heldTransferTTL. Declined and expired
+// transfers give the held points back to the sender, into the points lots
+// they came from, so holding and refunding can't extend their expiry.
+const (
+	heldTransferTTL           = 72 * time.Hour
+	heldTransferSweepInterval = 10 * time.Minute
+)
+
+// HeldLot is how much of one of the sender's points lots a transfer
+// awaiting acceptance took. The rows go when the transfer is settled.
+type HeldLot struct {
+	ID            uint  `gorm:"primaryKey"`
+	TransactionID uint  `gorm:"index;not null"`
+	LotID         uint  `gorm:"not null"`
+	Amount        int64 `gorm:"not null"`
+}
+
+func init() {
+	registerInvariant("held_lot_orphaned",
+		"held lots whose lot doesn't exist or whose transfer is no longer awaiting acceptance",
+		`SELECT h.id FROM held_lots h
+			LEFT JOIN transactions t ON t.id = h.transaction_id
+			LEFT JOIN points_lots l ON l.id = h.lot_id
+			WHERE t.id IS NULL OR t.status <> 'pending' OR l.id IS NULL`)
+	registerInvariant("held_points_mismatch",
+		"users whose held points differ from their transfers awaiting acceptance",
+		`SELECT u.id FROM users u
+			LEFT JOIN transactions t ON t.from_user_id = u.id AND t.status = 'pending' AND t.accept_required
+			GROUP BY u.id, u.held_points
+			HAVING COALESCE(SUM(t.amount), 0) <> u.held_points`)
+}
+
+// transferAcceptThreshold is the amount above which the recipient has to
+// accept a transfer (TRANSFER_ACCEPT_THRESHOLD); 0 when unset, leaving it
+// to the sender's require_accept
+func transferAcceptThreshold() int64 {
+	return int64(envPositiveInt("TRANSFER_ACCEPT_THRESHOLD", 0))
+}
+
+// requiresAcceptance reports whether req's transfer waits for the recipient
+func requiresAcceptance(req transferRequest) bool {
+	threshold := transferAcceptThreshold()
+	return req.RequireAccept || (threshold > 0 && req.Amount > threshold)
+}
+
+// createHeldTransfer holds req's amount from fromUser and records the
+// transfer awaiting toUser's acceptance
+func createHeldTransfer(fromUser, toUser User, req transferRequest) (*transferResult, error) {
+	result := &transferResult{Recipient: toUser, AwaitingAcceptance: true}
+	err := withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		taken, err := debitPoints(tx, fromUser, req.Amount)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&User{}).Where("id = ?", fromUser.ID).
+			Update("held_points", gorm.Expr("held_points + ?", req.Amount)).Error; err != nil {
+			return fmt.Errorf("hold points: %w", err)
+		}
+		fromAfter, err := balanceOf(tx, fromUser.ID)
+		if err != nil {
+			return err
+		}
+		result.Remaining = fromAfter
+
+		result.Transaction = Transaction{
+			FromUserID:       fromUser.ID,
+			ToUserID:         toUser.ID,
+			Amount:           req.Amount,
+			Type:             "transfer",
+			Status:           "pending",
+			AcceptRequired:   true,
+			Description:      fmt.Sprintf("Transfer to %s %s", toUser.FirstName, toUser.LastName),
+			Note:             req.Note,
+			FromBalanceAfter: &fromAfter,
+		}
+		if err := tx.Create(&result.Transaction).Error; err != nil {
+			return fmt.Errorf("create transaction record: %w", err)
+		}
+		if err := recordTransactionCreated(tx, &result.Transaction, actorUser, fromUser.ID); err != nil {
+			return err
+		}
+		for _, take := range taken {
+			held := HeldLot{TransactionID: result.Transaction.ID, LotID: take.LotID, Amount: take.Amount}
+			if err := tx.Create(&held).Error; err != nil {
+				return fmt.Errorf("record held lot: %w", err)
+			}
+		}
+		status, body := transferResponse(result)
+		return req.Idempotency.store(tx, status, body)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("held transfer from user %d: %w", fromUser.ID, err)
+	}
+	return result, nil
+}
+
+func heldTransferResponse(result *transferResult) fiber.Map {
+	return fiber.Map{
+		"message":          "Transfer awaiting the recipient's acceptance",
+		"transaction_id":   result.Transaction.ID,
+		"amount":           result.Transaction.Amount,
+		"remaining_points": result.Remaining,
+		"expires_at":       result.Transaction.CreatedAt.Add(heldTransferTTL),
+		"recipient": fiber.Map{
+			"member_id":  result.Recipient.MemberID,
+			"first_name": result.Recipient.FirstName,
+			"last_name":  result.Recipient.LastName,
+		},
+	}
+}
+
+// releaseHeldPoints takes txn's amount off its sender's held points inside
+// tx, locking their row first like debitPoints does
+func releaseHeldPoints(tx *gorm.DB, txn Transaction) error {
+	var sender User
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "held_points").
+		First(&sender, txn.FromUserID).Error; err != nil {
+		return fmt.Errorf("lock sender: %w", err)
+	}
+	res := tx.Model(&User{}).Where("id = ? AND held_points >= ?", txn.FromUserID, txn.Amount).
+		Update("held_points", gorm.Expr("held_points - ?", txn.Amount))
+	if res.Error != nil {
+		return fmt.Errorf("release held points: %w", res.Error)
+	}
+	if res.RowsAffected != 1 {
+		return fmt.Errorf("user %d holds less than transfer %d", txn.FromUserID, txn.ID)
+	}
+	return nil
+}
+
+// refundHeldPoints credits txn's amount back to its sender inside tx,
+// restoring the lots it was taken from with their original expiry; points
+// past due are left for the expiry job to take. Like openPointsLot, it
+// restores nothing that goes to pay off a negative balance. Holds made
+// before lots were recorded open a new lot instead.
+func refundHeldPoints(tx *gorm.DB, txn Transaction) error {
+	var held []HeldLot
+	if err := tx.Where("transaction_id = ?", txn.ID).Order("id").Find(&held).Error; err != nil {
+		return fmt.Errorf("find held lots: %w", err)
+	}
+	if len(held) == 0 {
+		return creditPoints(tx, txn.FromUserID, txn.Amount)
+	}
+	res := tx.Model(&User{}).Where("id = ?", txn.FromUserID).
+		Update("points", gorm.Expr("points + ?", txn.Amount))
+	if res.Error != nil {
+		return fmt.Errorf("refund points: %w", res.Error)
+	}
+	if res.RowsAffected != 1 {
+		return ErrUserNotFound
+	}
+	balance, err := balanceOf(tx, txn.FromUserID)
+	if err != nil {
+		return err
+	}
+	restorable := min(txn.Amount, balance)
+	for _, h := range held {
+		amount := min(h.Amount, restorable)
+		if amount <= 0 {
+			break
+		}
+		if err := tx.Model(&PointsLot{}).Where("id = ?", h.LotID).
+			Update("remaining", gorm.Expr("remaining + ?", amount)).Error; err != nil {
+			return fmt.Errorf("restore points lot %d: %w", h.LotID, err)
+		}
+		restorable -= amount
+	}
+	return releaseHeldLots(tx, txn)
+}
+
+// releaseHeldLots drops txn's held lot records once it's settled
+func releaseHeldLots(tx *gorm.DB, txn Transaction) error {
+	if err := tx.Where("transaction_id = ?", txn.ID).Delete(&HeldLot{}).Error; err != nil {
+		return fmt.Errorf("release held lots: %w", err)
+	}
+	return nil
+}
+
+// returnHeldTransfer ends a transfer awaiting acceptance with status
+// (declined or expired) and gives the held points back to the sender
+func returnHeldTransfer(txn Transaction, status, actor string, actorID uint, reason string) error {
+	return withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		return returnHeldTransferTx(tx, txn, status, actor, actorID, reason)
+	})
+}
+
+// returnHeldTransferTx is returnHeldTransfer inside tx
+func returnHeldTransferTx(tx *gorm.DB, txn Transaction, status, actor string, actorID uint, reason string) error {
+	if err := transitionTransaction(tx, &txn, status, actor, actorID, reason); err != nil {
+		return err
+	}
+	if err := releaseHeldPoints(tx, txn); err != nil {
+		return err
+	}
+	if err := refundHeldPoints(tx, txn); err != nil {
+		return err
+	}
+	// the sender's side of the transaction now ends with the refund
+	fromAfter, err := balanceOf(tx, txn.FromUserID)
+	if err != nil {
+		return err
+	}
+	return tx.Model(&txn).Updates(Transaction{FromBalanceAfter: &fromAfter}).Error
+}
+
+// findHeldTransfer loads transfer id awaiting acceptance by recipient,
+// expiring it first if it's past due
+func findHeldTransfer(id uint, recipient User) (Transaction, error) {
+	var txn Transaction
+	if err := db.Where("id = ? AND to_user_id = ? AND status = ? AND accept_required", id, recipient.ID, "pending").
+		Preload("FromUser").First(&txn).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return txn, ErrTransactionNotFound
+		}
+		return txn, fmt.Errorf("find transfer %d: %w", id, err)
+	}
+	if time.Since(txn.CreatedAt) > heldTransferTTL {
+		if err := returnHeldTransfer(txn, "expired", actorSystem, 0, "not accepted in time"); err != nil {
+			return txn, fmt.Errorf("expire transfer %d: %w", id, err)
+		}
+		return txn, ErrTransferExpired
+	}
+	return txn, nil
+}
+
+// Accept a transfer awaiting acceptance, receiving the points
+func acceptTransferHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return writeError(c, ErrTransactionNotFound)
+	}
+	txn, err := findHeldTransfer(uint(id), user)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	var balance int64
+	err = withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		// the status guard in the transition rolls back a double acceptance
+		if err := transitionTransaction(tx, &txn, "completed", actorUser, user.ID, "accepted by recipient"); err != nil {
+			return err
+		}
+		if err := releaseHeldPoints(tx, txn); err != nil {
+			return err
+		}
+		if err := releaseHeldLots(tx, txn); err != nil {
+			return err
+		}
+		// the recipient's points are new to them and expire from now
+		if err := creditPoints(tx, user.ID, txn.Amount); err != nil {
+			return err
+		}
+		after, err := balanceOf(tx, user.ID)
+		if err != nil {
+			return err
+		}
+		balance = after
+		return tx.Model(&txn).Updates(Transaction{ToBalanceAfter: &after}).Error
+	})
+	if err != nil {
+		return writeError(c, fmt.Errorf("accept transfer %d: %w", txn.ID, err))
+	}
+	return c.JSON(fiber.Map{
+		"message":         "Transfer accepted",
+		"transaction_id":  txn.ID,
+		"received_amount": txn.Amount,
+		"points":          balance,
+		"sender": fiber.Map{
+			"member_id":  txn.FromUser.MemberID,
+			"first_name": txn.FromUser.FirstName,
+			"last_name":  txn.FromUser.LastName,
+		},
+	})
+}
+
+// Decline a transfer awaiting acceptance, returning the points to the sender
+func declineTransferHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return writeError(c, ErrTransactionNotFound)
+	}
+	txn, err := findHeldTransfer(uint(id), user)
+	if err != nil {
+		return writeError(c, err)
+	}
+	if err := returnHeldTransfer(txn, "declined", actorUser, user.ID, "declined by recipient"); err != nil {
+		return writeError(c, fmt.Errorf("decline transfer %d: %w", txn.ID, err))
+	}
+	return c.JSON(fiber.Map{
+		"message":        "Transfer declined",
+		"transaction_id": txn.ID,
+		"status":         "declined",
+	})
+}
+
+// startHeldTransferExpiry returns the points of transfers nobody accepted
+// within heldTransferTTL, now and then every heldTransferSweepInterval
+func startHeldTransferExpiry() {
+	sweep := func() {
+		var expired []Transaction
+		if err := db.Where("status = ? AND accept_required AND created_at < ?", "pending", time.Now().Add(-heldTransferTTL)).
+			Find(&expired).Error; err != nil {
+			log.Printf("find expired held transfers: %v", err)
+			return
+		}
+		for _, txn := range expired {
+			if err := returnHeldTransfer(txn, "expired", actorSystem, 0, "not accepted in time"); err != nil {
+				log.Printf("expire held transfer %d: %v", txn.ID, err)
+				continue
+			}
+			log.Printf("audit: held transfer expired id=%d from=%d amount=%d", txn.ID, txn.FromUserID, txn.Amount)
+		}
+	}
+	sweep()
+	go func() {
+		for range time.Tick(heldTransferSweepInterval) {
+			sweep()
+		}
+	}()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// giveLots replaces user's balance with the given lots
+func giveLots(t *testing.T, user User, lots ...PointsLot) []PointsLot {
+	t.Helper()
+	if err := db.Where("user_id = ?", user.ID).Delete(&PointsLot{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for i := range lots {
+		lots[i].UserID = user.ID
+		lots[i].Granted = lots[i].Remaining
+		total += lots[i].Remaining
+		if err := db.Create(&lots[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Model(&User{}).Where("id = ?", user.ID).Update("points", total).Error; err != nil {
+		t.Fatal(err)
+	}
+	return lots
+}
+
+func lotsOf(t *testing.T, user User) []PointsLot {
+	t.Helper()
+	var lots []PointsLot
+	if err := db.Where("user_id = ?", user.ID).Order("id").Find(&lots).Error; err != nil {
+		t.Fatal(err)
+	}
+	return lots
+}
+
+// sendHeld sends amount from sender to recipient with require_accept and
+// returns the transaction ID
+func sendHeld(t *testing.T, app *fiber.App, sender, recipient User, amount int64) uint {
+	t.Helper()
+	status, body := doJSON(t, app, fiber.MethodPost, "/transfer", tokenFor(t, sender),
+		fiber.Map{"to_member_id": recipient.MemberID, "amount": amount, "pin": testPin, "require_accept": true, "confirm_large": true})
+	if status != fiber.StatusAccepted {
+		t.Fatalf("held transfer: status %d, body %v", status, body)
+	}
+	return uint(body["transaction_id"].(float64))
+}
+
+func TestRefundedHoldRestoresOriginalLots(t *testing.T) {
+	settle := map[string]func(t *testing.T, app *fiber.App, id uint, sender, recipient User){
+		"cancelled by sender": func(t *testing.T, app *fiber.App, id uint, sender, recipient User) {
+			status, body := doJSON(t, app, fiber.MethodPost, fmt.Sprintf("/transfers/%d/cancel", id), tokenFor(t, sender), nil)
+			if status != fiber.StatusOK {
+				t.Fatalf("cancel: status %d, body %v", status, body)
+			}
+		},
+		"declined by recipient": func(t *testing.T, app *fiber.App, id uint, sender, recipient User) {
+			status, body := doJSON(t, app, fiber.MethodPost, fmt.Sprintf("/transfers/%d/decline", id), tokenFor(t, recipient), nil)
+			if status != fiber.StatusOK {
+				t.Fatalf("decline: status %d, body %v", status, body)
+			}
+		},
+		"expired": func(t *testing.T, app *fiber.App, id uint, sender, recipient User) {
+			var txn Transaction
+			if err := db.First(&txn, id).Error; err != nil {
+				t.Fatal(err)
+			}
+			if err := returnHeldTransfer(txn, "expired", actorSystem, 0, "not accepted in time"); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+	for name, fn := range settle {
+		t.Run(name, func(t *testing.T) {
+			resetDB(t)
+			app := newTestApp(t)
+			sender := createUser(t, 0)
+			recipient := createUser(t, 0)
+			soon := time.Now().Add(10 * 24 * time.Hour).Truncate(time.Second)
+			later := time.Now().Add(200 * 24 * time.Hour).Truncate(time.Second)
+			before := giveLots(t, sender, PointsLot{Remaining: 100, ExpiresAt: soon}, PointsLot{Remaining: 500, ExpiresAt: later})
+
+			// takes all of the soon-expiring lot and 200 of the later one
+			id := sendHeld(t, app, sender, recipient, 300)
+			fn(t, app, id, sender, recipient)
+
+			after := lotsOf(t, sender)
+			if len(after) != len(before) {
+				t.Fatalf("sender has %d lots, want %d: a refund opened a new lot", len(after), len(before))
+			}
+			for i := range before {
+				if after[i].Remaining != before[i].Remaining || !after[i].ExpiresAt.Equal(before[i].ExpiresAt) {
+					t.Errorf("lot %d = %d expiring %s, want %d expiring %s", after[i].ID,
+						after[i].Remaining, after[i].ExpiresAt, before[i].Remaining, before[i].ExpiresAt)
+				}
+			}
+			if got := reloadUser(t, sender); got.Points != 600 || got.HeldPoints != 0 {
+				t.Errorf("sender points %d held %d, want 600 and 0", got.Points, got.HeldPoints)
+			}
+			var held int64
+			db.Model(&HeldLot{}).Count(&held)
+			if held != 0 {
+				t.Errorf("%d held lot records left", held)
+			}
+			assertInvariants(t)
+		})
+	}
+}
+
+func TestAcceptedHoldCreditsRecipientNewLot(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	sender := createUser(t, 0)
+	recipient := createUser(t, 0)
+	giveLots(t, sender, PointsLot{Remaining: 500, ExpiresAt: time.Now().Add(10 * 24 * time.Hour)})
+
+	id := sendHeld(t, app, sender, recipient, 300)
+	status, body := doJSON(t, app, fiber.MethodPost, fmt.Sprintf("/transfers/%d/accept", id), tokenFor(t, recipient), nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("accept: status %d, body %v", status, body)
+	}
+	lots := lotsOf(t, recipient)
+	if len(lots) != 1 || lots[0].Remaining != 300 || time.Until(lots[0].ExpiresAt) < pointsValidity()-time.Hour {
+		t.Errorf("recipient lots = %+v, want one full-validity lot of 300", lots)
+	}
+	if got := lotsOf(t, sender); got[0].Remaining != 200 {
+		t.Errorf("sender lot remaining = %d, want 200", got[0].Remaining)
+	}
+	assertInvariants(t)
+}
+
+func TestRefundPaysOffNegativeBalanceFirst(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	sender := createUser(t, 0)
+	recipient := createUser(t, 0)
+	giveLots(t, sender, PointsLot{Remaining: 500, ExpiresAt: time.Now().Add(10 * 24 * time.Hour)})
+
+	id := sendHeld(t, app, sender, recipient, 300)
+	// an adjustment with allow_negative takes the sender 100 below zero
+	if err := db.Model(&User{}).Where("id = ?", sender.ID).Update("points", -100).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&PointsLot{}).Where("user_id = ?", sender.ID).Update("remaining", 0).Error; err != nil {
+		t.Fatal(err)
+	}
+	status, body := doJSON(t, app, fiber.MethodPost, fmt.Sprintf("/transfers/%d/cancel", id), tokenFor(t, sender), nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("cancel: status %d, body %v", status, body)
+	}
+	lots := lotsOf(t, sender)
+	if reloadUser(t, sender).Points != 200 || len(lots) != 1 || lots[0].Remaining != 200 {
+		t.Errorf("after refund: points %d, lots %+v; want 200 in the original lot", reloadUser(t, sender).Points, lots)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Admins credit or debit points directly for promotions and corrections.
+// Each adjustment is recorded as a transaction of type "adjustment" from
+// user 0 (the program itself) with a signed amount, and the admin who made
+// it is the actor of its created event.
+const (
+	transactionTypeAdjustment = "adjustment"
+	maxAdjustmentReasonLength = 200
+)
+
+// adjustPoints applies delta to userID's balance on behalf of admin and
+// returns the audit transaction and the new balance
+func adjustPoints(userID uint, delta int64, reason string, allowNegative bool, admin User) (Transaction, int64, error) {
+	var adj Transaction
+	var balance int64
+	err := withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		var user User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "points").
+			First(&user, userID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrUserNotFound
+			}
+			return fmt.Errorf("lock user: %w", err)
+		}
+		q := tx.Model(&User{}).Where("id = ?", userID)
+		if !allowNegative {
+			// guard in the UPDATE itself, like movePoints
+			q = q.Where("points + ? >= 0", delta)
+		}
+		res := q.Update("points", gorm.Expr("points + ?", delta))
+		if res.Error != nil {
+			return fmt.Errorf("adjust points: %w", res.Error)
+		}
+		if res.RowsAffected != 1 {
+			return &NegativeBalanceError{Balance: user.Points, Delta: delta}
+		}
+		var err error
+		if delta > 0 {
+			err = openPointsLot(tx, userID, delta)
+		} else {
+			_, err = consumePointsLots(tx, userID, -delta)
+		}
+		if err != nil {
+			return err
+		}
+		if balance, err = balanceOf(tx, userID); err != nil {
+			return err
+		}
+
+		adj = Transaction{
+			FromUserID:     0,
+			ToUserID:       userID,
+			Amount:         delta,
+			Type:           transactionTypeAdjustment,
+			Status:         "completed",
+			Description:    reason,
+			ToBalanceAfter: &balance,
+			AllowNegative:  allowNegative,
+		}
+		if err := tx.Create(&adj).Error; err != nil {
+			return fmt.Errorf("create adjustment record: %w", err)
+		}
+		return recordTransactionCreated(tx, &adj, actorAdmin, admin.ID)
+	})
+	if err != nil {
+		return adj, 0, fmt.Errorf("adjust points of user %d: %w", userID, err)
+	}
+	return adj, balance, nil
+}
+
+// Credit (positive delta) or debit (negative delta) a user's points
+func adjustPointsHandler(c *fiber.Ctx) error {
+	admin := c.Locals("user").(User)
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid id"})
+	}
+	var payload struct {
+		Delta         int64  `json:"delta"`
+		Reason        string `json:"reason"`
+		AllowNegative bool   `json:"allow_negative"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	reason := sanitizeNote(payload.Reason)
+	problems := map[string]string{}
+	if payload.Delta == 0 {
+		problems["delta"] = "must not be zero"
+	}
+	if reason == "" {
+		problems["reason"] = "required"
+	} else if utf8.RuneCountInString(reason) > maxAdjustmentReasonLength {
+		problems["reason"] = "must be at most 200 characters"
+	}
+	if len(problems) > 0 {
+		return writeError(c, &ValidationError{Message: "invalid adjustment", Fields: problems})
+	}
+
+	adj, balance, err := adjustPoints(uint(id), payload.Delta, reason, payload.AllowNegative, admin)
+	if err != nil {
+		return writeError(c, err)
+	}
+	log.Printf("audit: points adjusted txn=%d target=%d delta=%d allow_negative=%t user=%d ip=%s",
+		adj.ID, id, payload.Delta, payload.AllowNegative, admin.ID, clientIP(c))
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"transaction_id": adj.ID,
+		"user_id":        id,
+		"delta":          payload.Delta,
+		"reason":         reason,
+		"points":         balance,
+		"adjusted_by":    admin.ID,
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Roles a user can hold. Everyone starts as a member; admins are promoted
+// with the set-role command.
+const (
+	roleMember = "member"
+	roleAdmin  = "admin"
+)
+
+var knownRoles = map[string]bool{roleMember: true, roleAdmin: true}
+
+// requireRole lets the request through only if the access token carries role
+// and the user still holds it, so a demotion takes effect immediately. Must
+// run after jwtMiddleware.
+func requireRole(role string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		u := c.Locals("user")
+		if u == nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+		}
+		user := u.(User)
+		if claimed, _ := c.Locals("role").(string); claimed != role || user.Role != role {
+			log.Printf("audit: %s role required user=%d ip=%s path=%s", role, user.ID, clientIP(c), c.Path())
+			return writeError(c, ErrForbidden)
+		}
+		return c.Next()
+	}
+}
+
+// likeEscaper escapes LIKE wildcards so user input matches literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// adminUserFilters narrows the user list by the email, member_id and
+// member_tier query parameters: an email substring (case-insensitive) and
+// exact member ID and tier
+func adminUserFilters(c *fiber.Ctx, q *gorm.DB) *gorm.DB {
+	if email := strings.TrimSpace(c.Query("email")); email != "" {
+		q = q.Where(`LOWER(email) LIKE ? ESCAPE '\'`, "%"+likeEscaper.Replace(strings.ToLower(email))+"%")
+	}
+	if memberID := strings.TrimSpace(c.Query("member_id")); memberID != "" {
+		q = q.Where("member_id = ?", memberID)
+	}
+	if tier := strings.TrimSpace(c.Query("member_tier")); tier != "" {
+		q = q.Where("member_tier = ?", tier)
+	}
+	return q
+}
+
+// List users, oldest first, optionally filtered, for back-office tooling
+func adminListUsersHandler(c *fiber.Ctx) error {
+	fields, err := parseFields(c, structFields(User{}))
+	if err != nil {
+		return writeError(c, err)
+	}
+	page, err := parsePagination(c)
+	if err != nil {
+		return writeError(c, err)
+	}
+	var total int64
+	if err := adminUserFilters(c, db.Model(&User{})).Count(&total).Error; err != nil {
+		return writeError(c, fmt.Errorf("count users: %w", err))
+	}
+	var users []User
+	if err := adminUserFilters(c, db).Order("id").Limit(page.PageSize).Offset(page.Offset()).Find(&users).Error; err != nil {
+		return writeError(c, fmt.Errorf("list users: %w", err))
+	}
+	selected := make([]interface{}, 0, len(users))
+	for _, user := range users {
+		view, err := selectFields(user, fields)
+		if err != nil {
+			return writeError(c, err)
+		}
+		selected = append(selected, view)
+	}
+	return sendFields(c, fields, fiber.Map{
+		"users":      selected,
+		"pagination": page.Meta(total),
+	})
+}
+
+// setRole changes a member's role; new tokens carry it on the next login or refresh
+func setRole(args []string) int {
+	if len(args) != 2 || !knownRoles[args[1]] {
+		fmt.Fprintln(os.Stderr, "usage: set-role MEMBER_ID member|admin")
+		return 2
+	}
+	initDB()
+	res := db.Model(&User{}).Where("member_id = ?", args[0]).Update("role", args[1])
+	if res.Error != nil {
+		fmt.Fprintf(os.Stderr, "set role: %v\n", res.Error)
+		return 1
+	}
+	if res.RowsAffected != 1 {
+		fmt.Fprintf(os.Stderr, "no member with ID %q\n", args[0])
+		return 1
+	}
+	log.Printf("audit: role set to %s member=%s", args[1], args[0])
+	return 0
+}
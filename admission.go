@@ -0,0 +1,221 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Admission control for the transfer path. At most maxInFlight transfers run
+// at once; up to maxQueue more wait for a slot until the queue timeout, and
+// anything beyond that is shed immediately with 503 so a burst degrades into
+// fast rejections instead of every request timing out together.
+//
+// Limits come from env vars and can be overridden at runtime through
+// app_settings rows of the same name in lower case, re-read every
+// admissionReloadInterval.
+const (
+	settingTransferMaxInFlight  = "transfer_max_in_flight"
+	settingTransferMaxQueue     = "transfer_max_queue"
+	settingTransferQueueTimeout = "transfer_queue_timeout_ms"
+
+	admissionReloadInterval = 10 * time.Second
+)
+
+// Gauges published on /debug/vars (when EXPOSE_METRICS=true)
+var (
+	transferInFlight   = expvar.NewInt("transfer_in_flight")
+	transferQueueDepth = expvar.NewInt("transfer_queue_depth")
+	transferShed       = expvar.NewInt("transfer_shed_total")
+)
+
+type admissionLimits struct {
+	MaxInFlight  int
+	MaxQueue     int
+	QueueTimeout time.Duration
+}
+
+type admissionGate struct {
+	mu       sync.Mutex
+	limits   admissionLimits
+	inFlight int
+	waiters  []chan struct{}
+	// avgService is an EWMA of how long an admitted request holds its slot,
+	// used to estimate Retry-After from current throughput
+	avgService time.Duration
+}
+
+var transferGate = &admissionGate{limits: defaultAdmissionLimits()}
+
+// envPositiveInt reads a positive integer env var, falling back to def
+func envPositiveInt(name string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+// defaultAdmissionLimits reads TRANSFER_MAX_IN_FLIGHT (default 8),
+// TRANSFER_MAX_QUEUE (default 32) and TRANSFER_QUEUE_TIMEOUT_MS (default 2000)
+func defaultAdmissionLimits() admissionLimits {
+	return admissionLimits{
+		MaxInFlight:  envPositiveInt("TRANSFER_MAX_IN_FLIGHT", 8),
+		MaxQueue:     envPositiveInt("TRANSFER_MAX_QUEUE", 32),
+		QueueTimeout: time.Duration(envPositiveInt("TRANSFER_QUEUE_TIMEOUT_MS", 2000)) * time.Millisecond,
+	}
+}
+
+// loadAdmissionLimits applies app_settings overrides on top of the env defaults
+func loadAdmissionLimits() admissionLimits {
+	limits := defaultAdmissionLimits()
+	var settings []AppSetting
+	if err := db.Where("key IN ?", []string{settingTransferMaxInFlight, settingTransferMaxQueue, settingTransferQueueTimeout}).
+		Find(&settings).Error; err != nil {
+		log.Printf("load admission limits: %v", err)
+		return limits
+	}
+	for _, s := range settings {
+		n, err := strconv.Atoi(s.Value)
+		if err != nil || n <= 0 {
+			log.Printf("ignoring invalid setting %s=%q", s.Key, s.Value)
+			continue
+		}
+		switch s.Key {
+		case settingTransferMaxInFlight:
+			limits.MaxInFlight = n
+		case settingTransferMaxQueue:
+			limits.MaxQueue = n
+		case settingTransferQueueTimeout:
+			limits.QueueTimeout = time.Duration(n) * time.Millisecond
+		}
+	}
+	return limits
+}
+
+// watchAdmissionLimits loads the limits now and keeps them in sync with
+// app_settings for the life of the process
+func watchAdmissionLimits() {
+	transferGate.SetLimits(loadAdmissionLimits())
+	go func() {
+		for range time.Tick(admissionReloadInterval) {
+			transferGate.SetLimits(loadAdmissionLimits())
+		}
+	}()
+}
+
+func (g *admissionGate) SetLimits(limits admissionLimits) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.limits != limits {
+		log.Printf("transfer admission limits: in-flight=%d queue=%d timeout=%s",
+			limits.MaxInFlight, limits.MaxQueue, limits.QueueTimeout)
+	}
+	g.limits = limits
+	// a raised limit admits queued requests straight away
+	for len(g.waiters) > 0 && g.inFlight < g.limits.MaxInFlight {
+		g.grantNext()
+	}
+	g.publish()
+}
+
+// grantNext hands a slot to the oldest waiter; callers hold g.mu
+func (g *admissionGate) grantNext() {
+	ch := g.waiters[0]
+	g.waiters = g.waiters[1:]
+	g.inFlight++
+	close(ch)
+}
+
+func (g *admissionGate) publish() {
+	transferInFlight.Set(int64(g.inFlight))
+	transferQueueDepth.Set(int64(len(g.waiters)))
+}
+
+// Acquire takes a slot, waiting in the queue if needed. It returns false if
+// the queue is full or the wait exceeded the queue timeout.
+func (g *admissionGate) Acquire() bool {
+	g.mu.Lock()
+	if g.inFlight < g.limits.MaxInFlight && len(g.waiters) == 0 {
+		g.inFlight++
+		g.publish()
+		g.mu.Unlock()
+		return true
+	}
+	if len(g.waiters) >= g.limits.MaxQueue {
+		g.mu.Unlock()
+		transferShed.Add(1)
+		return false
+	}
+	ch := make(chan struct{})
+	g.waiters = append(g.waiters, ch)
+	timeout := g.limits.QueueTimeout
+	g.publish()
+	g.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return true
+	case <-timer.C:
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i, w := range g.waiters {
+		if w == ch {
+			g.waiters = append(g.waiters[:i], g.waiters[i+1:]...)
+			g.publish()
+			transferShed.Add(1)
+			return false
+		}
+	}
+	// granted between the timer firing and taking the lock
+	return true
+}
+
+// Release frees a slot held for d
+func (g *admissionGate) Release(d time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.avgService == 0 {
+		g.avgService = d
+	} else {
+		g.avgService = (g.avgService*4 + d) / 5
+	}
+	g.inFlight--
+	if len(g.waiters) > 0 && g.inFlight < g.limits.MaxInFlight {
+		g.grantNext()
+	}
+	g.publish()
+}
+
+// RetryAfter estimates how long until the current backlog drains, in whole
+// seconds and never less than one
+func (g *admissionGate) RetryAfter() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	backlog := float64(g.inFlight + len(g.waiters) + 1)
+	perSecond := float64(g.limits.MaxInFlight) / math.Max(g.avgService.Seconds(), 0.001)
+	return int(math.Max(1, math.Ceil(backlog/perSecond)))
+}
+
+// admitTransfer gates a route behind transferGate
+func admitTransfer() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !transferGate.Acquire() {
+			c.Set(fiber.HeaderRetryAfter, fmt.Sprint(transferGate.RetryAfter()))
+			return writeError(c, ErrOverCapacity)
+		}
+		start := time.Now()
+		defer func() { transferGate.Release(time.Since(start)) }()
+		return c.Next()
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// percentile returns the p-th percentile (0-100) of sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(math.Ceil(p/100*float64(len(sorted))))-1]
+}
+
+// TestAdmissionUnderLoad drives a route behind the transfer gate with several
+// times the load it admits, over real HTTP, and checks that admitted requests
+// stay fast while the excess is shed with 503 right away.
+func TestAdmissionUnderLoad(t *testing.T) {
+	if testing.Short() {
+		t.Skip("load test")
+	}
+	const (
+		service  = 20 * time.Millisecond
+		workers  = 32
+		duration = time.Second
+	)
+	limits := admissionLimits{MaxInFlight: 4, MaxQueue: 8, QueueTimeout: 100 * time.Millisecond}
+	transferGate.mu.Lock()
+	previous := transferGate.limits
+	transferGate.mu.Unlock()
+	transferGate.SetLimits(limits)
+	t.Cleanup(func() { transferGate.SetLimits(previous) })
+	shedBefore := transferShed.Value()
+
+	var running, peak int64
+	config := fiberConfig()
+	config.DisableStartupMessage = true
+	app := fiber.New(config)
+	mountRoutes(app, []route{{Method: fiber.MethodPost, Path: "/work", RateLimit: rateLimitAdmission, Handler: func(c *fiber.Ctx) error {
+		n := atomic.AddInt64(&running, 1)
+		defer atomic.AddInt64(&running, -1)
+		for {
+			if p := atomic.LoadInt64(&peak); n <= p || atomic.CompareAndSwapInt64(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(service)
+		return c.SendStatus(fiber.StatusOK)
+	}}})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	t.Cleanup(func() { app.Shutdown() })
+	url := fmt.Sprintf("http://%s/work", ln.Addr())
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: workers}, Timeout: 5 * time.Second}
+
+	var (
+		mu               sync.Mutex
+		admitted, shed   []time.Duration
+		unexpected       []string
+		wg               sync.WaitGroup
+		deadline         = time.Now().Add(duration)
+		recordUnexpected = func(s string) { mu.Lock(); unexpected = append(unexpected, s); mu.Unlock() }
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				start := time.Now()
+				resp, err := client.Post(url, "application/json", nil)
+				if err != nil {
+					recordUnexpected(err.Error())
+					return
+				}
+				elapsed := time.Since(start)
+				var body map[string]interface{}
+				json.NewDecoder(resp.Body).Decode(&body)
+				resp.Body.Close()
+				switch resp.StatusCode {
+				case fiber.StatusOK:
+					mu.Lock()
+					admitted = append(admitted, elapsed)
+					mu.Unlock()
+				case fiber.StatusServiceUnavailable:
+					if retry, err := strconv.Atoi(resp.Header.Get(fiber.HeaderRetryAfter)); err != nil || retry < 1 || errorCodeOf(body) != "OVER_CAPACITY" {
+						recordUnexpected(fmt.Sprintf("503 with Retry-After %q, body %v", resp.Header.Get(fiber.HeaderRetryAfter), body))
+					}
+					mu.Lock()
+					shed = append(shed, elapsed)
+					mu.Unlock()
+					// a well-behaved client backs off instead of hammering
+					time.Sleep(service)
+				default:
+					recordUnexpected(fmt.Sprintf("status %d, body %v", resp.StatusCode, body))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(unexpected) > 0 {
+		t.Fatalf("%d unexpected responses, first: %s", len(unexpected), unexpected[0])
+	}
+	slices.Sort(admitted)
+	slices.Sort(shed)
+	t.Logf("admitted %d (p50 %s, p99 %s), shed %d (p99 %s), peak in flight %d",
+		len(admitted), percentile(admitted, 50), percentile(admitted, 99), len(shed), percentile(shed, 99), peak)
+
+	// the gate can't admit more than MaxInFlight per service time
+	if capacity := int(duration/service) * limits.MaxInFlight; len(admitted) == 0 || len(admitted) > capacity+limits.MaxInFlight+limits.MaxQueue {
+		t.Errorf("admitted %d requests, want between 1 and about %d", len(admitted), capacity)
+	}
+	if len(shed) == 0 {
+		t.Error("nothing was shed under several times the admitted load")
+	}
+	if got := transferShed.Value() - shedBefore; got != int64(len(shed)) {
+		t.Errorf("transfer_shed_total grew by %d, want %d", got, len(shed))
+	}
+	if peak > int64(limits.MaxInFlight) {
+		t.Errorf("%d requests ran at once, want at most %d", peak, limits.MaxInFlight)
+	}
+	// an admitted request waits at most the queue timeout before its own
+	// service time; the slack absorbs scheduling on a busy machine
+	const slack = 150 * time.Millisecond
+	if p99 := percentile(admitted, 99); p99 > limits.QueueTimeout+service+slack {
+		t.Errorf("admitted p99 = %s, want at most %s", p99, limits.QueueTimeout+service+slack)
+	}
+	// a full queue sheds without waiting; shed requests that did wait in
+	// the queue waited at most the queue timeout
+	if p99 := percentile(shed, 99); p99 > limits.QueueTimeout+slack {
+		t.Errorf("shed p99 = %s, want at most %s", p99, limits.QueueTimeout+slack)
+	}
+	if transferInFlight.Value() != 0 || transferQueueDepth.Value() != 0 {
+		t.Errorf("gauges after the run: in flight %d, queue depth %d, want 0", transferInFlight.Value(), transferQueueDepth.Value())
+	}
+}
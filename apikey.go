@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// API keys are static credentials for server-to-server callers such as the
+// POS integration. A key acts as a service principal, not as a user, and can
+// only reach routes that name one of its scopes.
+const (
+	apiKeyHeader = "X-API-Key"
+	apiKeyPrefix = "lbk_"
+)
+
+// Scopes an API key can be granted
+const (
+	scopeUsersRead       = "users:read"
+	scopeMembersRegister = "members:register"
+)
+
+var knownScopes = map[string]bool{scopeUsersRead: true, scopeMembersRegister: true}
+
+// APIKey is stored hashed; the full key is only returned when it's created
+type APIKey struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	Name       string     `json:"name" gorm:"not null"`
+	Prefix     string     `json:"prefix" gorm:"not null"` // first characters of the key, to tell keys apart
+	KeyHash    string     `json:"-" gorm:"uniqueIndex;not null"`
+	Scopes     string     `json:"-" gorm:"not null"` // comma-separated
+	PartnerID  string     `json:"partner_id"`        // partner program whose systems hold the key, if any
+	Revoked    bool       `json:"revoked" gorm:"not null;default:false"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// servicePrincipal is who an API key request runs as
+type servicePrincipal struct {
+	KeyID     uint
+	Name      string
+	Scopes    map[string]bool
+	PartnerID string
+}
+
+func (k APIKey) scopeList() []string {
+	if k.Scopes == "" {
+		return []string{}
+	}
+	return strings.Split(k.Scopes, ",")
+}
+
+func (k APIKey) view() fiber.Map {
+	return fiber.Map{
+		"id":           k.ID,
+		"name":         k.Name,
+		"prefix":       k.Prefix,
+		"scopes":       k.scopeList(),
+		"partner_id":   k.PartnerID,
+		"revoked":      k.Revoked,
+		"last_used_at": k.LastUsedAt,
+		"created_at":   k.CreatedAt,
+	}
+}
+
+// apiKeyMiddleware authenticates X-API-Key and stores the service principal
+// in c.Locals("service")
+func apiKeyMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get(apiKeyHeader)
+		if key == "" {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "missing api key"})
+		}
+		var k APIKey
+		if err := db.Where("key_hash = ? AND revoked = ?", hashToken(key), false).First(&k).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid api key"})
+			}
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to verify api key"})
+		}
+		if err := db.Model(&APIKey{}).Where("id = ?", k.ID).Update("last_used_at", time.Now()).Error; err != nil {
+			log.Printf("record api key %d use: %v", k.ID, err)
+		}
+		scopes := map[string]bool{}
+		for _, s := range k.scopeList() {
+			scopes[s] = true
+		}
+		c.Locals("service", servicePrincipal{KeyID: k.ID, Name: k.Name, Scopes: scopes, PartnerID: k.PartnerID})
+		return c.Next()
+	}
+}
+
+// requireScope lets an API key request through only with scope. Must run
+// after apiKeyMiddleware.
+func requireScope(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		svc, ok := c.Locals("service").(servicePrincipal)
+		if !ok {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+		}
+		if !svc.Scopes[scope] {
+			return writeError(c, &MissingScopeError{Scope: scope})
+		}
+		return c.Next()
+	}
+}
+
+// isAPIKeyRequest reports whether a route accepting either credential
+// should authenticate the request by API key
+func isAPIKeyRequest(c *fiber.Ctx) bool {
+	return c.Get(apiKeyHeader) != "" && c.Get("Authorization") == ""
+}
+
+// userOrServiceAuth authenticates with an API key when one is sent without
+// an Authorization header, and with a user access token otherwise
+func userOrServiceAuth() fiber.Handler {
+	viaKey, viaJWT := apiKeyMiddleware(), jwtMiddleware()
+	return func(c *fiber.Ctx) error {
+		if isAPIKeyRequest(c) {
+			return viaKey(c)
+		}
+		return viaJWT(c)
+	}
+}
+
+// optionalAPIKey authenticates an API key when one is sent and lets
+// anonymous requests through
+func optionalAPIKey() fiber.Handler {
+	viaKey := apiKeyMiddleware()
+	return func(c *fiber.Ctx) error {
+		if c.Get(apiKeyHeader) == "" {
+			return c.Next()
+		}
+		return viaKey(c)
+	}
+}
+
+// requireRoleOrScope checks scope for a service principal, and role (if not
+// empty) for a user. Must run after userOrServiceAuth or optionalAPIKey.
+func requireRoleOrScope(role, scope string) fiber.Handler {
+	byRole, byScope := requireRole(role), requireScope(scope)
+	return func(c *fiber.Ctx) error {
+		if _, ok := c.Locals("service").(servicePrincipal); ok {
+			return byScope(c)
+		}
+		if role == "" {
+			return c.Next()
+		}
+		return byRole(c)
+	}
+}
+
+// Create an API key; the response is the only time the full key is shown
+func createAPIKeyHandler(c *fiber.Ctx) error {
+	var payload struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		PartnerID string   `json:"partner_id"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	payload.Name = strings.TrimSpace(payload.Name)
+	payload.PartnerID = strings.TrimSpace(payload.PartnerID)
+	problems := map[string]string{}
+	if payload.Name == "" {
+		problems["name"] = "required"
+	}
+	if len(payload.Scopes) == 0 {
+		problems["scopes"] = "at least one scope required"
+	}
+	seen := map[string]bool{}
+	for _, s := range payload.Scopes {
+		if !knownScopes[s] {
+			problems["scopes"] = "unknown scope " + s
+		}
+		seen[s] = true
+	}
+	if len(problems) > 0 {
+		return writeError(c, &ValidationError{Message: "invalid api key", Fields: problems})
+	}
+	scopes := make([]string, 0, len(seen))
+	for s := range seen {
+		scopes = append(scopes, s)
+	}
+	sort.Strings(scopes)
+
+	token, err := randomToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate api key"})
+	}
+	key := apiKeyPrefix + token
+	k := APIKey{Name: payload.Name, Prefix: key[:len(apiKeyPrefix)+8], KeyHash: hashToken(key), Scopes: strings.Join(scopes, ","), PartnerID: payload.PartnerID}
+	if err := db.Create(&k).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create api key"})
+	}
+	admin := c.Locals("user").(User)
+	log.Printf("audit: api key created key=%d name=%q scopes=%s partner=%q user=%d ip=%s", k.ID, k.Name, k.Scopes, k.PartnerID, admin.ID, clientIP(c))
+	resp := k.view()
+	resp["key"] = key
+	return c.Status(fiber.StatusCreated).JSON(resp)
+}
+
+// List API keys without their secrets
+func listAPIKeysHandler(c *fiber.Ctx) error {
+	var keys []APIKey
+	if err := db.Order("id").Find(&keys).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to fetch api keys"})
+	}
+	views := make([]fiber.Map, 0, len(keys))
+	for _, k := range keys {
+		views = append(views, k.view())
+	}
+	return c.JSON(fiber.Map{"api_keys": views})
+}
+
+// Revoke an API key; revoked keys stop working immediately and can't be restored
+func revokeAPIKeyHandler(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid id"})
+	}
+	res := db.Model(&APIKey{}).Where("id = ?", id).Update("revoked", true)
+	if res.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to revoke api key"})
+	}
+	if res.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "api key not found"})
+	}
+	admin := c.Locals("user").(User)
+	log.Printf("audit: api key revoked key=%d user=%d ip=%s", id, admin.ID, clientIP(c))
+	return c.SendStatus(fiber.StatusNoContent)
+}
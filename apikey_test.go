@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// createAPIKey has admin create a key through the API and returns the full key
+func createAPIKey(t *testing.T, app *fiber.App, admin User, payload fiber.Map) string {
+	t.Helper()
+	status, body := doJSON(t, app, fiber.MethodPost, "/admin/api-keys", tokenFor(t, admin), payload, elevationHeader, elevatedTokenFor(t, admin))
+	if status != fiber.StatusCreated {
+		t.Fatalf("create api key: status %d, body %v", status, body)
+	}
+	key, _ := body["key"].(string)
+	return key
+}
+
+func TestRegisterTakesPartnerFromAPIKey(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	admin := createUser(t, 0)
+	if err := db.Model(&User{}).Where("id = ?", admin.ID).Update("role", roleAdmin).Error; err != nil {
+		t.Fatal(err)
+	}
+	partnerKey := createAPIKey(t, app, admin, fiber.Map{"name": "Acme CRM", "scopes": []string{scopeMembersRegister}, "partner_id": "acme"})
+	readOnlyKey := createAPIKey(t, app, admin, fiber.Map{"name": "POS", "scopes": []string{scopeUsersRead}, "partner_id": "acme"})
+
+	register := func(memberID string, headers ...string) (int, map[string]interface{}) {
+		return doJSON(t, app, fiber.MethodPost, "/register", "", fiber.Map{
+			"email":      memberID + "@example.com",
+			"password":   testPassword,
+			"member_id":  memberID,
+			"partner_id": "chosen-by-member",
+		}, headers...)
+	}
+	partnerOf := func(memberID string) string {
+		var user User
+		if err := db.Where("member_id = ?", memberID).First(&user).Error; err != nil {
+			t.Fatalf("find %s: %v", memberID, err)
+		}
+		return user.PartnerID
+	}
+
+	if status, body := register("LBK900001"); status != fiber.StatusCreated {
+		t.Fatalf("self sign-up: status %d, body %v", status, body)
+	}
+	if got := partnerOf("LBK900001"); got != "" {
+		t.Errorf("self sign-up partner = %q, want none despite the payload", got)
+	}
+
+	if status, body := register("LBK900002", apiKeyHeader, partnerKey); status != fiber.StatusCreated {
+		t.Fatalf("partner sign-up: status %d, body %v", status, body)
+	}
+	if got := partnerOf("LBK900002"); got != "acme" {
+		t.Errorf("partner sign-up partner = %q, want the key's acme", got)
+	}
+
+	if status, body := register("LBK900003", apiKeyHeader, readOnlyKey); status != fiber.StatusForbidden || errorCodeOf(body) != "INSUFFICIENT_SCOPE" {
+		t.Errorf("key without members:register: status %d, body %v", status, body)
+	}
+	if status, body := register("LBK900004", apiKeyHeader, "lbk_not-a-key"); status != fiber.StatusUnauthorized {
+		t.Errorf("unknown key: status %d, body %v", status, body)
+	}
+	var refused int64
+	db.Model(&User{}).Where("member_id IN ?", []string{"LBK900003", "LBK900004"}).Count(&refused)
+	if refused != 0 {
+		t.Errorf("%d members registered with a refused key", refused)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// signAccessToken signs claims for user after edit adjusts them, the way a
+// token from another service or an old deploy might look
+func signAccessToken(t *testing.T, user User, secret string, edit func(*accessClaims)) string {
+	t.Helper()
+	now := time.Now()
+	claims := accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        fmt.Sprintf("test-%d-%d", user.ID, now.UnixNano()),
+			Issuer:    jwtIssuer(),
+			Subject:   fmt.Sprint(user.ID),
+			Audience:  jwt.ClaimStrings{jwtAudience()},
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+	if edit != nil {
+		edit(&claims)
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAccessTokenValidation(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	user := createUser(t, 0)
+
+	tests := []struct {
+		name   string
+		secret string
+		edit   func(*accessClaims)
+		want   int
+	}{
+		{"valid", jwtSecret(), nil, fiber.StatusOK},
+		{"wrong issuer", jwtSecret(), func(c *accessClaims) { c.Issuer = "other-service" }, fiber.StatusUnauthorized},
+		{"no issuer", jwtSecret(), func(c *accessClaims) { c.Issuer = "" }, fiber.StatusUnauthorized},
+		{"wrong audience", jwtSecret(), func(c *accessClaims) { c.Audience = jwt.ClaimStrings{"other-api"} }, fiber.StatusUnauthorized},
+		{"no audience", jwtSecret(), func(c *accessClaims) { c.Audience = nil }, fiber.StatusUnauthorized},
+		{"expired", jwtSecret(), func(c *accessClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Second)) }, fiber.StatusUnauthorized},
+		{"wrong secret", "another-secret-that-is-at-least-32-bytes", nil, fiber.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := doJSON(t, app, fiber.MethodGet, "/me", signAccessToken(t, user, tt.secret, tt.edit), nil)
+			if status != tt.want {
+				t.Fatalf("status %d, want %d, body %v", status, tt.want, body)
+			}
+			if tt.want == fiber.StatusUnauthorized && body["error"] != "invalid token" {
+				t.Errorf("body = %v", body)
+			}
+		})
+	}
+}
+
+func TestAccessTokenTTL(t *testing.T) {
+	resetDB(t)
+	user := createUser(t, 0)
+	t.Setenv("JWT_TTL", "5m")
+
+	var claims accessClaims
+	if _, _, err := new(jwt.Parser).ParseUnverified(tokenFor(t, user), &claims); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := claims.ExpiresAt.Sub(claims.IssuedAt.Time); ttl != 5*time.Minute {
+		t.Errorf("token lives %v, want 5m", ttl)
+	}
+	if claims.Issuer != jwtIssuer() || !claims.VerifyAudience(jwtAudience(), true) {
+		t.Errorf("issuer %q, audience %v", claims.Issuer, claims.Audience)
+	}
+}
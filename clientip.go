@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// AppSetting stores small pieces of runtime state that must survive restarts
+type AppSetting struct {
+	Key   string `gorm:"primaryKey"`
+	Value string
+}
+
+const ipHashSaltKey = "ip_hash_salt"
+
+var ipHashSalt []byte
+
+func hashClientIPs() bool {
+	return envBool("HASH_CLIENT_IPS")
+}
+
+// initIPHashing loads the salt used for hashing client IPs. IP_HASH_SALT wins
+// when set; otherwise a random salt is generated once and persisted so hashes
+// stay comparable across restarts.
+func initIPHashing() {
+	if !hashClientIPs() {
+		return
+	}
+	if s := os.Getenv("IP_HASH_SALT"); s != "" {
+		ipHashSalt = []byte(s)
+		return
+	}
+	var setting AppSetting
+	if err := db.Where("key = ?", ipHashSaltKey).First(&setting).Error; err == nil {
+		ipHashSalt = []byte(setting.Value)
+		return
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("failed to generate ip hash salt: %v", err)
+	}
+	setting = AppSetting{Key: ipHashSaltKey, Value: hex.EncodeToString(b)}
+	if err := db.Create(&setting).Error; err != nil {
+		log.Fatalf("failed to persist ip hash salt: %v", err)
+	}
+	ipHashSalt = []byte(setting.Value)
+}
+
+func hashIP(ip string) string {
+	mac := hmac.New(sha256.New, ipHashSalt)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// clientIP returns the value to record for the caller's address: the raw IP,
+// or its salted hash when HASH_CLIENT_IPS=true. Anything that logs, stores or
+// keys on client addresses (login events, rate limits, admin views) should go
+// through here so the hashed and raw forms never mix.
+func clientIP(c *fiber.Ctx) string {
+	ip := requestIP(c)
+	if !hashClientIPs() {
+		return ip
+	}
+	return hashIP(ip)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// appEnv returns APP_ENV, defaulting to development
+func appEnv() string {
+	if e := os.Getenv("APP_ENV"); e != "" {
+		return e
+	}
+	return "development"
+}
+
+// envBool reads a boolean env var; unset or unparsable values are false
+// (validateConfig rejects the latter at startup)
+func envBool(name string) bool {
+	b, _ := strconv.ParseBool(os.Getenv(name))
+	return b
+}
+
+// validateConfig checks every env-derived setting up front so a bad deploy
+// fails at startup with a precise message instead of misbehaving later.
+// It returns the first problem found. It runs before initDB, so migrations
+// and seeding never see a setting it would reject, and mustn't use db.
+func validateConfig() error {
+	if _, err := databaseDialector(); err != nil {
+		return err
+	}
+	if s := os.Getenv("PORT"); s != "" {
+		if p, err := strconv.Atoi(s); err != nil || p < 1 || p > 65535 {
+			return fmt.Errorf("PORT must be a port number between 1 and 65535, got %q", s)
+		}
+	}
+	for _, name := range []string{"HASH_CLIENT_IPS", "ALLOW_CROSS_PARTNER", "EXPOSE_METRICS", "RELEASE_DELETED_ACCOUNT_IDS"} {
+		if s := os.Getenv(name); s != "" {
+			if _, err := strconv.ParseBool(s); err != nil {
+				return fmt.Errorf("%s must be true or false, got %q", name, s)
+			}
+		}
+	}
+	if s := os.Getenv("LARGE_TRANSFER_FRACTION"); s != "" {
+		if f, err := strconv.ParseFloat(s, 64); err != nil || f <= 0 || f > 1 {
+			return fmt.Errorf("LARGE_TRANSFER_FRACTION must be a number in (0, 1], got %q", s)
+		}
+	}
+	for _, name := range []string{"MAGIC_LINK_URL", "PASSWORD_RESET_URL"} {
+		if s := os.Getenv(name); s != "" {
+			if u, err := url.Parse(s); err != nil || u.Scheme == "" {
+				return fmt.Errorf("%s must be an absolute URL, got %q", name, s)
+			}
+		}
+	}
+	if s := os.Getenv("PHONE_PATTERN"); s != "" {
+		if _, err := regexp.Compile(s); err != nil {
+			return fmt.Errorf("PHONE_PATTERN must be a valid regular expression: %v", err)
+		}
+	}
+	if s := os.Getenv("BASE_PATH"); s != "" && strings.ContainsAny(s, " ?#:") {
+		return fmt.Errorf("BASE_PATH must be a plain path prefix like /loyalty, got %q", s)
+	}
+	if err := validateTrustedProxies(); err != nil {
+		return err
+	}
+	for _, name := range []string{"PUBLIC_BASE_URL", "INVARIANT_ALERT_WEBHOOK_URL"} {
+		if s := os.Getenv(name); s != "" {
+			if u, err := url.Parse(s); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("%s must be an absolute URL, got %q", name, s)
+			}
+		}
+	}
+	if s := os.Getenv("JWT_TTL"); s != "" {
+		if d, err := time.ParseDuration(s); err != nil || d <= 0 {
+			return fmt.Errorf("JWT_TTL must be a positive duration like 15m, got %q", s)
+		}
+	}
+	if s := os.Getenv("TOTP_ENCRYPTION_KEY"); s != "" && len(s) < minJWTSecretLength {
+		return fmt.Errorf("TOTP_ENCRYPTION_KEY must be at least %d bytes", minJWTSecretLength)
+	}
+	// a short secret can be brute-forced offline from any issued token, so
+	// the length applies in development too; only leaving it unset is allowed
+	if s := os.Getenv("JWT_SECRET"); s == "" && appEnv() != "development" {
+		return fmt.Errorf("JWT_SECRET is required when APP_ENV=%s", appEnv())
+	} else if s != "" && len(s) < minJWTSecretLength {
+		return fmt.Errorf("JWT_SECRET must be at least %d bytes", minJWTSecretLength)
+	}
+	cert, key := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if (cert == "") != (key == "") {
+		return fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if s := os.Getenv("BCRYPT_COST"); s != "" {
+		if n, err := strconv.Atoi(s); err != nil || n < bcrypt.MinCost || n > bcrypt.MaxCost {
+			return fmt.Errorf("BCRYPT_COST must be an integer between %d and %d, got %q", bcrypt.MinCost, bcrypt.MaxCost, s)
+		}
+	}
+	if (os.Getenv("GOOGLE_CLIENT_ID") == "") != (os.Getenv("GOOGLE_CLIENT_SECRET") == "") {
+		return fmt.Errorf("GOOGLE_CLIENT_ID and GOOGLE_CLIENT_SECRET must be set together")
+	}
+	if s := os.Getenv("RATE_LIMIT_WINDOW"); s != "" {
+		if d, err := time.ParseDuration(s); err != nil || d <= 0 {
+			return fmt.Errorf("RATE_LIMIT_WINDOW must be a positive duration like 1m, got %q", s)
+		}
+	}
+	if _, err := logLevel(); err != nil {
+		return err
+	}
+	if _, err := parseTierLimits(os.Getenv("DAILY_TRANSFER_LIMITS")); err != nil {
+		return fmt.Errorf("DAILY_TRANSFER_LIMITS: %v", err)
+	}
+	for _, name := range []string{"TRANSFER_MAX_IN_FLIGHT", "TRANSFER_MAX_QUEUE", "TRANSFER_QUEUE_TIMEOUT_MS", "MIN_PASSWORD_LENGTH", "DAILY_TRANSFER_LIMIT", "TRANSFER_CONFIRM_THRESHOLD", "POINTS_EXPIRY_DAYS", "RATE_LIMIT_MAX", "TRANSFER_ACCEPT_THRESHOLD"} {
+		if s := os.Getenv(name); s != "" {
+			if n, err := strconv.Atoi(s); err != nil || n <= 0 {
+				return fmt.Errorf("%s must be a positive integer, got %q", name, s)
+			}
+		}
+	}
+	for name, path := range map[string]string{"TLS_CERT_FILE": cert, "TLS_KEY_FILE": key} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("%s %q is not readable: %v", name, path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string // "" for a valid configuration
+	}{
+		{"test defaults", nil, ""},
+		{"unknown database driver", map[string]string{"DB_DRIVER": "mysql"}, "DB_DRIVER must be sqlite or postgres"},
+		{"postgres without a DSN", map[string]string{"DB_DRIVER": "postgres", "DATABASE_URL": ""}, "DATABASE_URL is required"},
+		{"port out of range", map[string]string{"PORT": "70000"}, "PORT must be a port number"},
+		{"port not a number", map[string]string{"PORT": "http"}, "PORT must be a port number"},
+		{"bool setting", map[string]string{"EXPOSE_METRICS": "yes please"}, "EXPOSE_METRICS must be true or false"},
+		{"large transfer fraction above 1", map[string]string{"LARGE_TRANSFER_FRACTION": "1.5"}, "LARGE_TRANSFER_FRACTION must be a number in (0, 1]"},
+		{"relative magic link URL", map[string]string{"MAGIC_LINK_URL": "/login"}, "MAGIC_LINK_URL must be an absolute URL"},
+		{"phone pattern", map[string]string{"PHONE_PATTERN": "(["}, "PHONE_PATTERN must be a valid regular expression"},
+		{"base path with a query", map[string]string{"BASE_PATH": "/api?x=1"}, "BASE_PATH must be a plain path prefix"},
+		{"trusted proxy", map[string]string{"TRUSTED_PROXIES": "10.0.0.0/33"}, "TRUSTED_PROXIES entry"},
+		{"public base URL without a host", map[string]string{"PUBLIC_BASE_URL": "https://"}, "PUBLIC_BASE_URL must be an absolute URL"},
+		{"relative alert webhook", map[string]string{"INVARIANT_ALERT_WEBHOOK_URL": "/hooks/alerts"}, "INVARIANT_ALERT_WEBHOOK_URL must be an absolute URL"},
+		{"JWT TTL", map[string]string{"JWT_TTL": "-5m"}, "JWT_TTL must be a positive duration"},
+		{"short TOTP key", map[string]string{"TOTP_ENCRYPTION_KEY": "short"}, "TOTP_ENCRYPTION_KEY must be at least"},
+		{"missing JWT secret in production", map[string]string{"APP_ENV": "production", "JWT_SECRET": ""}, "JWT_SECRET is required"},
+		{"short JWT secret", map[string]string{"JWT_SECRET": "short"}, "JWT_SECRET must be at least"},
+		{"TLS cert without key", map[string]string{"TLS_CERT_FILE": "cert.pem"}, "TLS_CERT_FILE and TLS_KEY_FILE must be set together"},
+		{"unreadable TLS files", map[string]string{"TLS_CERT_FILE": "missing.pem", "TLS_KEY_FILE": "missing.key"}, "is not readable"},
+		{"bcrypt cost", map[string]string{"BCRYPT_COST": "40"}, "BCRYPT_COST must be an integer"},
+		{"google client without secret", map[string]string{"GOOGLE_CLIENT_ID": "id"}, "GOOGLE_CLIENT_ID and GOOGLE_CLIENT_SECRET"},
+		{"rate limit window", map[string]string{"RATE_LIMIT_WINDOW": "soon"}, "RATE_LIMIT_WINDOW must be a positive duration"},
+		{"log level", map[string]string{"LOG_LEVEL": "loud"}, "LOG_LEVEL must be"},
+		{"tier limits", map[string]string{"DAILY_TRANSFER_LIMITS": "Gold"}, "DAILY_TRANSFER_LIMITS"},
+		{"positive integer setting", map[string]string{"TRANSFER_MAX_IN_FLIGHT": "0"}, "TRANSFER_MAX_IN_FLIGHT must be a positive integer"},
+	}
+	// validateConfig runs before initDB, so it must not need the database
+	saved := db
+	db = nil
+	t.Cleanup(func() { db = saved })
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			err := validateConfig()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
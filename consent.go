@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Consent is one grant or revocation for a purpose. Rows are append-only:
+// the latest row per (user, purpose) is the current state, and a purpose
+// with no rows has never been asked.
+type Consent struct {
+	ID            uint      `json:"-" gorm:"primaryKey"`
+	UserID        uint      `json:"-" gorm:"index:idx_consent_user_purpose;not null"`
+	Purpose       string    `json:"purpose" gorm:"index:idx_consent_user_purpose;not null"`
+	Granted       bool      `json:"granted"`
+	PolicyVersion string    `json:"policy_version"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Consent purposes
+var consentPurposes = []string{"marketing_push", "marketing_email", "partner_data_sharing", "analytics"}
+
+func init() {
+	registerInvariant("consent_orphaned",
+		"consents whose user doesn't exist",
+		`SELECT x.id FROM consents x LEFT JOIN users u ON u.id = x.user_id WHERE u.id IS NULL`)
+}
+
+// consentPolicyVersion is the privacy policy version currently shown to
+// users (CONSENT_POLICY_VERSION, default "1")
+func consentPolicyVersion() string {
+	if v := os.Getenv("CONSENT_POLICY_VERSION"); v != "" {
+		return v
+	}
+	return "1"
+}
+
+func isConsentPurpose(purpose string) bool {
+	for _, p := range consentPurposes {
+		if p == purpose {
+			return true
+		}
+	}
+	return false
+}
+
+// validateConsents checks a purpose → granted map from a request
+func validateConsents(consents map[string]bool) error {
+	for purpose := range consents {
+		if !isConsentPurpose(purpose) {
+			return fmt.Errorf("unknown consent purpose %q", purpose)
+		}
+	}
+	return nil
+}
+
+// recordConsents appends a history row for each purpose in consents
+func recordConsents(tx *gorm.DB, userID uint, consents map[string]bool, policyVersion string) error {
+	for _, purpose := range consentPurposes {
+		granted, ok := consents[purpose]
+		if !ok {
+			continue
+		}
+		if err := tx.Create(&Consent{
+			UserID:        userID,
+			Purpose:       purpose,
+			Granted:       granted,
+			PolicyVersion: policyVersion,
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// currentConsents returns the latest consent row per purpose
+func currentConsents(userID uint) (map[string]Consent, error) {
+	var history []Consent
+	if err := db.Where("user_id = ?", userID).Order("created_at ASC, id ASC").Find(&history).Error; err != nil {
+		return nil, err
+	}
+	current := map[string]Consent{}
+	for _, c := range history {
+		current[c.Purpose] = c
+	}
+	return current, nil
+}
+
+func consentResponse(userID uint) (fiber.Map, error) {
+	current, err := currentConsents(userID)
+	if err != nil {
+		return nil, err
+	}
+	version := consentPolicyVersion()
+	purposes := fiber.Map{}
+	needsConsent := false
+	for _, purpose := range consentPurposes {
+		c, ok := current[purpose]
+		if !ok {
+			purposes[purpose] = fiber.Map{"status": "not_asked"}
+			needsConsent = true
+			continue
+		}
+		status := "revoked"
+		if c.Granted {
+			status = "granted"
+		}
+		purposes[purpose] = fiber.Map{"status": status, "policy_version": c.PolicyVersion, "updated_at": c.CreatedAt}
+		if c.PolicyVersion != version {
+			needsConsent = true
+		}
+	}
+	return fiber.Map{
+		"policy_version": version,
+		"needs_consent":  needsConsent,
+		"consents":       purposes,
+	}, nil
+}
+
+// Get the current user's consent state
+func getConsentsHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	resp, err := consentResponse(u.(User).ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to fetch consents"})
+	}
+	return c.JSON(resp)
+}
+
+// Grant or revoke consents for the current user
+func updateConsentsHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+
+	var payload struct {
+		PolicyVersion string          `json:"policy_version"`
+		Consents      map[string]bool `json:"consents"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	if payload.PolicyVersion == "" || len(payload.Consents) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "policy_version and consents required"})
+	}
+	if err := validateConsents(payload.Consents); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := recordConsents(db, user.ID, payload.Consents, payload.PolicyVersion); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to record consents"})
+	}
+	resp, err := consentResponse(user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to fetch consents"})
+	}
+	return c.JSON(resp)
+}
+
+// Consent change history for the current user, newest first
+func consentHistoryHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	var history []Consent
+	if err := db.Where("user_id = ?", u.(User).ID).Order("created_at DESC, id DESC").Find(&history).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to fetch consent history"})
+	}
+	return c.JSON(fiber.Map{"history": history})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// deletedMemberName stands in for counterparties whose account is gone for
+// good; soft-deleted ones still show as they were
+const deletedMemberName = "Deleted member"
+
+type counterpartyTotals struct {
+	CounterpartyID uint
+	TotalSent      int64
+	TotalReceived  int64
+	TxCount        int64
+	FirstTxID      uint
+	LastTxID       uint
+}
+
+// counterpartyProjection maps each of @me's transactions onto the other
+// party, splitting the amount into sent and received; adjustments and
+// expiries have no other party and are left out
+const counterpartyProjection = `SELECT CASE WHEN from_user_id = @me THEN to_user_id ELSE from_user_id END AS counterparty_id,
+		CASE WHEN from_user_id = @me THEN amount ELSE 0 END AS sent,
+		CASE WHEN from_user_id = @me THEN 0 ELSE amount END AS received,
+		id
+	FROM transactions WHERE (from_user_id = @me OR to_user_id = @me) AND type NOT IN ('adjustment', 'expiry')`
+
+// Totals per counterparty, or the full history with one counterparty
+func counterpartyHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+
+	page, err := parsePagination(c)
+	if err != nil {
+		return writeError(c, err)
+	}
+	if memberID := c.Query("counterparty"); memberID != "" {
+		return counterpartyHistory(c, user, memberID, page)
+	}
+
+	order := "SUM(sent) + SUM(received) DESC, MAX(id) DESC"
+	switch c.Query("sort", "volume") {
+	case "volume":
+	case "recent":
+		order = "MAX(id) DESC"
+	default:
+		return writeError(c, &ValidationError{Message: "sort must be volume or recent"})
+	}
+
+	params := map[string]interface{}{"me": user.ID, "limit": page.PageSize, "offset": page.Offset()}
+	var total int64
+	if err := db.Raw("SELECT COUNT(DISTINCT counterparty_id) FROM ("+counterpartyProjection+") AS p", params).
+		Scan(&total).Error; err != nil {
+		return writeError(c, fmt.Errorf("count counterparties: %w", err))
+	}
+	var rows []counterpartyTotals
+	if err := db.Raw(`SELECT counterparty_id, SUM(sent) AS total_sent, SUM(received) AS total_received,
+			COUNT(*) AS tx_count, MIN(id) AS first_tx_id, MAX(id) AS last_tx_id
+		FROM (`+counterpartyProjection+`) AS p
+		GROUP BY counterparty_id
+		ORDER BY `+order+`
+		LIMIT @limit OFFSET @offset`, params).Scan(&rows).Error; err != nil {
+		return writeError(c, fmt.Errorf("aggregate counterparties: %w", err))
+	}
+
+	// resolve names and first/last dates for just this page
+	userIDs := make([]uint, 0, len(rows))
+	txIDs := make([]uint, 0, len(rows)*2)
+	for _, r := range rows {
+		userIDs = append(userIDs, r.CounterpartyID)
+		txIDs = append(txIDs, r.FirstTxID, r.LastTxID)
+	}
+	var users []User
+	if err := db.Unscoped().Where("id IN ?", userIDs).Find(&users).Error; err != nil {
+		return writeError(c, fmt.Errorf("load counterparties: %w", err))
+	}
+	byID := map[uint]User{}
+	for _, cp := range users {
+		byID[cp.ID] = cp
+	}
+	var txs []Transaction
+	if err := db.Select("id", "created_at").Where("id IN ?", txIDs).Find(&txs).Error; err != nil {
+		return writeError(c, fmt.Errorf("load transaction dates: %w", err))
+	}
+	dates := map[uint]time.Time{}
+	for _, tx := range txs {
+		dates[tx.ID] = tx.CreatedAt
+	}
+
+	counterparties := make([]fiber.Map, 0, len(rows))
+	for _, r := range rows {
+		entry := fiber.Map{
+			"member_id":            nil,
+			"name":                 deletedMemberName,
+			"total_sent":           r.TotalSent,
+			"total_received":       r.TotalReceived,
+			"transaction_count":    r.TxCount,
+			"first_transaction_at": dates[r.FirstTxID],
+			"last_transaction_at":  dates[r.LastTxID],
+		}
+		if cp, ok := byID[r.CounterpartyID]; ok {
+			entry["member_id"] = cp.MemberID
+			entry["name"] = fmt.Sprintf("%s %s", cp.FirstName, cp.LastName)
+		}
+		counterparties = append(counterparties, entry)
+	}
+	return c.JSON(fiber.Map{
+		"counterparties": counterparties,
+		"pagination":     page.Meta(total),
+	})
+}
+
+// counterpartyHistory lists every transaction between user and memberID
+func counterpartyHistory(c *fiber.Ctx, user User, memberID string, page pagination) error {
+	var other User
+	if err := db.Unscoped().Where("member_id = ?", memberID).First(&other).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "counterparty not found"})
+		}
+		return writeError(c, err)
+	}
+
+	pair := db.Model(&Transaction{}).Where("(from_user_id = ? AND to_user_id = ?) OR (from_user_id = ? AND to_user_id = ?)",
+		user.ID, other.ID, other.ID, user.ID)
+	var total int64
+	if err := pair.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return writeError(c, fmt.Errorf("count pair history: %w", err))
+	}
+	var transactions []Transaction
+	if err := pair.Session(&gorm.Session{}).
+		Preload("FromUser", withDeleted).
+		Preload("ToUser", withDeleted).
+		Order("created_at DESC").
+		Limit(page.PageSize).
+		Offset(page.Offset()).
+		Find(&transactions).Error; err != nil {
+		return writeError(c, fmt.Errorf("load pair history: %w", err))
+	}
+
+	formatted := make([]transactionView, 0, len(transactions))
+	for _, tx := range transactions {
+		formatted = append(formatted, formatTransaction(tx, user.ID))
+	}
+	return c.JSON(fiber.Map{
+		"counterparty": fiber.Map{
+			"member_id": other.MemberID,
+			"name":      fmt.Sprintf("%s %s", other.FirstName, other.LastName),
+		},
+		"transactions": formatted,
+		"pagination":   page.Meta(total),
+	})
+}
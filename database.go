@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// Supported DB_DRIVER values
+const (
+	driverSQLite   = "sqlite"
+	driverPostgres = "postgres"
+)
+
+// databaseDriver returns DB_DRIVER, inferring postgres from a postgres://
+// DATABASE_URL and defaulting to sqlite
+func databaseDriver() string {
+	if d := strings.ToLower(os.Getenv("DB_DRIVER")); d != "" {
+		return d
+	}
+	url := os.Getenv("DATABASE_URL")
+	if strings.HasPrefix(url, "postgres://") || strings.HasPrefix(url, "postgresql://") {
+		return driverPostgres
+	}
+	return driverSQLite
+}
+
+// databaseDialector picks the GORM driver from DB_DRIVER and DATABASE_URL.
+// For sqlite DATABASE_URL is the file (default app.db); for postgres it is a
+// URL or key=value DSN and is required.
+func databaseDialector() (gorm.Dialector, error) {
+	dsn := os.Getenv("DATABASE_URL")
+	switch driver := databaseDriver(); driver {
+	case driverSQLite:
+		if dsn == "" {
+			dsn = "app.db"
+		}
+		// Take the write lock at BEGIN: a transaction that reads then writes
+		// would otherwise fail with "database is locked" when another
+		// writer got there first, instead of waiting for it
+		if !strings.Contains(dsn, "_txlock=") {
+			sep := "?"
+			if strings.Contains(dsn, "?") {
+				sep = "&"
+			}
+			dsn += sep + "_txlock=immediate"
+		}
+		return sqlite.Open(dsn), nil
+	case driverPostgres:
+		if dsn == "" {
+			return nil, fmt.Errorf("DATABASE_URL is required when DB_DRIVER=postgres")
+		}
+		return postgres.Open(dsn), nil
+	default:
+		return nil, fmt.Errorf("DB_DRIVER must be sqlite or postgres, got %q", driver)
+	}
+}
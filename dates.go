@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Thai users often type birthdays in the Buddhist era (BE = CE + 543).
+// No plausible Gregorian birth year is above 2400, so such years are
+// read as BE and stored as Gregorian.
+const (
+	buddhistEraOffset   = 543
+	buddhistEraMinYear  = 2400
+	minBirthdayAgeYears = 10
+	maxBirthdayAgeYears = 120
+)
+
+// parseBirthday reads a YYYY-MM-DD birthday in either era and returns the
+// Gregorian date. The day is checked against the converted year, so BE
+// 2543-02-29 (CE 2000, a leap year) is accepted.
+func parseBirthday(s string, now time.Time) (time.Time, error) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) != 3 || len(parts[0]) != 4 || len(parts[1]) != 2 || len(parts[2]) != 2 {
+		return time.Time{}, fmt.Errorf("must be a date in YYYY-MM-DD format")
+	}
+	year, errY := strconv.Atoi(parts[0])
+	month, errM := strconv.Atoi(parts[1])
+	day, errD := strconv.Atoi(parts[2])
+	if errY != nil || errM != nil || errD != nil {
+		return time.Time{}, fmt.Errorf("must be a date in YYYY-MM-DD format")
+	}
+	if year > buddhistEraMinYear {
+		year -= buddhistEraOffset
+	}
+	date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	// time.Date normalizes overflow (Feb 30 → Mar 2); reject instead
+	if date.Year() != year || int(date.Month()) != month || date.Day() != day {
+		return time.Time{}, fmt.Errorf("must be a valid calendar date")
+	}
+	age := ageOn(date, now)
+	if age < minBirthdayAgeYears || age > maxBirthdayAgeYears {
+		return time.Time{}, fmt.Errorf("must give an age between %d and %d", minBirthdayAgeYears, maxBirthdayAgeYears)
+	}
+	return date, nil
+}
+
+// dateRange is an optional [From, To) window on created_at
+type dateRange struct {
+	From, To *time.Time
+}
+
+// parseDateRange reads ?from= and ?to= (inclusive YYYY-MM-DD dates, UTC)
+func parseDateRange(c *fiber.Ctx) (dateRange, error) {
+	var r dateRange
+	for _, name := range []string{"from", "to"} {
+		s := c.Query(name)
+		if s == "" {
+			continue
+		}
+		day, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return r, &ValidationError{Message: name + " must be a date in YYYY-MM-DD format"}
+		}
+		if name == "from" {
+			r.From = &day
+		} else {
+			// inclusive: everything before the start of the next day
+			end := day.AddDate(0, 0, 1)
+			r.To = &end
+		}
+	}
+	if r.From != nil && r.To != nil && !r.From.Before(*r.To) {
+		return r, &ValidationError{Message: "from must not be after to"}
+	}
+	return r, nil
+}
+
+// Apply narrows query to rows created inside the range
+func (r dateRange) Apply(query *gorm.DB) *gorm.DB {
+	if r.From != nil {
+		query = query.Where("created_at >= ?", *r.From)
+	}
+	if r.To != nil {
+		query = query.Where("created_at < ?", *r.To)
+	}
+	return query
+}
+
+// ageOn is the age in whole years of someone born on birth, as of now
+func ageOn(birth, now time.Time) int {
+	age := now.Year() - birth.Year()
+	if now.Month() < birth.Month() || (now.Month() == birth.Month() && now.Day() < birth.Day()) {
+		age--
+	}
+	return age
+}
+
+// normalizeBuddhistEraBirthdays rewrites stored BE birthdays as Gregorian.
+// Rows that still don't parse are logged for manual review and left as is.
+func normalizeBuddhistEraBirthdays() {
+	var rows []struct {
+		ID       uint
+		Birthday string
+	}
+	if err := db.Model(&User{}).Select("id", "birthday").
+		Where("birthday >= ?", strconv.Itoa(buddhistEraMinYear)).Scan(&rows).Error; err != nil {
+		log.Fatalf("scan buddhist era birthdays failed: %v", err)
+	}
+	fixed := 0
+	for _, row := range rows {
+		date, err := parseBirthday(row.Birthday, time.Now())
+		if err != nil {
+			log.Printf("birthday migration: user %d has ambiguous birthday %q: %v", row.ID, row.Birthday, err)
+			continue
+		}
+		if err := db.Model(&User{}).Where("id = ?", row.ID).
+			Update("birthday", date.Format("2006-01-02")).Error; err != nil {
+			log.Fatalf("normalize birthday of user %d failed: %v", row.ID, err)
+		}
+		fixed++
+	}
+	if len(rows) > 0 {
+		log.Printf("birthday migration: converted %d buddhist era birthdays, %d need review", fixed, len(rows)-fixed)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBirthday(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	// before any CE 2400 birthday, so a year read as CE can't pass the age check
+	longAgo := time.Date(1900, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name  string
+		input string
+		now   time.Time
+		want  string // Gregorian date, or "" for an error
+	}{
+		{"CE date", "1990-05-20", now, "1990-05-20"},
+		{"BE date", "2533-05-20", now, "1990-05-20"},
+		{"surrounding whitespace", " 1990-05-20 ", now, "1990-05-20"},
+
+		{"year 2400 is CE", "2400-01-01", longAgo, ""},
+		{"year 2401 is BE", "2401-01-01", longAgo, "1858-01-01"},
+
+		{"BE 2543 is leap (CE 2000)", "2543-02-29", now, "2000-02-29"},
+		{"BE 2542 is not (CE 1999)", "2542-02-29", now, ""},
+		{"CE 2000 is leap", "2000-02-29", now, "2000-02-29"},
+		{"CE 1900 is not", "1900-02-29", longAgo, ""},
+
+		{"turns 10 today", "2016-10-16", now, "2016-10-16"},
+		{"turns 10 tomorrow", "2016-10-17", now, ""},
+		{"turns 10 today, BE", "2559-10-16", now, "2016-10-16"},
+		{"leap day, 10 on 1 March", "2016-02-29", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), "2016-02-29"},
+		{"leap day, still 9 on 28 February", "2016-02-29", time.Date(2026, 2, 28, 0, 0, 0, 0, time.UTC), ""},
+		{"120, turning 121 tomorrow", "1905-10-17", now, "1905-10-17"},
+		{"turns 121 today", "1905-10-16", now, ""},
+		{"born in the future", "2027-01-01", now, ""},
+
+		{"empty", "", now, ""},
+		{"slashes", "1990/05/20", now, ""},
+		{"unpadded month", "1990-5-20", now, ""},
+		{"five-digit year", "19900-05-20", now, ""},
+		{"letters", "199O-05-20", now, ""},
+		{"timestamp", "1990-05-20T00:00:00Z", now, ""},
+		{"month 13", "1990-13-01", now, ""},
+		{"month 00", "1990-00-10", now, ""},
+		{"day 00", "1990-05-00", now, ""},
+		{"31 April", "1990-04-31", now, ""},
+		{"day first", "20-05-1990", now, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseBirthday(tc.input, tc.now)
+			switch {
+			case tc.want == "" && err == nil:
+				t.Errorf("parseBirthday(%q) = %s, want an error", tc.input, got.Format("2006-01-02"))
+			case tc.want != "" && err != nil:
+				t.Errorf("parseBirthday(%q): %v, want %s", tc.input, err, tc.want)
+			case tc.want != "" && got.Format("2006-01-02") != tc.want:
+				t.Errorf("parseBirthday(%q) = %s, want %s", tc.input, got.Format("2006-01-02"), tc.want)
+			}
+		})
+	}
+}
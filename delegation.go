@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Delegation grants another member read-only access to the owner's
+// transactions. It starts as an emailed invite and becomes usable once the
+// invited member accepts it while signed in with the invited email.
+type Delegation struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	OwnerID       uint       `json:"-" gorm:"index;not null"`
+	DelegateEmail string     `json:"delegate_email" gorm:"not null"`
+	DelegateID    uint       `json:"-" gorm:"index"`
+	Scope         string     `json:"scope" gorm:"not null"`
+	TokenHash     string     `json:"-" gorm:"uniqueIndex;not null"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	AcceptedAt    *time.Time `json:"accepted_at"`
+	RevokedAt     *time.Time `json:"revoked_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// DelegatedAccess is one request a delegate made against an owner's data
+type DelegatedAccess struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	DelegationID uint      `json:"delegation_id" gorm:"index;not null"`
+	OwnerID      uint      `json:"-" gorm:"index;not null"`
+	DelegateID   uint      `json:"-"`
+	Path         string    `json:"path"`
+	IP           string    `json:"ip"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// delegationScopeReadOnly is the only scope for now
+const delegationScopeReadOnly = "read_only"
+
+// delegationInviteTTL bounds how long an unaccepted invite stays valid
+const delegationInviteTTL = 7 * 24 * time.Hour
+
+func init() {
+	registerInvariant("delegation_orphaned",
+		"delegations whose owner, or accepted delegate, doesn't exist",
+		`SELECT d.id FROM delegations d
+			LEFT JOIN users o ON o.id = d.owner_id
+			LEFT JOIN users g ON g.id = d.delegate_id
+			WHERE o.id IS NULL OR (d.delegate_id <> 0 AND g.id IS NULL)`)
+	registerInvariant("delegated_access_orphaned",
+		"delegated access log rows whose delegation doesn't exist",
+		`SELECT a.id FROM delegated_accesses a LEFT JOIN delegations d ON d.id = a.delegation_id WHERE d.id IS NULL`)
+	registerInvariant("delegated_access_mismatch",
+		"delegated access log rows whose owner or delegate isn't their delegation's",
+		`SELECT a.id FROM delegated_accesses a JOIN delegations d ON d.id = a.delegation_id
+			WHERE a.owner_id <> d.owner_id OR a.delegate_id <> d.delegate_id`)
+}
+
+func (d Delegation) active(now time.Time) bool {
+	return d.AcceptedAt != nil && d.RevokedAt == nil && (d.ExpiresAt == nil || now.Before(*d.ExpiresAt))
+}
+
+// Invite a member by email to read the current user's transactions
+func createDelegateHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+
+	var payload struct {
+		Email     string     `json:"email"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	if strings.TrimSpace(payload.Email) == "" {
+		return writeError(c, &ValidationError{Message: "email required", Fields: map[string]string{"email": "required"}})
+	}
+	// normalized like a registered email, so acceptance compares like with like
+	email, err := validateEmail(payload.Email)
+	if err != nil {
+		return writeError(c, &ValidationError{Message: err.Error(), Fields: map[string]string{"email": "must be a valid email address"}})
+	}
+	if email == normalizeEmail(user.Email) {
+		return writeError(c, &ValidationError{Message: "cannot delegate to yourself"})
+	}
+	if payload.ExpiresAt != nil && !payload.ExpiresAt.After(time.Now()) {
+		return writeError(c, &ValidationError{Message: "expires_at must be in the future"})
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate token"})
+	}
+	d := Delegation{
+		OwnerID:       user.ID,
+		DelegateEmail: email,
+		Scope:         delegationScopeReadOnly,
+		TokenHash:     hashToken(token),
+		ExpiresAt:     payload.ExpiresAt,
+	}
+	if err := db.Create(&d).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create delegation"})
+	}
+	body := fmt.Sprintf("%s %s (%s) has invited you to view their LBK Points transactions.\n\n"+
+		"Sign in to the LBK Points app with this email address (or register with it) and accept with this code within 7 days:\n\n%s",
+		user.FirstName, user.LastName, user.MemberID, token)
+	if err := mailer.Send(email, "You've been invited to view LBK Points transactions", body); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to send invitation"})
+	}
+	return c.Status(fiber.StatusCreated).JSON(d)
+}
+
+// List the current user's delegates
+func listDelegatesHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	var delegations []Delegation
+	if err := db.Where("owner_id = ?", u.(User).ID).Order("created_at DESC, id DESC").Find(&delegations).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to fetch delegates"})
+	}
+	return c.JSON(fiber.Map{"delegates": delegations})
+}
+
+// Revoke a delegate; takes effect on their next request
+func revokeDelegateHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	res := db.Model(&Delegation{}).
+		Where("id = ? AND owner_id = ? AND revoked_at IS NULL", c.Params("id"), u.(User).ID).
+		Update("revoked_at", time.Now())
+	if res.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to revoke delegate"})
+	}
+	if res.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "delegate not found"})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Access log of what delegates viewed, newest first
+func delegateAccessLogHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	page, err := parsePagination(c)
+	if err != nil {
+		return writeError(c, err)
+	}
+	q := db.Model(&DelegatedAccess{}).Where("owner_id = ?", u.(User).ID)
+	var total int64
+	if err := q.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to fetch access log"})
+	}
+	var entries []DelegatedAccess
+	if err := q.Session(&gorm.Session{}).Order("created_at DESC, id DESC").
+		Limit(page.PageSize).Offset(page.Offset()).Find(&entries).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to fetch access log"})
+	}
+	return c.JSON(fiber.Map{"access_log": entries, "pagination": page.Meta(total)})
+}
+
+// Accept a delegation invite as the signed-in member
+func acceptDelegationHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+
+	var payload struct {
+		Token string `json:"token"`
+	}
+	if err := c.BodyParser(&payload); err != nil || payload.Token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "token required"})
+	}
+	invalid := func() error {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "invalid or expired invitation"})
+	}
+	var d Delegation
+	if err := db.Where("token_hash = ?", hashToken(payload.Token)).First(&d).Error; err != nil {
+		return invalid()
+	}
+	// the invite is bound to the email it was sent to
+	if !strings.EqualFold(d.DelegateEmail, user.Email) || d.OwnerID == user.ID {
+		return invalid()
+	}
+	// otherwise anyone could register with the invited address and accept
+	if !user.EmailVerified {
+		return writeError(c, ErrEmailNotVerified)
+	}
+	now := time.Now()
+	if d.RevokedAt != nil || now.Sub(d.CreatedAt) > delegationInviteTTL || (d.ExpiresAt != nil && !now.Before(*d.ExpiresAt)) {
+		return invalid()
+	}
+	res := db.Model(&Delegation{}).Where("id = ? AND accepted_at IS NULL", d.ID).
+		Updates(map[string]interface{}{"delegate_id": user.ID, "accepted_at": now})
+	if res.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to accept invitation"})
+	}
+	if res.RowsAffected != 1 {
+		return invalid()
+	}
+	var owner User
+	if err := db.First(&owner, d.OwnerID).Error; err != nil {
+		return invalid()
+	}
+	return c.JSON(fiber.Map{
+		"owner": fiber.Map{
+			"member_id":  owner.MemberID,
+			"first_name": owner.FirstName,
+			"last_name":  owner.LastName,
+		},
+		"scope":      d.Scope,
+		"expires_at": d.ExpiresAt,
+	})
+}
+
+// delegationMiddleware resolves :owner_member_id, checks the signed-in user
+// holds an active delegation for it and logs the access. The owner is
+// stored in Locals("owner"); Locals("user") stays the delegate so owner-only
+// handlers can never be reached through a delegated route by accident.
+func delegationMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		u := c.Locals("user")
+		if u == nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+		}
+		delegate := u.(User)
+		forbidden := func() error {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "no delegated access to this member"})
+		}
+
+		var owner User
+		if err := db.Where("member_id = ?", c.Params("owner_member_id")).First(&owner).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return forbidden()
+			}
+			return writeError(c, err)
+		}
+		var d Delegation
+		if err := db.Where("owner_id = ? AND delegate_id = ? AND revoked_at IS NULL AND accepted_at IS NOT NULL", owner.ID, delegate.ID).
+			Order("id DESC").First(&d).Error; err != nil || !d.active(time.Now()) {
+			return forbidden()
+		}
+		if err := db.Create(&DelegatedAccess{
+			DelegationID: d.ID,
+			OwnerID:      owner.ID,
+			DelegateID:   delegate.ID,
+			Path:         c.Path(),
+			IP:           clientIP(c),
+		}).Error; err != nil {
+			return writeError(c, fmt.Errorf("log delegated access: %w", err))
+		}
+		c.Locals("owner", owner)
+		return c.Next()
+	}
+}
+
+// Owner's transaction history as seen by a delegate
+func delegatedTransactionsHandler(c *fiber.Ctx) error {
+	owner := c.Locals("owner").(User)
+	page, err := parsePagination(c)
+	if err != nil {
+		return writeError(c, err)
+	}
+	q := db.Model(&Transaction{}).Where("from_user_id = ? OR to_user_id = ?", owner.ID, owner.ID)
+	var total int64
+	if err := q.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to fetch transactions"})
+	}
+	var transactions []Transaction
+	if err := q.Session(&gorm.Session{}).
+		Preload("FromUser", withDeleted).
+		Preload("ToUser", withDeleted).
+		Order("created_at DESC, id DESC").
+		Limit(page.PageSize).
+		Offset(page.Offset()).
+		Find(&transactions).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to fetch transactions"})
+	}
+	formatted := make([]transactionView, 0, len(transactions))
+	for _, tx := range transactions {
+		formatted = append(formatted, formatTransaction(tx, owner.ID))
+	}
+	return c.JSON(fiber.Map{
+		"owner_member_id": owner.MemberID,
+		"transactions":    formatted,
+		"pagination":      page.Meta(total),
+	})
+}
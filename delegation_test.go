@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestCreateDelegateValidatesEmail(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	mail := useCaptureMailer(t)
+	owner := createUser(t, 0)
+	token, elevated := tokenFor(t, owner), elevatedTokenFor(t, owner)
+
+	for name, email := range map[string]string{
+		"missing":           " ",
+		"not an address":    "accountant",
+		"no domain dot":     "accountant@example",
+		"with display name": "Accountant <accountant@example.com>",
+		"own email":         " " + strings.ToUpper(owner.Email),
+	} {
+		t.Run(name, func(t *testing.T) {
+			status, body := doJSON(t, app, fiber.MethodPost, "/me/delegates", token, fiber.Map{"email": email}, elevationHeader, elevated)
+			if status != fiber.StatusBadRequest || errorCodeOf(body) != "INVALID_REQUEST" {
+				t.Errorf("status %d, body %v", status, body)
+			}
+		})
+	}
+
+	status, body := doJSON(t, app, fiber.MethodPost, "/me/delegates", token, fiber.Map{"email": " Accountant@Example.COM "}, elevationHeader, elevated)
+	if status != fiber.StatusCreated {
+		t.Fatalf("valid email: status %d, body %v", status, body)
+	}
+	if body["delegate_email"] != "accountant@example.com" {
+		t.Errorf("delegate_email = %v, want it normalized", body["delegate_email"])
+	}
+	if len(mail.sent) != 1 || mail.sent[0].To != "accountant@example.com" {
+		t.Errorf("sent %+v, want one invitation to the normalized address", mail.sent)
+	}
+}
+
+// idsOf returns the id field of each entry in a list response
+func idsOf(t *testing.T, entries interface{}) []float64 {
+	t.Helper()
+	list, ok := entries.([]interface{})
+	if !ok {
+		t.Fatalf("not a list: %v", entries)
+	}
+	ids := make([]float64, 0, len(list))
+	for _, e := range list {
+		ids = append(ids, e.(map[string]interface{})["id"].(float64))
+	}
+	return ids
+}
+
+func TestDelegationListsBreakTiesByID(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	owner := createUser(t, 0)
+	delegate := createUser(t, 0)
+	at := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	var delegations []Delegation
+	for i := 0; i < 3; i++ {
+		d := Delegation{OwnerID: owner.ID, DelegateEmail: delegate.Email, Scope: delegationScopeReadOnly, TokenHash: fmt.Sprint("tie-", i), CreatedAt: at}
+		if i == 0 {
+			d.DelegateID, d.AcceptedAt = delegate.ID, &at
+		}
+		if err := db.Create(&d).Error; err != nil {
+			t.Fatal(err)
+		}
+		delegations = append(delegations, d)
+	}
+	var transactions []Transaction
+	for i := 0; i < 3; i++ {
+		txn := Transaction{FromUserID: owner.ID, ToUserID: delegate.ID, Amount: 10, Type: "transfer", Status: "completed", CreatedAt: at}
+		if err := db.Create(&txn).Error; err != nil {
+			t.Fatal(err)
+		}
+		transactions = append(transactions, txn)
+	}
+
+	status, body := doJSON(t, app, fiber.MethodGet, "/me/delegates", tokenFor(t, owner), nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("list delegates: status %d, body %v", status, body)
+	}
+	want := []float64{float64(delegations[2].ID), float64(delegations[1].ID), float64(delegations[0].ID)}
+	if got := idsOf(t, body["delegates"]); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("delegates = %v, want %v", got, want)
+	}
+
+	status, body = doJSON(t, app, fiber.MethodGet, "/delegated/"+owner.MemberID+"/transactions", tokenFor(t, delegate), nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("delegated transactions: status %d, body %v", status, body)
+	}
+	want = []float64{float64(transactions[2].ID), float64(transactions[1].ID), float64(transactions[0].ID)}
+	if got := idsOf(t, body["transactions"]); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("transactions = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+// Members delete their own account with DELETE /me. The row is soft-deleted
+// (User.DeletedAt), so GORM leaves it out of logins, search and transfers,
+// while past transactions still show who was on the other side. The email
+// and member ID stay reserved unless RELEASE_DELETED_ACCOUNT_IDS is set, in
+// which case they're cleared and can be registered again.
+var deleteAccountLimiter = newAttemptLimiter(5, 15*time.Minute)
+
+// releaseDeletedAccountIDs reports whether a deleted account's email and
+// member ID become free for new accounts (RELEASE_DELETED_ACCOUNT_IDS=true)
+func releaseDeletedAccountIDs() bool {
+	return envBool("RELEASE_DELETED_ACCOUNT_IDS")
+}
+
+// withDeleted includes soft-deleted users, for preloading the
+// counterparties of past transactions
+func withDeleted(tx *gorm.DB) *gorm.DB {
+	return tx.Unscoped()
+}
+
+// deleteAccount soft-deletes user inside one transaction, first settling
+// anything still in flight: transfers awaiting their acceptance are
+// returned to the senders, and their own pending transfers are cancelled
+func deleteAccount(user User) error {
+	return withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		var pending []Transaction
+		if err := tx.Where("status = ? AND (from_user_id = ? OR to_user_id = ?)", "pending", user.ID, user.ID).
+			Find(&pending).Error; err != nil {
+			return fmt.Errorf("find pending transfers: %w", err)
+		}
+		for _, txn := range pending {
+			var err error
+			switch {
+			case txn.FromUserID == user.ID:
+				err = cancelTransferTx(tx, &txn, user.ID, "sender deleted their account")
+			case txn.AcceptRequired:
+				err = returnHeldTransferTx(tx, txn, "declined", actorUser, user.ID, "recipient deleted their account")
+			}
+			if err != nil {
+				return fmt.Errorf("settle transfer %d: %w", txn.ID, err)
+			}
+		}
+
+		// the Google account may sign up afresh, so don't keep it linked
+		updates := map[string]interface{}{"google_subject": nil}
+		if releaseDeletedAccountIDs() {
+			updates["email"] = fmt.Sprintf("deleted-%d@deleted.invalid", user.ID)
+			updates["member_id"] = ""
+		}
+		if err := tx.Model(&User{}).Where("id = ?", user.ID).Updates(updates).Error; err != nil {
+			return fmt.Errorf("clear account identifiers: %w", err)
+		}
+		if err := tx.Delete(&User{}, user.ID).Error; err != nil {
+			return fmt.Errorf("soft-delete user: %w", err)
+		}
+		return tx.Model(&RefreshToken{}).Where("user_id = ? AND revoked = ?", user.ID, false).
+			Update("revoked", true).Error
+	})
+}
+
+// Delete the logged-in user's account; the route needs elevation, and the
+// password, if the account has one, is confirmed again
+func deleteAccountHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+
+	var payload struct {
+		CurrentPassword string `json:"current_password"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	if hasPassword(user) && payload.CurrentPassword == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "current_password required"})
+	}
+	if !deleteAccountLimiter.Allow(fmt.Sprint(user.ID)) {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "too many requests"})
+	}
+	ip := clientIP(c)
+	if !passwordConfirmed(user, payload.CurrentPassword) {
+		log.Printf("audit: account deletion denied user=%d ip=%s", user.ID, ip)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "current password is incorrect"})
+	}
+	if err := deleteAccount(user); err != nil {
+		return writeError(c, fmt.Errorf("delete account of user %d: %w", user.ID, err))
+	}
+	if claims, ok := c.Locals("claims").(jwt.RegisteredClaims); ok {
+		if err := revokeAccessToken(claims); err != nil {
+			log.Printf("revoke access token after account deletion for user %d: %v", user.ID, err)
+		}
+	}
+	log.Printf("audit: account deleted user=%d ip=%s released_ids=%t", user.ID, ip, releaseDeletedAccountIDs())
+	clearSessionCookies(c)
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+func TestDeleteAccountRequiresElevation(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	user := createUser(t, 100)
+	token := tokenFor(t, user)
+	payload := fiber.Map{"current_password": testPassword}
+
+	status, body := doJSON(t, app, fiber.MethodDelete, "/me", token, payload)
+	if status != fiber.StatusUnauthorized || errorCodeOf(body) != "ELEVATION_REQUIRED" {
+		t.Fatalf("without elevation: status %d, body %v", status, body)
+	}
+	reloadUser(t, user)
+
+	status, body = doJSON(t, app, fiber.MethodDelete, "/me", token, payload, elevationHeader, elevatedTokenFor(t, user))
+	if status != fiber.StatusNoContent {
+		t.Fatalf("with elevation: status %d, body %v", status, body)
+	}
+	if err := db.First(&User{}, user.ID).Error; !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("account still active: %v", err)
+	}
+}
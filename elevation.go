@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Elevation is a short-lived proof that the user re-entered their password,
+// and their TOTP or recovery code when 2FA is on. Accounts without a
+// password (Google sign-ups) prove themselves with a code emailed by
+// POST /auth/elevate/email-code instead.
+// It travels as a separate JWT in X-Elevated-Token so the long-lived access
+// token alone can't perform sensitive actions. Each one is recorded by its
+// jti so logging out or changing the password can revoke it early.
+const (
+	elevationTTL      = 10 * time.Minute
+	elevationAudience = "elevated"
+	elevationHeader   = "X-Elevated-Token"
+)
+
+const elevationCodeTTL = 10 * time.Minute
+
+var (
+	elevateLimiter       = newAttemptLimiter(5, 15*time.Minute)
+	elevationCodeLimiter = newAttemptLimiter(3, 15*time.Minute)
+)
+
+// ElevationCode is a single-use 6-digit code emailed to a password-less
+// account, which it exchanges at /auth/elevate
+type ElevationCode struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"index;not null"`
+	CodeHash  string    `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// ElevatedToken records an issued elevation token until it expires, so the
+// user's outstanding ones can be found and denylisted, see
+// revokeElevatedTokens
+type ElevatedToken struct {
+	JTI       string    `gorm:"primaryKey"`
+	UserID    uint      `gorm:"index;not null"`
+	ExpiresAt time.Time `gorm:"index;not null"`
+}
+
+func init() {
+	registerInvariant("elevation_code_orphaned",
+		"emailed elevation codes whose user doesn't exist",
+		`SELECT x.id FROM elevation_codes x LEFT JOIN users u ON u.id = x.user_id WHERE u.id IS NULL`)
+	registerInvariant("elevated_token_orphaned",
+		"issued elevation tokens whose user doesn't exist",
+		`SELECT x.jti FROM elevated_tokens x LEFT JOIN users u ON u.id = x.user_id WHERE u.id IS NULL`)
+}
+
+// elevationCodeHash salts the code with the user ID: six digits are few
+// enough that an unsalted hash would read back every code at once
+func elevationCodeHash(userID uint, code string) string {
+	return hashToken(fmt.Sprintf("%d:%s", userID, code))
+}
+
+// consumeElevationCode marks an unexpired, unused code as used, reporting
+// whether there was one
+func consumeElevationCode(userID uint, code string) (bool, error) {
+	now := time.Now()
+	// a single conditional update so concurrent attempts can't both use it
+	res := db.Model(&ElevationCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL AND expires_at > ?", userID, elevationCodeHash(userID, code), now).
+		Update("used_at", now)
+	return res.RowsAffected == 1, res.Error
+}
+
+// hasPassword reports whether user can sign in with a password; accounts
+// created by Google sign-in have none until they set one
+func hasPassword(user User) bool {
+	return user.Password != ""
+}
+
+// passwordConfirmed checks a re-entered password. Accounts without one have
+// nothing to re-enter; the routes asking for it need elevation, which they
+// got with an emailed code.
+func passwordConfirmed(user User, password string) bool {
+	return !hasPassword(user) || checkPasswordHash(password, user.Password) == nil
+}
+
+func generateElevatedToken(userID uint) (string, time.Time, error) {
+	jti, err := randomToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(elevationTTL)
+	if err := db.Create(&ElevatedToken{JTI: jti, UserID: userID, ExpiresAt: expiresAt}).Error; err != nil {
+		return "", time.Time{}, fmt.Errorf("record elevation token: %w", err)
+	}
+	claims := jwt.RegisteredClaims{
+		ID:        jti,
+		Issuer:    jwtIssuer(),
+		Subject:   fmt.Sprint(userID),
+		Audience:  jwt.ClaimStrings{elevationAudience},
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(jwtSecret()))
+	return token, expiresAt, err
+}
+
+// isElevatedClaims reports whether claims belong to an elevation token
+func isElevatedClaims(claims jwt.RegisteredClaims) bool {
+	for _, aud := range claims.Audience {
+		if aud == elevationAudience {
+			return true
+		}
+	}
+	return false
+}
+
+// requireElevation rejects the request unless X-Elevated-Token holds a valid,
+// unrevoked elevation token for the authenticated user. Must run after
+// jwtMiddleware.
+func requireElevation() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		u := c.Locals("user")
+		if u == nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+		}
+		tokStr := c.Get(elevationHeader)
+		if tokStr == "" {
+			return writeError(c, ErrElevationRequired)
+		}
+		var claims jwt.RegisteredClaims
+		tok, err := jwt.ParseWithClaims(tokStr, &claims, func(t *jwt.Token) (interface{}, error) {
+			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method")
+			}
+			return []byte(jwtSecret()), nil
+		})
+		if err != nil || !tok.Valid || !isElevatedClaims(claims) || !claims.VerifyIssuer(jwtIssuer(), true) ||
+			claims.Subject != fmt.Sprint(u.(User).ID) {
+			return writeError(c, ErrElevationRequired)
+		}
+		revoked, err := isTokenRevoked(claims.ID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to verify token"})
+		}
+		// tokens issued before jtis were added can't be revoked, so they don't count
+		if revoked || claims.ID == "" {
+			return writeError(c, ErrElevationRequired)
+		}
+		return c.Next()
+	}
+}
+
+// Email a one-time elevation code to an account without a password
+func sendElevationCodeHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+	if hasPassword(user) {
+		return writeError(c, ErrElevateWithPassword)
+	}
+	if !elevationCodeLimiter.Allow(fmt.Sprint(user.ID)) {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "too many requests"})
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate code"})
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+	// a new code replaces any still outstanding
+	if err := db.Where("user_id = ? AND used_at IS NULL", user.ID).Delete(&ElevationCode{}).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create code"})
+	}
+	record := ElevationCode{
+		UserID:    user.ID,
+		CodeHash:  elevationCodeHash(user.ID, code),
+		ExpiresAt: time.Now().Add(elevationCodeTTL),
+	}
+	if err := db.Create(&record).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create code"})
+	}
+	body := fmt.Sprintf("Your LBK security code is %s. It expires in 10 minutes. If you didn't ask for it, ignore this email.", code)
+	if err := mailer.Send(user.Email, "Your LBK security code", body); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to send code"})
+	}
+	log.Printf("audit: elevation code sent user=%d ip=%s", user.ID, clientIP(c))
+	return c.JSON(fiber.Map{"message": "code sent", "expires_in": int(elevationCodeTTL.Seconds())})
+}
+
+// Re-enter the password, or an emailed code for accounts without one (and a
+// 2FA code when 2FA is on) to get a 10-minute elevation token
+func elevateHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+
+	var payload struct {
+		Password  string `json:"password"`
+		EmailCode string `json:"email_code"` // from /auth/elevate/email-code, for accounts without a password
+		Code      string `json:"code"`       // TOTP or recovery code, when 2FA is on
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	if hasPassword(user) && payload.Password == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "password required"})
+	}
+	if !hasPassword(user) && payload.EmailCode == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "email_code required, request one with /auth/elevate/email-code"})
+	}
+	// elevation unlocks turning 2FA off, so it can't need less than a login
+	if user.TOTPEnabled && payload.Code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "code required, two-factor authentication is enabled"})
+	}
+	if !elevateLimiter.Allow(fmt.Sprint(user.ID)) {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "too many requests"})
+	}
+	ip := clientIP(c)
+	if hasPassword(user) {
+		if err := checkPasswordHash(payload.Password, user.Password); err != nil {
+			log.Printf("audit: elevation denied user=%d ip=%s", user.ID, ip)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid credentials"})
+		}
+	} else {
+		ok, err := consumeElevationCode(user.ID, payload.EmailCode)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to verify code"})
+		}
+		if !ok {
+			log.Printf("audit: elevation denied user=%d ip=%s reason=invalid_email_code", user.ID, ip)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid credentials"})
+		}
+	}
+	if user.TOTPEnabled {
+		ok, err := verifySecondFactor(user, payload.Code)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to verify code"})
+		}
+		if !ok {
+			log.Printf("audit: elevation denied user=%d ip=%s reason=invalid_code", user.ID, ip)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid credentials"})
+		}
+	}
+	token, expiresAt, err := generateElevatedToken(user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate token"})
+	}
+	log.Printf("audit: elevation granted user=%d ip=%s expires=%s", user.ID, ip, expiresAt.UTC().Format(time.RFC3339))
+	return c.JSON(fiber.Map{
+		"elevated_token": token,
+		"expires_at":     expiresAt,
+	})
+}
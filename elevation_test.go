@@ -0,0 +1,163 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var emailedCodePattern = regexp.MustCompile(`\b\d{6}\b`)
+
+// createGoogleUser stores a password-less member, as Google sign-in does
+func createGoogleUser(t *testing.T) User {
+	t.Helper()
+	user := createUser(t, 0)
+	if err := db.Model(&User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{"password": "", "pin_hash": ""}).Error; err != nil {
+		t.Fatal(err)
+	}
+	return reloadUser(t, user)
+}
+
+// elevateByEmail requests an emailed code and exchanges it at /auth/elevate
+func elevateByEmail(t *testing.T, app *fiber.App, mail *captureMailer, token string) string {
+	t.Helper()
+	status, body := doJSON(t, app, fiber.MethodPost, "/auth/elevate/email-code", token, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("email-code: status %d, body %v", status, body)
+	}
+	code := emailedCodePattern.FindString(mail.sent[len(mail.sent)-1].Body)
+	if code == "" {
+		t.Fatalf("no code in %q", mail.sent[len(mail.sent)-1].Body)
+	}
+	status, body = doJSON(t, app, fiber.MethodPost, "/auth/elevate", token, fiber.Map{"email_code": code})
+	if status != fiber.StatusOK {
+		t.Fatalf("elevate: status %d, body %v", status, body)
+	}
+	elevated, _ := body["elevated_token"].(string)
+	return elevated
+}
+
+func TestPasswordlessAccountElevatesByEmail(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	mail := useCaptureMailer(t)
+	user := createGoogleUser(t)
+	token := tokenFor(t, user)
+
+	status, body := doJSON(t, app, fiber.MethodPost, "/auth/elevate", token, fiber.Map{"email_code": "123456"})
+	if status != fiber.StatusUnauthorized {
+		t.Fatalf("made-up code: status %d, body %v", status, body)
+	}
+
+	elevated := elevateByEmail(t, app, mail, token)
+	if mail.sent[0].To != user.Email {
+		t.Errorf("code sent to %q, want %q", mail.sent[0].To, user.Email)
+	}
+
+	status, body = doJSON(t, app, fiber.MethodPost, "/me/pin", token, fiber.Map{"pin": "246810"}, elevationHeader, elevated)
+	if status != fiber.StatusOK {
+		t.Fatalf("set pin: status %d, body %v", status, body)
+	}
+	if err := checkPasswordHash("246810", reloadUser(t, user).PinHash); err != nil {
+		t.Errorf("pin not set: %v", err)
+	}
+
+	status, body = doJSON(t, app, fiber.MethodDelete, "/me", token, fiber.Map{}, elevationHeader, elevated)
+	if status != fiber.StatusNoContent {
+		t.Fatalf("delete account: status %d, body %v", status, body)
+	}
+}
+
+func TestEmailedCodeIsSingleUse(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	mail := useCaptureMailer(t)
+	user := createGoogleUser(t)
+	token := tokenFor(t, user)
+
+	elevateByEmail(t, app, mail, token)
+	code := emailedCodePattern.FindString(mail.sent[0].Body)
+	status, body := doJSON(t, app, fiber.MethodPost, "/auth/elevate", token, fiber.Map{"email_code": code})
+	if status != fiber.StatusUnauthorized {
+		t.Fatalf("reused code: status %d, body %v", status, body)
+	}
+}
+
+func TestEmailedCodeNeedsPasswordlessAccount(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	useCaptureMailer(t)
+	user := createUser(t, 0)
+
+	status, body := doJSON(t, app, fiber.MethodPost, "/auth/elevate/email-code", tokenFor(t, user), nil)
+	if status != fiber.StatusConflict || errorCodeOf(body) != "ELEVATE_WITH_PASSWORD" {
+		t.Fatalf("status %d, body %v", status, body)
+	}
+}
+
+func TestElevationTokenIsRevoked(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	const newPassword = "Marigold2025!"
+
+	// elevated reports whether token and elevated still pass requireElevation
+	elevated := func(t *testing.T, token, elevated string) bool {
+		t.Helper()
+		status, body := doJSON(t, app, fiber.MethodPost, "/me/feed-token", token, nil, elevationHeader, elevated)
+		if status != fiber.StatusCreated && errorCodeOf(body) != "ELEVATION_REQUIRED" {
+			t.Fatalf("status %d, body %v", status, body)
+		}
+		return status == fiber.StatusCreated
+	}
+
+	for _, tc := range []struct {
+		name   string
+		revoke func(t *testing.T, user User, token string)
+	}{
+		{"logout", func(t *testing.T, user User, token string) {
+			if status, body := doJSON(t, app, fiber.MethodPost, "/logout", token, nil); status != fiber.StatusNoContent {
+				t.Fatalf("logout: status %d, body %v", status, body)
+			}
+		}},
+		{"password change", func(t *testing.T, user User, token string) {
+			if status, body := doJSON(t, app, fiber.MethodPost, "/me/password", token,
+				fiber.Map{"current_password": testPassword, "new_password": newPassword}); status != fiber.StatusOK {
+				t.Fatalf("change password: status %d, body %v", status, body)
+			}
+		}},
+		{"password reset", func(t *testing.T, user User, token string) {
+			if err := db.Create(&PasswordReset{UserID: user.ID, TokenHash: hashToken("reset-" + user.MemberID), ExpiresAt: time.Now().Add(time.Hour)}).Error; err != nil {
+				t.Fatal(err)
+			}
+			if status, body := doJSON(t, app, fiber.MethodPost, "/password/reset", "",
+				fiber.Map{"token": "reset-" + user.MemberID, "new_password": newPassword}); status != fiber.StatusOK {
+				t.Fatalf("reset password: status %d, body %v", status, body)
+			}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			user := createUser(t, 0)
+			bystander := createUser(t, 0)
+			token, bystanderToken := tokenFor(t, user), tokenFor(t, bystander)
+			first, second, bystanderElevated := elevatedTokenFor(t, user), elevatedTokenFor(t, user), elevatedTokenFor(t, bystander)
+			if !elevated(t, token, first) {
+				t.Fatal("fresh elevation token refused")
+			}
+
+			tc.revoke(t, user, token)
+			fresh := tokenFor(t, user)
+			if elevated(t, fresh, first) || elevated(t, fresh, second) {
+				t.Error("elevation token still accepted")
+			}
+			if !elevated(t, fresh, elevatedTokenFor(t, user)) {
+				t.Error("elevation granted afterwards refused")
+			}
+			if !elevated(t, bystanderToken, bystanderElevated) {
+				t.Error("another user's elevation token was revoked")
+			}
+		})
+	}
+	assertInvariants(t)
+}
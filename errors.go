@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Domain errors returned by the service layer. Handlers never pick status
+// codes for these themselves; they pass them to writeError.
+var (
+	ErrInsufficientPoints    = errors.New("insufficient points")
+	ErrRecipientNotFound     = errors.New("recipient not found")
+	ErrSelfTransfer          = errors.New("cannot transfer to yourself")
+	ErrCrossPartner          = errors.New("cannot transfer to a member of another partner program")
+	ErrTransactionNotFound   = errors.New("transaction not found")
+	ErrElevationRequired     = errors.New("elevation required")
+	ErrOverCapacity          = errors.New("server is over capacity, retry later")
+	ErrRateLimited           = errors.New("too many requests, retry later")
+	ErrRefreshTokenInvalid   = errors.New("refresh token is invalid, expired or revoked")
+	ErrSyntheticMismatch     = errors.New("test accounts can only transact with other test accounts")
+	ErrEmailNotVerified      = errors.New("verify your email address first")
+	ErrPinNotSet             = errors.New("set a transfer PIN first")
+	ErrPinInvalid            = errors.New("incorrect PIN")
+	ErrPinLocked             = errors.New("PIN locked after too many wrong attempts, try again later")
+	ErrForbidden             = errors.New("you don't have permission to do this")
+	ErrConfirmationExpired   = errors.New("transfer confirmation expired, start the transfer again")
+	ErrTransferExpired       = errors.New("transfer expired and its points went back to the sender")
+	ErrMemberIDRequired      = errors.New("claim a member ID first")
+	ErrMemberIDAlreadySet    = errors.New("member ID is already set")
+	ErrMemberIDTaken         = errors.New("member_id already registered")
+	ErrGoogleEmailUnverified = errors.New("google account email is not verified")
+	ErrAccountDeleted        = errors.New("this account was deleted")
+	ErrGoogleAccountConflict = errors.New("this email is linked to a different google account")
+	ErrElevateWithPassword   = errors.New("this account has a password, elevate with it")
+	ErrGoogleLinkUnverified  = errors.New("an unverified account already uses this email, sign in with its password and verify the email before linking google")
+	ErrNotReversible         = errors.New("only transfers can be reversed")
+	ErrAlreadyReversed       = errors.New("transaction has already been reversed")
+	ErrReversalSenderDeleted = errors.New("the sender has deleted their account, so the points can't be returned to them")
+	ErrIdempotencyKeyReused  = errors.New("idempotency key was already used for a different request")
+	ErrCSRFTokenInvalid      = errors.New("missing or invalid X-CSRF-Token header")
+	ErrUserNotFound          = errors.New("user not found")
+	ErrNotTransferSender     = errors.New("only the sender can cancel a transfer")
+	ErrPointRequestNotFound  = errors.New("point request not found")
+	ErrNotRequestPayer       = errors.New("only the member asked can pay or decline a point request")
+	ErrPointRequestExpired   = errors.New("point request expired")
+)
+
+// ValidationError reports a malformed request; Fields optionally maps
+// individual input fields to what's wrong with them
+type ValidationError struct {
+	Message string
+	Fields  map[string]string
+}
+
+func (e *ValidationError) Error() string { return e.Message }
+
+// PasswordPolicyError lists the password rules a new password breaks
+type PasswordPolicyError struct {
+	FailedRules []string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return "password doesn't meet the policy: " + strings.Join(e.FailedRules, ", ")
+}
+
+// LargeRelativeTransferError asks the client to confirm a transfer that
+// moves an unusually large share of the balance
+type LargeRelativeTransferError struct {
+	Percentage int64
+}
+
+func (e *LargeRelativeTransferError) Error() string {
+	return fmt.Sprintf("transfer moves %d%% of your balance", e.Percentage)
+}
+
+// DailyLimitExceededError rejects a transfer that would exceed the sender's
+// daily limit; Remaining is what they can still send until ResetsAt
+type DailyLimitExceededError struct {
+	Limit     int64
+	Used      int64
+	Remaining int64
+	ResetsAt  time.Time
+}
+
+func (e *DailyLimitExceededError) Error() string {
+	return fmt.Sprintf("transfer exceeds the daily limit of %d points, %d remaining today", e.Limit, e.Remaining)
+}
+
+// PerTransferLimitExceededError rejects a transfer above the sender's
+// tier's cap on a single transfer; Used is what they've sent today, as for
+// the daily limit
+type PerTransferLimitExceededError struct {
+	Limit    int64
+	Used     int64
+	ResetsAt time.Time
+}
+
+func (e *PerTransferLimitExceededError) Error() string {
+	return fmt.Sprintf("transfer exceeds the limit of %d points per transfer", e.Limit)
+}
+
+// MissingScopeError rejects an API key that wasn't granted Scope
+type MissingScopeError struct {
+	Scope string
+}
+
+func (e *MissingScopeError) Error() string {
+	return "api key is missing scope " + e.Scope
+}
+
+// ReversalShortfallError rejects a reversal because the recipient no longer
+// holds the points; Available is their current balance
+type ReversalShortfallError struct {
+	Amount    int64
+	Available int64
+}
+
+func (e *ReversalShortfallError) Error() string {
+	return fmt.Sprintf("recipient has %d points left, %d needed to reverse this transfer", e.Available, e.Amount)
+}
+
+// NegativeBalanceError rejects an adjustment that would leave a negative
+// balance without allow_negative
+type NegativeBalanceError struct {
+	Balance int64
+	Delta   int64
+}
+
+func (e *NegativeBalanceError) Error() string {
+	return fmt.Sprintf("adjustment of %d would leave a balance of %d, set allow_negative to proceed", e.Delta, e.Balance+e.Delta)
+}
+
+// TransferNotPendingError rejects cancelling, confirming, accepting or
+// declining a transfer that has already completed, been declined or
+// otherwise left pending, possibly by a concurrent request
+type TransferNotPendingError struct {
+	Status string
+}
+
+func (e *TransferNotPendingError) Error() string {
+	return fmt.Sprintf("transfer is %s and no longer pending", e.Status)
+}
+
+// PointRequestNotPendingError rejects paying or declining a point request
+// that has already been fulfilled, declined or has expired
+type PointRequestNotPendingError struct {
+	Status string
+}
+
+func (e *PointRequestNotPendingError) Error() string {
+	return fmt.Sprintf("point request is %s, only pending requests can be paid or declined", e.Status)
+}
+
+// errorMapping is the HTTP representation of a sentinel domain error
+type errorMapping struct {
+	Err    error
+	Status int
+	Code   string
+}
+
+// sentinelErrors maps each sentinel domain error to exactly one response.
+// It's checked in order, so an error wrapping two sentinels gets the first.
+var sentinelErrors = []errorMapping{
+	{ErrInsufficientPoints, fiber.StatusBadRequest, "INSUFFICIENT_POINTS"},
+	{ErrRecipientNotFound, fiber.StatusNotFound, "RECIPIENT_NOT_FOUND"},
+	{ErrSelfTransfer, fiber.StatusBadRequest, "SELF_TRANSFER"},
+	{ErrCrossPartner, fiber.StatusForbidden, "CROSS_PARTNER_NOT_ALLOWED"},
+	{ErrTransactionNotFound, fiber.StatusNotFound, "TRANSACTION_NOT_FOUND"},
+	{ErrElevationRequired, fiber.StatusUnauthorized, "ELEVATION_REQUIRED"},
+	{ErrOverCapacity, fiber.StatusServiceUnavailable, "OVER_CAPACITY"},
+	{ErrRateLimited, fiber.StatusTooManyRequests, "RATE_LIMITED"},
+	{ErrRefreshTokenInvalid, fiber.StatusUnauthorized, "INVALID_REFRESH_TOKEN"},
+	{ErrSyntheticMismatch, fiber.StatusForbidden, "SYNTHETIC_ACCOUNT_MISMATCH"},
+	{ErrEmailNotVerified, fiber.StatusForbidden, "EMAIL_NOT_VERIFIED"},
+	{ErrPinNotSet, fiber.StatusPreconditionRequired, "PIN_NOT_SET"},
+	{ErrPinInvalid, fiber.StatusForbidden, "INVALID_PIN"},
+	{ErrPinLocked, fiber.StatusLocked, "PIN_LOCKED"},
+	{ErrForbidden, fiber.StatusForbidden, "FORBIDDEN"},
+	{ErrConfirmationExpired, fiber.StatusGone, "CONFIRMATION_EXPIRED"},
+	{ErrTransferExpired, fiber.StatusGone, "TRANSFER_EXPIRED"},
+	{ErrMemberIDRequired, fiber.StatusForbidden, "MEMBER_ID_REQUIRED"},
+	{ErrMemberIDAlreadySet, fiber.StatusConflict, "MEMBER_ID_ALREADY_SET"},
+	{ErrMemberIDTaken, fiber.StatusConflict, "MEMBER_ID_TAKEN"},
+	{ErrGoogleEmailUnverified, fiber.StatusForbidden, "GOOGLE_EMAIL_UNVERIFIED"},
+	{ErrAccountDeleted, fiber.StatusForbidden, "ACCOUNT_DELETED"},
+	{ErrGoogleAccountConflict, fiber.StatusConflict, "GOOGLE_ACCOUNT_CONFLICT"},
+	{ErrElevateWithPassword, fiber.StatusConflict, "ELEVATE_WITH_PASSWORD"},
+	{ErrGoogleLinkUnverified, fiber.StatusConflict, "GOOGLE_LINK_UNVERIFIED_ACCOUNT"},
+	{ErrNotReversible, fiber.StatusConflict, "NOT_REVERSIBLE"},
+	{ErrAlreadyReversed, fiber.StatusConflict, "ALREADY_REVERSED"},
+	{ErrReversalSenderDeleted, fiber.StatusConflict, "SENDER_DELETED"},
+	{ErrIdempotencyKeyReused, fiber.StatusConflict, "IDEMPOTENCY_KEY_REUSED"},
+	{ErrCSRFTokenInvalid, fiber.StatusForbidden, "CSRF_TOKEN_INVALID"},
+	{ErrUserNotFound, fiber.StatusNotFound, "USER_NOT_FOUND"},
+	{ErrNotTransferSender, fiber.StatusForbidden, "NOT_TRANSFER_SENDER"},
+	{ErrPointRequestNotFound, fiber.StatusNotFound, "REQUEST_NOT_FOUND"},
+	{ErrNotRequestPayer, fiber.StatusForbidden, "NOT_REQUEST_PAYER"},
+	{ErrPointRequestExpired, fiber.StatusGone, "REQUEST_EXPIRED"},
+}
+
+// structErrorExamples has a value of every domain error type, so their
+// responses can be listed without a request failing
+var structErrorExamples = []error{
+	&ValidationError{Message: "invalid request"},
+	&PasswordPolicyError{},
+	&LargeRelativeTransferError{},
+	&DailyLimitExceededError{},
+	&PerTransferLimitExceededError{},
+	&MissingScopeError{},
+	&ReversalShortfallError{},
+	&NegativeBalanceError{},
+	&TransferNotPendingError{},
+	&PointRequestNotPendingError{},
+	&InvalidTransitionError{From: statusCreated},
+}
+
+// errorStatuses maps the code of every domain error to its status
+func errorStatuses() map[string]int {
+	statuses := map[string]int{}
+	for _, m := range sentinelErrors {
+		statuses[m.Code] = m.Status
+	}
+	for _, err := range structErrorExamples {
+		status, body := errorResponse(err)
+		statuses[body["code"].(string)] = status
+	}
+	return statuses
+}
+
+// errorCode is the code writeError reports for err, or "" for an error that
+// isn't a domain error
+func errorCode(err error) string {
+	_, body := errorResponse(err)
+	code, _ := body["code"].(string)
+	return code
+}
+
+// errorResponse is the status and error envelope for a domain error, or
+// 0 and nil for any other error
+func errorResponse(err error) (int, fiber.Map) {
+	for _, m := range sentinelErrors {
+		if errors.Is(err, m.Err) {
+			return m.Status, fiber.Map{"error": m.Err.Error(), "code": m.Code}
+		}
+	}
+
+	var validation *ValidationError
+	if errors.As(err, &validation) {
+		resp := fiber.Map{"error": validation.Message, "code": "INVALID_REQUEST"}
+		if len(validation.Fields) > 0 {
+			resp["fields"] = validation.Fields
+		}
+		return fiber.StatusBadRequest, resp
+	}
+	var weak *PasswordPolicyError
+	if errors.As(err, &weak) {
+		return fiber.StatusUnprocessableEntity, fiber.Map{
+			"error":        weak.Error(),
+			"code":         "WEAK_PASSWORD",
+			"failed_rules": weak.FailedRules,
+		}
+	}
+	var large *LargeRelativeTransferError
+	if errors.As(err, &large) {
+		return fiber.StatusBadRequest, fiber.Map{
+			"error":      "transfer moves a large share of your balance, resend with confirm_large to proceed",
+			"code":       "LARGE_RELATIVE_TRANSFER",
+			"percentage": large.Percentage,
+		}
+	}
+	var daily *DailyLimitExceededError
+	if errors.As(err, &daily) {
+		return fiber.StatusUnprocessableEntity, fiber.Map{
+			"error":       daily.Error(),
+			"code":        "DAILY_LIMIT_EXCEEDED",
+			"daily_limit": daily.Limit,
+			"used":        daily.Used,
+			"remaining":   daily.Remaining,
+			"resets_at":   daily.ResetsAt,
+		}
+	}
+	var perTxn *PerTransferLimitExceededError
+	if errors.As(err, &perTxn) {
+		return fiber.StatusUnprocessableEntity, fiber.Map{
+			"error":         perTxn.Error(),
+			"code":          "PER_TRANSFER_LIMIT_EXCEEDED",
+			"per_txn_limit": perTxn.Limit,
+			"used":          perTxn.Used,
+			"resets_at":     perTxn.ResetsAt,
+		}
+	}
+	var scope *MissingScopeError
+	if errors.As(err, &scope) {
+		return fiber.StatusForbidden, fiber.Map{"error": scope.Error(), "code": "INSUFFICIENT_SCOPE", "missing_scope": scope.Scope}
+	}
+	var shortfall *ReversalShortfallError
+	if errors.As(err, &shortfall) {
+		return fiber.StatusConflict, fiber.Map{
+			"error":            shortfall.Error(),
+			"code":             "REVERSAL_INSUFFICIENT_BALANCE",
+			"required":         shortfall.Amount,
+			"available_points": shortfall.Available,
+		}
+	}
+	var negative *NegativeBalanceError
+	if errors.As(err, &negative) {
+		return fiber.StatusConflict, fiber.Map{
+			"error":  negative.Error(),
+			"code":   "NEGATIVE_BALANCE",
+			"points": negative.Balance,
+		}
+	}
+	var notPending *TransferNotPendingError
+	if errors.As(err, &notPending) {
+		return fiber.StatusConflict, fiber.Map{
+			"error":  notPending.Error(),
+			"code":   "TRANSFER_NOT_PENDING",
+			"status": notPending.Status,
+		}
+	}
+	var requestNotPending *PointRequestNotPendingError
+	if errors.As(err, &requestNotPending) {
+		return fiber.StatusConflict, fiber.Map{
+			"error":  requestNotPending.Error(),
+			"code":   "REQUEST_NOT_PENDING",
+			"status": requestNotPending.Status,
+		}
+	}
+	var transition *InvalidTransitionError
+	if errors.As(err, &transition) {
+		return fiber.StatusConflict, fiber.Map{"error": transition.Error(), "code": "INVALID_STATUS_TRANSITION"}
+	}
+
+	return 0, nil
+}
+
+// writeError translates a domain error into the error envelope. Errors that
+// aren't domain errors are logged and reported as a generic 500.
+func writeError(c *fiber.Ctx, err error) error {
+	if status, body := errorResponse(err); body != nil {
+		return c.Status(status).JSON(body)
+	}
+	log.Printf("%s %s: %v", c.Method(), c.Path(), err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "internal error", "code": "INTERNAL"})
+}
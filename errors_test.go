@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// declaredErrors parses the package's non-test sources for its sentinel
+// Err* variables and the names of the types with an Error method
+func declaredErrors(t *testing.T) (sentinels, types []string) {
+	t.Helper()
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		src, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := parser.ParseFile(fset, name, src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, decl := range file.Decls {
+			switch d := decl.(type) {
+			case *ast.GenDecl:
+				if d.Tok != token.VAR {
+					continue
+				}
+				for _, spec := range d.Specs {
+					for _, ident := range spec.(*ast.ValueSpec).Names {
+						if strings.HasPrefix(ident.Name, "Err") {
+							sentinels = append(sentinels, ident.Name)
+						}
+					}
+				}
+			case *ast.FuncDecl:
+				if d.Recv == nil || d.Name.Name != "Error" {
+					continue
+				}
+				recv := d.Recv.List[0].Type
+				if star, ok := recv.(*ast.StarExpr); ok {
+					recv = star.X
+				}
+				types = append(types, recv.(*ast.Ident).Name)
+			}
+		}
+	}
+	return sentinels, types
+}
+
+func TestEveryDomainErrorHasOneResponse(t *testing.T) {
+	sentinels, types := declaredErrors(t)
+	if len(sentinelErrors) != len(sentinels) {
+		t.Errorf("%d sentinel errors declared (%v), %d mapped", len(sentinels), sentinels, len(sentinelErrors))
+	}
+	mapped := map[string]bool{}
+	for _, err := range structErrorExamples {
+		mapped[reflect.TypeOf(err).Elem().Name()] = true
+	}
+	for _, name := range types {
+		if !mapped[name] {
+			t.Errorf("%s has no entry in structErrorExamples", name)
+		}
+	}
+
+	all := append([]error{}, structErrorExamples...)
+	seen := map[error]bool{}
+	for _, m := range sentinelErrors {
+		if seen[m.Err] {
+			t.Errorf("%v is mapped twice", m.Err)
+		}
+		seen[m.Err] = true
+		all = append(all, m.Err)
+	}
+
+	codes := map[string]error{}
+	for _, domainErr := range all {
+		// handlers usually add context before the error reaches writeError
+		err := fmt.Errorf("context: %w", domainErr)
+		status, body := errorResponse(err)
+		code, _ := body["code"].(string)
+		if status < 400 || status == fiber.StatusInternalServerError || code == "" {
+			t.Errorf("%T %v: status %d, code %q", domainErr, domainErr, status, code)
+			continue
+		}
+		if other, ok := codes[code]; ok {
+			t.Errorf("%v and %v share code %s", other, domainErr, code)
+		}
+		codes[code] = domainErr
+		if got := errorCode(err); got != code {
+			t.Errorf("errorCode(%v) = %q, writeError says %q", domainErr, got, code)
+		}
+		if got, _ := writeErrorResponse(t, err); got != status {
+			t.Errorf("writeError(%v) answered %d, want %d", domainErr, got, status)
+		}
+	}
+
+	other := errors.New("database is down")
+	if status, body := errorResponse(other); status != 0 || body != nil || errorCode(other) != "" {
+		t.Errorf("non-domain error mapped to %d %v", status, body)
+	}
+	if status, _ := writeErrorResponse(t, other); status != fiber.StatusInternalServerError {
+		t.Errorf("non-domain error answered %d, want 500", status)
+	}
+}
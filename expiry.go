@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Points expire POINTS_EXPIRY_DAYS (default 365) after they're credited.
+// Every credit opens a PointsLot and every debit consumes lots oldest
+// first, so the remaining amounts of a user's lots add up to their balance
+// (or to zero while it's negative). A daily job zeroes expired lots, takes
+// them off the balance and records an "expiry" transaction from user 0,
+// with a signed amount like an adjustment.
+type PointsLot struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	UserID    uint      `json:"user_id" gorm:"index:idx_points_lots_user_expiry,priority:1"`
+	Granted   int64     `json:"granted"`
+	Remaining int64     `json:"remaining"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"index:idx_points_lots_user_expiry,priority:2"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const (
+	transactionTypeExpiry     = "expiry"
+	defaultPointsExpiryDays   = 365
+	pointsExpirySweepInterval = 24 * time.Hour
+	defaultExpiringWindowDays = 90
+	maxExpiringWindowDays     = 3650
+)
+
+func init() {
+	registerInvariant("points_lots_mismatch",
+		"users whose unexpired points lots don't add up to their balance",
+		`SELECT u.id FROM users u
+			LEFT JOIN points_lots l ON l.user_id = u.id AND l.remaining > 0
+			GROUP BY u.id, u.points
+			HAVING COALESCE(SUM(l.remaining), 0) <> CASE WHEN u.points > 0 THEN u.points ELSE 0 END`)
+}
+
+// pointsValidity is how long credited points last (POINTS_EXPIRY_DAYS)
+func pointsValidity() time.Duration {
+	return time.Duration(envPositiveInt("POINTS_EXPIRY_DAYS", defaultPointsExpiryDays)) * 24 * time.Hour
+}
+
+// openPointsLot records amount points credited to userID inside tx. Call it
+// after the balance update: whatever went to pay off a negative balance
+// doesn't open a lot.
+func openPointsLot(tx *gorm.DB, userID uint, amount int64) error {
+	balance, err := balanceOf(tx, userID)
+	if err != nil {
+		return err
+	}
+	if balance < amount {
+		amount = balance
+	}
+	if amount <= 0 {
+		return nil
+	}
+	lot := PointsLot{UserID: userID, Granted: amount, Remaining: amount, ExpiresAt: time.Now().Add(pointsValidity())}
+	if err := tx.Create(&lot).Error; err != nil {
+		return fmt.Errorf("open points lot: %w", err)
+	}
+	return nil
+}
+
+// lotTake is how much a debit took out of one points lot
+type lotTake struct {
+	LotID  uint
+	Amount int64
+}
+
+// consumePointsLots takes amount points debited from userID out of their
+// lots inside tx, oldest first, and returns what it took from each. Any
+// shortfall is a negative balance, which no lot covers.
+func consumePointsLots(tx *gorm.DB, userID uint, amount int64) ([]lotTake, error) {
+	var lots []PointsLot
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("user_id = ? AND remaining > 0", userID).Order("expires_at, id").
+		Find(&lots).Error; err != nil {
+		return nil, fmt.Errorf("find points lots: %w", err)
+	}
+	var taken []lotTake
+	for _, lot := range lots {
+		if amount <= 0 {
+			break
+		}
+		take := min(lot.Remaining, amount)
+		if err := tx.Model(&PointsLot{}).Where("id = ?", lot.ID).
+			Update("remaining", gorm.Expr("remaining - ?", take)).Error; err != nil {
+			return nil, fmt.Errorf("consume points lot %d: %w", lot.ID, err)
+		}
+		taken = append(taken, lotTake{LotID: lot.ID, Amount: take})
+		amount -= take
+	}
+	return taken, nil
+}
+
+// migratePointsLots opens a lot for balances that predate points expiry
+// (or that otherwise have no lots), valid for the full period from now
+func migratePointsLots() {
+	var missing []struct {
+		ID       uint
+		Shortage int64
+	}
+	if err := db.Raw(`SELECT u.id, u.points - COALESCE(SUM(l.remaining), 0) AS shortage FROM users u
+		LEFT JOIN points_lots l ON l.user_id = u.id AND l.remaining > 0
+		GROUP BY u.id, u.points
+		HAVING u.points > COALESCE(SUM(l.remaining), 0)`).Scan(&missing).Error; err != nil {
+		log.Fatalf("find balances without points lots failed: %v", err)
+	}
+	expiresAt := time.Now().Add(pointsValidity())
+	for _, m := range missing {
+		lot := PointsLot{UserID: m.ID, Granted: m.Shortage, Remaining: m.Shortage, ExpiresAt: expiresAt}
+		if err := db.Create(&lot).Error; err != nil {
+			log.Fatalf("open points lot for user %d failed: %v", m.ID, err)
+		}
+	}
+	if len(missing) > 0 {
+		log.Printf("opened points lots for %d existing balances", len(missing))
+	}
+}
+
+// expireUserPoints expires userID's lots that are past due at now and
+// returns the number of points taken off the balance
+func expireUserPoints(userID uint, now time.Time) (int64, error) {
+	var expired int64
+	err := withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		// lock the user before the lots, in the same order as movePoints
+		var user User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "points").
+			First(&user, userID).Error; err != nil {
+			return fmt.Errorf("lock user: %w", err)
+		}
+		var lots []PointsLot
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ? AND remaining > 0 AND expires_at <= ?", userID, now).
+			Find(&lots).Error; err != nil {
+			return fmt.Errorf("find expired lots: %w", err)
+		}
+		for _, lot := range lots {
+			expired += lot.Remaining
+			if err := tx.Model(&PointsLot{}).Where("id = ?", lot.ID).Update("remaining", 0).Error; err != nil {
+				return fmt.Errorf("expire points lot %d: %w", lot.ID, err)
+			}
+		}
+		// never expire more than the balance holds
+		expired = min(expired, max(user.Points, 0))
+		if expired == 0 {
+			return nil
+		}
+		if err := tx.Model(&User{}).Where("id = ?", userID).
+			Update("points", gorm.Expr("points - ?", expired)).Error; err != nil {
+			return fmt.Errorf("deduct points: %w", err)
+		}
+		balance := user.Points - expired
+		record := Transaction{
+			FromUserID:     0,
+			ToUserID:       userID,
+			Amount:         -expired,
+			Type:           transactionTypeExpiry,
+			Status:         "completed",
+			Description:    fmt.Sprintf("%d points expired", expired),
+			ToBalanceAfter: &balance,
+		}
+		if err := tx.Create(&record).Error; err != nil {
+			return fmt.Errorf("create expiry record: %w", err)
+		}
+		return recordTransactionCreated(tx, &record, actorSystem, 0)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("expire points of user %d: %w", userID, err)
+	}
+	return expired, nil
+}
+
+// startPointsExpiry expires lots now and then every pointsExpirySweepInterval
+func startPointsExpiry() {
+	sweep := func() {
+		now := time.Now()
+		var userIDs []uint
+		if err := db.Model(&PointsLot{}).Distinct("user_id").
+			// deleted accounts' points stay as they were left
+			Where("remaining > 0 AND expires_at <= ? AND user_id IN (?)", now, db.Model(&User{}).Select("id")).
+			Pluck("user_id", &userIDs).Error; err != nil {
+			log.Printf("find expired points lots: %v", err)
+			return
+		}
+		for _, id := range userIDs {
+			expired, err := expireUserPoints(id, now)
+			if err != nil {
+				log.Printf("%v", err)
+				continue
+			}
+			if expired > 0 {
+				log.Printf("audit: points expired target=%d amount=%d", id, expired)
+			}
+		}
+	}
+	sweep()
+	go func() {
+		for range time.Tick(pointsExpirySweepInterval) {
+			sweep()
+		}
+	}()
+}
+
+// Points that will expire within ?days= (default 90), grouped by date
+func expiringPointsHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+	days := c.QueryInt("days", defaultExpiringWindowDays)
+	if days <= 0 || days > maxExpiringWindowDays {
+		return writeError(c, &ValidationError{
+			Message: "invalid days",
+			Fields:  map[string]string{"days": fmt.Sprintf("must be between 1 and %d", maxExpiringWindowDays)},
+		})
+	}
+
+	var lots []PointsLot
+	if err := db.Where("user_id = ? AND remaining > 0 AND expires_at <= ?", user.ID, time.Now().AddDate(0, 0, days)).
+		Order("expires_at, id").Find(&lots).Error; err != nil {
+		return writeError(c, err)
+	}
+	expiring := []fiber.Map{}
+	var total int64
+	for _, lot := range lots {
+		total += lot.Remaining
+		date := lot.ExpiresAt.UTC().Format("2006-01-02")
+		if n := len(expiring); n > 0 && expiring[n-1]["date"] == date {
+			expiring[n-1]["points"] = expiring[n-1]["points"].(int64) + lot.Remaining
+			continue
+		}
+		expiring = append(expiring, fiber.Map{"date": date, "points": lot.Remaining})
+	}
+	return c.JSON(fiber.Map{
+		"points":          user.Points,
+		"expiring_points": total,
+		"days":            days,
+		"expiring":        expiring,
+	})
+}
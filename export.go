@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// exportBatchSize is how many transactions are loaded per query while streaming
+const exportBatchSize = 500
+
+var exportHeader = []string{"date", "time", "type", "counterparty_member_id", "counterparty_name", "amount", "status", "description", "note"}
+
+// csvSafe stops spreadsheet apps from evaluating user-supplied text as a formula
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// exportFilename names the download after the member and the requested range
+func exportFilename(user User, period dateRange, now time.Time) string {
+	name := "lbk-transactions-" + user.MemberID
+	if period.From != nil {
+		name += "-from-" + period.From.Format("2006-01-02")
+	}
+	if period.To != nil {
+		// To is exclusive; name the last day actually included
+		name += "-to-" + period.To.AddDate(0, 0, -1).Format("2006-01-02")
+	}
+	if period.From == nil && period.To == nil {
+		name += "-" + now.Format("2006-01-02")
+	}
+	return name + ".csv"
+}
+
+// Stream the current user's transaction history as CSV, oldest first.
+// Accepts the same from/to filters as /transactions/recent.
+func exportTransactionsHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+	period, err := parseDateRange(c)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s"`, exportFilename(user, period, time.Now())))
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		// a BOM so spreadsheet apps read Thai names as UTF-8
+		w.WriteString("\ufeff")
+		out := csv.NewWriter(w)
+		out.Write(exportHeader)
+
+		var batch []Transaction
+		res := period.Apply(db.Model(&Transaction{}).Where("from_user_id = ? OR to_user_id = ?", user.ID, user.ID)).
+			Preload("FromUser", withDeleted).
+			Preload("ToUser", withDeleted).
+			FindInBatches(&batch, exportBatchSize, func(tx *gorm.DB, _ int) error {
+				for _, t := range batch {
+					row := formatTransaction(t, user.ID)
+					out.Write([]string{
+						row.Date,
+						row.Time,
+						row.Type,
+						row.ContactMemberID,
+						csvSafe(row.ContactName),
+						fmt.Sprint(row.Amount),
+						t.Status,
+						csvSafe(t.Description),
+						csvSafe(t.Note),
+					})
+				}
+				out.Flush()
+				if err := out.Error(); err != nil {
+					return err
+				}
+				// push each batch to the client instead of buffering the whole history
+				return w.Flush()
+			})
+		if res.Error != nil {
+			// headers are already sent, so the client just sees a truncated file
+			log.Printf("export transactions for user %d: %v", user.ID, res.Error)
+		}
+		out.Flush()
+	})
+	return nil
+}
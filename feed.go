@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// FeedToken lets a feed reader fetch a user's transaction feed without a JWT
+type FeedToken struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"uniqueIndex;not null"`
+	TokenHash string `gorm:"uniqueIndex;not null"`
+	CreatedAt time.Time
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	ID      string `xml:"id"`
+	Title   string `xml:"title"`
+	Updated string `xml:"updated"`
+	Summary string `xml:"summary"`
+}
+
+func init() {
+	registerInvariant("feed_token_orphaned",
+		"feed tokens whose user doesn't exist",
+		`SELECT x.id FROM feed_tokens x LEFT JOIN users u ON u.id = x.user_id WHERE u.id IS NULL`)
+}
+
+// maskMemberID keeps the prefix and last two characters, e.g. LBK0****45
+func maskMemberID(memberID string) string {
+	if len(memberID) <= 6 {
+		return strings.Repeat("*", len(memberID))
+	}
+	return memberID[:4] + strings.Repeat("*", len(memberID)-6) + memberID[len(memberID)-2:]
+}
+
+// maskName shows the first name and the initial of the last name
+func maskName(first, last string) string {
+	if r := []rune(last); len(r) > 0 {
+		return fmt.Sprintf("%s %s.", first, string(r[0]))
+	}
+	return first
+}
+
+// Create (or rotate) the current user's feed token
+func createFeedTokenHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+
+	token, err := randomToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate token"})
+	}
+	// one token per user: generating a new one revokes the old
+	if err := db.Where("user_id = ?", user.ID).Delete(&FeedToken{}).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to rotate feed token"})
+	}
+	if err := db.Create(&FeedToken{UserID: user.ID, TokenHash: hashToken(token)}).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create feed token"})
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"token":    token,
+		"feed_url": externalURL(c, "/me/feed.atom?token="+token),
+	})
+}
+
+// Revoke the current user's feed token
+func revokeFeedTokenHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+
+	if err := db.Where("user_id = ?", user.ID).Delete(&FeedToken{}).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to revoke feed token"})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Atom feed of the token owner's recent transactions
+func transactionFeedHandler(c *fiber.Ctx) error {
+	token := c.Query("token")
+	if token == "" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "missing feed token"})
+	}
+	var ft FeedToken
+	if err := db.Where("token_hash = ?", hashToken(token)).First(&ft).Error; err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid feed token"})
+	}
+	var user User
+	if err := db.First(&user, ft.UserID).Error; err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid feed token"})
+	}
+
+	var transactions []Transaction
+	if err := db.Where("from_user_id = ? OR to_user_id = ?", user.ID, user.ID).
+		Preload("FromUser", withDeleted).
+		Preload("ToUser", withDeleted).
+		Order("created_at DESC").
+		Limit(20).
+		Find(&transactions).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to fetch transactions"})
+	}
+
+	feed := atomFeed{
+		Xmlns:   "http://www.w3.org/2005/Atom",
+		ID:      fmt.Sprintf("urn:lbk:feed:%s", user.MemberID),
+		Title:   "LBK Points transactions",
+		Updated: user.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+	if len(transactions) > 0 {
+		feed.Updated = transactions[0].CreatedAt.UTC().Format(time.RFC3339)
+	}
+	for _, tx := range transactions {
+		var title string
+		if tx.Type == transactionTypeAdjustment {
+			title = fmt.Sprintf("Points adjusted by %+d: %s", tx.Amount, tx.Description)
+		} else if tx.Type == transactionTypeExpiry {
+			title = fmt.Sprintf("%d points expired", -tx.Amount)
+		} else if tx.FromUserID == user.ID {
+			title = fmt.Sprintf("Sent %d points to %s (%s)", tx.Amount,
+				maskName(tx.ToUser.FirstName, tx.ToUser.LastName), maskMemberID(tx.ToUser.MemberID))
+		} else {
+			title = fmt.Sprintf("Received %d points from %s (%s)", tx.Amount,
+				maskName(tx.FromUser.FirstName, tx.FromUser.LastName), maskMemberID(tx.FromUser.MemberID))
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      fmt.Sprintf("urn:lbk:transaction:%d", tx.ID),
+			Title:   title,
+			Updated: tx.CreatedAt.UTC().Format(time.RFC3339),
+			Summary: fmt.Sprintf("%s (%s)", title, tx.Status),
+		})
+	}
+
+	out, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to render feed"})
+	}
+	c.Set("Content-Type", "application/atom+xml; charset=utf-8")
+	return c.Send(append([]byte(xml.Header), out...))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Sparse fieldsets: read endpoints accept ?fields=a,b,c and return only
+// those keys. Selection only ever narrows what the endpoint already
+// renders, so fields hidden from JSON (json:"-") can't be requested.
+// Responses carry an ETag that covers the field set as well as the body.
+
+// transactionFields are the keys formatTransaction renders
+var transactionFields = structFields(transactionView{})
+
+// structFields lists the JSON keys a struct serializes to, including those
+// of embedded structs
+func structFields(v interface{}) []string {
+	t := reflect.TypeOf(v)
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && f.Tag.Get("json") == "" {
+			names = append(names, structFields(reflect.Zero(f.Type).Interface())...)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			if tag == "-" {
+				continue
+			}
+			if n := strings.Split(tag, ",")[0]; n != "" {
+				name = n
+			}
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// parseFields reads ?fields= against the valid keys; a nil set means the
+// client didn't ask for a subset
+func parseFields(c *fiber.Ctx, valid []string) (map[string]bool, error) {
+	raw := c.Query("fields")
+	if raw == "" {
+		return nil, nil
+	}
+	known := map[string]bool{}
+	for _, name := range valid {
+		known[name] = true
+	}
+	set := map[string]bool{}
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !known[name] {
+			sorted := append([]string(nil), valid...)
+			sort.Strings(sorted)
+			return nil, &ValidationError{Message: "unknown field " + name + " (valid: " + strings.Join(sorted, ", ") + ")"}
+		}
+		set[name] = true
+	}
+	if len(set) == 0 {
+		return nil, &ValidationError{Message: "fields must name at least one field"}
+	}
+	return set, nil
+}
+
+// pickFields keeps only the keys in set; a nil set keeps everything
+func pickFields(m fiber.Map, set map[string]bool) fiber.Map {
+	if set == nil {
+		return m
+	}
+	out := fiber.Map{}
+	for k, v := range m {
+		if set[k] {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// toMap renders v the way c.JSON would, as a map that pickFields can trim
+func toMap(v interface{}) (fiber.Map, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var m fiber.Map
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// selectFields trims v to the fields in set; a nil set leaves v as it is
+func selectFields(v interface{}, set map[string]bool) (interface{}, error) {
+	if set == nil {
+		return v, nil
+	}
+	m, err := toMap(v)
+	if err != nil {
+		return nil, err
+	}
+	return pickFields(m, set), nil
+}
+
+// sendFields writes body as JSON with an ETag and answers 304 Not Modified
+// when If-None-Match already has it. body must be trimmed to fields.
+func sendFields(c *fiber.Ctx, fields map[string]bool, body interface{}) error {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return writeError(c, err)
+	}
+	etag := fieldsETag(fields, raw)
+	c.Set(fiber.HeaderETag, etag)
+	if etagMatches(c.Get(fiber.HeaderIfNoneMatch), etag) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(raw)
+}
+
+// fieldsETag hashes the field set along with the body, so a response cached
+// for one selection never validates a request for another, even where the
+// bodies happen to match (an empty list, say)
+func fieldsETag(fields map[string]bool, body []byte) string {
+	selected := "*"
+	if fields != nil {
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		selected = strings.Join(names, ",")
+	}
+	h := sha256.New()
+	h.Write([]byte(selected))
+	h.Write([]byte{0})
+	h.Write(body)
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, comparing
+// weakly as RFC 9110 asks for GET
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate != "" && strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
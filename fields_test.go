@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestTransactionFieldsFollowTheView(t *testing.T) {
+	resetDB(t)
+	sender := createUser(t, 100)
+	recipient := createUser(t, 0)
+	view, err := toMap(formatTransaction(Transaction{FromUserID: sender.ID, ToUserID: recipient.ID, ToUser: recipient, Amount: 10, Type: "transfer", CreatedAt: time.Now()}, sender.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rendered []string
+	for k := range view {
+		rendered = append(rendered, k)
+	}
+	sort.Strings(rendered)
+	declared := append([]string(nil), transactionFields...)
+	sort.Strings(declared)
+	if fmt.Sprint(rendered) != fmt.Sprint(declared) {
+		t.Errorf("formatTransaction renders %v, transactionFields lists %v", rendered, declared)
+	}
+	if got := structFields(transactionDetail{}); len(got) != len(transactionFields)+2 || got[len(got)-2] != "description" || got[len(got)-1] != "timeline" {
+		t.Errorf("detail fields = %v, want the view's plus description and timeline", got)
+	}
+}
+
+func TestFieldsCannotExposeHiddenFields(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	admin := createUser(t, 0)
+	if err := db.Model(&User{}).Where("id = ?", admin.ID).Update("role", roleAdmin).Error; err != nil {
+		t.Fatal(err)
+	}
+	token := tokenFor(t, admin)
+
+	for _, path := range []string{"/me?fields=password", "/me?fields=pin_hash", "/admin/users?fields=id,password", "/admin/users?fields=TOTPSecret", "/transactions/recent?fields=from_user_id"} {
+		if status, body := doJSON(t, app, fiber.MethodGet, path, token, nil); status != fiber.StatusBadRequest || errorCodeOf(body) != "INVALID_REQUEST" {
+			t.Errorf("%s: status %d, body %v", path, status, body)
+		}
+	}
+
+	status, body := doJSON(t, app, fiber.MethodGet, "/admin/users?fields=member_id,points", token, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d, body %v", status, body)
+	}
+	users := body["users"].([]interface{})
+	if len(users) != 1 || fmt.Sprint(users[0]) != fmt.Sprintf("map[member_id:%s points:0]", admin.MemberID) {
+		t.Errorf("users = %v, want only member_id and points", users)
+	}
+	if body["pagination"] == nil {
+		t.Error("pagination was trimmed along with the users")
+	}
+}
+
+// getETag fetches path and returns the status and ETag, sending ifNoneMatch
+// when it is set
+func getETag(t *testing.T, app *fiber.App, path, token, ifNoneMatch string) (int, string) {
+	t.Helper()
+	var headers []string
+	if ifNoneMatch != "" {
+		headers = []string{fiber.HeaderIfNoneMatch, ifNoneMatch}
+	}
+	resp := doRequest(t, app, fiber.MethodGet, path, token, nil, headers...)
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == fiber.StatusNotModified && len(raw) != 0 {
+		t.Errorf("%s: 304 with a body %q", path, raw)
+	}
+	return resp.StatusCode, resp.Header.Get(fiber.HeaderETag)
+}
+
+func TestETagCoversTheFieldSet(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	user := createUser(t, 500)
+	token := tokenFor(t, user)
+
+	status, full := getETag(t, app, "/me", token, "")
+	if status != fiber.StatusOK || full == "" {
+		t.Fatalf("status %d, ETag %q", status, full)
+	}
+	if status, etag := getETag(t, app, "/me", token, full); status != fiber.StatusNotModified || etag != full {
+		t.Errorf("revalidating: status %d, ETag %q, want 304 with %q", status, etag, full)
+	}
+	if status, _ := getETag(t, app, "/me", token, `"other", `+full); status != fiber.StatusNotModified {
+		t.Errorf("ETag in a list: status %d, want 304", status)
+	}
+	status, subset := getETag(t, app, "/me?fields=member_id,points", token, full)
+	if status != fiber.StatusOK || subset == full {
+		t.Errorf("full ETag for a subset: status %d, ETag %q", status, subset)
+	}
+	if status, _ := getETag(t, app, "/me?fields=points,member_id", token, subset); status != fiber.StatusNotModified {
+		t.Errorf("same fields in another order: status %d, want 304", status)
+	}
+
+	// no transactions yet, so both selections render the same empty list
+	_, ids := getETag(t, app, "/transactions/recent?fields=id", token, "")
+	if status, amounts := getETag(t, app, "/transactions/recent?fields=amount", token, ids); status != fiber.StatusOK || amounts == ids {
+		t.Errorf("ETag shared across field sets with equal bodies: status %d, ETag %q", status, amounts)
+	}
+
+	sendPoints(t, app, user, createUser(t, 0), 100)
+	if status, _ := getETag(t, app, "/me?fields=member_id,points", token, subset); status != fiber.StatusOK {
+		t.Errorf("after the balance changed: status %d, want 200", status)
+	}
+	if status, _ := getETag(t, app, "/transactions/recent?fields=id", token, ids); status != fiber.StatusOK {
+		t.Errorf("after a transfer: status %d, want 200", status)
+	}
+	_, list := getETag(t, app, "/transactions/recent", token, "")
+	if list == "" {
+		t.Error("no ETag on the transactions list")
+	}
+}
+
+// BenchmarkTransactionsListPayload reports the size of a 50-row page of
+// history with every field and with the few the history tab shows
+func BenchmarkTransactionsListPayload(b *testing.B) {
+	resetDB(b)
+	app := newTestApp(b)
+	user := createUser(b, 0)
+	other := createUser(b, 0)
+	for i := 0; i < 50; i++ {
+		txn := Transaction{FromUserID: other.ID, ToUserID: user.ID, Amount: int64(10 + i), Type: "transfer", Status: "completed",
+			Description: "โอนแต้มให้เพื่อน", Note: fmt.Sprintf("ค่ากาแฟวันที่ %d ☕", i), CreatedAt: time.Now().Add(-time.Duration(i) * time.Minute)}
+		if err := db.Create(&txn).Error; err != nil {
+			b.Fatal(err)
+		}
+	}
+	token := tokenFor(b, user)
+
+	for _, bc := range []struct{ name, query string }{
+		{"all fields", ""},
+		{"id,amount,date", "&fields=id,amount,date"},
+		{"id,contact_name,amount,date,time", "&fields=id,contact_name,amount,date,time"},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var size int
+			for i := 0; i < b.N; i++ {
+				resp := doRequest(b, app, fiber.MethodGet, "/transactions/recent?page_size=50"+bc.query, token, nil)
+				raw, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil || resp.StatusCode != http.StatusOK {
+					b.Fatalf("status %d: %v", resp.StatusCode, err)
+				}
+				size = len(raw)
+			}
+			b.ReportMetric(float64(size), "bytes/response")
+		})
+	}
+}
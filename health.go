@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// healthCheckTimeout bounds the database ping so a hung connection fails
+// the probe instead of stalling it
+const healthCheckTimeout = 2 * time.Second
+
+// Liveness/readiness probe: 200 if the database answers a ping, else 503
+func healthzHandler(c *fiber.Ctx) error {
+	sqlDB, err := db.DB()
+	if err == nil {
+		ctx, cancel := context.WithTimeout(c.UserContext(), healthCheckTimeout)
+		defer cancel()
+		err = sqlDB.PingContext(ctx)
+	}
+	if err != nil {
+		log.Printf("health check: database ping failed: %v", err)
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"status": "unavailable", "db": "down"})
+	}
+	return c.JSON(fiber.Map{"status": "ok", "db": "up"})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Clients retrying POST /transfer after a lost response send the same
+// Idempotency-Key header. A successful response is stored under the key in
+// the same DB transaction as the transfer, so a crash can't leave one
+// without the other, and retries within idempotencyKeyTTL get it replayed
+// instead of moving points again. A failed transfer commits nothing, so its
+// retry runs again.
+const (
+	idempotencyKeyHeader       = "Idempotency-Key"
+	idempotentReplayHeader     = "Idempotent-Replay"
+	idempotencyKeyTTL          = 24 * time.Hour
+	idempotencyCleanupInterval = time.Hour
+	maxIdempotencyKeyLength    = 255
+)
+
+func init() {
+	registerInvariant("idempotency_record_orphaned",
+		"idempotency records whose user doesn't exist",
+		`SELECT x.id FROM idempotency_records x LEFT JOIN users u ON u.id = x.user_id WHERE u.id IS NULL`)
+}
+
+// IdempotencyRecord is the response a request with an Idempotency-Key got
+type IdempotencyRecord struct {
+	ID             uint      `gorm:"primaryKey"`
+	UserID         uint      `gorm:"uniqueIndex:idx_idempotency_user_key;not null"`
+	IdempotencyKey string    `gorm:"uniqueIndex:idx_idempotency_user_key;size:255;not null"`
+	RequestHash    string    `gorm:"not null"` // tells a retry from a different request reusing the key
+	StatusCode     int       `gorm:"not null"`
+	Response       []byte    `gorm:"not null"`
+	CreatedAt      time.Time `gorm:"index"`
+}
+
+// idempotencyClaim is the key a request runs under, carried into the DB
+// transaction that stores its response
+type idempotencyClaim struct {
+	UserID      uint
+	Key         string
+	RequestHash string
+}
+
+// claimIdempotencyKey reads the Idempotency-Key header. It returns a nil
+// claim if there is none, and the stored record if the key was used before.
+// request is hashed to detect a key reused for something else.
+func claimIdempotencyKey(c *fiber.Ctx, userID uint, request interface{}) (*idempotencyClaim, *IdempotencyRecord, error) {
+	key := c.Get(idempotencyKeyHeader)
+	if key == "" {
+		return nil, nil, nil
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return nil, nil, &ValidationError{
+			Message: "invalid Idempotency-Key",
+			Fields:  map[string]string{idempotencyKeyHeader: fmt.Sprintf("must be at most %d characters", maxIdempotencyKeyLength)},
+		}
+	}
+	b, err := json.Marshal(request)
+	if err != nil {
+		return nil, nil, fmt.Errorf("hash request: %w", err)
+	}
+	sum := sha256.Sum256(b)
+	claim := &idempotencyClaim{UserID: userID, Key: key, RequestHash: hex.EncodeToString(sum[:])}
+
+	// an expired record no longer counts, and would block storing a new one
+	if err := db.Where("user_id = ? AND idempotency_key = ? AND created_at < ?", userID, key, time.Now().Add(-idempotencyKeyTTL)).
+		Delete(&IdempotencyRecord{}).Error; err != nil {
+		return nil, nil, fmt.Errorf("delete expired idempotency record: %w", err)
+	}
+	record, err := claim.existing()
+	return claim, record, err
+}
+
+// existing returns the record stored under the claimed key, if any
+func (claim *idempotencyClaim) existing() (*IdempotencyRecord, error) {
+	var record IdempotencyRecord
+	err := db.Where("user_id = ? AND idempotency_key = ?", claim.UserID, claim.Key).First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("find idempotency record: %w", err)
+	}
+	return &record, nil
+}
+
+// store saves the response under the claimed key inside tx. A concurrent
+// request that stored first makes this fail on the unique index, rolling
+// back the whole transaction. A nil claim stores nothing.
+func (claim *idempotencyClaim) store(tx *gorm.DB, status int, body fiber.Map) error {
+	if claim == nil {
+		return nil
+	}
+	response, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("encode idempotent response: %w", err)
+	}
+	record := IdempotencyRecord{
+		UserID:         claim.UserID,
+		IdempotencyKey: claim.Key,
+		RequestHash:    claim.RequestHash,
+		StatusCode:     status,
+		Response:       response,
+	}
+	if err := tx.Create(&record).Error; err != nil {
+		return fmt.Errorf("store idempotency record: %w", err)
+	}
+	return nil
+}
+
+// replay writes the stored response for a retry of the same request
+func (claim *idempotencyClaim) replay(c *fiber.Ctx, record *IdempotencyRecord) error {
+	if record.RequestHash != claim.RequestHash {
+		return writeError(c, ErrIdempotencyKeyReused)
+	}
+	c.Set(idempotentReplayHeader, "true")
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Status(record.StatusCode).Send(record.Response)
+}
+
+// startIdempotencyCleanup purges expired records, once now and then every
+// idempotencyCleanupInterval
+func startIdempotencyCleanup() {
+	purge := func() {
+		if err := db.Where("created_at < ?", time.Now().Add(-idempotencyKeyTTL)).Delete(&IdempotencyRecord{}).Error; err != nil {
+			log.Printf("purge idempotency records: %v", err)
+		}
+	}
+	purge()
+	go func() {
+		for range time.Tick(idempotencyCleanupInterval) {
+			purge()
+		}
+	}()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// transferWithKey posts a transfer under an Idempotency-Key and returns the
+// response with its body read
+func transferWithKey(t *testing.T, app *fiber.App, from, to User, amount int64, key string) (*http.Response, []byte) {
+	t.Helper()
+	resp := doRequest(t, app, fiber.MethodPost, "/transfer", tokenFor(t, from),
+		fiber.Map{"to_member_id": to.MemberID, "amount": amount, "pin": testPin}, idempotencyKeyHeader, key)
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, raw
+}
+
+func TestIdempotentRetryReplaysTheResponse(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	sender := createUser(t, 1000)
+	recipient := createUser(t, 0)
+
+	first, firstBody := transferWithKey(t, app, sender, recipient, 100, "retry-1")
+	if first.StatusCode != fiber.StatusOK || first.Header.Get(idempotentReplayHeader) != "" {
+		t.Fatalf("first: status %d, replay header %q, body %s", first.StatusCode, first.Header.Get(idempotentReplayHeader), firstBody)
+	}
+	retry, retryBody := transferWithKey(t, app, sender, recipient, 100, "retry-1")
+	if retry.StatusCode != fiber.StatusOK || retry.Header.Get(idempotentReplayHeader) != "true" {
+		t.Errorf("retry: status %d, replay header %q", retry.StatusCode, retry.Header.Get(idempotentReplayHeader))
+	}
+	if !bytes.Equal(retryBody, firstBody) {
+		t.Errorf("retry body %s, want the stored %s", retryBody, firstBody)
+	}
+	if got := reloadUser(t, sender).Points; got != 900 {
+		t.Errorf("sender balance = %d, want 900 after one transfer", got)
+	}
+	var transfers int64
+	db.Model(&Transaction{}).Where("from_user_id = ?", sender.ID).Count(&transfers)
+	if transfers != 1 {
+		t.Errorf("%d transactions, want 1", transfers)
+	}
+
+	// another key is another transfer
+	if other, body := transferWithKey(t, app, sender, recipient, 100, "retry-2"); other.StatusCode != fiber.StatusOK || other.Header.Get(idempotentReplayHeader) != "" {
+		t.Errorf("new key: status %d, body %s", other.StatusCode, body)
+	}
+	if got := reloadUser(t, sender).Points; got != 800 {
+		t.Errorf("sender balance = %d, want 800 after the second key", got)
+	}
+	assertInvariants(t)
+}
+
+func TestIdempotencyKeyReusedForAnotherRequest(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	sender := createUser(t, 1000)
+	recipient := createUser(t, 0)
+
+	if resp, body := transferWithKey(t, app, sender, recipient, 100, "reused"); resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("first: status %d, body %s", resp.StatusCode, body)
+	}
+	resp, raw := transferWithKey(t, app, sender, recipient, 200, "reused")
+	var body map[string]interface{}
+	json.Unmarshal(raw, &body)
+	if resp.StatusCode != fiber.StatusConflict || errorCodeOf(body) != "IDEMPOTENCY_KEY_REUSED" {
+		t.Errorf("status %d, body %s", resp.StatusCode, raw)
+	}
+	if resp.Header.Get(idempotentReplayHeader) != "" {
+		t.Error("a refused request was marked as a replay")
+	}
+	if got := reloadUser(t, sender).Points; got != 900 {
+		t.Errorf("sender balance = %d, want 900", got)
+	}
+}
+
+// The record is written inside the transfer's transaction, so a transfer
+// that fails after storing it leaves neither, and the retry runs afresh
+func TestFailedTransferKeepsNoIdempotencyRecord(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	sender := createUser(t, 1000)
+	recipient := createUser(t, 0)
+	// the record's insert goes through, then the transaction fails
+	if err := db.Exec("CREATE TRIGGER fail_after_store AFTER INSERT ON idempotency_records BEGIN SELECT RAISE(ABORT, 'injected'); END").Error; err != nil {
+		t.Fatal(err)
+	}
+	drop := func() { db.Exec("DROP TRIGGER IF EXISTS fail_after_store") }
+	t.Cleanup(drop)
+
+	if resp, body := transferWithKey(t, app, sender, recipient, 100, "fails"); resp.StatusCode != fiber.StatusInternalServerError {
+		t.Fatalf("status %d, body %s", resp.StatusCode, body)
+	}
+	var records, transfers int64
+	db.Model(&IdempotencyRecord{}).Count(&records)
+	db.Model(&Transaction{}).Count(&transfers)
+	if records != 0 || transfers != 0 {
+		t.Errorf("%d idempotency records and %d transactions survived the rollback", records, transfers)
+	}
+	if got := reloadUser(t, sender).Points; got != 1000 {
+		t.Errorf("sender balance = %d, want 1000", got)
+	}
+
+	drop()
+	resp, body := transferWithKey(t, app, sender, recipient, 100, "fails")
+	if resp.StatusCode != fiber.StatusOK || resp.Header.Get(idempotentReplayHeader) != "" {
+		t.Errorf("retry: status %d, replay header %q, body %s", resp.StatusCode, resp.Header.Get(idempotentReplayHeader), body)
+	}
+	if got := reloadUser(t, sender).Points; got != 900 {
+		t.Errorf("sender balance = %d, want 900 after the retry", got)
+	}
+	assertInvariants(t)
+}
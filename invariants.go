@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// An invariant is a query for rows that should never exist. Features
+// register their own invariants from an init func next to the code that
+// maintains them; the suite runs them all on a schedule.
+type invariant struct {
+	Name        string
+	Description string
+	// Query selects the violating rows; zero rows means the invariant holds
+	Query string
+}
+
+var invariants []invariant
+
+// invariantViolations publishes the latest violation count per invariant
+var invariantViolations = expvar.NewMap("invariant_violations")
+
+const invariantCheckInterval = 24 * time.Hour
+
+func registerInvariant(name, description, query string) {
+	invariants = append(invariants, invariant{Name: name, Description: description, Query: query})
+}
+
+// suppressedInvariants lists invariants with known, accepted violations
+// (INVARIANTS_SUPPRESS, comma separated). They still run and publish
+// counts but don't raise alerts.
+func suppressedInvariants() map[string]bool {
+	suppressed := map[string]bool{}
+	for _, name := range strings.Split(os.Getenv("INVARIANTS_SUPPRESS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			suppressed[name] = true
+		}
+	}
+	return suppressed
+}
+
+// invariantResult is one invariant's outcome; Err is set when its query
+// failed and Count is meaningless
+type invariantResult struct {
+	invariant
+	Count int64
+	Err   error
+}
+
+// checkInvariants runs every registered invariant without publishing or
+// alerting
+func checkInvariants() []invariantResult {
+	results := make([]invariantResult, 0, len(invariants))
+	for _, inv := range invariants {
+		result := invariantResult{invariant: inv}
+		result.Err = db.Raw("SELECT COUNT(*) FROM (" + inv.Query + ") AS violations").Scan(&result.Count).Error
+		results = append(results, result)
+	}
+	return results
+}
+
+// runInvariants checks every registered invariant, publishes the counts,
+// alerts on unsuppressed violations and returns the violation count per name
+func runInvariants() map[string]int64 {
+	suppressed := suppressedInvariants()
+	counts := map[string]int64{}
+	for _, result := range checkInvariants() {
+		if result.Err != nil {
+			log.Printf("invariant %s: query failed: %v", result.Name, result.Err)
+			continue
+		}
+		counts[result.Name] = result.Count
+		v := new(expvar.Int)
+		v.Set(result.Count)
+		invariantViolations.Set(result.Name, v)
+		if result.Count > 0 && !suppressed[result.Name] {
+			alertInvariantViolation(result.invariant, result.Count)
+		}
+	}
+	return counts
+}
+
+var invariantAlertClient = &http.Client{Timeout: 10 * time.Second}
+
+// alertInvariantViolation logs the violation and, when
+// INVARIANT_ALERT_WEBHOOK_URL is set, posts it there as JSON so it reaches
+// whoever is on call (Slack and most paging tools accept incoming webhooks)
+func alertInvariantViolation(inv invariant, count int64) {
+	log.Printf("ALERT invariant %s violated by %d rows: %s", inv.Name, count, inv.Description)
+	webhook := os.Getenv("INVARIANT_ALERT_WEBHOOK_URL")
+	if webhook == "" {
+		return
+	}
+	if err := postInvariantAlert(webhook, inv, count); err != nil {
+		log.Printf("invariant %s: alert webhook failed: %v", inv.Name, err)
+	}
+}
+
+func postInvariantAlert(webhook string, inv invariant, count int64) error {
+	body, err := json.Marshal(fiber.Map{
+		"text":        fmt.Sprintf("Invariant %s violated by %d rows: %s", inv.Name, count, inv.Description),
+		"invariant":   inv.Name,
+		"description": inv.Description,
+		"violations":  count,
+		"checked_at":  time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := invariantAlertClient.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Report every invariant's current violation count (admin only). The
+// checks run on demand and don't alert; the scheduled run does that.
+func invariantReportHandler(c *fiber.Ctx) error {
+	suppressed := suppressedInvariants()
+	checkedAt := time.Now().UTC()
+	results := checkInvariants()
+	report := make([]fiber.Map, 0, len(results))
+	violated := 0
+	for _, result := range results {
+		entry := fiber.Map{
+			"name":        result.Name,
+			"description": result.Description,
+			"suppressed":  suppressed[result.Name],
+		}
+		if result.Err != nil {
+			log.Printf("invariant %s: query failed: %v", result.Name, result.Err)
+			entry["violations"], entry["error"] = nil, "query failed"
+		} else {
+			entry["violations"] = result.Count
+			if result.Count > 0 {
+				violated++
+			}
+		}
+		report = append(report, entry)
+	}
+	return c.JSON(fiber.Map{"checked_at": checkedAt, "violated": violated, "invariants": report})
+}
+
+// startInvariantChecks runs the suite now and then every invariantCheckInterval
+func startInvariantChecks() {
+	go func() {
+		runInvariants()
+		for range time.Tick(invariantCheckInterval) {
+			runInvariants()
+		}
+	}()
+}
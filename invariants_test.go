@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// columns named like references that don't point at a row of ours
+var unreferencedIDColumns = map[string]string{
+	"users.member_id":                 "the member's own public ID",
+	"api_keys.partner_id":             "partners aren't stored in this database",
+	"users.partner_id":                "partners aren't stored in this database",
+	"transfer_templates.to_member_id": "a template outlives its recipient's account; using it is refused then",
+}
+
+func TestEveryReferenceHasAnInvariant(t *testing.T) {
+	for _, model := range appModels() {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatal(err)
+		}
+		table := stmt.Schema.Table
+		for _, field := range stmt.Schema.Fields {
+			column := table + "." + field.DBName
+			if !strings.HasSuffix(field.DBName, "_id") || unreferencedIDColumns[column] != "" {
+				continue
+			}
+			if !invariantCovers(table, field.DBName) {
+				t.Errorf("%s looks like a reference but no invariant checks it; register one next to %T", column, model)
+			}
+		}
+	}
+	for column := range unreferencedIDColumns {
+		table, name, _ := strings.Cut(column, ".")
+		if !db.Migrator().HasColumn(table, name) {
+			t.Errorf("unreferencedIDColumns lists %s, which doesn't exist", column)
+		}
+	}
+}
+
+// invariantCovers reports whether some invariant's query reads column of table
+func invariantCovers(table, column string) bool {
+	mentions := regexp.MustCompile(`\b` + column + `\b`)
+	for _, inv := range invariants {
+		if regexp.MustCompile(`\b`+table+`\b`).MatchString(inv.Query) && mentions.MatchString(inv.Query) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestNegativeBalanceAllowedByAdjustment(t *testing.T) {
+	resetDB(t)
+	admin := createUser(t, 0)
+	allowed := createUser(t, 100)
+	if _, _, err := adjustPoints(allowed.ID, -300, "chargeback", true, admin); err != nil {
+		t.Fatal(err)
+	}
+	assertInvariants(t)
+
+	// sinking below what the adjustment left, or going negative without
+	// one, is still a violation
+	unexplained := createUser(t, 0)
+	for id, points := range map[uint]int64{allowed.ID: -250, unexplained.ID: -1} {
+		if err := db.Model(&User{}).Where("id = ?", id).Update("points", points).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := runInvariants()["negative_balance"]; got != 2 {
+		t.Errorf("negative_balance = %d, want 2", got)
+	}
+}
+
+func TestInvariantReport(t *testing.T) {
+	resetDB(t)
+	t.Setenv("INVARIANTS_SUPPRESS", "negative_balance")
+	app := newTestApp(t)
+	admin := createUser(t, 0)
+	if err := db.Model(&User{}).Where("id = ?", admin.ID).Update("role", roleAdmin).Error; err != nil {
+		t.Fatal(err)
+	}
+	member := createUser(t, 0)
+	if err := db.Model(&User{}).Where("id = ?", member.ID).Update("points", -5).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if status, body := doJSON(t, app, fiber.MethodGet, "/admin/invariants", tokenFor(t, member), nil); status != fiber.StatusForbidden {
+		t.Fatalf("as a member: status %d, body %v", status, body)
+	}
+	status, body := doJSON(t, app, fiber.MethodGet, "/admin/invariants", tokenFor(t, admin), nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("as an admin: status %d, body %v", status, body)
+	}
+	entries, _ := body["invariants"].([]interface{})
+	if len(entries) != len(invariants) {
+		t.Fatalf("report has %d invariants, want %d", len(entries), len(invariants))
+	}
+	// the negative balance also leaves the member's points out of step
+	// with their lots and latest balance_after
+	violated := map[string]bool{}
+	for _, e := range entries {
+		entry := e.(map[string]interface{})
+		if entry["violations"] != float64(0) {
+			violated[entry["name"].(string)] = true
+		}
+		if entry["name"] == "negative_balance" && (entry["violations"] != float64(1) || entry["suppressed"] != true) {
+			t.Errorf("negative_balance entry = %v, want 1 suppressed violation", entry)
+		}
+	}
+	if body["violated"] != float64(len(violated)) || !violated["negative_balance"] {
+		t.Errorf("violated = %v, entries %v", body["violated"], violated)
+	}
+}
+
+func TestInvariantAlertWebhook(t *testing.T) {
+	alerts := make(chan map[string]interface{}, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alert := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Errorf("decode alert: %v", err)
+		}
+		alerts <- alert
+	}))
+	defer hook.Close()
+	t.Setenv("INVARIANT_ALERT_WEBHOOK_URL", hook.URL)
+
+	alertInvariantViolation(invariant{Name: "widgets_orphaned", Description: "widgets whose owner doesn't exist"}, 3)
+	select {
+	case alert := <-alerts:
+		if alert["invariant"] != "widgets_orphaned" || alert["violations"] != float64(3) || !strings.Contains(alert["text"].(string), "widgets_orphaned") {
+			t.Errorf("alert = %v", alert)
+		}
+	default:
+		t.Fatal("no alert was posted")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Each member tier has a cap on a single transfer and on the points sent
+// per day, counted over completed outgoing transfers since midnight in
+// Bangkok. The caps live in the tier_limits table, seeded on first start;
+// finance edits the rows directly. A tier without a row falls back to
+// DAILY_TRANSFER_LIMITS / DAILY_TRANSFER_LIMIT and no per-transfer cap.
+const (
+	defaultDailyTransferLimit = 50000
+	defaultGoldPerTxnLimit    = 20000
+)
+
+// TierLimit holds the transfer limits of one member tier
+type TierLimit struct {
+	Tier        string    `json:"tier" gorm:"primaryKey"`
+	PerTxnLimit int64     `json:"per_txn_limit" gorm:"not null"`
+	DailyLimit  int64     `json:"daily_limit" gorm:"not null"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// limitDayZone is where the limit day starts and ends; Thailand keeps no
+// daylight saving time, so a fixed offset needs no tz database
+var limitDayZone = time.FixedZone("Asia/Bangkok", 7*60*60)
+
+// seedTierLimits fills an empty tier_limits table from the environment
+// settings it replaces, with Gold's per-transfer cap at 20,000
+func seedTierLimits() {
+	var count int64
+	if err := db.Model(&TierLimit{}).Count(&count).Error; err != nil {
+		log.Fatalf("count tier limits failed: %v", err)
+	}
+	if count > 0 {
+		return
+	}
+	// validateConfig has rejected a malformed setting before initDB runs
+	tiers, err := parseTierLimits(os.Getenv("DAILY_TRANSFER_LIMITS"))
+	if err != nil {
+		log.Fatalf("DAILY_TRANSFER_LIMITS: %v", err)
+	}
+	tiers["Gold"] = dailyTransferLimit("Gold")
+	for tier, daily := range tiers {
+		limit := TierLimit{Tier: tier, PerTxnLimit: daily, DailyLimit: daily}
+		if tier == "Gold" {
+			limit.PerTxnLimit = min(defaultGoldPerTxnLimit, daily)
+		}
+		if err := db.Create(&limit).Error; err != nil {
+			log.Fatalf("seed tier limit %s failed: %v", limit.Tier, err)
+		}
+	}
+}
+
+// transferLimits returns tier's limits; PerTxnLimit is 0 when it has none
+func transferLimits(tx *gorm.DB, tier string) (TierLimit, error) {
+	var limit TierLimit
+	err := tx.Where("tier = ?", tier).First(&limit).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return TierLimit{Tier: tier, DailyLimit: dailyTransferLimit(tier)}, nil
+	}
+	if err != nil {
+		return limit, fmt.Errorf("find limits of tier %s: %w", tier, err)
+	}
+	return limit, nil
+}
+
+// parseTierLimits reads a "Tier=amount,..." list
+func parseTierLimits(s string) (map[string]int64, error) {
+	limits := map[string]int64{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		tier, amount, ok := strings.Cut(part, "=")
+		n, err := strconv.ParseInt(strings.TrimSpace(amount), 10, 64)
+		if !ok || strings.TrimSpace(tier) == "" || err != nil || n <= 0 {
+			return nil, fmt.Errorf("entry %q is not Tier=positive amount", part)
+		}
+		limits[strings.TrimSpace(tier)] = n
+	}
+	return limits, nil
+}
+
+// dailyTransferLimit is the environment's daily limit for tier
+// (validateConfig has already rejected malformed settings)
+func dailyTransferLimit(tier string) int64 {
+	if limits, err := parseTierLimits(os.Getenv("DAILY_TRANSFER_LIMITS")); err == nil {
+		if n, ok := limits[tier]; ok {
+			return n
+		}
+	}
+	return int64(envPositiveInt("DAILY_TRANSFER_LIMIT", defaultDailyTransferLimit))
+}
+
+// startOfDay is midnight in Bangkok of the day containing now
+func startOfDay(now time.Time) time.Time {
+	y, m, d := now.In(limitDayZone).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, limitDayZone)
+}
+
+// sentToday sums userID's completed outgoing transfers since midnight,
+// and those whose points are held for the recipient; reversals taken back
+// from them don't count. SQLite compares timestamps as text, so midnight is
+// given in now's zone, the one created_at is written in.
+func sentToday(tx *gorm.DB, userID uint, now time.Time) (int64, error) {
+	var sent int64
+	err := tx.Model(&Transaction{}).
+		Where("from_user_id = ? AND type = ? AND (status = ? OR (status = ? AND accept_required)) AND created_at >= ?",
+			userID, "transfer", "completed", "pending", startOfDay(now).In(now.Location())).
+		Select("COALESCE(SUM(amount), 0)").Scan(&sent).Error
+	return sent, err
+}
+
+// checkTransferLimits rejects user sending amount if it's over their tier's
+// per-transfer cap or would take them past its daily limit
+func checkTransferLimits(tx *gorm.DB, user User, amount int64) error {
+	limit, err := transferLimits(tx, user.MemberTier)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	sent, err := sentToday(tx, user.ID, now)
+	if err != nil {
+		return fmt.Errorf("sum today's transfers: %w", err)
+	}
+	resetsAt := startOfDay(now).AddDate(0, 0, 1)
+	if limit.PerTxnLimit > 0 && amount > limit.PerTxnLimit {
+		return &PerTransferLimitExceededError{Limit: limit.PerTxnLimit, Used: sent, ResetsAt: resetsAt}
+	}
+	if sent+amount > limit.DailyLimit {
+		return &DailyLimitExceededError{
+			Limit:     limit.DailyLimit,
+			Used:      sent,
+			Remaining: max(limit.DailyLimit-sent, 0),
+			ResetsAt:  resetsAt,
+		}
+	}
+	return nil
+}
+
+// The current user's transfer limits and what they can still send today
+func transferLimitHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+	now := time.Now()
+	sent, err := sentToday(db, user.ID, now)
+	if err != nil {
+		return writeError(c, fmt.Errorf("sum today's transfers: %w", err))
+	}
+	limit, err := transferLimits(db, user.MemberTier)
+	if err != nil {
+		return writeError(c, err)
+	}
+	remaining := max(limit.DailyLimit-sent, 0)
+	// the largest single transfer allowed right now
+	available := remaining
+	var perTxn *int64
+	if limit.PerTxnLimit > 0 {
+		perTxn = &limit.PerTxnLimit
+		available = min(available, limit.PerTxnLimit)
+	}
+	return c.JSON(fiber.Map{
+		"member_tier":   user.MemberTier,
+		"per_txn_limit": perTxn,
+		"daily_limit":   limit.DailyLimit,
+		"used":          sent,
+		"remaining":     remaining,
+		"available_now": available,
+		"resets_at":     startOfDay(now).AddDate(0, 0, 1),
+	})
+}
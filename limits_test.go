@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestTransferLimitErrors(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	if err := db.Model(&TierLimit{}).Where("tier = ?", "Gold").
+		Updates(map[string]interface{}{"per_txn_limit": 300, "daily_limit": 500}).Error; err != nil {
+		t.Fatal(err)
+	}
+	alice := createUser(t, 1000)
+	bob := createUser(t, 0)
+	token := tokenFor(t, alice)
+	transfer := func(amount int64) (int, map[string]interface{}) {
+		return doJSON(t, app, fiber.MethodPost, "/transfer", token,
+			fiber.Map{"to_member_id": bob.MemberID, "amount": amount, "pin": testPin})
+	}
+
+	if status, body := transfer(200); status != fiber.StatusOK {
+		t.Fatalf("first transfer: status %d, body %v", status, body)
+	}
+
+	status, body := transfer(400)
+	if status != fiber.StatusUnprocessableEntity || errorCodeOf(body) != "PER_TRANSFER_LIMIT_EXCEEDED" {
+		t.Fatalf("over the per-transfer cap: status %d, body %v", status, body)
+	}
+	if body["per_txn_limit"] != float64(300) || body["used"] != float64(200) || body["resets_at"] == nil {
+		t.Errorf("per-transfer body = %v", body)
+	}
+
+	if status, body := transfer(300); status != fiber.StatusOK {
+		t.Fatalf("transfer up to the daily limit: status %d, body %v", status, body)
+	}
+
+	status, body = transfer(1)
+	if status != fiber.StatusUnprocessableEntity || errorCodeOf(body) != "DAILY_LIMIT_EXCEEDED" {
+		t.Fatalf("over the daily limit: status %d, body %v", status, body)
+	}
+	if body["used"] != float64(500) || body["remaining"] != float64(0) || body["resets_at"] == nil {
+		t.Errorf("daily body = %v", body)
+	}
+	if got := reloadUser(t, alice).Points; got != 500 {
+		t.Errorf("sender balance = %d, want 500", got)
+	}
+}
+
+func TestTransferLimitIsDeprecated(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	token := tokenFor(t, createUser(t, 1000))
+
+	bodies := map[string]string{}
+	for _, path := range []string{"/me/limits", "/transfer/limit"} {
+		resp := doRequest(t, app, fiber.MethodGet, path, token, nil)
+		raw, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("%s: status %d, body %s", path, resp.StatusCode, raw)
+		}
+		bodies[path] = string(raw)
+
+		deprecation, link := resp.Header.Get("Deprecation"), resp.Header.Get(fiber.HeaderLink)
+		if path == "/transfer/limit" && (deprecation != "true" || link != `</me/limits>; rel="successor-version"`) {
+			t.Errorf("%s: Deprecation %q, Link %q", path, deprecation, link)
+		}
+		if path == "/me/limits" && (deprecation != "" || link != "") {
+			t.Errorf("%s: marked deprecated", path)
+		}
+	}
+	if bodies["/me/limits"] != bodies["/transfer/limit"] {
+		t.Errorf("answers differ:\n/me/limits      %s\n/transfer/limit %s", bodies["/me/limits"], bodies["/transfer/limit"])
+	}
+
+	paths := openAPIPaths(appRoutes(), operationDocs())
+	op := paths["/transfer/limit"].(map[string]interface{})["get"].(map[string]interface{})
+	if op["deprecated"] != true || op["description"] != "Deprecated, use GET /me/limits instead." {
+		t.Errorf("/transfer/limit operation: deprecated %v, description %v", op["deprecated"], op["description"])
+	}
+	if op := paths["/me/limits"].(map[string]interface{})["get"].(map[string]interface{}); op["deprecated"] != nil {
+		t.Error("/me/limits documented as deprecated")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// loginHistoryLimit is how many events GET /me/logins returns
+const loginHistoryLimit = 20
+
+// Login methods recorded on login events
+const (
+	loginMethodPassword  = "password"
+	loginMethodMagicLink = "magic_link"
+	loginMethodTwoFactor = "two_factor"
+	loginMethodGoogle    = "google"
+)
+
+// LoginEvent records one login attempt against an existing account.
+// Attempts for unknown identifiers aren't recorded, as there's no user to
+// tie them to.
+type LoginEvent struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	UserID    uint      `json:"-" gorm:"index;not null"`
+	Method    string    `json:"method"` // password, magic_link, two_factor, google
+	Success   bool      `json:"success"`
+	Reason    string    `json:"reason,omitempty"` // why it didn't complete, e.g. invalid_password
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func init() {
+	registerInvariant("login_event_orphaned",
+		"login events whose user doesn't exist",
+		`SELECT x.id FROM login_events x LEFT JOIN users u ON u.id = x.user_id WHERE u.id IS NULL`)
+}
+
+// recordLogin logs a login attempt by userID. An empty reason means the
+// login completed and tokens were issued, which also updates the user's
+// last login. Failures to record are logged rather than failing the login.
+func recordLogin(c *fiber.Ctx, userID uint, method, reason string) {
+	now := time.Now()
+	ip := clientIP(c)
+	event := LoginEvent{
+		UserID:    userID,
+		Method:    method,
+		Success:   reason == "",
+		Reason:    reason,
+		IP:        ip,
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+		CreatedAt: now,
+	}
+	if err := db.Create(&event).Error; err != nil {
+		log.Printf("record login event for user %d: %v", userID, err)
+	}
+	if reason != "" {
+		return
+	}
+	if err := db.Model(&User{}).Where("id = ?", userID).
+		Updates(map[string]interface{}{"last_login_at": now, "last_login_ip": ip}).Error; err != nil {
+		log.Printf("update last login of user %d: %v", userID, err)
+	}
+}
+
+// loginOutcome is the reason to record for a login that reached
+// loginResponse: empty when tokens were issued
+func loginOutcome(resp fiber.Map) string {
+	if resp["mfa_required"] == true {
+		return "mfa_required"
+	}
+	return ""
+}
+
+// The current user's most recent login attempts, newest first
+func loginHistoryHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	var events []LoginEvent
+	if err := db.Where("user_id = ?", u.(User).ID).Order("created_at DESC, id DESC").
+		Limit(loginHistoryLimit).Find(&events).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to fetch login history"})
+	}
+	return c.JSON(fiber.Map{"logins": events})
+}
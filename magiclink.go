@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// MagicLink is a single-use, short-lived password-less login token
+type MagicLink struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"index;not null"`
+	TokenHash string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	IP        string
+	CreatedAt time.Time
+}
+
+const magicLinkTTL = 10 * time.Minute
+
+var (
+	magicLinkEmailLimiter = newAttemptLimiter(3, 15*time.Minute)
+	magicLinkIPLimiter    = newAttemptLimiter(10, 15*time.Minute)
+)
+
+func init() {
+	registerInvariant("magic_link_orphaned",
+		"magic links whose user doesn't exist",
+		`SELECT x.id FROM magic_links x LEFT JOIN users u ON u.id = x.user_id WHERE u.id IS NULL`)
+}
+
+// magicLinkURL builds the deep link the app opens (MAGIC_LINK_URL)
+func magicLinkURL(token string) string {
+	base := os.Getenv("MAGIC_LINK_URL")
+	if base == "" {
+		base = "lbkpoints://auth/magic-login"
+	}
+	return fmt.Sprintf("%s?token=%s", base, token)
+}
+
+// Request a magic login link; always 200 so emails can't be enumerated
+func magicLinkHandler(c *fiber.Ctx) error {
+	var payload struct {
+		Email string `json:"email"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	if payload.Email == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "email required"})
+	}
+	ip := clientIP(c)
+	if !magicLinkIPLimiter.Allow(ip) {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "too many requests"})
+	}
+	accepted := func() error {
+		return c.JSON(fiber.Map{"message": "if the account exists, a login link has been sent"})
+	}
+
+	// per-email limit is silent, a 429 here would reveal the account exists
+	email := strings.TrimSpace(payload.Email)
+	if !magicLinkEmailLimiter.Allow(strings.ToLower(email)) {
+		return accepted()
+	}
+	var user User
+	if err := db.Where("LOWER(email) = ?", normalizeEmail(email)).First(&user).Error; err != nil {
+		return accepted()
+	}
+	token, err := randomToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate token"})
+	}
+	link := MagicLink{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(magicLinkTTL),
+		IP:        ip,
+	}
+	if err := db.Create(&link).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create login link"})
+	}
+	body := fmt.Sprintf("Tap the link below to sign in. It expires in 10 minutes and can only be used once.\n\n%s", magicLinkURL(token))
+	if err := mailer.Send(user.Email, "Your LBK sign-in link", body); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to send login link"})
+	}
+	return accepted()
+}
+
+// Exchange a magic link token for a JWT
+func magicLoginHandler(c *fiber.Ctx) error {
+	var payload struct {
+		Token string `json:"token"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	if payload.Token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "token required"})
+	}
+	hash := hashToken(payload.Token)
+	now := time.Now()
+	// consume in a single conditional update so concurrent exchanges can't both win
+	res := db.Model(&MagicLink{}).
+		Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hash, now).
+		Update("used_at", now)
+	if res.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to verify login link"})
+	}
+	if res.RowsAffected != 1 {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid or expired login link"})
+	}
+	var link MagicLink
+	if err := db.Where("token_hash = ?", hash).First(&link).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to verify login link"})
+	}
+	// the link arrived by email, so the address is proven
+	if err := markEmailVerified(db, link.UserID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to verify login link"})
+	}
+	var user User
+	if err := db.First(&user, link.UserID).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to verify login link"})
+	}
+	// a login link replaces the password, not the second factor
+	tokens, err := loginResponse(user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate token"})
+	}
+	recordLogin(c, user.ID, loginMethodMagicLink, loginOutcome(tokens))
+	return sendLoginTokens(c, tokens)
+}
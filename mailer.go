@@ -0,0 +1,21 @@
+package main
+
+import (
+	"log"
+)
+
+// Mailer delivers transactional email (login links, resets, verification)
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// logMailer writes messages to stdout; it is the default until a real
+// provider is configured and keeps flows testable without SMTP
+type logMailer struct{}
+
+func (logMailer) Send(to, subject, body string) error {
+	log.Printf("mail to=%s subject=%q\n%s", to, subject, body)
+	return nil
+}
+
+var mailer Mailer = logMailer{}
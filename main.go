@@ -1,66 +1,144 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"net/mail"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v4"
 	"golang.org/x/crypto/bcrypt"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
 // User model
 type User struct {
-	ID          uint   `json:"id" gorm:"primaryKey"`
-	Email       string `json:"email" gorm:"uniqueIndex;not null"`
-	Password    string `json:"-"`
-	FirstName   string `json:"first_name"`
-	LastName    string `json:"last_name"`
-	Phone       string `json:"phone"`
-	Birthday    string `json:"birthday"` // keep simple as YYYY-MM-DD
-	MemberID    string `json:"member_id" gorm:"uniqueIndex;not null"` // LBK member ID
-	MemberTier  string `json:"member_tier" gorm:"default:'Gold'"`     // Gold, Silver, etc.
-	Points      int64  `json:"points" gorm:"default:0"`               // Available points
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
+	ID                uint       `json:"id" gorm:"primaryKey"`
+	Email             string     `json:"email" gorm:"uniqueIndex;not null"`
+	Password          string     `json:"-"`
+	FirstName         string     `json:"first_name"`
+	LastName          string     `json:"last_name"`
+	Phone             string     `json:"phone"`
+	Birthday          string     `json:"birthday"`                                                                            // keep simple as YYYY-MM-DD
+	MemberID          string     `json:"member_id" gorm:"uniqueIndex:idx_users_member_id_set,where:member_id <> '';not null"` // LBK member ID; empty until claimed for Google sign-ups
+	MemberTier        string     `json:"member_tier" gorm:"default:'Gold'"`                                                   // Gold, Silver, etc.
+	Points            int64      `json:"points" gorm:"default:0"`                                                             // Available points
+	HeldPoints        int64      `json:"held_points" gorm:"not null;default:0"`                                               // sent, awaiting the recipient's acceptance, see accept.go
+	PartnerID         string     `json:"partner_id" gorm:"index"`                                                             // program/partner the member belongs to
+	Role              string     `json:"role" gorm:"not null;default:'member'"`                                               // member or admin, see admin.go
+	EmailVerified     bool       `json:"email_verified" gorm:"not null;default:false"`                                        // required before transferring
+	IsSynthetic       bool       `json:"-" gorm:"not null;default:false"`                                                     // smoke-test account, see smoketest.go
+	PinHash           string     `json:"-"`                                                                                   // transfer PIN, see pin.go
+	PinFailedAttempts int        `json:"-" gorm:"not null;default:0"`
+	PinLockedUntil    *time.Time `json:"-"`
+	TOTPSecret        string     `json:"-"` // AES-GCM encrypted, see totp.go
+	TOTPEnabled       bool       `json:"two_factor_enabled" gorm:"not null;default:false"`
+	TOTPLastStep      int64      `json:"-" gorm:"not null;default:0"` // last accepted code, blocks replays
+	LastLoginAt       *time.Time `json:"last_login_at"`               // last completed login, see loginhistory.go
+	LastLoginIP       string     `json:"last_login_ip"`
+	GoogleSubject     *string    `json:"-" gorm:"uniqueIndex"` // Google account ID, see oauth.go
+	DeletedAt         gorm.DeletedAt `json:"-" gorm:"index"` // soft delete, see deletion.go
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
 }
 
 // Transaction model for transfer history
 type Transaction struct {
 	ID          uint      `json:"id" gorm:"primaryKey"`
-	FromUserID  uint      `json:"from_user_id"`
-	ToUserID    uint      `json:"to_user_id"`
+	FromUserID  uint      `json:"from_user_id" gorm:"index"`
+	ToUserID    uint      `json:"to_user_id" gorm:"index"`
 	FromUser    User      `json:"from_user" gorm:"foreignKey:FromUserID"`
 	ToUser      User      `json:"to_user" gorm:"foreignKey:ToUserID"`
 	Amount      int64     `json:"amount"`
-	Type        string    `json:"type"` // "transfer", "receive"
-	Status      string    `json:"status" gorm:"default:'completed'"` // completed, pending, failed
+	Type        string    `json:"type"` // "transfer", "reversal", "adjustment", "expiry"
+	Status      string    `json:"status" gorm:"default:'completed'"` // completed, pending, failed, declined, expired, cancelled
+	AcceptRequired bool   `json:"accept_required" gorm:"not null;default:false"` // pending until the recipient accepts, see accept.go
 	Description string    `json:"description"`
+	Note        string    `json:"note"` // sender's memo, see transferRequest
+	ReversalOf  *uint     `json:"reversal_of,omitempty" gorm:"uniqueIndex"` // transfer this reversal undoes, see reversal.go
+	// an adjustment an admin allowed to take the balance below zero, see
+	// adjustment.go and the negative_balance invariant
+	AllowNegative bool `json:"-" gorm:"not null;default:false"`
+	// each side's balance once the points moved; null on older rows and
+	// while pending, and on the program's side of adjustments and expiries
+	FromBalanceAfter *int64 `json:"from_balance_after"`
+	ToBalanceAfter   *int64 `json:"to_balance_after"`
+	// who cancelled a pending transfer and when, see cancelTransferHandler
+	CancelledBy *uint      `json:"cancelled_by,omitempty"`
+	CancelledAt *time.Time `json:"cancelled_at,omitempty"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time
 }
 
 var db *gorm.DB
 
+// appModels lists every table initDB migrates
+func appModels() []interface{} {
+	return []interface{}{&User{}, &Transaction{}, &AppSetting{}, &FeedToken{}, &MagicLink{}, &TransactionEvent{}, &TransferTemplate{}, &Consent{}, &Delegation{}, &DelegatedAccess{}, &RefreshToken{}, &RevokedToken{}, &PasswordReset{}, &VerificationToken{}, &RecoveryCode{}, &APIKey{}, &LoginEvent{}, &PointsLot{}, &IdempotencyRecord{}, &TierLimit{}, &PointRequest{}, &ElevationCode{}, &HeldLot{}, &ElevatedToken{}}
+}
+
 func initDB() {
-	var err error
-	db, err = gorm.Open(sqlite.Open("app.db"), &gorm.Config{})
+	dialector, err := databaseDialector()
+	if err != nil {
+		log.Fatalf("invalid database configuration: %v", err)
+	}
+	db, err = gorm.Open(dialector, &gorm.Config{})
 	if err != nil {
 		log.Fatalf("failed to connect database: %v", err)
 	}
 
-	if err := db.AutoMigrate(&User{}, &Transaction{}); err != nil {
+	if err := db.AutoMigrate(appModels()...); err != nil {
 		log.Fatalf("auto migrate failed: %v", err)
 	}
+	migrateMemberIDIndex()
+	migratePointsLots()
+	seedTierLimits()
+	backfillTransactionEvents()
+	normalizeBuddhistEraBirthdays()
+}
+
+// txHooks collects side effects (notifications, webhooks, business metrics)
+// queued while a transaction is open. They run only after a successful
+// commit and are dropped on rollback, so nothing leaks from a failed write.
+//
+// Mail sent after a single autocommitted insert isn't queued, since there
+// is no transaction to roll back by the time it goes out: the elevation
+// code (elevation.go), magic link (magiclink.go), password reset link
+// (passwordreset.go) and delegation invitation (delegation.go). A failed
+// send is reported to the caller, and the stored token expires unused.
+type txHooks struct {
+	afterCommit []func()
+}
+
+// AfterCommit queues fn to run once the transaction has committed
+func (h *txHooks) AfterCommit(fn func()) {
+	h.afterCommit = append(h.afterCommit, fn)
+}
+
+// withinTx runs fn inside a database transaction and then fires any
+// post-commit hooks fn registered
+func withinTx(fn func(tx *gorm.DB, hooks *txHooks) error) error {
+	hooks := &txHooks{}
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return fn(tx, hooks)
+	}); err != nil {
+		return err
+	}
+	for _, f := range hooks.afterCommit {
+		f()
+	}
+	return nil
 }
 
 func hashPassword(password string) (string, error) {
-	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost())
 	return string(b), err
 }
 
@@ -68,46 +146,143 @@ func checkPasswordHash(password, hash string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 }
 
+// randomToken returns a URL-safe random token for one-off secrets
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken is used to store tokens at rest; unlike passwords they are
+// high-entropy, so a fast hash is enough and allows direct lookups
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// defaultAccessTokenTTL is how long an access token is valid unless JWT_TTL
+// says otherwise; clients renew it with their refresh token
+const defaultAccessTokenTTL = 15 * time.Minute
+
+func accessTokenTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("JWT_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return defaultAccessTokenTTL
+}
+
+// jwtIssuer and jwtAudience are stamped on every token this service mints
+// and required on every token it accepts, so tokens from other services
+// sharing the secret are rejected
+func jwtIssuer() string {
+	if s := os.Getenv("JWT_ISSUER"); s != "" {
+		return s
+	}
+	return "lbk-points"
+}
+
+func jwtAudience() string {
+	if s := os.Getenv("JWT_AUDIENCE"); s != "" {
+		return s
+	}
+	return "lbk-points-api"
+}
+
+// accessClaims are the claims of an access token
+type accessClaims struct {
+	Role string `json:"role"`
+	jwt.RegisteredClaims
+}
+
 func generateJWT(userID uint) (string, error) {
 	secret := jwtSecret()
-	claims := jwt.RegisteredClaims{
-		Subject:   fmt.Sprint(userID),
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
+	jti, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	var role string
+	if err := db.Model(&User{}).Where("id = ?", userID).Select("role").Scan(&role).Error; err != nil {
+		return "", err
+	}
+	claims := accessClaims{
+		Role: role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Issuer:    jwtIssuer(),
+			Subject:   fmt.Sprint(userID),
+			Audience:  jwt.ClaimStrings{jwtAudience()},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenTTL())),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString([]byte(secret))
 }
 
+const (
+	devJWTSecret       = "secret"
+	minJWTSecretLength = 32
+)
+
+var (
+	jwtSecretOnce  sync.Once
+	jwtSecretValue string
+)
+
+// jwtSecret returns JWT_SECRET, read once. Outside development
+// validateConfig refuses to start without a strong one; in development
+// the fallback is used with a warning.
 func jwtSecret() string {
-	if s := os.Getenv("JWT_SECRET"); s != "" {
-		return s
-	}
-	return "secret" // default (override in production)
+	jwtSecretOnce.Do(func() {
+		jwtSecretValue = os.Getenv("JWT_SECRET")
+		if jwtSecretValue == "" {
+			log.Printf("WARNING: JWT_SECRET is not set; signing tokens with the insecure development key %q. Never run like this outside development.", devJWTSecret)
+			jwtSecretValue = devJWTSecret
+		}
+	})
+	return jwtSecretValue
 }
 
 // Middleware to protect routes
 func jwtMiddleware() fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		auth := c.Get("Authorization")
-		if auth == "" {
+		var tokStr string
+		if auth := c.Get("Authorization"); auth != "" {
+			parts := strings.SplitN(auth, " ", 2)
+			if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid authorization header"})
+			}
+			tokStr = parts[1]
+		} else if tokStr = c.Cookies(accessTokenCookie); tokStr != "" {
+			// browsers attach cookies to cross-site requests too, see cookieauth.go
+			if err := checkCSRF(c); err != nil {
+				return writeError(c, err)
+			}
+		} else {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "missing authorization header"})
 		}
-		parts := strings.SplitN(auth, " ", 2)
-		if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid authorization header"})
-		}
-		tokStr := parts[1]
-		var claims jwt.RegisteredClaims
-		tok, err := jwt.ParseWithClaims(tokStr, &claims, func(t *jwt.Token) (interface{}, error) {
+		var access accessClaims
+		tok, err := jwt.ParseWithClaims(tokStr, &access, func(t *jwt.Token) (interface{}, error) {
 			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
 				return nil, fmt.Errorf("unexpected signing method")
 			}
 			return []byte(jwtSecret()), nil
 		})
-		if err != nil || !tok.Valid {
+		claims := access.RegisteredClaims
+		// elevation tokens only accompany an access token, never replace one
+		if err != nil || !tok.Valid || isElevatedClaims(claims) ||
+			!claims.VerifyIssuer(jwtIssuer(), true) || !claims.VerifyAudience(jwtAudience(), true) {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid token"})
 		}
+		revoked, err := isTokenRevoked(claims.ID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to verify token"})
+		}
+		if revoked {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "token revoked"})
+		}
 		// load user
 		userID := claims.Subject
 		var user User
@@ -115,10 +290,28 @@ func jwtMiddleware() fiber.Handler {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "user not found"})
 		}
 		c.Locals("user", user)
+		c.Locals("claims", claims)
+		c.Locals("role", access.Role)
 		return c.Next()
 	}
 }
 
+// normalizeEmail is the form emails are stored and looked up in
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// validateEmail accepts a bare address (no display name) and returns it
+// normalized
+func validateEmail(email string) (string, error) {
+	email = normalizeEmail(email)
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || !strings.Contains(email[strings.LastIndex(email, "@")+1:], ".") {
+		return "", fmt.Errorf("email must be a valid email address")
+	}
+	return email, nil
+}
+
 func registerHandler(c *fiber.Ctx) error {
 	var payload struct {
 		Email     string `json:"email"`
@@ -128,6 +321,9 @@ func registerHandler(c *fiber.Ctx) error {
 		Phone     string `json:"phone"`
 		Birthday  string `json:"birthday"`
 		MemberID  string `json:"member_id"`
+		// optional consents collected on the sign-up screen
+		Consents             map[string]bool `json:"consents"`
+		ConsentPolicyVersion string          `json:"consent_policy_version"`
 	}
 	if err := c.BodyParser(&payload); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
@@ -135,19 +331,49 @@ func registerHandler(c *fiber.Ctx) error {
 	if payload.Email == "" || payload.Password == "" || payload.MemberID == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "email, password and member_id required"})
 	}
+	email, err := validateEmail(payload.Email)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	payload.Email = email
+	if err := validatePassword(payload.Password, payload.Email, payload.MemberID); err != nil {
+		return writeError(c, err)
+	}
+	if payload.Birthday != "" {
+		day, err := parseBirthday(payload.Birthday, time.Now())
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "birthday " + err.Error()})
+		}
+		payload.Birthday = day.Format("2006-01-02")
+	}
+	if len(payload.Consents) > 0 {
+		if payload.ConsentPolicyVersion == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "consent_policy_version required with consents"})
+		}
+		if err := validateConsents(payload.Consents); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
 	// check existing email
 	var existing User
-	if err := db.Where("email = ?", payload.Email).First(&existing).Error; err == nil {
+	// deleted accounts keep theirs unless RELEASE_DELETED_ACCOUNT_IDS cleared them
+	if err := db.Unscoped().Where("LOWER(email) = ?", payload.Email).First(&existing).Error; err == nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "email already registered"})
 	}
 	// check existing member_id
-	if err := db.Where("member_id = ?", payload.MemberID).First(&existing).Error; err == nil {
+	if err := db.Unscoped().Where("member_id = ?", payload.MemberID).First(&existing).Error; err == nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "member_id already registered"})
 	}
 	hash, err := hashPassword(payload.Password)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to hash password"})
 	}
+	// the partner program comes from the partner's own API key, never from
+	// the member, who could otherwise pick one to transfer within
+	var partnerID string
+	if svc, ok := c.Locals("service").(servicePrincipal); ok {
+		partnerID = svc.PartnerID
+	}
 	user := User{
 		Email:      payload.Email,
 		Password:   hash,
@@ -156,35 +382,104 @@ func registerHandler(c *fiber.Ctx) error {
 		Phone:      payload.Phone,
 		Birthday:   payload.Birthday,
 		MemberID:   payload.MemberID,
+		PartnerID:  partnerID,
 		MemberTier: "Gold", // default tier
 		Points:     15420,  // default points like in screenshot
 	}
-	if err := db.Create(&user).Error; err != nil {
+	err = withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		if err := openPointsLot(tx, user.ID, user.Points); err != nil {
+			return err
+		}
+		if err := queueVerificationEmail(tx, hooks, c, user); err != nil {
+			return err
+		}
+		return recordConsents(tx, user.ID, payload.Consents, payload.ConsentPolicyVersion)
+	})
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create user"})
 	}
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"id": user.ID, "email": user.Email, "member_id": user.MemberID})
 }
 
+// findUserByIdentifier resolves a login identifier, trying an exact
+// member_id first, then email, then phone compared digits-only (0 and +66
+// prefixes are equivalent). A phone shared by several accounts matches none.
+func findUserByIdentifier(identifier string) (User, error) {
+	var user User
+	identifier = strings.TrimSpace(identifier)
+	if identifier == "" {
+		return user, gorm.ErrRecordNotFound
+	}
+	if err := db.Where("member_id = ?", identifier).First(&user).Error; err == nil {
+		return user, nil
+	}
+	if err := db.Where("LOWER(email) = ?", normalizeEmail(identifier)).First(&user).Error; err == nil {
+		return user, nil
+	}
+
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, identifier)
+	if len(digits) < 9 {
+		return user, gorm.ErrRecordNotFound
+	}
+	forms := []string{digits}
+	if strings.HasPrefix(digits, "0") {
+		forms = append(forms, "66"+digits[1:])
+	} else if strings.HasPrefix(digits, "66") {
+		forms = append(forms, "0"+digits[2:])
+	}
+	var matches []User
+	if err := db.Where("REPLACE(REPLACE(REPLACE(phone, '-', ''), ' ', ''), '+', '') IN ?", forms).
+		Limit(2).Find(&matches).Error; err != nil {
+		return user, err
+	}
+	if len(matches) != 1 {
+		return user, gorm.ErrRecordNotFound
+	}
+	return matches[0], nil
+}
+
 func loginHandler(c *fiber.Ctx) error {
 	var payload struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		// Identifier is an email, member ID or phone number; Email is the
+		// original field and still accepted
+		Identifier string `json:"identifier"`
+		Email      string `json:"email"`
+		Password   string `json:"password"`
 	}
 	if err := c.BodyParser(&payload); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
 	}
 	var user User
-	if err := db.Where("email = ?", payload.Email).First(&user).Error; err != nil {
+	if payload.Identifier != "" {
+		found, err := findUserByIdentifier(payload.Identifier)
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid credentials"})
+		}
+		user = found
+	} else if err := db.Where("LOWER(email) = ?", normalizeEmail(payload.Email)).First(&user).Error; err != nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid credentials"})
 	}
 	if err := checkPasswordHash(payload.Password, user.Password); err != nil {
+		recordLogin(c, user.ID, loginMethodPassword, "invalid_password")
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid credentials"})
 	}
-	token, err := generateJWT(user.ID)
+	// done before answering so the upgrade can't be lost to a shutdown;
+	// it only costs a slower login once per user after BCRYPT_COST rises
+	upgradePasswordHash(user.ID, payload.Password, user.Password)
+	tokens, err := loginResponse(user)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate token"})
 	}
-	return c.JSON(fiber.Map{"token": token})
+	recordLogin(c, user.ID, loginMethodPassword, loginOutcome(tokens))
+	return sendLoginTokens(c, tokens)
 }
 
 func meHandler(c *fiber.Ctx) error {
@@ -195,155 +490,130 @@ func meHandler(c *fiber.Ctx) error {
 	user := u.(User)
 	// don't return password
 	user.Password = ""
-	return c.JSON(user)
-}
-
-// Transfer points handler
-func transferHandler(c *fiber.Ctx) error {
-	u := c.Locals("user")
-	if u == nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
-	}
-	fromUser := u.(User)
-
-	var payload struct {
-		ToMemberID string `json:"to_member_id"`
-		Amount     int64  `json:"amount"`
-	}
-	if err := c.BodyParser(&payload); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
-	}
-
-	if payload.ToMemberID == "" || payload.Amount <= 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "to_member_id and positive amount required"})
-	}
-
-	if payload.ToMemberID == fromUser.MemberID {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot transfer to yourself"})
-	}
-
-	// Check if sender has enough points
-	if fromUser.Points < payload.Amount {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "insufficient points"})
+	fields, err := parseFields(c, structFields(user))
+	if err != nil {
+		return writeError(c, err)
 	}
-
-	// Find recipient by member ID
-	var toUser User
-	if err := db.Where("member_id = ?", payload.ToMemberID).First(&toUser).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "recipient not found"})
+	resp, err := selectFields(user, fields)
+	if err != nil {
+		return writeError(c, err)
 	}
-
-	// Start transaction
-	tx := db.Begin()
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
-		}
-	}()
-
-	// Deduct points from sender
-	if err := tx.Model(&fromUser).Update("points", fromUser.Points-payload.Amount).Error; err != nil {
-		tx.Rollback()
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to deduct points"})
-	}
-
-	// Add points to recipient
-	if err := tx.Model(&toUser).Update("points", toUser.Points+payload.Amount).Error; err != nil {
-		tx.Rollback()
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to add points"})
-	}
-
-	// Create transaction record
-	transaction := Transaction{
-		FromUserID:  fromUser.ID,
-		ToUserID:    toUser.ID,
-		Amount:      payload.Amount,
-		Type:        "transfer",
-		Status:      "completed",
-		Description: fmt.Sprintf("Transfer to %s %s", toUser.FirstName, toUser.LastName),
-	}
-	if err := tx.Create(&transaction).Error; err != nil {
-		tx.Rollback()
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create transaction record"})
-	}
-
-	// Commit transaction
-	if err := tx.Commit().Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to complete transfer"})
-	}
-
-	// Return success response with updated balance
-	updatedFromUser := fromUser
-	updatedFromUser.Points -= payload.Amount
-	
-	return c.JSON(fiber.Map{
-		"message":           "Transfer successful",
-		"transaction_id":    transaction.ID,
-		"remaining_points":  updatedFromUser.Points,
-		"transferred_amount": payload.Amount,
-		"recipient":         fiber.Map{
-			"member_id":  toUser.MemberID,
-			"first_name": toUser.FirstName,
-			"last_name":  toUser.LastName,
-		},
-	})
+	return sendFields(c, fields, resp)
 }
 
-// Get recent transactions for current user
+// Get the current user's transactions, newest first, a page at a time,
+// optionally limited to a from/to date range
 func recentTransactionsHandler(c *fiber.Ctx) error {
 	u := c.Locals("user")
 	if u == nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
 	}
 	user := u.(User)
+	fields, err := parseFields(c, transactionFields)
+	if err != nil {
+		return writeError(c, err)
+	}
+	page, err := parsePagination(c)
+	if err != nil {
+		return writeError(c, err)
+	}
+	period, err := parseDateRange(c)
+	if err != nil {
+		return writeError(c, err)
+	}
 
+	mine := period.Apply(db.Model(&Transaction{}).Where("from_user_id = ? OR to_user_id = ?", user.ID, user.ID))
+	var total int64
+	if err := mine.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to fetch transactions"})
+	}
 	var transactions []Transaction
-	if err := db.Where("from_user_id = ? OR to_user_id = ?", user.ID, user.ID).
-		Preload("FromUser").
-		Preload("ToUser").
-		Order("created_at DESC").
-		Limit(10).
+	if err := mine.Session(&gorm.Session{}).
+		Preload("FromUser", withDeleted).
+		Preload("ToUser", withDeleted).
+		Order("created_at DESC, id DESC").
+		Limit(page.PageSize).
+		Offset(page.Offset()).
 		Find(&transactions).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to fetch transactions"})
 	}
 
 	// Format transactions for response
-	var formattedTx []fiber.Map
+	formattedTx := make([]interface{}, 0, len(transactions))
 	for _, tx := range transactions {
-		var contactName, contactMemberID, txType string
-		var amount int64
-
-		if tx.FromUserID == user.ID {
-			// User sent money
-			contactName = fmt.Sprintf("%s %s", tx.ToUser.FirstName, tx.ToUser.LastName)
-			contactMemberID = tx.ToUser.MemberID
-			txType = "sent"
-			amount = -tx.Amount // negative for sent
-		} else {
-			// User received money
-			contactName = fmt.Sprintf("%s %s", tx.FromUser.FirstName, tx.FromUser.LastName)
-			contactMemberID = tx.FromUser.MemberID
-			txType = "received"
-			amount = tx.Amount // positive for received
+		view, err := selectFields(formatTransaction(tx, user.ID), fields)
+		if err != nil {
+			return writeError(c, err)
 		}
-
-		formattedTx = append(formattedTx, fiber.Map{
-			"id":               tx.ID,
-			"contact_name":     contactName,
-			"contact_member_id": contactMemberID,
-			"amount":           amount,
-			"type":             txType,
-			"status":           tx.Status,
-			"date":             tx.CreatedAt.Format("2006-01-02"),
-			"time":             tx.CreatedAt.Format("15:04"),
-		})
+		formattedTx = append(formattedTx, view)
 	}
 
-	return c.JSON(fiber.Map{
+	return sendFields(c, fields, fiber.Map{
 		"transactions": formattedTx,
+		"pagination":   page.Meta(total),
 	})
 }
 
+// transactionView is a transaction as one of its parties sees it
+type transactionView struct {
+	ID              uint   `json:"id"`
+	ContactName     string `json:"contact_name"`
+	ContactMemberID string `json:"contact_member_id"`
+	Amount          int64  `json:"amount"` // negative when sent
+	Type            string `json:"type"`   // sent, received, adjustment or expiry
+	Status          string `json:"status"`
+	AcceptRequired  bool   `json:"accept_required"`
+	Note            string `json:"note"`
+	ReversalOf      *uint  `json:"reversal_of"`
+	BalanceAfter    *int64 `json:"balance_after"` // the viewer's balance
+	Date            string `json:"date"`
+	Time            string `json:"time"`
+}
+
+// formatTransaction renders a transaction from the point of view of userID
+func formatTransaction(tx Transaction, userID uint) transactionView {
+	var contactName, contactMemberID, txType string
+	var amount int64
+	var balanceAfter *int64
+
+	if tx.Type == transactionTypeAdjustment || tx.Type == transactionTypeExpiry {
+		// made by the program, amount is already signed
+		contactName = "LBK Points"
+		txType = tx.Type
+		amount = tx.Amount
+		balanceAfter = tx.ToBalanceAfter
+	} else if tx.FromUserID == userID {
+		// User sent money
+		contactName = fmt.Sprintf("%s %s", tx.ToUser.FirstName, tx.ToUser.LastName)
+		contactMemberID = tx.ToUser.MemberID
+		txType = "sent"
+		amount = -tx.Amount // negative for sent
+		balanceAfter = tx.FromBalanceAfter
+	} else {
+		// User received money
+		contactName = fmt.Sprintf("%s %s", tx.FromUser.FirstName, tx.FromUser.LastName)
+		contactMemberID = tx.FromUser.MemberID
+		txType = "received"
+		amount = tx.Amount // positive for received
+		balanceAfter = tx.ToBalanceAfter
+	}
+
+	return transactionView{
+		ID:              tx.ID,
+		ContactName:     contactName,
+		ContactMemberID: contactMemberID,
+		Amount:          amount,
+		Type:            txType,
+		Status:          tx.Status,
+		AcceptRequired:  tx.AcceptRequired,
+		Note:            tx.Note,
+		ReversalOf:      tx.ReversalOf,
+		BalanceAfter:    balanceAfter,
+		Date:            tx.CreatedAt.Format("2006-01-02"),
+		Time:            tx.CreatedAt.Format("15:04"),
+	}
+}
+
 // Search user by member ID for transfer
 func searchUserHandler(c *fiber.Ctx) error {
 	memberID := c.Query("member_id")
@@ -361,164 +631,42 @@ func searchUserHandler(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot search for yourself"})
 	}
 
+	// scope to the requester's partner program by default
+	query := db.Where("member_id = ?", memberID)
+	if !allowCrossPartner() {
+		query = query.Where("partner_id = ?", currentUser.PartnerID)
+	}
 	var user User
-	if err := db.Where("member_id = ?", memberID).First(&user).Error; err != nil {
+	if err := query.First(&user).Error; err != nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user not found"})
 	}
 
-	return c.JSON(fiber.Map{
+	result := fiber.Map{
 		"member_id":   user.MemberID,
 		"first_name":  user.FirstName,
 		"last_name":   user.LastName,
 		"member_tier": user.MemberTier,
-	})
+		"eligible":    true,
+	}
+	// reason is the code /transfer would answer with, so the app can disable
+	// the transfer button and say why
+	if err := transferEligibility(currentUser, user); err != nil {
+		code := errorCode(err)
+		if code == "" {
+			return writeError(c, err)
+		}
+		result["eligible"], result["reason"] = false, code
+	}
+	return c.JSON(result)
 }
 
 // Serve minimal OpenAPI JSON and Swagger UI
 func swaggerJSON(c *fiber.Ctx) error {
-	op := map[string]interface{}{
-		"openapi": "3.0.0",
-		"info": map[string]interface{}{
-			"title":   "LBK Points Transfer API",
-			"version": "1.0.0",
-			"description": "API for LBK member points transfer system",
-		},
-		"paths": map[string]interface{}{
-			"/register": map[string]interface{}{
-				"post": map[string]interface{}{
-					"summary": "Register user",
-					"requestBody": map[string]interface{}{
-						"required": true,
-						"content": map[string]interface{}{
-							"application/json": map[string]interface{}{
-								"schema": map[string]interface{}{
-									"type": "object",
-									"required": []string{"email", "password", "member_id"},
-									"properties": map[string]interface{}{
-										"email":      map[string]interface{}{"type": "string"},
-										"password":   map[string]interface{}{"type": "string"},
-										"first_name": map[string]interface{}{"type": "string"},
-										"last_name":  map[string]interface{}{"type": "string"},
-										"phone":      map[string]interface{}{"type": "string"},
-										"birthday":   map[string]interface{}{"type": "string"},
-										"member_id":  map[string]interface{}{"type": "string"},
-									},
-								},
-							},
-						},
-					},
-					"responses": map[string]interface{}{
-						"201": map[string]interface{}{"description": "User created successfully"},
-						"400": map[string]interface{}{"description": "Bad request"},
-					},
-				},
-			},
-			"/login": map[string]interface{}{
-				"post": map[string]interface{}{
-					"summary": "Login user",
-					"requestBody": map[string]interface{}{
-						"required": true,
-						"content": map[string]interface{}{
-							"application/json": map[string]interface{}{
-								"schema": map[string]interface{}{
-									"type": "object",
-									"required": []string{"email", "password"},
-									"properties": map[string]interface{}{
-										"email":    map[string]interface{}{"type": "string"},
-										"password": map[string]interface{}{"type": "string"},
-									},
-								},
-							},
-						},
-					},
-					"responses": map[string]interface{}{
-						"200": map[string]interface{}{"description": "Login successful"},
-						"401": map[string]interface{}{"description": "Invalid credentials"},
-					},
-				},
-			},
-			"/me": map[string]interface{}{
-				"get": map[string]interface{}{
-					"summary":   "Get current user profile",
-					"security":  []map[string][]string{{"bearerAuth": {}}},
-					"responses": map[string]interface{}{
-						"200": map[string]interface{}{"description": "User profile"},
-						"401": map[string]interface{}{"description": "Unauthorized"},
-					},
-				},
-			},
-			"/transfer": map[string]interface{}{
-				"post": map[string]interface{}{
-					"summary": "Transfer points to another user",
-					"security": []map[string][]string{{"bearerAuth": {}}},
-					"requestBody": map[string]interface{}{
-						"required": true,
-						"content": map[string]interface{}{
-							"application/json": map[string]interface{}{
-								"schema": map[string]interface{}{
-									"type": "object",
-									"required": []string{"to_member_id", "amount"},
-									"properties": map[string]interface{}{
-										"to_member_id": map[string]interface{}{"type": "string"},
-										"amount":       map[string]interface{}{"type": "integer"},
-									},
-								},
-							},
-						},
-					},
-					"responses": map[string]interface{}{
-						"200": map[string]interface{}{"description": "Transfer successful"},
-						"400": map[string]interface{}{"description": "Bad request"},
-						"401": map[string]interface{}{"description": "Unauthorized"},
-					},
-				},
-			},
-			"/transactions/recent": map[string]interface{}{
-				"get": map[string]interface{}{
-					"summary":   "Get recent transactions",
-					"security":  []map[string][]string{{"bearerAuth": {}}},
-					"responses": map[string]interface{}{
-						"200": map[string]interface{}{"description": "Recent transactions"},
-						"401": map[string]interface{}{"description": "Unauthorized"},
-					},
-				},
-			},
-			"/search/user": map[string]interface{}{
-				"get": map[string]interface{}{
-					"summary":   "Search user by member ID",
-					"security":  []map[string][]string{{"bearerAuth": {}}},
-					"parameters": []map[string]interface{}{
-						{
-							"name":        "member_id",
-							"in":          "query",
-							"required":    true,
-							"description": "LBK Member ID to search for",
-							"schema":      map[string]interface{}{"type": "string"},
-						},
-					},
-					"responses": map[string]interface{}{
-						"200": map[string]interface{}{"description": "User found"},
-						"404": map[string]interface{}{"description": "User not found"},
-						"401": map[string]interface{}{"description": "Unauthorized"},
-					},
-				},
-			},
-		},
-		"components": map[string]interface{}{
-			"securitySchemes": map[string]interface{}{
-				"bearerAuth": map[string]interface{}{
-					"type":         "http",
-					"scheme":       "bearer",
-					"bearerFormat": "JWT",
-				},
-			},
-		},
-	}
-	return c.JSON(op)
+	return c.JSON(swaggerDoc(externalURL(c, "")))
 }
 
 func swaggerUI(c *fiber.Ctx) error {
-	html := `<!doctype html>
+	html := strings.Replace(`<!doctype html>
 <html>
   <head>
     <meta charset="utf-8" />
@@ -530,43 +678,53 @@ func swaggerUI(c *fiber.Ctx) error {
     <script src="https://cdnjs.cloudflare.com/ajax/libs/swagger-ui/4.18.3/swagger-ui-bundle.min.js"></script>
     <script>
       window.ui = SwaggerUIBundle({
-        url: '/swagger/doc.json',
+        url: '{{BASE_PATH}}/swagger/doc.json',
         dom_id: '#swagger-ui'
       })
     </script>
   </body>
-</html>`
+</html>`, "{{BASE_PATH}}", basePath(), 1)
 	c.Set("Content-Type", "text/html")
 	return c.SendString(html)
 }
 
 func main() {
+	if err := validateConfig(); err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
 	initDB()
-	app := fiber.New()
-
-	// basic endpoints
-	app.Get("/", func(c *fiber.Ctx) error {
-		return c.JSON(fiber.Map{"message": "Hello World"})
-	})
-
-	api := app.Group("/")
-	api.Post("/register", registerHandler)
-	api.Post("/login", loginHandler)
-	api.Get("/me", jwtMiddleware(), meHandler)
-
-	// Transfer and transaction endpoints
-	api.Post("/transfer", jwtMiddleware(), transferHandler)
-	api.Get("/transactions/recent", jwtMiddleware(), recentTransactionsHandler)
-	api.Get("/search/user", jwtMiddleware(), searchUserHandler)
-
-	// swagger
-	app.Get("/swagger/doc.json", swaggerJSON)
-	app.Get("/swagger", swaggerUI)
+	jwtSecret() // load now so a development fallback warns at startup
+	initIPHashing()
+	watchAdmissionLimits()
+	startRevokedTokenCleanup()
+	startPendingTransferExpiry()
+	startHeldTransferExpiry()
+	startPointRequestExpiry()
+	startPointsExpiry()
+	startIdempotencyCleanup()
+	startInvariantChecks()
+	app := fiber.New(fiberConfig())
+	app.Use(requestLogger(newRequestLogger()))
+
+	// everything is mounted under BASE_PATH (empty by default)
+	api := app.Group(basePath())
+
+	routes := appRoutes()
+	if err := validateRoutes(routes, operationDocs()); err != nil {
+		log.Fatalf("invalid route table: %v", err)
+	}
+	mountRoutes(api, routes)
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "3000"
 	}
+	if cert := os.Getenv("TLS_CERT_FILE"); cert != "" {
+		log.Fatal(app.ListenTLS(":"+port, cert, os.Getenv("TLS_KEY_FILE")))
+	}
 	log.Fatal(app.Listen(":" + port))
 }
 
@@ -578,17 +736,17 @@ curl http://localhost:3000/
 
 # Register a new user
 curl -X POST -H "Content-Type: application/json" \
-  -d '{"email":"test@example.com","password":"password123","first_name":"สมชาย","last_name":"ใจดี","phone":"081-234-5678","birthday":"1990-01-01","member_id":"LBK001234"}' \
+  -d '{"email":"test@example.com","password":"Sunflower2024","first_name":"สมชาย","last_name":"ใจดี","phone":"081-234-5678","birthday":"1990-01-01","member_id":"LBK001234"}' \
   http://localhost:3000/register
 
 # Register another user for testing transfers
 curl -X POST -H "Content-Type: application/json" \
-  -d '{"email":"test2@example.com","password":"password123","first_name":"นางสาว","last_name":"สวยงาม","phone":"081-234-5679","birthday":"1992-05-15","member_id":"LBK002345"}' \
+  -d '{"email":"test2@example.com","password":"Sunflower2024","first_name":"นางสาว","last_name":"สวยงาม","phone":"081-234-5679","birthday":"1992-05-15","member_id":"LBK002345"}' \
   http://localhost:3000/register
 
 # Login
 curl -X POST -H "Content-Type: application/json" \
-  -d '{"email":"test@example.com","password":"password123"}' \
+  -d '{"email":"test@example.com","password":"Sunflower2024"}' \
   http://localhost:3000/login
 
 # Get current user profile
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// The tests share one in-memory sqlite database, migrated once by TestMain
+// and emptied by resetDB at the start of each test that touches it.
+
+const (
+	testPassword = "Sunflower2024"
+	testPin      = "123456"
+)
+
+func TestMain(m *testing.M) {
+	os.Setenv("BCRYPT_COST", "4")
+	os.Setenv("DB_DRIVER", driverSQLite)
+	os.Setenv("DATABASE_URL", "file:lbktest?mode=memory&cache=shared")
+	os.Setenv("JWT_SECRET", "test-secret-that-is-at-least-32-characters")
+	log.SetOutput(io.Discard)
+	initDB()
+	// shared-cache memory databases report "table is locked" instead of
+	// waiting, so the tests serialize on a single connection
+	sqlDB, err := db.DB()
+	if err != nil {
+		log.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	os.Exit(m.Run())
+}
+
+// resetDB empties every table and reseeds the defaults initDB writes
+func resetDB(t testing.TB) {
+	t.Helper()
+	for _, model := range appModels() {
+		if err := db.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(model).Error; err != nil {
+			t.Fatalf("reset %T: %v", model, err)
+		}
+	}
+	seedTierLimits()
+}
+
+// newTestApp builds the app the way main does, without listening
+func newTestApp(t testing.TB) *fiber.App {
+	t.Helper()
+	app := fiber.New(fiberConfig())
+	routes := appRoutes()
+	if err := validateRoutes(routes, operationDocs()); err != nil {
+		t.Fatalf("invalid route table: %v", err)
+	}
+	mountRoutes(app.Group(basePath()), routes)
+	return app
+}
+
+var testMemberSeq int64
+
+// createUser stores a verified member with a password, a PIN and points
+func createUser(t testing.TB, points int64) User {
+	t.Helper()
+	n := atomic.AddInt64(&testMemberSeq, 1)
+	password, err := hashPassword(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin, err := hashPassword(testPin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := User{
+		Email:         fmt.Sprintf("member%d@example.com", n),
+		Password:      password,
+		FirstName:     "Test",
+		LastName:      fmt.Sprint(n),
+		MemberID:      fmt.Sprintf("LBK%06d", n),
+		MemberTier:    "Gold",
+		Points:        points,
+		EmailVerified: true,
+		PinHash:       pin,
+	}
+	err = withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		return openPointsLot(tx, user.ID, user.Points)
+	})
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	return user
+}
+
+// reloadUser reads user back from the database
+func reloadUser(t *testing.T, user User) User {
+	t.Helper()
+	var fresh User
+	if err := db.First(&fresh, user.ID).Error; err != nil {
+		t.Fatalf("reload user %d: %v", user.ID, err)
+	}
+	return fresh
+}
+
+// tokenFor mints an access token for user
+func tokenFor(t testing.TB, user User) string {
+	t.Helper()
+	token, err := generateJWT(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// elevatedTokenFor mints an elevation token for user
+func elevatedTokenFor(t *testing.T, user User) string {
+	t.Helper()
+	token, _, err := generateElevatedToken(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// doJSON sends body as JSON with an optional bearer token and returns the
+// status and decoded response. Extra headers are given as name, value pairs.
+func doJSON(t testing.TB, app *fiber.App, method, path, token string, body interface{}, headers ...string) (int, map[string]interface{}) {
+	t.Helper()
+	resp := doRequest(t, app, method, path, token, body, headers...)
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := map[string]interface{}{}
+	if len(raw) > 0 && json.Unmarshal(raw, &out) != nil {
+		out["_raw"] = string(raw)
+	}
+	return resp.StatusCode, out
+}
+
+// doRequest is doJSON returning the raw response
+func doRequest(t testing.TB, app *fiber.App, method, path, token string, body interface{}, headers ...string) *http.Response {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return resp
+}
+
+// errorCodeOf returns the code field of an error response
+func errorCodeOf(body map[string]interface{}) string {
+	code, _ := body["code"].(string)
+	return code
+}
+
+// captureMailer records sent mail instead of logging it
+type captureMailer struct {
+	mu   sync.Mutex
+	sent []sentMail
+}
+
+type sentMail struct {
+	To, Subject, Body string
+}
+
+func (m *captureMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, sentMail{To: to, Subject: subject, Body: body})
+	return nil
+}
+
+// useCaptureMailer swaps the mailer for the duration of the test
+func useCaptureMailer(t *testing.T) *captureMailer {
+	t.Helper()
+	capture := &captureMailer{}
+	previous := mailer
+	mailer = capture
+	t.Cleanup(func() { mailer = previous })
+	return capture
+}
+
+func TestHarnessTransfer(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	alice := createUser(t, 1000)
+	bob := createUser(t, 0)
+
+	status, body := doJSON(t, app, fiber.MethodPost, "/transfer", tokenFor(t, alice),
+		fiber.Map{"to_member_id": bob.MemberID, "amount": 100, "pin": testPin})
+	if status != fiber.StatusOK {
+		t.Fatalf("transfer: status %d, body %v", status, body)
+	}
+	if got := reloadUser(t, alice).Points; got != 900 {
+		t.Errorf("sender balance = %d, want 900", got)
+	}
+	if got := reloadUser(t, bob).Points; got != 100 {
+		t.Errorf("recipient balance = %d, want 100", got)
+	}
+}
+
+// assertInvariants fails the test for any registered invariant with violations
+func assertInvariants(t *testing.T) {
+	t.Helper()
+	for name, count := range runInvariants() {
+		if count > 0 {
+			t.Errorf("invariant %s violated by %d rows", name, count)
+		}
+	}
+}
+
+func TestWithinTxRunsHooksOnlyAfterCommit(t *testing.T) {
+	resetDB(t)
+	boom := errors.New("boom")
+
+	var ran []string
+	err := withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		if err := tx.Create(&AppSetting{Key: "rolled_back", Value: "1"}).Error; err != nil {
+			return err
+		}
+		hooks.AfterCommit(func() { ran = append(ran, "rolled back") })
+		return boom
+	})
+	if !errors.Is(err, boom) || len(ran) != 0 {
+		t.Errorf("failed transaction: err %v, hooks run %v", err, ran)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("panic was swallowed")
+			}
+		}()
+		withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+			hooks.AfterCommit(func() { ran = append(ran, "panicked") })
+			panic("boom")
+		})
+	}()
+	if len(ran) != 0 {
+		t.Errorf("hooks run after a panic: %v", ran)
+	}
+	var leaked int64
+	db.Model(&AppSetting{}).Where("key = ?", "rolled_back").Count(&leaked)
+	if leaked != 0 {
+		t.Error("rolled back row was stored")
+	}
+
+	err = withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		hooks.AfterCommit(func() {
+			// the hook sees the committed row
+			var stored int64
+			db.Model(&AppSetting{}).Where("key = ?", "committed").Count(&stored)
+			ran = append(ran, fmt.Sprint("first ", stored))
+		})
+		hooks.AfterCommit(func() { ran = append(ran, "second") })
+		return tx.Create(&AppSetting{Key: "committed", Value: "1"}).Error
+	})
+	if err != nil || fmt.Sprint(ran) != "[first 1 second]" {
+		t.Errorf("committed transaction: err %v, hooks run %v", err, ran)
+	}
+}
+
+// A sign-up queues its verification email, then fails to store the
+// consents; neither the email nor anything the sign-up wrote may survive
+func TestRegisterRollbackSendsNoEmail(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	mail := useCaptureMailer(t)
+	if err := db.Exec("CREATE TRIGGER fail_consents BEFORE INSERT ON consents BEGIN SELECT RAISE(ABORT, 'injected'); END").Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec("DROP TRIGGER fail_consents") })
+
+	status, body := doJSON(t, app, fiber.MethodPost, "/register", "", fiber.Map{
+		"email":                  "rollback@example.com",
+		"password":               testPassword,
+		"member_id":              "LBK800001",
+		"consents":               map[string]bool{"analytics": true},
+		"consent_policy_version": "1",
+	})
+	if status != fiber.StatusInternalServerError {
+		t.Fatalf("status %d, body %v", status, body)
+	}
+	if len(mail.sent) != 0 {
+		t.Errorf("sent %+v after the rollback", mail.sent)
+	}
+	for _, model := range []interface{}{&User{}, &VerificationToken{}, &PointsLot{}, &Consent{}} {
+		var n int64
+		db.Model(model).Count(&n)
+		if n != 0 {
+			t.Errorf("%d %T rows survived the rollback", n, model)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Sign in with Google uses the OAuth2 authorization-code flow. The callback
+// matches the Google account to a user by subject ID, then by verified
+// email, and creates one otherwise. Users created this way have no password
+// and no member ID; they claim a member ID with POST /me/member-id before
+// they can transfer.
+const (
+	googleStateCookie = "google_oauth_state"
+	googleStateTTL    = 10 * time.Minute
+)
+
+// Google endpoints, variables so they can be pointed at a stub
+var (
+	googleAuthURL     = "https://accounts.google.com/o/oauth2/v2/auth"
+	googleTokenURL    = "https://oauth2.googleapis.com/token"
+	googleUserInfoURL = "https://openidconnect.googleapis.com/v1/userinfo"
+)
+
+var googleHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// googleUser is the part of the OpenID Connect userinfo response we use
+type googleUser struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+}
+
+// googleConfigured reports whether GOOGLE_CLIENT_ID and GOOGLE_CLIENT_SECRET
+// are set (validateConfig requires both or neither)
+func googleConfigured() bool {
+	return os.Getenv("GOOGLE_CLIENT_ID") != ""
+}
+
+func googleRedirectURL(c *fiber.Ctx) string {
+	return externalURL(c, "/auth/google/callback")
+}
+
+// Redirect to Google's consent screen
+func googleLoginHandler(c *fiber.Ctx) error {
+	if !googleConfigured() {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "google sign-in is not configured"})
+	}
+	state, err := randomToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to start google sign-in"})
+	}
+	// the state round-trips through Google and must come back to the same
+	// browser, which stops a third party from completing a login for it
+	c.Cookie(&fiber.Cookie{
+		Name:     googleStateCookie,
+		Value:    state,
+		Path:     basePath() + "/auth/google",
+		MaxAge:   int(googleStateTTL.Seconds()),
+		Secure:   secureCookies(c),
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+	q := url.Values{
+		"client_id":     {os.Getenv("GOOGLE_CLIENT_ID")},
+		"redirect_uri":  {googleRedirectURL(c)},
+		"response_type": {"code"},
+		"scope":         {"openid email profile"},
+		"state":         {state},
+	}
+	return c.Redirect(googleAuthURL+"?"+q.Encode(), fiber.StatusFound)
+}
+
+// Finish Google sign-in: exchange the code, find or create the user and
+// issue the same tokens as POST /login
+func googleCallbackHandler(c *fiber.Ctx) error {
+	if !googleConfigured() {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "google sign-in is not configured"})
+	}
+	state := c.Cookies(googleStateCookie)
+	c.ClearCookie(googleStateCookie)
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(c.Query("state"))) != 1 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid or expired sign-in state"})
+	}
+	if e := c.Query("error"); e != "" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "google sign-in failed: " + e})
+	}
+	code := c.Query("code")
+	if code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "code required"})
+	}
+
+	profile, err := fetchGoogleUser(code, googleRedirectURL(c))
+	if err != nil {
+		log.Printf("google sign-in: %v", err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "failed to verify google account"})
+	}
+	user, err := findOrCreateGoogleUser(profile)
+	if err != nil {
+		return writeError(c, err)
+	}
+	tokens, err := loginResponse(user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate token"})
+	}
+	recordLogin(c, user.ID, loginMethodGoogle, loginOutcome(tokens))
+	tokens["needs_member_id"] = user.MemberID == ""
+	return sendLoginTokens(c, tokens)
+}
+
+// fetchGoogleUser exchanges an authorization code and reads the account's
+// profile with the resulting access token
+func fetchGoogleUser(code, redirectURL string) (googleUser, error) {
+	var profile googleUser
+	resp, err := googleHTTPClient.PostForm(googleTokenURL, url.Values{
+		"code":          {code},
+		"client_id":     {os.Getenv("GOOGLE_CLIENT_ID")},
+		"client_secret": {os.Getenv("GOOGLE_CLIENT_SECRET")},
+		"redirect_uri":  {redirectURL},
+		"grant_type":    {"authorization_code"},
+	})
+	if err != nil {
+		return profile, fmt.Errorf("exchange code: %w", err)
+	}
+	defer resp.Body.Close()
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		return profile, fmt.Errorf("exchange code: status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil || token.AccessToken == "" {
+		return profile, fmt.Errorf("exchange code: no access token in response")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, googleUserInfoURL, nil)
+	if err != nil {
+		return profile, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	info, err := googleHTTPClient.Do(req)
+	if err != nil {
+		return profile, fmt.Errorf("fetch userinfo: %w", err)
+	}
+	defer info.Body.Close()
+	if info.StatusCode != http.StatusOK {
+		return profile, fmt.Errorf("fetch userinfo: status %d", info.StatusCode)
+	}
+	if err := json.NewDecoder(info.Body).Decode(&profile); err != nil || profile.Subject == "" {
+		return profile, fmt.Errorf("fetch userinfo: malformed response")
+	}
+	return profile, nil
+}
+
+// findOrCreateGoogleUser resolves a Google account to a user. The subject
+// ID is stable across email changes, so it's tried first; an email match
+// links the account on first use, but only to an account that has already
+// verified the address: anyone can register an unverified account under a
+// victim's email and wait for them to sign in with Google. Unverified
+// Google emails never match or create an account.
+func findOrCreateGoogleUser(profile googleUser) (User, error) {
+	var user User
+	err := db.Where("google_subject = ?", profile.Subject).First(&user).Error
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return user, fmt.Errorf("find google user: %w", err)
+	}
+	if !profile.EmailVerified {
+		return user, ErrGoogleEmailUnverified
+	}
+	email := normalizeEmail(profile.Email)
+	err = db.Unscoped().Where("LOWER(email) = ?", email).First(&user).Error
+	switch {
+	case err == nil && user.DeletedAt.Valid:
+		// the address is still reserved by a deleted account
+		return user, ErrAccountDeleted
+	case err == nil:
+		if user.GoogleSubject != nil {
+			// the address belongs to a user already linked to another Google account
+			return user, ErrGoogleAccountConflict
+		}
+		if !user.EmailVerified {
+			// whoever registered it never proved they own the address
+			return user, ErrGoogleLinkUnverified
+		}
+		subject := profile.Subject
+		if err := db.Model(&User{}).Where("id = ? AND google_subject IS NULL", user.ID).
+			Update("google_subject", subject).Error; err != nil {
+			return user, fmt.Errorf("link google account to user %d: %w", user.ID, err)
+		}
+		user.GoogleSubject = &subject
+		log.Printf("audit: google account linked user=%d", user.ID)
+		return user, nil
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return user, fmt.Errorf("find user by email: %w", err)
+	}
+
+	subject := profile.Subject
+	user = User{
+		Email:         email,
+		FirstName:     profile.GivenName,
+		LastName:      profile.FamilyName,
+		GoogleSubject: &subject,
+		EmailVerified: true,   // Google has verified it
+		MemberTier:    "Gold", // same defaults as registerHandler
+		Points:        15420,
+	}
+	err = withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		return openPointsLot(tx, user.ID, user.Points)
+	})
+	if err != nil {
+		return user, fmt.Errorf("create google user: %w", err)
+	}
+	return user, nil
+}
+
+// Claim a member ID; users who signed in with Google start without one
+func claimMemberIDHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+	var payload struct {
+		MemberID string `json:"member_id"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	memberID := strings.TrimSpace(payload.MemberID)
+	if memberID == "" {
+		return writeError(c, &ValidationError{Message: "member_id required", Fields: map[string]string{"member_id": "required"}})
+	}
+	if user.MemberID != "" {
+		return writeError(c, ErrMemberIDAlreadySet)
+	}
+	var taken int64
+	if err := db.Unscoped().Model(&User{}).Where("member_id = ?", memberID).Count(&taken).Error; err != nil {
+		return writeError(c, fmt.Errorf("check member_id: %w", err))
+	}
+	if taken > 0 {
+		return writeError(c, ErrMemberIDTaken)
+	}
+	// the empty-member_id guard makes a concurrent second claim a no-op; the
+	// unique index still rejects a racing claim of the same ID
+	res := db.Model(&User{}).Where("id = ? AND member_id = ?", user.ID, "").Update("member_id", memberID)
+	if res.Error != nil {
+		return writeError(c, fmt.Errorf("claim member_id: %w", res.Error))
+	}
+	if res.RowsAffected == 0 {
+		return writeError(c, ErrMemberIDAlreadySet)
+	}
+	return c.JSON(fiber.Map{"member_id": memberID})
+}
+
+// migrateMemberIDIndex replaces the original unique index on member_id,
+// which allowed only one user without a member ID, with a partial one that
+// ignores empty IDs
+func migrateMemberIDIndex() {
+	if !db.Migrator().HasIndex(&User{}, "idx_users_member_id") {
+		return
+	}
+	// AutoMigrate has already created the replacement
+	if err := db.Migrator().DropIndex(&User{}, "idx_users_member_id"); err != nil {
+		log.Fatalf("drop member_id index failed: %v", err)
+	}
+}
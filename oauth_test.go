@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFindOrCreateGoogleUserLinking(t *testing.T) {
+	resetDB(t)
+	verified := createUser(t, 0)
+	unverified := createUser(t, 0)
+	if err := db.Model(&User{}).Where("id = ?", unverified.ID).Update("email_verified", false).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		profile googleUser
+		wantErr error
+		wantID  uint // 0 for a newly created user
+	}{
+		{"verified account is linked", googleUser{Subject: "g-verified", Email: verified.Email, EmailVerified: true}, nil, verified.ID},
+		{"linked account matches by subject", googleUser{Subject: "g-verified", Email: "changed@example.com", EmailVerified: true}, nil, verified.ID},
+		{"unverified account is not linked", googleUser{Subject: "g-attacker-victim", Email: unverified.Email, EmailVerified: true}, ErrGoogleLinkUnverified, 0},
+		{"unverified google email", googleUser{Subject: "g-unverified", Email: "new@example.com"}, ErrGoogleEmailUnverified, 0},
+		{"email linked to another google account", googleUser{Subject: "g-other", Email: verified.Email, EmailVerified: true}, ErrGoogleAccountConflict, 0},
+		{"new email creates a user", googleUser{Subject: "g-new", Email: "New@Example.com", EmailVerified: true}, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := findOrCreateGoogleUser(tt.profile)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tt.wantID != 0 && user.ID != tt.wantID {
+				t.Errorf("user = %d, want %d", user.ID, tt.wantID)
+			}
+			if tt.wantID == 0 && (user.ID == verified.ID || user.ID == unverified.ID || user.Password != "") {
+				t.Errorf("expected a new password-less user, got %+v", user)
+			}
+		})
+	}
+
+	if got := reloadUser(t, unverified); got.GoogleSubject != nil || got.EmailVerified {
+		t.Errorf("unverified account was changed: subject %v, verified %v", got.GoogleSubject, got.EmailVerified)
+	}
+}
@@ -0,0 +1,1507 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// swaggerDoc is the OpenAPI document, generated from the route table and
+// the per-operation detail in operationDocs
+func swaggerDoc(serverURL string) map[string]interface{} {
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":       "LBK Points Transfer API",
+			"version":     "1.0.0",
+			"description": "API for LBK member points transfer system",
+		},
+		"servers": []map[string]interface{}{
+			{"url": serverURL},
+		},
+		"paths": openAPIPaths(appRoutes(), operationDocs()),
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"TransferTemplateInput": map[string]interface{}{
+					"type":     "object",
+					"required": []string{"to_member_id", "amount"},
+					"properties": map[string]interface{}{
+						"to_member_id": map[string]interface{}{"type": "string"},
+						"amount":       map[string]interface{}{"type": "integer"},
+						"note":         map[string]interface{}{"type": "string", "maxLength": 200},
+					},
+				},
+			},
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{
+					"type":         "http",
+					"scheme":       "bearer",
+					"bearerFormat": "JWT",
+					"description":  "Browsers that logged in with ?cookie=true may send the token cookie instead; non-GET requests then need X-CSRF-Token matching the csrf_token cookie",
+				},
+				"apiKeyAuth": map[string]interface{}{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        "X-API-Key",
+					"description": "Server-to-server key from POST /admin/api-keys",
+				},
+				"elevatedToken": map[string]interface{}{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        "X-Elevated-Token",
+					"description": "Short-lived token from POST /auth/elevate",
+				},
+			},
+		},
+	}
+}
+
+// operationDocs describes each documented operation by OpenAPI path and
+// method: its summary, parameters, request body and responses. swaggerDoc
+// adds what the route table says (security, rate limit, error codes,
+// deprecation), and validateRoutes keeps the two in step.
+func operationDocs() map[string]interface{} {
+	return map[string]interface{}{
+		"/register": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary":     "Register user",
+				"description": "Members sign up without credentials. A partner's backend signing members up sends its X-API-Key (scope members:register) instead, and the member joins the key's partner program; the partner is never taken from the request body.",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":     "object",
+								"required": []string{"email", "password", "member_id"},
+								"properties": map[string]interface{}{
+									"email":      map[string]interface{}{"type": "string"},
+									"password":   map[string]interface{}{"type": "string"},
+									"first_name": map[string]interface{}{"type": "string"},
+									"last_name":  map[string]interface{}{"type": "string"},
+									"phone":      map[string]interface{}{"type": "string"},
+									"birthday":   map[string]interface{}{"type": "string"},
+									"member_id":  map[string]interface{}{"type": "string"},
+									"consents": map[string]interface{}{
+										"type":                 "object",
+										"description":          "Purpose to granted flag: marketing_push, marketing_email, partner_data_sharing, analytics",
+										"additionalProperties": map[string]interface{}{"type": "boolean"},
+									},
+									"consent_policy_version": map[string]interface{}{"type": "string"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"201": map[string]interface{}{"description": "User created successfully"},
+					"400": map[string]interface{}{"description": "Bad request"},
+					"422": map[string]interface{}{"description": "Password breaks the password policy (WEAK_PASSWORD)"},
+					"429": map[string]interface{}{"description": "Too many requests from this IP, retry after the Retry-After header (RATE_LIMITED)"},
+				},
+			},
+		},
+		"/login": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Login user",
+				"parameters": []map[string]interface{}{
+					{"name": "cookie", "in": "query", "description": "true to set the access token as an HttpOnly cookie (plus a csrf_token) instead of returning it", "schema": map[string]interface{}{"type": "boolean"}},
+				},
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":     "object",
+								"required": []string{"password"},
+								"properties": map[string]interface{}{
+									"identifier": map[string]interface{}{"type": "string", "description": "Member ID, email or phone number"},
+									"email":      map[string]interface{}{"type": "string", "description": "Used when identifier is absent"},
+									"password":   map[string]interface{}{"type": "string"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Login successful: access token, refresh token and expires_in"},
+					"401": map[string]interface{}{"description": "Invalid credentials"},
+					"429": map[string]interface{}{"description": "Too many requests from this IP, retry after the Retry-After header (RATE_LIMITED)"},
+				},
+			},
+		},
+		"/me": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Get current user profile",
+				"parameters": []map[string]interface{}{
+					{"name": "fields", "in": "query", "description": "Comma-separated fields to return (400 lists valid names)", "schema": map[string]interface{}{"type": "string"}},
+					{"name": "If-None-Match", "in": "header", "description": "ETag of a copy the client holds; 304 if it is still current", "schema": map[string]interface{}{"type": "string"}},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "User profile, with an ETag covering the selected fields"},
+					"304": map[string]interface{}{"description": "Not modified since the ETag in If-None-Match"},
+					"400": map[string]interface{}{"description": "Unknown field in fields"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+				},
+			},
+			"put": map[string]interface{}{
+				"summary": "Update profile fields (partial)",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type": "object",
+								"properties": map[string]interface{}{
+									"first_name": map[string]interface{}{"type": "string"},
+									"last_name":  map[string]interface{}{"type": "string"},
+									"phone":      map[string]interface{}{"type": "string", "example": "081-234-5678"},
+									"birthday":   map[string]interface{}{"type": "string", "format": "date"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Updated user profile"},
+					"400": map[string]interface{}{"description": "Invalid or read-only fields, details in fields"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+				},
+			},
+			"patch": map[string]interface{}{
+				"summary": "Same as PUT /me",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type": "object",
+								"properties": map[string]interface{}{
+									"first_name": map[string]interface{}{"type": "string"},
+									"last_name":  map[string]interface{}{"type": "string"},
+									"phone":      map[string]interface{}{"type": "string", "example": "081-234-5678"},
+									"birthday":   map[string]interface{}{"type": "string", "format": "date"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Updated user profile"},
+					"400": map[string]interface{}{"description": "Invalid or read-only fields, details in fields"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+				},
+			},
+			"delete": map[string]interface{}{
+				"summary": "Delete your account; transfers awaiting acceptance go back to their senders",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type": "object",
+								"properties": map[string]interface{}{
+									"current_password": map[string]interface{}{"type": "string", "description": "Required when the account has a password"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"204": map[string]interface{}{"description": "Account deleted and signed out everywhere"},
+					"400": map[string]interface{}{"description": "Missing or incorrect current_password"},
+					"401": map[string]interface{}{"description": "Unauthorized, or elevation required (ELEVATION_REQUIRED)"},
+					"429": map[string]interface{}{"description": "Too many attempts"},
+				},
+			},
+		},
+		"/transfer": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Transfer points to another user",
+				"parameters": []map[string]interface{}{
+					{"name": "Idempotency-Key", "in": "header", "schema": map[string]interface{}{"type": "string", "maxLength": 255}, "description": "Retrying with the same key within 24 hours replays the first successful response (with Idempotent-Replay: true) instead of transferring again"},
+				},
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":     "object",
+								"required": []string{"to_member_id", "pin"},
+								"properties": map[string]interface{}{
+									"to_member_id":   map[string]interface{}{"type": "string"},
+									"pin":            map[string]interface{}{"type": "string", "description": "6-digit transfer PIN"},
+									"amount":         map[string]interface{}{"type": "integer"},
+									"confirm_large":  map[string]interface{}{"type": "boolean", "description": "Confirm a transfer that moves a large share of the balance"},
+									"send_all":       map[string]interface{}{"type": "boolean", "description": "Transfer the entire balance (amount is ignored)"},
+									"require_accept": map[string]interface{}{"type": "boolean", "description": "Hold the points until the recipient accepts (always the case above TRANSFER_ACCEPT_THRESHOLD)"},
+									"note":           map[string]interface{}{"type": "string", "maxLength": 200, "description": "Optional memo shown to both members; control characters are removed"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Transfer successful"},
+					"202": map[string]interface{}{"description": "Amount above TRANSFER_CONFIRM_THRESHOLD: pending, confirm with POST /transfer/confirm within 10 minutes. With require_accept or above TRANSFER_ACCEPT_THRESHOLD: points held until the recipient accepts or declines within 72 hours"},
+					"400": map[string]interface{}{"description": "Bad request"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"403": map[string]interface{}{"description": "Email not verified (EMAIL_NOT_VERIFIED), wrong PIN (INVALID_PIN) or recipient belongs to another partner program (CROSS_PARTNER_NOT_ALLOWED)"},
+					"409": map[string]interface{}{"description": "Idempotency-Key already used for a different request (IDEMPOTENCY_KEY_REUSED)"},
+					"422": map[string]interface{}{"description": "Over the tier's per-transfer cap (PER_TRANSFER_LIMIT_EXCEEDED, with per_txn_limit, used and resets_at) or daily limit (DAILY_LIMIT_EXCEEDED, with used, remaining and resets_at)"},
+					"423": map[string]interface{}{"description": "PIN locked after too many wrong attempts (PIN_LOCKED)"},
+					"428": map[string]interface{}{"description": "No transfer PIN set yet (PIN_NOT_SET)"},
+					"503": map[string]interface{}{"description": "Over capacity, retry after the Retry-After header (OVER_CAPACITY)"},
+				},
+			},
+		},
+		"/transactions/recent": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Get transaction history, newest first (paginated)",
+				"parameters": []map[string]interface{}{
+					{"name": "page", "in": "query", "schema": map[string]interface{}{"type": "integer", "minimum": 1, "default": 1}},
+					{"name": "page_size", "in": "query", "schema": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 100, "default": 20}},
+					{"name": "from", "in": "query", "description": "First day to include (YYYY-MM-DD, UTC)", "schema": map[string]interface{}{"type": "string", "format": "date"}},
+					{"name": "to", "in": "query", "description": "Last day to include (YYYY-MM-DD, UTC)", "schema": map[string]interface{}{"type": "string", "format": "date"}},
+					{"name": "fields", "in": "query", "description": "Comma-separated fields to return (400 lists valid names)", "schema": map[string]interface{}{"type": "string"}},
+					{"name": "If-None-Match", "in": "header", "description": "ETag of a copy the client holds; 304 if it is still current", "schema": map[string]interface{}{"type": "string"}},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Transactions with pagination metadata, with an ETag covering the selected fields"},
+					"304": map[string]interface{}{"description": "Not modified since the ETag in If-None-Match"},
+					"400": map[string]interface{}{"description": "Invalid page, page_size, from, to or fields"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+				},
+			},
+		},
+		"/search/user": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Search user by member ID",
+				"parameters": []map[string]interface{}{
+					{
+						"name":        "member_id",
+						"in":          "query",
+						"required":    true,
+						"description": "LBK Member ID to search for",
+						"schema":      map[string]interface{}{"type": "string"},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "User found; eligible says whether you can transfer to them now, and reason gives the error code /transfer would return if not"},
+					"404": map[string]interface{}{"description": "User not found"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"429": map[string]interface{}{"description": "Too many requests from this IP, retry after the Retry-After header (RATE_LIMITED)"},
+				},
+			},
+		},
+		"/me/feed-token": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Create or rotate the transaction feed token",
+				"responses": map[string]interface{}{
+					"201": map[string]interface{}{"description": "Feed token and URL (token shown once)"},
+					"401": map[string]interface{}{"description": "Unauthorized, or elevation required (ELEVATION_REQUIRED)"},
+				},
+			},
+			"delete": map[string]interface{}{
+				"summary": "Revoke the transaction feed token",
+				"responses": map[string]interface{}{
+					"204": map[string]interface{}{"description": "Feed token revoked"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+				},
+			},
+		},
+		"/me/feed.atom": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Atom feed of recent transactions",
+				"parameters": []map[string]interface{}{
+					{
+						"name":        "token",
+						"in":          "query",
+						"required":    true,
+						"description": "Feed token from POST /me/feed-token",
+						"schema":      map[string]interface{}{"type": "string"},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Atom feed"},
+					"401": map[string]interface{}{"description": "Invalid feed token"},
+				},
+			},
+		},
+		"/auth/magic-link": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Email a single-use sign-in link",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":     "object",
+								"required": []string{"email"},
+								"properties": map[string]interface{}{
+									"email": map[string]interface{}{"type": "string"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Accepted (returned whether or not the account exists)"},
+					"429": map[string]interface{}{"description": "Too many requests"},
+				},
+			},
+		},
+		"/auth/magic-login": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Exchange a sign-in link token for a JWT",
+				"parameters": []map[string]interface{}{
+					{"name": "cookie", "in": "query", "description": "true to set the access token as an HttpOnly cookie (plus a csrf_token) instead of returning it", "schema": map[string]interface{}{"type": "boolean"}},
+				},
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":     "object",
+								"required": []string{"token"},
+								"properties": map[string]interface{}{
+									"token": map[string]interface{}{"type": "string"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Login successful"},
+					"401": map[string]interface{}{"description": "Invalid or expired link"},
+				},
+			},
+		},
+		"/transactions/{id}": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Get a transaction with its status timeline",
+				"parameters": []map[string]interface{}{
+					{
+						"name":     "id",
+						"in":       "path",
+						"required": true,
+						"schema":   map[string]interface{}{"type": "integer"},
+					},
+					{"name": "fields", "in": "query", "description": "Comma-separated fields to return (400 lists valid names)", "schema": map[string]interface{}{"type": "string"}},
+					{"name": "If-None-Match", "in": "header", "description": "ETag of a copy the client holds; 304 if it is still current", "schema": map[string]interface{}{"type": "string"}},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Transaction detail with timeline, with an ETag covering the selected fields"},
+					"304": map[string]interface{}{"description": "Not modified since the ETag in If-None-Match"},
+					"400": map[string]interface{}{"description": "Unknown field in fields"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"404": map[string]interface{}{"description": "Transaction not found"},
+				},
+			},
+		},
+		"/transfer/templates": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "List transfer templates",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Templates"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+				},
+			},
+			"post": map[string]interface{}{
+				"summary": "Create a transfer template",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{"$ref": "#/components/schemas/TransferTemplateInput"},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"201": map[string]interface{}{"description": "Template created"},
+					"400": map[string]interface{}{"description": "Bad request"},
+					"404": map[string]interface{}{"description": "Recipient not found"},
+				},
+			},
+		},
+		"/transfer/templates/{id}": map[string]interface{}{
+			"parameters": []map[string]interface{}{
+				{"name": "id", "in": "path", "required": true, "schema": map[string]interface{}{"type": "integer"}},
+			},
+			"get": map[string]interface{}{
+				"summary": "Get a transfer template",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Template"},
+					"404": map[string]interface{}{"description": "Template not found"},
+				},
+			},
+			"put": map[string]interface{}{
+				"summary": "Update a transfer template",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{"$ref": "#/components/schemas/TransferTemplateInput"},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Template updated"},
+					"400": map[string]interface{}{"description": "Bad request"},
+					"404": map[string]interface{}{"description": "Template or recipient not found"},
+				},
+			},
+			"delete": map[string]interface{}{
+				"summary": "Delete a transfer template",
+				"responses": map[string]interface{}{
+					"204": map[string]interface{}{"description": "Template deleted"},
+					"404": map[string]interface{}{"description": "Template not found"},
+				},
+			},
+		},
+		"/transfer/from-template/{id}": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Transfer using a saved template",
+				"parameters": []map[string]interface{}{
+					{"name": "id", "in": "path", "required": true, "schema": map[string]interface{}{"type": "integer"}},
+				},
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":     "object",
+								"required": []string{"pin"},
+								"properties": map[string]interface{}{
+									"pin":           map[string]interface{}{"type": "string", "description": "6-digit transfer PIN"},
+									"confirm_large": map[string]interface{}{"type": "boolean"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Transfer successful"},
+					"400": map[string]interface{}{"description": "Bad request"},
+					"403": map[string]interface{}{"description": "Wrong PIN (INVALID_PIN)"},
+					"404": map[string]interface{}{"description": "Template or recipient not found"},
+					"423": map[string]interface{}{"description": "PIN locked (PIN_LOCKED)"},
+					"428": map[string]interface{}{"description": "No transfer PIN set yet (PIN_NOT_SET)"},
+				},
+			},
+		},
+		"/me/consents": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Get current consent state per purpose",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Consent state and whether the app should prompt (needs_consent)"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+				},
+			},
+			"put": map[string]interface{}{
+				"summary": "Grant or revoke consents",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":     "object",
+								"required": []string{"policy_version", "consents"},
+								"properties": map[string]interface{}{
+									"policy_version": map[string]interface{}{"type": "string"},
+									"consents": map[string]interface{}{
+										"type":                 "object",
+										"additionalProperties": map[string]interface{}{"type": "boolean"},
+									},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Updated consent state"},
+					"400": map[string]interface{}{"description": "Bad request"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+				},
+			},
+		},
+		"/me/consents/history": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Consent change history",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Consent history, newest first"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+				},
+			},
+		},
+		"/transactions/by-counterparty": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Points statement grouped by counterparty, or one counterparty's history",
+				"parameters": []map[string]interface{}{
+					{"name": "sort", "in": "query", "schema": map[string]interface{}{"type": "string", "enum": []string{"volume", "recent"}}},
+					{"name": "counterparty", "in": "query", "description": "Member ID to drill down into", "schema": map[string]interface{}{"type": "string"}},
+					{"name": "page", "in": "query", "schema": map[string]interface{}{"type": "integer", "minimum": 1}},
+					{"name": "page_size", "in": "query", "schema": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 100}},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Counterparty totals, or the pair's transactions when counterparty is set"},
+					"400": map[string]interface{}{"description": "Invalid sort or pagination (INVALID_REQUEST)"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"404": map[string]interface{}{"description": "Counterparty not found"},
+				},
+			},
+		},
+		"/transactions/export": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Download the transaction history as CSV, oldest first",
+				"parameters": []map[string]interface{}{
+					{"name": "from", "in": "query", "description": "First day to include (YYYY-MM-DD, UTC)", "schema": map[string]interface{}{"type": "string", "format": "date"}},
+					{"name": "to", "in": "query", "description": "Last day to include (YYYY-MM-DD, UTC)", "schema": map[string]interface{}{"type": "string", "format": "date"}},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{
+						"description": "CSV with columns date, time, type, counterparty_member_id, counterparty_name, amount, status, description, note",
+						"content":     map[string]interface{}{"text/csv": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}},
+					},
+					"400": map[string]interface{}{"description": "Invalid date range (INVALID_REQUEST)"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+				},
+			},
+		},
+		"/auth/elevate": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Re-enter the password (and a 2FA code, when enabled) to get a 10-minute elevation token for sensitive actions",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type": "object",
+								"properties": map[string]interface{}{
+									"password":   map[string]interface{}{"type": "string", "description": "Required when the account has a password"},
+									"email_code": map[string]interface{}{"type": "string", "description": "Code from /auth/elevate/email-code; required instead of password when the account has none (Google sign-ups)"},
+									"code":       map[string]interface{}{"type": "string", "description": "TOTP or recovery code; required when 2FA is enabled"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Elevation token, send it as X-Elevated-Token"},
+					"400": map[string]interface{}{"description": "Missing password (or email_code), or missing code with 2FA enabled"},
+					"401": map[string]interface{}{"description": "Invalid credentials"},
+					"429": map[string]interface{}{"description": "Too many attempts"},
+				},
+			},
+		},
+		"/auth/elevate/email-code": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Email a 10-minute, single-use code that an account without a password exchanges at /auth/elevate",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Code sent; expires_in seconds"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"409": map[string]interface{}{"description": "The account has a password, elevate with it (ELEVATE_WITH_PASSWORD)"},
+					"429": map[string]interface{}{"description": "Too many requests"},
+				},
+			},
+		},
+		"/me/delegates": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "List delegates with read-only access to your transactions",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Delegates"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+				},
+			},
+			"post": map[string]interface{}{
+				"summary": "Invite a member by email to read your transactions",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":     "object",
+								"required": []string{"email"},
+								"properties": map[string]interface{}{
+									"email":      map[string]interface{}{"type": "string", "format": "email"},
+									"expires_at": map[string]interface{}{"type": "string", "format": "date-time"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"201": map[string]interface{}{"description": "Invitation sent"},
+					"400": map[string]interface{}{"description": "Missing or invalid email, your own email, or expires_at in the past (INVALID_REQUEST)"},
+					"401": map[string]interface{}{"description": "Unauthorized, or elevation required (ELEVATION_REQUIRED)"},
+				},
+			},
+		},
+		"/me/delegates/{id}": map[string]interface{}{
+			"delete": map[string]interface{}{
+				"summary": "Revoke a delegate",
+				"parameters": []map[string]interface{}{
+					{"name": "id", "in": "path", "required": true, "schema": map[string]interface{}{"type": "integer"}},
+				},
+				"responses": map[string]interface{}{
+					"204": map[string]interface{}{"description": "Delegate revoked"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"404": map[string]interface{}{"description": "Delegate not found"},
+				},
+			},
+		},
+		"/me/delegates/access-log": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Requests delegates made against your data",
+				"parameters": []map[string]interface{}{
+					{"name": "page", "in": "query", "schema": map[string]interface{}{"type": "integer", "minimum": 1}},
+					{"name": "page_size", "in": "query", "schema": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 100}},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Access log"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+				},
+			},
+		},
+		"/delegates/accept": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Accept a delegation invitation as the invited member",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":       "object",
+								"required":   []string{"token"},
+								"properties": map[string]interface{}{"token": map[string]interface{}{"type": "string"}},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Delegation active"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"404": map[string]interface{}{"description": "Invalid or expired invitation"},
+				},
+			},
+		},
+		"/delegated/{owner_member_id}/transactions": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Read an owner's transactions as their delegate",
+				"parameters": []map[string]interface{}{
+					{"name": "owner_member_id", "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"}},
+					{"name": "page", "in": "query", "schema": map[string]interface{}{"type": "integer", "minimum": 1}},
+					{"name": "page_size", "in": "query", "schema": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 100}},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Owner's transactions"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"403": map[string]interface{}{"description": "No active delegation for this member"},
+				},
+			},
+		},
+		"/auth/refresh": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Exchange a refresh token for a new access token (the refresh token is rotated)",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":       "object",
+								"required":   []string{"refresh_token"},
+								"properties": map[string]interface{}{"refresh_token": map[string]interface{}{"type": "string"}},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "New access token and refresh token"},
+					"401": map[string]interface{}{"description": "Refresh token invalid, expired or revoked (INVALID_REFRESH_TOKEN)"},
+				},
+			},
+		},
+		"/refresh": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Alias of /auth/refresh",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "New access token and refresh token"},
+					"401": map[string]interface{}{"description": "Refresh token invalid, expired or revoked (INVALID_REFRESH_TOKEN)"},
+				},
+			},
+		},
+		"/logout": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Log out, revoking the current access token and the given refresh token",
+				"requestBody": map[string]interface{}{
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":       "object",
+								"properties": map[string]interface{}{"refresh_token": map[string]interface{}{"type": "string"}},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"204": map[string]interface{}{"description": "Logged out"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+				},
+			},
+		},
+		"/password/forgot": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Email a password reset link (always 200)",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":       "object",
+								"required":   []string{"email"},
+								"properties": map[string]interface{}{"email": map[string]interface{}{"type": "string", "format": "email"}},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Reset link sent if the account exists"},
+					"429": map[string]interface{}{"description": "Too many requests from this IP"},
+				},
+			},
+		},
+		"/password/reset": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Set a new password with a reset token",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":     "object",
+								"required": []string{"token", "new_password"},
+								"properties": map[string]interface{}{
+									"token":        map[string]interface{}{"type": "string"},
+									"new_password": map[string]interface{}{"type": "string"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Password reset"},
+					"400": map[string]interface{}{"description": "Invalid or expired reset token"},
+					"422": map[string]interface{}{"description": "Password breaks the password policy (WEAK_PASSWORD)"},
+				},
+			},
+		},
+		"/password/reset/request": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Alias of /password/forgot",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Reset link sent if the account exists"},
+					"429": map[string]interface{}{"description": "Too many requests from this IP"},
+				},
+			},
+		},
+		"/password/reset/confirm": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Alias of /password/reset",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Password reset"},
+					"400": map[string]interface{}{"description": "Invalid or expired reset token"},
+					"422": map[string]interface{}{"description": "Password breaks the password policy (WEAK_PASSWORD)"},
+				},
+			},
+		},
+		"/verify": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Confirm an email address with the emailed token",
+				"parameters": []map[string]interface{}{
+					{"name": "token", "in": "query", "required": true, "schema": map[string]interface{}{"type": "string"}},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Email verified"},
+					"400": map[string]interface{}{"description": "Invalid or expired verification link"},
+				},
+			},
+		},
+		"/verify/resend": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Send a new verification email",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Verification email sent, or already verified"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"429": map[string]interface{}{"description": "Too many requests"},
+				},
+			},
+		},
+		"/me/password": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Change password (signs out every session, returns new tokens)",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":     "object",
+								"required": []string{"current_password", "new_password"},
+								"properties": map[string]interface{}{
+									"current_password": map[string]interface{}{"type": "string"},
+									"new_password":     map[string]interface{}{"type": "string"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Password changed, new token pair"},
+					"400": map[string]interface{}{"description": "Current password is incorrect"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"422": map[string]interface{}{"description": "Password breaks the password policy (WEAK_PASSWORD)"},
+					"429": map[string]interface{}{"description": "Too many requests"},
+				},
+			},
+		},
+		"/me/pin": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Set or change the 6-digit transfer PIN",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":     "object",
+								"required": []string{"pin"},
+								"properties": map[string]interface{}{
+									"current_password": map[string]interface{}{"type": "string", "description": "Required when the account has a password"},
+									"pin":              map[string]interface{}{"type": "string", "pattern": "^[0-9]{6}$"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "PIN set"},
+					"400": map[string]interface{}{"description": "Current password incorrect or PIN not 6 digits"},
+					"401": map[string]interface{}{"description": "Unauthorized, or elevation required (ELEVATION_REQUIRED)"},
+					"429": map[string]interface{}{"description": "Too many requests"},
+				},
+			},
+		},
+		"/login/2fa": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Exchange an mfa_token from /login and a TOTP or recovery code for tokens",
+				"parameters": []map[string]interface{}{
+					{"name": "cookie", "in": "query", "description": "true to set the access token as an HttpOnly cookie (plus a csrf_token) instead of returning it", "schema": map[string]interface{}{"type": "boolean"}},
+				},
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":     "object",
+								"required": []string{"mfa_token", "code"},
+								"properties": map[string]interface{}{
+									"mfa_token": map[string]interface{}{"type": "string"},
+									"code":      map[string]interface{}{"type": "string"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Access and refresh token"},
+					"401": map[string]interface{}{"description": "Invalid or expired mfa_token, or invalid code"},
+					"429": map[string]interface{}{"description": "Too many requests"},
+				},
+			},
+		},
+		"/me/2fa/setup": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Generate a TOTP secret and recovery codes; 2FA stays off until enabled",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "secret, otpauth_uri and recovery_codes"},
+					"401": map[string]interface{}{"description": "Unauthorized, or elevation required (ELEVATION_REQUIRED)"},
+					"409": map[string]interface{}{"description": "2FA already enabled"},
+				},
+			},
+		},
+		"/me/2fa/enable": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Turn on 2FA by confirming a code from the authenticator app",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":     "object",
+								"required": []string{"code"},
+								"properties": map[string]interface{}{
+									"code": map[string]interface{}{"type": "string", "pattern": "^[0-9]{6}$"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "2FA enabled"},
+					"400": map[string]interface{}{"description": "Invalid code, or setup not started"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"409": map[string]interface{}{"description": "2FA already enabled"},
+				},
+			},
+		},
+		"/me/2fa/disable": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Turn off 2FA; needs the password and a TOTP or recovery code",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":     "object",
+								"required": []string{"code"},
+								"properties": map[string]interface{}{
+									"password": map[string]interface{}{"type": "string", "description": "Required when the account has a password"},
+									"code":     map[string]interface{}{"type": "string"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "2FA disabled"},
+					"400": map[string]interface{}{"description": "2FA not enabled"},
+					"401": map[string]interface{}{"description": "Unauthorized, elevation required (ELEVATION_REQUIRED), or wrong password or code"},
+					"429": map[string]interface{}{"description": "Too many requests"},
+				},
+			},
+		},
+		"/admin/users": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "List all users (admin token, or API key with users:read)",
+				"parameters": []map[string]interface{}{
+					{"name": "page", "in": "query", "schema": map[string]interface{}{"type": "integer", "minimum": 1}},
+					{"name": "page_size", "in": "query", "schema": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 100}},
+					{"name": "email", "in": "query", "description": "Email contains (case-insensitive)", "schema": map[string]interface{}{"type": "string"}},
+					{"name": "member_id", "in": "query", "description": "Exact member ID", "schema": map[string]interface{}{"type": "string"}},
+					{"name": "member_tier", "in": "query", "description": "Exact tier, e.g. Gold", "schema": map[string]interface{}{"type": "string"}},
+					{"name": "fields", "in": "query", "description": "Comma-separated fields to return (400 lists valid names)", "schema": map[string]interface{}{"type": "string"}},
+					{"name": "If-None-Match", "in": "header", "description": "ETag of a copy the client holds; 304 if it is still current", "schema": map[string]interface{}{"type": "string"}},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Matching users, oldest first, with pagination, with an ETag covering the selected fields"},
+					"304": map[string]interface{}{"description": "Not modified since the ETag in If-None-Match"},
+					"400": map[string]interface{}{"description": "Invalid pagination or unknown field in fields (INVALID_REQUEST)"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"403": map[string]interface{}{"description": "Not an admin (FORBIDDEN), or API key lacks users:read (INSUFFICIENT_SCOPE)"},
+				},
+			},
+		},
+		"/admin/api-keys": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Create an API key (admin only); the full key is returned only once",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":     "object",
+								"required": []string{"name", "scopes"},
+								"properties": map[string]interface{}{
+									"name":       map[string]interface{}{"type": "string"},
+									"scopes":     map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string", "enum": []string{"users:read", "members:register"}}},
+									"partner_id": map[string]interface{}{"type": "string", "description": "Partner program the key's holder runs; members it registers join it"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"201": map[string]interface{}{"description": "API key, including the full key"},
+					"400": map[string]interface{}{"description": "Missing name or unknown scope (INVALID_REQUEST)"},
+					"401": map[string]interface{}{"description": "Unauthorized, or elevation required (ELEVATION_REQUIRED)"},
+					"403": map[string]interface{}{"description": "Not an admin (FORBIDDEN)"},
+				},
+			},
+			"get": map[string]interface{}{
+				"summary": "List API keys without their secrets (admin only)",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "API keys"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"403": map[string]interface{}{"description": "Not an admin (FORBIDDEN)"},
+				},
+			},
+		},
+		"/admin/api-keys/{id}": map[string]interface{}{
+			"delete": map[string]interface{}{
+				"summary": "Revoke an API key (admin only)",
+				"responses": map[string]interface{}{
+					"204": map[string]interface{}{"description": "API key revoked"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"403": map[string]interface{}{"description": "Not an admin (FORBIDDEN)"},
+					"404": map[string]interface{}{"description": "API key not found"},
+				},
+			},
+		},
+		"/admin/invariants": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Run the data invariants now and report each one's violation count (admin only)",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "checked_at, the number violated, and per invariant its name, description, violations and whether alerts for it are suppressed"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"403": map[string]interface{}{"description": "Not an admin (FORBIDDEN)"},
+				},
+			},
+		},
+		"/transfer/limit": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Transfer limits and how much is left today (the old path of /me/limits)",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "member_tier, per_txn_limit, daily_limit, used, remaining, available_now and resets_at"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+				},
+			},
+		},
+		"/transfer/confirm": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Confirm a pending transfer, moving the points",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":     "object",
+								"required": []string{"confirmation_id"},
+								"properties": map[string]interface{}{
+									"confirmation_id": map[string]interface{}{"type": "integer"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Transfer successful"},
+					"400": map[string]interface{}{"description": "Insufficient points, or bad request"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"404": map[string]interface{}{"description": "No pending transfer with this id (TRANSACTION_NOT_FOUND)"},
+					"409": map[string]interface{}{"description": "Transfer is no longer pending, current status in status (TRANSFER_NOT_PENDING)"},
+					"410": map[string]interface{}{"description": "Confirmation window passed (CONFIRMATION_EXPIRED)"},
+					"422": map[string]interface{}{"description": "Over a transfer limit (PER_TRANSFER_LIMIT_EXCEEDED, DAILY_LIMIT_EXCEEDED)"},
+					"503": map[string]interface{}{"description": "Over capacity (OVER_CAPACITY)"},
+				},
+			},
+		},
+		"/me/logins": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Last 20 login attempts on your account, newest first",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Login events with method, success, reason, IP and user agent"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+				},
+			},
+		},
+		"/auth/google": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Start Google sign-in (redirects to Google)",
+				"responses": map[string]interface{}{
+					"302": map[string]interface{}{"description": "Redirect to Google's consent screen"},
+					"503": map[string]interface{}{"description": "Google sign-in is not configured"},
+				},
+			},
+		},
+		"/auth/google/callback": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Finish Google sign-in; returns the same tokens as /login plus needs_member_id",
+				"parameters": []map[string]interface{}{
+					{"name": "code", "in": "query", "required": true, "schema": map[string]interface{}{"type": "string"}},
+					{"name": "state", "in": "query", "required": true, "schema": map[string]interface{}{"type": "string"}},
+					{"name": "cookie", "in": "query", "description": "true to set the access token as an HttpOnly cookie (plus a csrf_token) instead of returning it", "schema": map[string]interface{}{"type": "boolean"}},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Tokens (or an MFA challenge) and needs_member_id"},
+					"400": map[string]interface{}{"description": "Missing code or state mismatch"},
+					"403": map[string]interface{}{"description": "Google email not verified (GOOGLE_EMAIL_UNVERIFIED)"},
+					"409": map[string]interface{}{"description": "Email linked to another Google account (GOOGLE_ACCOUNT_CONFLICT), or used by an account that hasn't verified it (GOOGLE_LINK_UNVERIFIED_ACCOUNT)"},
+					"502": map[string]interface{}{"description": "Google rejected the code"},
+				},
+			},
+		},
+		"/me/member-id": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Claim a member ID (accounts created by Google sign-in start without one)",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":     "object",
+								"required": []string{"member_id"},
+								"properties": map[string]interface{}{
+									"member_id": map[string]interface{}{"type": "string"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Member ID claimed"},
+					"400": map[string]interface{}{"description": "member_id missing (INVALID_REQUEST)"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"409": map[string]interface{}{"description": "Already has a member ID (MEMBER_ID_ALREADY_SET) or it's taken (MEMBER_ID_TAKEN)"},
+				},
+			},
+		},
+		"/admin/transactions/{id}/reverse": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Reverse a completed transfer, moving the points back to the sender (admin only)",
+				"parameters": []map[string]interface{}{
+					{"name": "id", "in": "path", "required": true, "schema": map[string]interface{}{"type": "integer"}},
+				},
+				"requestBody": map[string]interface{}{
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type": "object",
+								"properties": map[string]interface{}{
+									"reason": map[string]interface{}{"type": "string", "description": "Recorded on the transaction timeline"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Transfer reversed; includes the compensating transaction's ID"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"403": map[string]interface{}{"description": "Not an admin (FORBIDDEN)"},
+					"404": map[string]interface{}{"description": "Transaction not found"},
+					"409": map[string]interface{}{"description": "Already reversed, not a completed transfer, the sender deleted their account (SENDER_DELETED), or the recipient no longer holds the points (REVERSAL_INSUFFICIENT_BALANCE)"},
+				},
+			},
+		},
+		"/admin/users/{id}/points": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Credit or debit a user's points (admin only)",
+				"parameters": []map[string]interface{}{
+					{"name": "id", "in": "path", "required": true, "schema": map[string]interface{}{"type": "integer"}},
+				},
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":     "object",
+								"required": []string{"delta", "reason"},
+								"properties": map[string]interface{}{
+									"delta":          map[string]interface{}{"type": "integer", "description": "Positive to credit, negative to debit"},
+									"reason":         map[string]interface{}{"type": "string", "maxLength": 200},
+									"allow_negative": map[string]interface{}{"type": "boolean", "description": "Allow the balance to go below zero"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"201": map[string]interface{}{"description": "Adjustment recorded; includes the new balance"},
+					"400": map[string]interface{}{"description": "Zero delta or missing reason (INVALID_REQUEST)"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"403": map[string]interface{}{"description": "Not an admin (FORBIDDEN)"},
+					"404": map[string]interface{}{"description": "User not found (USER_NOT_FOUND)"},
+					"409": map[string]interface{}{"description": "Would make the balance negative (NEGATIVE_BALANCE)"},
+				},
+			},
+		},
+		"/me/points/expiring": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Points that will expire soon, grouped by date",
+				"parameters": []map[string]interface{}{
+					{"name": "days", "in": "query", "schema": map[string]interface{}{"type": "integer", "default": 90, "minimum": 1, "maximum": 3650}, "description": "How far ahead to look"},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Balance, total expiring within the window, and points per expiry date (UTC)"},
+					"400": map[string]interface{}{"description": "days out of range (INVALID_REQUEST)"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+				},
+			},
+		},
+		"/healthz": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Health check that pings the database",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "{\"status\":\"ok\",\"db\":\"up\"}"},
+					"503": map[string]interface{}{"description": "Database unreachable: {\"status\":\"unavailable\",\"db\":\"down\"}"},
+				},
+			},
+		},
+		"/me/limits": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "The member tier's transfer limits and how much is left today (resets at midnight Asia/Bangkok)",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "member_tier, per_txn_limit (null if none), daily_limit, used, remaining, available_now (largest transfer allowed now) and resets_at"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+				},
+			},
+		},
+		"/transfers/{id}/accept": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Accept a transfer awaiting your acceptance, receiving the points (recipient only)",
+				"parameters": []map[string]interface{}{
+					{"name": "id", "in": "path", "required": true, "schema": map[string]interface{}{"type": "integer"}},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Transfer accepted; includes your new balance"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"404": map[string]interface{}{"description": "No transfer awaiting your acceptance with this id (TRANSACTION_NOT_FOUND)"},
+					"409": map[string]interface{}{"description": "Transfer is no longer pending, current status in status (TRANSFER_NOT_PENDING)"},
+					"410": map[string]interface{}{"description": "Not accepted within 72 hours, points went back to the sender (TRANSFER_EXPIRED)"},
+					"503": map[string]interface{}{"description": "Over capacity (OVER_CAPACITY)"},
+				},
+			},
+		},
+		"/transfers/{id}/decline": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Decline a transfer awaiting your acceptance, returning the points to the sender (recipient only)",
+				"parameters": []map[string]interface{}{
+					{"name": "id", "in": "path", "required": true, "schema": map[string]interface{}{"type": "integer"}},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Transfer declined"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"404": map[string]interface{}{"description": "No transfer awaiting your acceptance with this id (TRANSACTION_NOT_FOUND)"},
+					"409": map[string]interface{}{"description": "Transfer is no longer pending, current status in status (TRANSFER_NOT_PENDING)"},
+					"410": map[string]interface{}{"description": "Already expired, points went back to the sender (TRANSFER_EXPIRED)"},
+					"503": map[string]interface{}{"description": "Over capacity (OVER_CAPACITY)"},
+				},
+			},
+		},
+		"/transfers/{id}/cancel": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Cancel one of your pending transfers, returning any held points (sender only)",
+				"parameters": []map[string]interface{}{
+					{"name": "id", "in": "path", "required": true, "schema": map[string]interface{}{"type": "integer"}},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Transfer cancelled; includes the refunded amount and your balance"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"403": map[string]interface{}{"description": "You didn't send this transfer (NOT_TRANSFER_SENDER)"},
+					"404": map[string]interface{}{"description": "No transaction with this id (TRANSACTION_NOT_FOUND)"},
+					"409": map[string]interface{}{"description": "Transfer is no longer pending, current status in status (TRANSFER_NOT_PENDING)"},
+					"503": map[string]interface{}{"description": "Over capacity (OVER_CAPACITY)"},
+				},
+			},
+		},
+		"/requests": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "List point requests you made or received, newest first",
+				"parameters": []map[string]interface{}{
+					{"name": "direction", "in": "query", "schema": map[string]interface{}{"type": "string", "enum": []string{"incoming", "outgoing"}}},
+					{"name": "page", "in": "query", "schema": map[string]interface{}{"type": "integer", "minimum": 1, "default": 1}},
+					{"name": "page_size", "in": "query", "schema": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 100, "default": 20}},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Point requests with pagination"},
+					"400": map[string]interface{}{"description": "Invalid direction or pagination (VALIDATION_ERROR)"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+				},
+			},
+			"post": map[string]interface{}{
+				"summary": "Ask another member for points; the request expires after 7 days",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":     "object",
+								"required": []string{"member_id", "amount"},
+								"properties": map[string]interface{}{
+									"member_id": map[string]interface{}{"type": "string", "description": "Member asked to pay"},
+									"amount":    map[string]interface{}{"type": "integer"},
+									"note":      map[string]interface{}{"type": "string", "maxLength": 200},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"201": map[string]interface{}{"description": "Request created"},
+					"400": map[string]interface{}{"description": "Invalid input (VALIDATION_ERROR)"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"403": map[string]interface{}{"description": "Email not verified, no member ID, or the member can't pay you (EMAIL_NOT_VERIFIED, MEMBER_ID_REQUIRED, SYNTHETIC_ACCOUNT_MISMATCH, CROSS_PARTNER_NOT_ALLOWED)"},
+					"404": map[string]interface{}{"description": "No member with this member_id (RECIPIENT_NOT_FOUND)"},
+				},
+			},
+		},
+		"/requests/{id}/pay": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Pay a point request addressed to you, transferring the amount to the requester",
+				"parameters": []map[string]interface{}{
+					{"name": "id", "in": "path", "required": true, "schema": map[string]interface{}{"type": "integer"}},
+				},
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type": "object",
+								"properties": map[string]interface{}{
+									"pin":           map[string]interface{}{"type": "string"},
+									"confirm_large": map[string]interface{}{"type": "boolean"},
+								},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Transfer completed and request fulfilled; same body as /transfer plus request_id"},
+					"400": map[string]interface{}{"description": "Transfer refused (INSUFFICIENT_POINTS, ...)"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"403": map[string]interface{}{"description": "Request addressed to someone else, or the transfer is refused (NOT_REQUEST_PAYER, INVALID_PIN, ...)"},
+					"404": map[string]interface{}{"description": "No request with this id (REQUEST_NOT_FOUND)"},
+					"409": map[string]interface{}{"description": "Request is no longer pending, current status in status (REQUEST_NOT_PENDING)"},
+					"410": map[string]interface{}{"description": "Request expired (REQUEST_EXPIRED)"},
+					"422": map[string]interface{}{"description": "Over a transfer limit (PER_TRANSFER_LIMIT_EXCEEDED, DAILY_LIMIT_EXCEEDED)"},
+					"503": map[string]interface{}{"description": "Over capacity (OVER_CAPACITY)"},
+				},
+			},
+		},
+		"/requests/{id}/decline": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Decline a point request addressed to you",
+				"parameters": []map[string]interface{}{
+					{"name": "id", "in": "path", "required": true, "schema": map[string]interface{}{"type": "integer"}},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Request declined"},
+					"401": map[string]interface{}{"description": "Unauthorized"},
+					"403": map[string]interface{}{"description": "Request addressed to someone else (NOT_REQUEST_PAYER)"},
+					"404": map[string]interface{}{"description": "No request with this id (REQUEST_NOT_FOUND)"},
+					"409": map[string]interface{}{"description": "Request is no longer pending (REQUEST_NOT_PENDING)"},
+					"410": map[string]interface{}{"description": "Request expired (REQUEST_EXPIRED)"},
+				},
+			},
+		},
+	}
+}
+
+// openAPIPaths is the document's paths object for the documented routes
+func openAPIPaths(routes []route, docs map[string]interface{}) map[string]interface{} {
+	statuses := errorStatuses()
+	paths := map[string]interface{}{}
+	for _, r := range routes {
+		if r.Undocumented {
+			continue
+		}
+		doc, _ := operationDoc(docs, r)
+		path := openAPIPath(r.Path)
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			// path-level fields such as shared parameters carry over as they are
+			item = map[string]interface{}{}
+			shared, _ := docs[path].(map[string]interface{})
+			for k, v := range shared {
+				if !slices.Contains(fiber.DefaultMethods, strings.ToUpper(k)) {
+					item[k] = v
+				}
+			}
+			paths[path] = item
+		}
+		shared, _ := item["parameters"].([]map[string]interface{})
+		item[strings.ToLower(r.Method)] = openAPIOperation(r, doc, shared, statuses)
+	}
+	return paths
+}
+
+// operationDoc is the detail docs has for r, if any
+func operationDoc(docs map[string]interface{}, r route) (map[string]interface{}, bool) {
+	item, _ := docs[openAPIPath(r.Path)].(map[string]interface{})
+	doc, ok := item[strings.ToLower(r.Method)].(map[string]interface{})
+	return doc, ok
+}
+
+// openAPIOperation combines r's detail doc with what the route table says:
+// security, path parameters not in shared, rate limit, error codes and
+// deprecation
+func openAPIOperation(r route, doc map[string]interface{}, shared []map[string]interface{}, statuses map[string]int) map[string]interface{} {
+	op := map[string]interface{}{}
+	for k, v := range doc {
+		op[k] = v
+	}
+	responses := map[string]interface{}{}
+	if documented, ok := doc["responses"].(map[string]interface{}); ok {
+		for status, resp := range documented {
+			responses[status] = resp
+		}
+	}
+	op["responses"] = responses
+
+	switch r.Auth {
+	case authUser:
+		op["security"] = []map[string][]string{{"bearerAuth": {}}}
+	case authElevated:
+		op["security"] = []map[string][]string{{"bearerAuth": {}, "elevatedToken": {}}}
+	case authUserOrService:
+		op["security"] = []map[string][]string{{"bearerAuth": {}}, {"apiKeyAuth": {}}}
+	case authPublicOrService:
+		op["security"] = []map[string][]string{{}, {"apiKeyAuth": {}}}
+	}
+	if r.Auth != authPublic {
+		addResponse(responses, "401", "Unauthorized")
+	}
+
+	// every path parameter is documented, typed by its Fiber constraint
+	params, _ := op["parameters"].([]map[string]interface{})
+	for _, m := range fiberParamPattern.FindAllStringSubmatch(r.Path, -1) {
+		if !hasPathParam(params, m[1]) && !hasPathParam(shared, m[1]) {
+			typ := "string"
+			if m[2] == "<int>" {
+				typ = "integer"
+			}
+			params = append(params, map[string]interface{}{"name": m[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": typ}})
+		}
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if name, ok := rateLimitNames[r.RateLimit]; ok {
+		op["x-rate-limit"] = name
+	}
+	if codes := r.errorCodes(); len(codes) > 0 {
+		op["x-error-codes"] = codes
+		byStatus := map[string][]string{}
+		for _, code := range codes {
+			status := fmt.Sprint(statuses[code])
+			byStatus[status] = append(byStatus[status], code)
+		}
+		for status, codes := range byStatus {
+			addResponse(responses, status, "Refused ("+strings.Join(codes, ", ")+")")
+		}
+	}
+	if r.Deprecated {
+		op["deprecated"] = true
+		note := fmt.Sprintf("Deprecated, use %s %s instead.", r.Method, openAPIPath(r.Successor))
+		if description, ok := op["description"].(string); ok {
+			note = description + " " + note
+		}
+		op["description"] = note
+	}
+	return op
+}
+
+// addResponse documents status with description unless it already is
+func addResponse(responses map[string]interface{}, status, description string) {
+	if _, ok := responses[status]; !ok {
+		responses[status] = map[string]interface{}{"description": description}
+	}
+}
+
+func hasPathParam(params []map[string]interface{}, name string) bool {
+	for _, p := range params {
+		if p["name"] == name && p["in"] == "path" {
+			return true
+		}
+	}
+	return false
+}
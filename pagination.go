@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// pagination is the page/page_size pair shared by list endpoints
+type pagination struct {
+	Page     int
+	PageSize int
+}
+
+// parsePagination reads ?page= and ?page_size= (page_size capped at 100)
+func parsePagination(c *fiber.Ctx) (pagination, error) {
+	p := pagination{Page: 1, PageSize: defaultPageSize}
+	if s := c.Query("page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return p, &ValidationError{Message: "page must be a positive integer"}
+		}
+		p.Page = n
+	}
+	if s := c.Query("page_size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return p, &ValidationError{Message: "page_size must be a positive integer"}
+		}
+		if n > maxPageSize {
+			n = maxPageSize
+		}
+		p.PageSize = n
+	}
+	return p, nil
+}
+
+func (p pagination) Offset() int {
+	return (p.Page - 1) * p.PageSize
+}
+
+// Meta is the pagination block returned alongside list results
+func (p pagination) Meta(total int64) fiber.Map {
+	totalPages := (total + int64(p.PageSize) - 1) / int64(p.PageSize)
+	return fiber.Map{
+		"total":       total,
+		"page":        p.Page,
+		"page_size":   p.PageSize,
+		"total_pages": totalPages,
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const defaultMinPasswordLength = 8
+
+// bcryptCost reads BCRYPT_COST (default bcrypt.DefaultCost); validateConfig
+// has already rejected values outside bcrypt's range
+func bcryptCost() int {
+	return envPositiveInt("BCRYPT_COST", bcrypt.DefaultCost)
+}
+
+// upgradePasswordHash re-hashes a just-verified password whose stored hash
+// was made at a lower cost than BCRYPT_COST, so raising the cost migrates
+// users as they log in. The update is skipped if the password changed in
+// the meantime.
+func upgradePasswordHash(userID uint, password, hash string) {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil || cost >= bcryptCost() {
+		return
+	}
+	upgraded, err := hashPassword(password)
+	if err != nil {
+		log.Printf("rehash password of user %d: %v", userID, err)
+		return
+	}
+	if err := db.Model(&User{}).Where("id = ? AND password = ?", userID, hash).
+		Update("password", upgraded).Error; err != nil {
+		log.Printf("store rehashed password of user %d: %v", userID, err)
+	}
+}
+
+// minPasswordLength reads MIN_PASSWORD_LENGTH (default 8)
+func minPasswordLength() int {
+	return envPositiveInt("MIN_PASSWORD_LENGTH", defaultMinPasswordLength)
+}
+
+// commonPasswords are widely used passwords that would otherwise pass the
+// length, letter and digit rules; compared case-insensitively
+var commonPasswords = map[string]bool{
+	"password1": true, "password12": true, "password123": true, "passw0rd": true, "p@ssw0rd": true,
+	"p@ssword1": true, "qwerty123": true, "qwerty12": true, "qwerty1234": true, "1qaz2wsx": true,
+	"zaq12wsx": true, "1q2w3e4r": true, "q1w2e3r4": true, "1q2w3e4r5t": true, "abc12345": true,
+	"abcd1234": true, "abc123456": true, "a1234567": true, "a12345678": true, "aa123456": true,
+	"asdf1234": true, "1234qwer": true, "qwe12345": true, "123456789a": true, "1234567890a": true,
+	"test1234": true, "admin123": true, "admin1234": true, "welcome1": true, "welcome123": true,
+	"letmein1": true, "iloveyou1": true, "iloveyou2": true, "trustno1": true, "sunshine1": true,
+	"princess1": true, "football1": true, "baseball1": true, "superman1": true, "monkey123": true,
+	"dragon123": true, "master123": true, "michael1": true, "charlie1": true, "shadow123": true,
+	"changeme1": true, "secret123": true, "computer1": true, "internet1": true, "hello123": true,
+}
+
+// validatePassword is the single password policy for every endpoint that
+// sets a password. personal holds the account's own identifiers (email,
+// member ID), which can't be used as the password. It reports every rule
+// the password breaks.
+func validatePassword(password string, personal ...string) error {
+	var failed []string
+	if n := minPasswordLength(); utf8.RuneCountInString(password) < n {
+		failed = append(failed, fmt.Sprintf("at least %d characters", n))
+	}
+	if !strings.ContainsFunc(password, unicode.IsLetter) {
+		failed = append(failed, "at least one letter")
+	}
+	if !strings.ContainsFunc(password, unicode.IsDigit) {
+		failed = append(failed, "at least one digit")
+	}
+	for _, p := range personal {
+		local, _, _ := strings.Cut(p, "@")
+		if p != "" && (strings.EqualFold(password, p) || strings.EqualFold(password, local)) {
+			failed = append(failed, "not your email or member ID")
+			break
+		}
+	}
+	if commonPasswords[strings.ToLower(password)] {
+		failed = append(failed, "not a commonly used password")
+	}
+	if len(failed) > 0 {
+		return &PasswordPolicyError{FailedRules: failed}
+	}
+	return nil
+}
+
+var passwordChangeLimiter = newAttemptLimiter(5, 15*time.Minute)
+
+// Change the password of the logged-in user. Every existing session is
+// signed out; the caller gets a fresh token pair in the response.
+func changePasswordHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+
+	var payload struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	if payload.CurrentPassword == "" || payload.NewPassword == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "current_password and new_password required"})
+	}
+	if !passwordChangeLimiter.Allow(fmt.Sprint(user.ID)) {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "too many requests"})
+	}
+	ip := clientIP(c)
+	if err := checkPasswordHash(payload.CurrentPassword, user.Password); err != nil {
+		log.Printf("audit: password change denied user=%d ip=%s", user.ID, ip)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "current password is incorrect"})
+	}
+	if err := validatePassword(payload.NewPassword, user.Email, user.MemberID); err != nil {
+		return writeError(c, err)
+	}
+	hash, err := hashPassword(payload.NewPassword)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to hash password"})
+	}
+
+	err = withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		if err := tx.Model(&User{}).Where("id = ?", user.ID).Update("password", hash).Error; err != nil {
+			return err
+		}
+		// reset links, sessions and elevation granted under the old password stop working
+		if err := tx.Model(&PasswordReset{}).Where("user_id = ? AND used_at IS NULL", user.ID).
+			Update("used_at", time.Now()).Error; err != nil {
+			return err
+		}
+		if err := revokeElevatedTokens(tx, user.ID); err != nil {
+			return err
+		}
+		return tx.Model(&RefreshToken{}).Where("user_id = ? AND revoked = ?", user.ID, false).
+			Update("revoked", true).Error
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to change password"})
+	}
+	if claims, ok := c.Locals("claims").(jwt.RegisteredClaims); ok {
+		if err := revokeAccessToken(claims); err != nil {
+			log.Printf("revoke access token after password change for user %d: %v", user.ID, err)
+		}
+	}
+	log.Printf("audit: password changed user=%d ip=%s", user.ID, ip)
+
+	tokens, err := issueTokens(user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate token"})
+	}
+	return c.JSON(tokens)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoginRehashesCheaperPassword(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	user := createUser(t, 0) // hashed at the harness's BCRYPT_COST of 4
+	login := func(password string) int {
+		status, _ := doJSON(t, app, fiber.MethodPost, "/login", "", fiber.Map{"email": user.Email, "password": password})
+		return status
+	}
+	costOf := func() int {
+		cost, err := bcrypt.Cost([]byte(reloadUser(t, user).Password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cost
+	}
+
+	t.Setenv("BCRYPT_COST", "5")
+	if status := login("Wrong2024pass"); status != fiber.StatusUnauthorized {
+		t.Fatalf("wrong password: status %d", status)
+	}
+	if cost := costOf(); cost != 4 {
+		t.Fatalf("failed login rehashed the password at cost %d", cost)
+	}
+
+	if status := login(testPassword); status != fiber.StatusOK {
+		t.Fatalf("login: status %d", status)
+	}
+	// the rehash is done by the time the login answers
+	if cost := costOf(); cost != 5 {
+		t.Fatalf("cost after login = %d, want 5", cost)
+	}
+	if err := checkPasswordHash(testPassword, reloadUser(t, user).Password); err != nil {
+		t.Fatalf("rehashed password doesn't verify: %v", err)
+	}
+
+	// a hash already at or above the cost is left alone
+	hash := reloadUser(t, user).Password
+	t.Setenv("BCRYPT_COST", "4")
+	if status := login(testPassword); status != fiber.StatusOK {
+		t.Fatalf("second login: status %d", status)
+	}
+	if got := reloadUser(t, user).Password; got != hash {
+		t.Error("password rehashed at a lower cost")
+	}
+}
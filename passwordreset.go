@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// PasswordReset is a single-use token emailed to let a user set a new
+// password without knowing the old one
+type PasswordReset struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"index;not null"`
+	TokenHash string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	IP        string
+	CreatedAt time.Time
+}
+
+const passwordResetTTL = time.Hour
+
+var (
+	passwordResetEmailLimiter = newAttemptLimiter(3, 15*time.Minute)
+	passwordResetIPLimiter    = newAttemptLimiter(10, 15*time.Minute)
+)
+
+func init() {
+	registerInvariant("password_reset_orphaned",
+		"password resets whose user doesn't exist",
+		`SELECT x.id FROM password_resets x LEFT JOIN users u ON u.id = x.user_id WHERE u.id IS NULL`)
+}
+
+// passwordResetURL builds the deep link the app opens (PASSWORD_RESET_URL)
+func passwordResetURL(token string) string {
+	base := os.Getenv("PASSWORD_RESET_URL")
+	if base == "" {
+		base = "lbkpoints://auth/reset-password"
+	}
+	return fmt.Sprintf("%s?token=%s", base, token)
+}
+
+// Request a password reset email; always 200 so emails can't be enumerated
+func forgotPasswordHandler(c *fiber.Ctx) error {
+	var payload struct {
+		Email string `json:"email"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	if payload.Email == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "email required"})
+	}
+	ip := clientIP(c)
+	if !passwordResetIPLimiter.Allow(ip) {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "too many requests"})
+	}
+	accepted := func() error {
+		return c.JSON(fiber.Map{"message": "if the account exists, a password reset link has been sent"})
+	}
+
+	email := strings.TrimSpace(payload.Email)
+	if !passwordResetEmailLimiter.Allow(strings.ToLower(email)) {
+		return accepted()
+	}
+	var user User
+	if err := db.Where("LOWER(email) = ?", normalizeEmail(email)).First(&user).Error; err != nil {
+		return accepted()
+	}
+	token, err := randomToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate token"})
+	}
+	reset := PasswordReset{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(passwordResetTTL),
+		IP:        ip,
+	}
+	if err := db.Create(&reset).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create password reset"})
+	}
+	body := fmt.Sprintf("Tap the link below to choose a new password. It expires in 1 hour and can only be used once.\n\n"+
+		"If you didn't ask to reset your password you can ignore this email.\n\n%s", passwordResetURL(token))
+	if err := mailer.Send(user.Email, "Reset your LBK password", body); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to send password reset"})
+	}
+	return accepted()
+}
+
+// Set a new password with a reset token
+func resetPasswordHandler(c *fiber.Ctx) error {
+	var payload struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	if payload.Token == "" || payload.NewPassword == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "token and new_password required"})
+	}
+	// look the account up without consuming the token so the policy can
+	// check the password against its email and member ID
+	var owner User
+	err := db.Joins("JOIN password_resets r ON r.user_id = users.id").
+		Where("r.token_hash = ? AND r.used_at IS NULL AND r.expires_at > ?", hashToken(payload.Token), time.Now()).
+		First(&owner).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid or expired reset token"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to reset password"})
+	}
+	if err := validatePassword(payload.NewPassword, owner.Email, owner.MemberID); err != nil {
+		return writeError(c, err)
+	}
+	hash, err := hashPassword(payload.NewPassword)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to hash password"})
+	}
+
+	invalid := false
+	err = withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		now := time.Now()
+		// consume in a single conditional update so the token works only once
+		res := tx.Model(&PasswordReset{}).
+			Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashToken(payload.Token), now).
+			Update("used_at", now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 1 {
+			invalid = true
+			return nil
+		}
+		var reset PasswordReset
+		if err := tx.Where("token_hash = ?", hashToken(payload.Token)).First(&reset).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&User{}).Where("id = ?", reset.UserID).Update("password", hash).Error; err != nil {
+			return err
+		}
+		// the reset link arrived by email, so the address is proven
+		if err := markEmailVerified(tx, reset.UserID); err != nil {
+			return err
+		}
+		// other outstanding reset links, existing sessions and elevation die
+		// with the old password
+		if err := tx.Model(&PasswordReset{}).Where("user_id = ? AND used_at IS NULL", reset.UserID).
+			Update("used_at", now).Error; err != nil {
+			return err
+		}
+		if err := revokeElevatedTokens(tx, reset.UserID); err != nil {
+			return err
+		}
+		return tx.Model(&RefreshToken{}).Where("user_id = ? AND revoked = ?", reset.UserID, false).
+			Update("revoked", true).Error
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to reset password"})
+	}
+	if invalid {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid or expired reset token"})
+	}
+	return c.JSON(fiber.Map{"message": "password has been reset"})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Transfers above TRANSFER_CONFIRM_THRESHOLD are created as pending and
+// only move points once the sender confirms them. No points are held while
+// a transfer is pending; the balance and daily limit are checked again on
+// confirmation. Unconfirmed transfers fail after pendingTransferTTL.
+// Pending transfers waiting for the recipient instead are in accept.go.
+const (
+	defaultTransferConfirmThreshold = 10000
+	pendingTransferTTL              = 10 * time.Minute
+	pendingTransferSweepInterval    = time.Minute
+)
+
+// transferConfirmThreshold is the largest amount that transfers without a
+// confirmation step (TRANSFER_CONFIRM_THRESHOLD, default 10000)
+func transferConfirmThreshold() int64 {
+	return int64(envPositiveInt("TRANSFER_CONFIRM_THRESHOLD", defaultTransferConfirmThreshold))
+}
+
+// createPendingTransfer records req's transfer awaiting confirmation
+func createPendingTransfer(fromUser, toUser User, req transferRequest) (*transferResult, error) {
+	amount := req.Amount
+	// fail early rather than at confirmation if the limit is already in the way
+	if err := checkTransferLimits(db, fromUser, amount); err != nil {
+		return nil, err
+	}
+	result := &transferResult{Recipient: toUser, Remaining: fromUser.Points, Pending: true}
+	err := withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		result.Transaction = Transaction{
+			FromUserID:  fromUser.ID,
+			ToUserID:    toUser.ID,
+			Amount:      amount,
+			Type:        "transfer",
+			Status:      "pending",
+			Description: fmt.Sprintf("Transfer to %s %s", toUser.FirstName, toUser.LastName),
+			Note:        req.Note,
+		}
+		if err := tx.Create(&result.Transaction).Error; err != nil {
+			return fmt.Errorf("create transaction record: %w", err)
+		}
+		if err := recordTransactionCreated(tx, &result.Transaction, actorUser, fromUser.ID); err != nil {
+			return err
+		}
+		status, body := transferResponse(result)
+		return req.Idempotency.store(tx, status, body)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pending transfer from user %d: %w", fromUser.ID, err)
+	}
+	return result, nil
+}
+
+func pendingTransferResponse(result *transferResult) fiber.Map {
+	return fiber.Map{
+		"message":         "Transfer awaiting confirmation",
+		"confirmation_id": result.Transaction.ID,
+		"amount":          result.Transaction.Amount,
+		"expires_at":      result.Transaction.CreatedAt.Add(pendingTransferTTL),
+		"recipient": fiber.Map{
+			"member_id":  result.Recipient.MemberID,
+			"first_name": result.Recipient.FirstName,
+			"last_name":  result.Recipient.LastName,
+		},
+	}
+}
+
+// Confirm a pending transfer, moving the points
+func confirmTransferHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+	var payload struct {
+		ConfirmationID uint `json:"confirmation_id"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	if payload.ConfirmationID == 0 {
+		return writeError(c, &ValidationError{Message: "confirmation_id required"})
+	}
+
+	var txn Transaction
+	if err := db.Where("id = ? AND from_user_id = ? AND status = ? AND NOT accept_required", payload.ConfirmationID, user.ID, "pending").
+		Preload("ToUser").First(&txn).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return writeError(c, ErrTransactionNotFound)
+		}
+		return writeError(c, err)
+	}
+	if time.Since(txn.CreatedAt) > pendingTransferTTL {
+		if err := expirePendingTransfer(txn); err != nil {
+			return writeError(c, err)
+		}
+		return writeError(c, ErrConfirmationExpired)
+	}
+
+	var remaining int64
+	err := withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		// points move before the status changes so the daily limit doesn't
+		// count this transfer twice; the status guard in the transition
+		// rolls back a double confirmation
+		if err := movePoints(tx, user, txn.ToUserID, txn.Amount); err != nil {
+			return err
+		}
+		if err := transitionTransaction(tx, &txn, "completed", actorUser, user.ID, "confirmed by sender"); err != nil {
+			return err
+		}
+		fromAfter, toAfter, err := balancesOf(tx, user.ID, txn.ToUserID)
+		if err != nil {
+			return err
+		}
+		remaining = fromAfter
+		return tx.Model(&txn).Updates(Transaction{FromBalanceAfter: &fromAfter, ToBalanceAfter: &toAfter}).Error
+	})
+	if err != nil {
+		return writeError(c, fmt.Errorf("confirm transfer %d: %w", txn.ID, err))
+	}
+	return c.JSON(fiber.Map{
+		"message":            "Transfer successful",
+		"transaction_id":     txn.ID,
+		"remaining_points":   remaining,
+		"transferred_amount": txn.Amount,
+		"recipient": fiber.Map{
+			"member_id":  txn.ToUser.MemberID,
+			"first_name": txn.ToUser.FirstName,
+			"last_name":  txn.ToUser.LastName,
+		},
+	})
+}
+
+// expirePendingTransfer fails a pending transfer that was never confirmed
+func expirePendingTransfer(txn Transaction) error {
+	return withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		return transitionTransaction(tx, &txn, "failed", actorSystem, 0, "confirmation expired")
+	})
+}
+
+// startPendingTransferExpiry fails unconfirmed transfers once they expire
+func startPendingTransferExpiry() {
+	sweep := func() {
+		var expired []Transaction
+		if err := db.Where("status = ? AND NOT accept_required AND created_at < ?", "pending", time.Now().Add(-pendingTransferTTL)).
+			Find(&expired).Error; err != nil {
+			log.Printf("find expired pending transfers: %v", err)
+			return
+		}
+		for _, txn := range expired {
+			if err := expirePendingTransfer(txn); err != nil {
+				log.Printf("expire pending transfer %d: %v", txn.ID, err)
+			}
+		}
+	}
+	sweep()
+	go func() {
+		for range time.Tick(pendingTransferSweepInterval) {
+			sweep()
+		}
+	}()
+}
+
+// cancelTransferTx cancels pending txn on behalf of its sender inside tx,
+// returning any held points and recording who cancelled it and when
+func cancelTransferTx(tx *gorm.DB, txn *Transaction, senderID uint, reason string) error {
+	if txn.AcceptRequired {
+		if err := returnHeldTransferTx(tx, *txn, "cancelled", actorUser, senderID, reason); err != nil {
+			return err
+		}
+		txn.Status = "cancelled"
+	} else if err := transitionTransaction(tx, txn, "cancelled", actorUser, senderID, reason); err != nil {
+		return err
+	}
+	now := time.Now()
+	txn.CancelledBy, txn.CancelledAt = &senderID, &now
+	return tx.Model(txn).Updates(Transaction{CancelledBy: &senderID, CancelledAt: &now}).Error
+}
+
+// Cancel one of your pending transfers before it's confirmed or accepted
+func cancelTransferHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return writeError(c, ErrTransactionNotFound)
+	}
+
+	var txn Transaction
+	var remaining int64
+	err = withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		// lock the row so an acceptance can't slip in between the checks
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&txn, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrTransactionNotFound
+			}
+			return fmt.Errorf("find transaction: %w", err)
+		}
+		if txn.FromUserID != user.ID {
+			return ErrNotTransferSender
+		}
+		if txn.Status != "pending" {
+			return &TransferNotPendingError{Status: txn.Status}
+		}
+		if err := cancelTransferTx(tx, &txn, user.ID, "cancelled by sender"); err != nil {
+			return err
+		}
+		var err error
+		remaining, err = balanceOf(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return writeError(c, fmt.Errorf("cancel transfer %d: %w", id, err))
+	}
+	log.Printf("audit: transfer cancelled id=%d user=%d amount=%d", txn.ID, user.ID, txn.Amount)
+	var refunded int64
+	if txn.AcceptRequired {
+		refunded = txn.Amount
+	}
+	return c.JSON(fiber.Map{
+		"message":          "Transfer cancelled",
+		"transaction_id":   txn.ID,
+		"status":           txn.Status,
+		"refunded_amount":  refunded,
+		"remaining_points": remaining,
+		"cancelled_at":     txn.CancelledAt,
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// A 6-digit transfer PIN guards every transfer, so a stolen access token
+// alone can't move points. Wrong PINs lock the PIN (not the login) for
+// pinLockDuration after pinMaxAttempts failures.
+const (
+	pinMaxAttempts  = 5
+	pinLockDuration = 30 * time.Minute
+)
+
+var (
+	pinPattern    = regexp.MustCompile(`^\d{6}$`)
+	pinSetLimiter = newAttemptLimiter(5, 15*time.Minute)
+)
+
+// verifyTransferPin checks pin against the user's PIN, counting failures
+// and locking the PIN once they reach pinMaxAttempts
+func verifyTransferPin(user User, pin string) error {
+	if user.PinHash == "" {
+		return ErrPinNotSet
+	}
+	if user.PinLockedUntil != nil && user.PinLockedUntil.After(time.Now()) {
+		return ErrPinLocked
+	}
+	if pin == "" {
+		return &ValidationError{Message: "pin required", Fields: map[string]string{"pin": "required"}}
+	}
+	if err := checkPasswordHash(pin, user.PinHash); err == nil {
+		if user.PinFailedAttempts > 0 {
+			if err := db.Model(&User{}).Where("id = ?", user.ID).Update("pin_failed_attempts", 0).Error; err != nil {
+				return fmt.Errorf("reset pin attempts: %w", err)
+			}
+		}
+		return nil
+	}
+
+	locked := false
+	err := withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		if err := tx.Model(&User{}).Where("id = ?", user.ID).
+			Update("pin_failed_attempts", gorm.Expr("pin_failed_attempts + 1")).Error; err != nil {
+			return err
+		}
+		var attempts int
+		if err := tx.Model(&User{}).Where("id = ?", user.ID).Select("pin_failed_attempts").Scan(&attempts).Error; err != nil {
+			return err
+		}
+		if attempts < pinMaxAttempts {
+			return nil
+		}
+		locked = true
+		return tx.Model(&User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+			"pin_failed_attempts": 0,
+			"pin_locked_until":    time.Now().Add(pinLockDuration),
+		}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("record pin failure: %w", err)
+	}
+	if locked {
+		log.Printf("audit: transfer pin locked user=%d", user.ID)
+		return ErrPinLocked
+	}
+	return ErrPinInvalid
+}
+
+// Set or change the transfer PIN; the route needs elevation, and the current
+// password is required either way when the account has one
+func setPinHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+
+	var payload struct {
+		CurrentPassword string `json:"current_password"`
+		Pin             string `json:"pin"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	if (hasPassword(user) && payload.CurrentPassword == "") || payload.Pin == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "current_password and pin required"})
+	}
+	if !pinPattern.MatchString(payload.Pin) {
+		return writeError(c, &ValidationError{Message: "pin must be exactly 6 digits", Fields: map[string]string{"pin": "must be exactly 6 digits"}})
+	}
+	if !pinSetLimiter.Allow(fmt.Sprint(user.ID)) {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "too many requests"})
+	}
+	ip := clientIP(c)
+	if !passwordConfirmed(user, payload.CurrentPassword) {
+		log.Printf("audit: pin change denied user=%d ip=%s", user.ID, ip)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "current password is incorrect"})
+	}
+	hash, err := hashPassword(payload.Pin)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to hash pin"})
+	}
+	// a new PIN also clears any lock on the old one
+	if err := db.Model(&User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+		"pin_hash":            hash,
+		"pin_failed_attempts": 0,
+		"pin_locked_until":    nil,
+	}).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to set pin"})
+	}
+	log.Printf("audit: transfer pin set user=%d ip=%s", user.ID, ip)
+	return c.JSON(fiber.Map{"message": "pin set"})
+}
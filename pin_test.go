@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestSetPinRequiresElevation(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	user := createUser(t, 0)
+	token := tokenFor(t, user)
+	payload := fiber.Map{"current_password": testPassword, "pin": "654321"}
+
+	status, body := doJSON(t, app, fiber.MethodPost, "/me/pin", token, payload)
+	if status != fiber.StatusUnauthorized || errorCodeOf(body) != "ELEVATION_REQUIRED" {
+		t.Fatalf("without elevation: status %d, body %v", status, body)
+	}
+
+	status, body = doJSON(t, app, fiber.MethodPost, "/me/pin", token, payload, elevationHeader, elevatedTokenFor(t, user))
+	if status != fiber.StatusOK {
+		t.Fatalf("with elevation: status %d, body %v", status, body)
+	}
+	if err := checkPasswordHash("654321", reloadUser(t, user).PinHash); err != nil {
+		t.Errorf("pin not changed: %v", err)
+	}
+}
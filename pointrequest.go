@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Members ask another member for points with a PointRequest. The payer
+// pays it through transferPoints like any transfer, and the request is
+// marked fulfilled with the resulting transaction in the same DB
+// transaction, so a request can't be paid twice. Requests the payer
+// neither pays nor declines expire after pointRequestTTL.
+type PointRequest struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	RequesterID   uint      `json:"requester_id" gorm:"index;not null"`
+	PayerID       uint      `json:"payer_id" gorm:"index;not null"`
+	Requester     User      `json:"-" gorm:"foreignKey:RequesterID"`
+	Payer         User      `json:"-" gorm:"foreignKey:PayerID"`
+	Amount        int64     `json:"amount"`
+	Note          string    `json:"note"`
+	Status        string    `json:"status" gorm:"not null;default:'pending'"` // pending, fulfilled, declined, expired
+	TransactionID *uint     `json:"transaction_id"`                           // the payment, once fulfilled
+	ExpiresAt     time.Time `json:"expires_at" gorm:"index"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"-"`
+}
+
+const (
+	pointRequestTTL           = 7 * 24 * time.Hour
+	pointRequestSweepInterval = time.Hour
+)
+
+func init() {
+	registerInvariant("point_request_payment_mismatch",
+		"fulfilled point requests whose transaction doesn't pay them",
+		`SELECT r.id FROM point_requests r
+			LEFT JOIN transactions t ON t.id = r.transaction_id
+			WHERE r.status = 'fulfilled'
+				AND (t.id IS NULL OR t.amount <> r.amount OR t.from_user_id <> r.payer_id OR t.to_user_id <> r.requester_id)`)
+}
+
+// effectiveStatus is the request's status, counting a pending request past
+// its expiry as expired before the sweep gets to it
+func (r PointRequest) effectiveStatus(now time.Time) string {
+	if r.Status == "pending" && !now.Before(r.ExpiresAt) {
+		return "expired"
+	}
+	return r.Status
+}
+
+// fulfil marks the request paid by txn inside tx. The status guard makes a
+// concurrent second payment fail, rolling its transfer back. A nil request
+// does nothing.
+func (r *PointRequest) fulfil(tx *gorm.DB, txn Transaction) error {
+	if r == nil {
+		return nil
+	}
+	res := tx.Model(&PointRequest{}).Where("id = ? AND status = ?", r.ID, "pending").
+		Updates(map[string]interface{}{"status": "fulfilled", "transaction_id": txn.ID})
+	if res.Error != nil {
+		return fmt.Errorf("fulfil point request %d: %w", r.ID, res.Error)
+	}
+	if res.RowsAffected != 1 {
+		return pointRequestNoLongerPending(tx, r.ID)
+	}
+	r.Status, r.TransactionID = "fulfilled", &txn.ID
+	return nil
+}
+
+// pointRequestNoLongerPending reports request id, which another payment,
+// decline or the expiry sweep got to first, as no longer pending
+func pointRequestNoLongerPending(tx *gorm.DB, id uint) error {
+	var status string
+	if err := tx.Model(&PointRequest{}).Where("id = ?", id).Select("status").Scan(&status).Error; err != nil {
+		return fmt.Errorf("read point request %d: %w", id, err)
+	}
+	return &PointRequestNotPendingError{Status: status}
+}
+
+// formatPointRequest renders a request from the point of view of userID
+func formatPointRequest(r PointRequest, userID uint) fiber.Map {
+	direction, contact := "outgoing", r.Payer
+	if r.PayerID == userID {
+		direction, contact = "incoming", r.Requester
+	}
+	return fiber.Map{
+		"id":                r.ID,
+		"direction":         direction,
+		"contact_name":      fmt.Sprintf("%s %s", contact.FirstName, contact.LastName),
+		"contact_member_id": contact.MemberID,
+		"amount":            r.Amount,
+		"note":              r.Note,
+		"status":            r.effectiveStatus(time.Now()),
+		"transaction_id":    r.TransactionID,
+		"expires_at":        r.ExpiresAt,
+		"created_at":        r.CreatedAt,
+	}
+}
+
+// Ask another member for points
+func createPointRequestHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+	var payload struct {
+		MemberID string `json:"member_id"`
+		Amount   int64  `json:"amount"`
+		Note     string `json:"note"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	if !user.EmailVerified {
+		return writeError(c, ErrEmailNotVerified)
+	}
+	// the payment goes to the requester's member ID
+	if user.MemberID == "" {
+		return writeError(c, ErrMemberIDRequired)
+	}
+	if payload.MemberID == "" || payload.Amount <= 0 {
+		return writeError(c, &ValidationError{Message: "member_id and positive amount required"})
+	}
+	note := sanitizeNote(payload.Note)
+	if utf8.RuneCountInString(note) > maxTransferNoteLength {
+		tooLong := fmt.Sprintf("must be at most %d characters", maxTransferNoteLength)
+		return writeError(c, &ValidationError{Message: "note " + tooLong, Fields: map[string]string{"note": tooLong}})
+	}
+	if payload.MemberID == user.MemberID {
+		return writeError(c, &ValidationError{Message: "cannot request points from yourself", Fields: map[string]string{"member_id": "must be another member"}})
+	}
+	payer, err := findRecipient(payload.MemberID)
+	if err != nil {
+		return writeError(c, err)
+	}
+	// the same pairs transferPoints would refuse
+	if payer.IsSynthetic != user.IsSynthetic {
+		return writeError(c, ErrSyntheticMismatch)
+	}
+	if !allowCrossPartner() && payer.PartnerID != user.PartnerID {
+		return writeError(c, ErrCrossPartner)
+	}
+
+	request := PointRequest{
+		RequesterID: user.ID,
+		PayerID:     payer.ID,
+		Amount:      payload.Amount,
+		Note:        note,
+		Status:      "pending",
+		ExpiresAt:   time.Now().Add(pointRequestTTL),
+		Payer:       payer,
+	}
+	if err := db.Omit("Requester", "Payer").Create(&request).Error; err != nil {
+		return writeError(c, fmt.Errorf("create point request: %w", err))
+	}
+	return c.Status(fiber.StatusCreated).JSON(formatPointRequest(request, user.ID))
+}
+
+// List the current user's incoming and outgoing point requests, newest first
+func listPointRequestsHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+	page, err := parsePagination(c)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	var mine *gorm.DB
+	switch c.Query("direction") {
+	case "":
+		mine = db.Model(&PointRequest{}).Where("requester_id = ? OR payer_id = ?", user.ID, user.ID)
+	case "incoming":
+		mine = db.Model(&PointRequest{}).Where("payer_id = ?", user.ID)
+	case "outgoing":
+		mine = db.Model(&PointRequest{}).Where("requester_id = ?", user.ID)
+	default:
+		return writeError(c, &ValidationError{Message: "direction must be incoming or outgoing"})
+	}
+	var total int64
+	if err := mine.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return writeError(c, fmt.Errorf("count point requests: %w", err))
+	}
+	var requests []PointRequest
+	if err := mine.Session(&gorm.Session{}).
+		Preload("Requester", withDeleted).
+		Preload("Payer", withDeleted).
+		Order("created_at DESC, id DESC").
+		Limit(page.PageSize).
+		Offset(page.Offset()).
+		Find(&requests).Error; err != nil {
+		return writeError(c, fmt.Errorf("list point requests: %w", err))
+	}
+	formatted := make([]fiber.Map, 0, len(requests))
+	for _, r := range requests {
+		formatted = append(formatted, formatPointRequest(r, user.ID))
+	}
+	return c.JSON(fiber.Map{
+		"requests":   formatted,
+		"pagination": page.Meta(total),
+	})
+}
+
+// findIncomingPointRequest loads request id for payer to act on. It must be
+// addressed to them and still pending; one found past its expiry is marked
+// expired.
+func findIncomingPointRequest(c *fiber.Ctx, payer User) (PointRequest, error) {
+	var request PointRequest
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return request, ErrPointRequestNotFound
+	}
+	if err := db.First(&request, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return request, ErrPointRequestNotFound
+		}
+		return request, fmt.Errorf("find point request: %w", err)
+	}
+	if request.PayerID != payer.ID {
+		return request, ErrNotRequestPayer
+	}
+	if status := request.effectiveStatus(time.Now()); status == "expired" && request.Status == "pending" {
+		if err := db.Model(&PointRequest{}).Where("id = ? AND status = ?", request.ID, "pending").
+			Update("status", "expired").Error; err != nil {
+			return request, fmt.Errorf("expire point request: %w", err)
+		}
+		return request, ErrPointRequestExpired
+	}
+	if request.Status != "pending" {
+		return request, &PointRequestNotPendingError{Status: request.Status}
+	}
+	return request, nil
+}
+
+// Pay a point request addressed to you, transferring the amount to the requester
+func payPointRequestHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+	var payload struct {
+		Pin          string `json:"pin"`
+		ConfirmLarge bool   `json:"confirm_large"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	request, err := findIncomingPointRequest(c, user)
+	if err != nil {
+		return writeError(c, err)
+	}
+	var requester User
+	if err := db.First(&requester, request.RequesterID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return writeError(c, ErrRecipientNotFound)
+		}
+		return writeError(c, fmt.Errorf("find requester: %w", err))
+	}
+
+	result, err := transferPoints(user, transferRequest{
+		ToMemberID:   requester.MemberID,
+		Amount:       request.Amount,
+		ConfirmLarge: payload.ConfirmLarge,
+		Pin:          payload.Pin,
+		Note:         request.Note,
+		Fulfils:      &request,
+	})
+	if err != nil {
+		return writeError(c, err)
+	}
+	log.Printf("audit: point request paid id=%d payer=%d transaction=%d", request.ID, user.ID, result.Transaction.ID)
+	status, body := transferResponse(result)
+	body["request_id"] = request.ID
+	return c.Status(status).JSON(body)
+}
+
+// Decline a point request addressed to you
+func declinePointRequestHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+	request, err := findIncomingPointRequest(c, user)
+	if err != nil {
+		return writeError(c, err)
+	}
+	res := db.Model(&PointRequest{}).Where("id = ? AND status = ?", request.ID, "pending").Update("status", "declined")
+	if res.Error != nil {
+		return writeError(c, fmt.Errorf("decline point request: %w", res.Error))
+	}
+	if res.RowsAffected != 1 {
+		return writeError(c, pointRequestNoLongerPending(db, request.ID))
+	}
+	return c.JSON(fiber.Map{"message": "Request declined", "request_id": request.ID, "status": "declined"})
+}
+
+// startPointRequestExpiry marks requests past their expiry as expired,
+// once now and then every pointRequestSweepInterval
+func startPointRequestExpiry() {
+	sweep := func() {
+		if err := db.Model(&PointRequest{}).Where("status = ? AND expires_at <= ?", "pending", time.Now()).
+			Update("status", "expired").Error; err != nil {
+			log.Printf("expire point requests: %v", err)
+		}
+	}
+	sweep()
+	go func() {
+		for range time.Tick(pointRequestSweepInterval) {
+			sweep()
+		}
+	}()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const maxNameLength = 100
+
+// Thai mobile numbers: 06/08/09 followed by 8 digits, optionally written
+// with dashes or spaces, or in +66 form without the leading zero.
+// PHONE_PATTERN replaces it; it's matched after dashes and spaces are removed.
+var thaiMobilePattern = regexp.MustCompile(`^(?:0|\+66)[689]\d{8}$`)
+
+var (
+	phonePatternOnce sync.Once
+	phonePatternRe   *regexp.Regexp
+)
+
+// phonePattern returns the regex phone numbers must match (validateConfig
+// has already rejected an invalid PHONE_PATTERN)
+func phonePattern() *regexp.Regexp {
+	phonePatternOnce.Do(func() {
+		phonePatternRe = thaiMobilePattern
+		if s := os.Getenv("PHONE_PATTERN"); s != "" {
+			phonePatternRe = regexp.MustCompile(s)
+		}
+	})
+	return phonePatternRe
+}
+
+// profileEditableFields are the keys PUT and PATCH /me accept
+var profileEditableFields = map[string]bool{
+	"first_name": true,
+	"last_name":  true,
+	"phone":      true,
+	"birthday":   true,
+}
+
+func normalizePhone(phone string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(phone))
+}
+
+// validateProfileField checks one editable field and returns the value to
+// store, or a message describing the problem
+func validateProfileField(name, value string) (string, string) {
+	value = strings.TrimSpace(value)
+	switch name {
+	case "first_name", "last_name":
+		if len([]rune(value)) > maxNameLength {
+			return "", "must be at most 100 characters"
+		}
+	case "phone":
+		if value == "" {
+			return "", ""
+		}
+		if !phonePattern().MatchString(normalizePhone(value)) {
+			if os.Getenv("PHONE_PATTERN") != "" {
+				return "", "is not a valid phone number"
+			}
+			return "", "must be a Thai mobile number, e.g. 081-234-5678"
+		}
+	case "birthday":
+		if value == "" {
+			return "", ""
+		}
+		day, err := parseBirthday(value, time.Now())
+		if err != nil {
+			return "", err.Error()
+		}
+		value = day.Format("2006-01-02")
+	}
+	return value, ""
+}
+
+// parseProfileUpdate reads a partial profile from the request body. Only
+// the keys present are returned, so absent fields keep their value.
+func parseProfileUpdate(c *fiber.Ctx) (map[string]interface{}, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(c.Body(), &raw); err != nil {
+		return nil, &ValidationError{Message: "invalid payload"}
+	}
+	userFields := map[string]bool{}
+	for _, name := range structFields(User{}) {
+		userFields[name] = true
+	}
+
+	updates := map[string]interface{}{}
+	problems := map[string]string{}
+	for key, val := range raw {
+		if !profileEditableFields[key] {
+			if userFields[key] || key == "password" {
+				problems[key] = "cannot be changed through this endpoint"
+			} else {
+				problems[key] = "unknown field"
+			}
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(val, &s); err != nil {
+			problems[key] = "must be a string"
+			continue
+		}
+		v, problem := validateProfileField(key, s)
+		if problem != "" {
+			problems[key] = problem
+			continue
+		}
+		updates[key] = v
+	}
+	if len(problems) > 0 {
+		return nil, &ValidationError{Message: "invalid profile update", Fields: problems}
+	}
+	if len(updates) == 0 {
+		return nil, &ValidationError{Message: "no profile fields to update"}
+	}
+	return updates, nil
+}
+
+// Update the current user's profile (first_name, last_name, phone,
+// birthday); serves both PUT and PATCH /me
+func updateProfileHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+
+	updates, err := parseProfileUpdate(c)
+	if err != nil {
+		return writeError(c, err)
+	}
+	if err := db.Model(&User{}).Where("id = ?", user.ID).Updates(updates).Error; err != nil {
+		return writeError(c, err)
+	}
+	if err := db.First(&user, user.ID).Error; err != nil {
+		return writeError(c, err)
+	}
+	// don't return password
+	user.Password = ""
+	return c.JSON(user)
+}
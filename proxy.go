@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// basePath is the prefix all routes are mounted under when the API sits
+// behind a gateway (BASE_PATH, e.g. /loyalty). Empty by default.
+func basePath() string {
+	p := strings.TrimRight(os.Getenv("BASE_PATH"), "/")
+	if p != "" && !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p
+}
+
+// trustedProxies lists the peers (IPs or CIDRs) whose forwarding headers we
+// believe (TRUSTED_PROXIES, comma separated)
+func trustedProxies() []string {
+	var proxies []string
+	for _, p := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			proxies = append(proxies, p)
+		}
+	}
+	return proxies
+}
+
+func validateTrustedProxies() error {
+	for _, p := range trustedProxies() {
+		if net.ParseIP(p) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(p); err != nil {
+			return fmt.Errorf("TRUSTED_PROXIES entry %q is not an IP or CIDR", p)
+		}
+	}
+	return nil
+}
+
+// isTrustedProxy reports whether ip is one of TRUSTED_PROXIES
+func isTrustedProxy(ip net.IP) bool {
+	for _, p := range trustedProxies() {
+		if trusted := net.ParseIP(p); trusted != nil {
+			if trusted.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		if _, network, err := net.ParseCIDR(p); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fiberConfig builds the app config. Forwarding headers (scheme, host) are
+// only honored when the direct peer is a trusted proxy; with no
+// TRUSTED_PROXIES nothing is trusted. The client IP is resolved by
+// requestIP rather than Fiber's ProxyHeader, which takes the leftmost
+// X-Forwarded-For entry: the client writes that one itself.
+func fiberConfig() fiber.Config {
+	return fiber.Config{
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          trustedProxies(),
+	}
+}
+
+// requestIP is the caller's address, so clients can't spoof it for rate
+// limits or audit logs. An untrusted peer is the client. Behind trusted
+// proxies, each hop appends the address it received the request from to
+// X-Forwarded-For, so reading it right to left and skipping our own proxies
+// finds the first address a trusted hop vouched for; anything left of that
+// came from the client and is ignored.
+func requestIP(c *fiber.Ctx) string {
+	client := c.Context().RemoteIP()
+	if !c.IsProxyTrusted() {
+		return client.String()
+	}
+	hops := strings.Split(c.Get(fiber.HeaderXForwardedFor), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			// a malformed hop can't be vouched for, nor anything before it
+			break
+		}
+		client = ip
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// forwardedParam reads a parameter from the first element of an RFC 7239
+// Forwarded header, e.g. proto or host
+func forwardedParam(header, name string) string {
+	first := strings.SplitN(header, ",", 2)[0]
+	for _, part := range strings.Split(first, ";") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], name) {
+			return strings.Trim(kv[1], `"`)
+		}
+	}
+	return ""
+}
+
+// externalURL builds an absolute URL for path as the client sees us:
+// PUBLIC_BASE_URL when set, otherwise scheme and host from the request,
+// honoring Forwarded/X-Forwarded-* headers only from trusted proxies, plus
+// the base path
+func externalURL(c *fiber.Ctx, path string) string {
+	if base := strings.TrimRight(os.Getenv("PUBLIC_BASE_URL"), "/"); base != "" {
+		return base + path
+	}
+	// Protocol and Hostname already honor X-Forwarded-Proto/Host from trusted peers
+	scheme, host := c.Protocol(), c.Hostname()
+	if fwd := c.Get(fiber.HeaderForwarded); fwd != "" && c.IsProxyTrusted() {
+		if p := forwardedParam(fwd, "proto"); p != "" {
+			scheme = p
+		}
+		if h := forwardedParam(fwd, "host"); h != "" {
+			host = h
+		}
+	}
+	return fmt.Sprintf("%s://%s%s%s", scheme, host, basePath(), path)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// app.Test connections come from 0.0.0.0, so that's the proxy to trust
+
+func TestRequestIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted string
+		xff     string
+		want    string
+	}{
+		{"untrusted peer ignores the header", "", "203.0.113.7", "0.0.0.0"},
+		{"untrusted peer with a trusted list", "10.0.0.0/8", "203.0.113.7", "0.0.0.0"},
+		{"trusted peer without a header", "0.0.0.0", "", "0.0.0.0"},
+		{"one hop", "0.0.0.0", "203.0.113.7", "203.0.113.7"},
+		{"spoofed leftmost entry", "0.0.0.0", "6.6.6.6, 203.0.113.7", "203.0.113.7"},
+		{"chain of trusted proxies", "0.0.0.0,10.0.0.0/8", "6.6.6.6, 203.0.113.7, 10.0.0.5, 10.1.2.3", "203.0.113.7"},
+		{"malformed spoofed entry", "0.0.0.0", "garbage, 203.0.113.7", "203.0.113.7"},
+		{"malformed last hop", "0.0.0.0", "203.0.113.7, garbage", "0.0.0.0"},
+		{"only trusted hops", "0.0.0.0,10.0.0.0/8", "10.0.0.1, 10.0.0.2", "10.0.0.1"},
+		{"ipv6 client", "0.0.0.0", "2001:db8::1", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TRUSTED_PROXIES", tt.trusted)
+			t.Setenv("HASH_CLIENT_IPS", "")
+			app := fiber.New(fiberConfig())
+			app.Get("/ip", func(c *fiber.Ctx) error { return c.SendString(clientIP(c)) })
+			req := httptest.NewRequest(fiber.MethodGet, "/ip", nil)
+			if tt.xff != "" {
+				req.Header.Set(fiber.HeaderXForwardedFor, tt.xff)
+			}
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(resp.Body)
+			if string(got) != tt.want {
+				t.Errorf("client IP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExternalURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		publicURL string
+		basePath  string
+		trusted   string
+		headers   map[string]string
+		want      string
+	}{
+		{"request host", "", "", "", nil, "http://example.com/verify"},
+		{"base path", "", "/loyalty", "", nil, "http://example.com/loyalty/verify"},
+		{"PUBLIC_BASE_URL wins", "https://points.example/", "/loyalty", "0.0.0.0",
+			map[string]string{fiber.HeaderXForwardedHost: "evil.example"}, "https://points.example/verify"},
+		{"untrusted forwarding headers ignored", "", "", "",
+			map[string]string{fiber.HeaderXForwardedProto: "https", fiber.HeaderXForwardedHost: "evil.example", fiber.HeaderForwarded: "proto=https;host=evil.example"},
+			"http://example.com/verify"},
+		{"trusted X-Forwarded headers", "", "", "0.0.0.0",
+			map[string]string{fiber.HeaderXForwardedProto: "https", fiber.HeaderXForwardedHost: "points.example"}, "https://points.example/verify"},
+		{"trusted Forwarded header", "", "/loyalty", "0.0.0.0",
+			map[string]string{fiber.HeaderForwarded: `proto=https;host="points.example", proto=http;host=inner`}, "https://points.example/loyalty/verify"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PUBLIC_BASE_URL", tt.publicURL)
+			t.Setenv("BASE_PATH", tt.basePath)
+			t.Setenv("TRUSTED_PROXIES", tt.trusted)
+			app := fiber.New(fiberConfig())
+			app.Get("/url", func(c *fiber.Ctx) error { return c.SendString(externalURL(c, "/verify")) })
+			req := httptest.NewRequest(fiber.MethodGet, "/url", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(resp.Body)
+			if string(got) != tt.want {
+				t.Errorf("externalURL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted string
+		xff     []string // one request each
+		want    []int
+	}{
+		{"no proxy: forged headers share the peer's bucket", "",
+			[]string{"1.1.1.1", "2.2.2.2", "3.3.3.3"},
+			[]int{fiber.StatusOK, fiber.StatusOK, fiber.StatusTooManyRequests}},
+		{"behind a proxy: clients get their own buckets", "0.0.0.0",
+			[]string{"203.0.113.7", "203.0.113.8", "203.0.113.7", "203.0.113.8", "203.0.113.7"},
+			[]int{fiber.StatusOK, fiber.StatusOK, fiber.StatusOK, fiber.StatusOK, fiber.StatusTooManyRequests}},
+		{"behind a proxy: forged leftmost entries don't reset the bucket", "0.0.0.0",
+			[]string{"1.1.1.1, 203.0.113.7", "2.2.2.2, 203.0.113.7", "3.3.3.3, 203.0.113.7"},
+			[]int{fiber.StatusOK, fiber.StatusOK, fiber.StatusTooManyRequests}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TRUSTED_PROXIES", tt.trusted)
+			t.Setenv("HASH_CLIENT_IPS", "")
+			t.Setenv("RATE_LIMIT_MAX", "2")
+			app := fiber.New(fiberConfig())
+			app.Get("/limited", rateLimitByIP(), func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusOK) })
+			for i, xff := range tt.xff {
+				status, body := doJSON(t, app, fiber.MethodGet, "/limited", "", nil, fiber.HeaderXForwardedFor, xff)
+				if status != tt.want[i] {
+					t.Fatalf("request %d (%s): status %d, want %d, body %v", i+1, xff, status, tt.want[i], body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// attemptLimiter is a fixed-window counter keyed by an arbitrary string
+// (email, client IP, ...). State is in-memory and per process.
+type attemptLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	entries map[string]*attemptWindow
+}
+
+type attemptWindow struct {
+	start time.Time
+	count int
+}
+
+func newAttemptLimiter(limit int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{limit: limit, window: window, entries: map[string]*attemptWindow{}}
+}
+
+// Allow records an attempt for key and reports whether it is within the limit
+func (l *attemptLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	w, ok := l.entries[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		// drop stale windows so the map doesn't grow without bound
+		for k, e := range l.entries {
+			if now.Sub(e.start) >= l.window {
+				delete(l.entries, k)
+			}
+		}
+		w = &attemptWindow{start: now}
+		l.entries[key] = w
+	}
+	w.count++
+	return w.count <= l.limit
+}
+
+// RetryAfter is how long until key's current window ends
+func (l *attemptLimiter) RetryAfter(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w, ok := l.entries[key]
+	if !ok {
+		return 0
+	}
+	return max(l.window-time.Since(w.start), 0)
+}
+
+// Unauthenticated entry points and member search are throttled per client
+// IP to RATE_LIMIT_MAX requests per RATE_LIMIT_WINDOW, each route counting
+// separately. Other routes aren't throttled here.
+const (
+	defaultRateLimitMax    = 20
+	defaultRateLimitWindow = time.Minute
+)
+
+// rateLimitWindow reads RATE_LIMIT_WINDOW (a Go duration, default 1m)
+func rateLimitWindow() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("RATE_LIMIT_WINDOW")); err == nil && d > 0 {
+		return d
+	}
+	return defaultRateLimitWindow
+}
+
+// rateLimitByIP returns middleware with its own per-IP limiter that answers
+// 429 RATE_LIMITED with Retry-After once the limit is used up
+func rateLimitByIP() fiber.Handler {
+	limiter := newAttemptLimiter(envPositiveInt("RATE_LIMIT_MAX", defaultRateLimitMax), rateLimitWindow())
+	return func(c *fiber.Ctx) error {
+		ip := clientIP(c)
+		if !limiter.Allow(ip) {
+			seconds := int(math.Ceil(limiter.RetryAfter(ip).Seconds()))
+			c.Set(fiber.HeaderRetryAfter, fmt.Sprint(max(seconds, 1)))
+			return writeError(c, ErrRateLimited)
+		}
+		return c.Next()
+	}
+}
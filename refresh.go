@@ -0,0 +1,164 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+// RefreshToken is a long-lived, single-use credential exchanged for a new
+// access token. Only the hash is stored.
+type RefreshToken struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"index;not null"`
+	TokenHash string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	Revoked   bool      `gorm:"not null;default:false"`
+	CreatedAt time.Time
+}
+
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+func init() {
+	registerInvariant("refresh_token_orphaned",
+		"refresh tokens whose user doesn't exist",
+		`SELECT x.id FROM refresh_tokens x LEFT JOIN users u ON u.id = x.user_id WHERE u.id IS NULL`)
+}
+
+// createRefreshToken stores a new refresh token for userID and returns the
+// plaintext
+func createRefreshToken(tx *gorm.DB, userID uint) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	rt := RefreshToken{
+		UserID:    userID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+	}
+	if err := tx.Create(&rt).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// issueTokens returns the login response body: a fresh access token plus a
+// refresh token
+func issueTokens(userID uint) (fiber.Map, error) {
+	access, err := generateJWT(userID)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := createRefreshToken(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	return fiber.Map{
+		"token":         access,
+		"refresh_token": refresh,
+		"expires_in":    int(accessTokenTTL().Seconds()),
+	}, nil
+}
+
+// rotateRefreshToken consumes token and returns the owner's ID and a
+// replacement. Presenting an already-used token revokes every refresh token
+// the user holds, since it means the token was copied.
+func rotateRefreshToken(token string) (uint, string, error) {
+	var rt RefreshToken
+	if err := db.Where("token_hash = ?", hashToken(token)).First(&rt).Error; err != nil {
+		return 0, "", ErrRefreshTokenInvalid
+	}
+	if rt.Revoked {
+		if err := db.Model(&RefreshToken{}).Where("user_id = ? AND revoked = ?", rt.UserID, false).
+			Update("revoked", true).Error; err != nil {
+			return 0, "", err
+		}
+		return 0, "", ErrRefreshTokenInvalid
+	}
+	if !time.Now().Before(rt.ExpiresAt) {
+		return 0, "", ErrRefreshTokenInvalid
+	}
+
+	var replacement string
+	err := withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		// guard on revoked so two concurrent refreshes can't both succeed
+		res := tx.Model(&RefreshToken{}).Where("id = ? AND revoked = ?", rt.ID, false).Update("revoked", true)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 1 {
+			return ErrRefreshTokenInvalid
+		}
+		var err error
+		replacement, err = createRefreshToken(tx, rt.UserID)
+		return err
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	return rt.UserID, replacement, nil
+}
+
+// Exchange a refresh token for a new access token and refresh token
+func refreshHandler(c *fiber.Ctx) error {
+	var payload struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	if payload.RefreshToken == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "refresh_token required"})
+	}
+	userID, refresh, err := rotateRefreshToken(payload.RefreshToken)
+	if err != nil {
+		return writeError(c, err)
+	}
+	access, err := generateJWT(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate token"})
+	}
+	return c.JSON(fiber.Map{
+		"token":         access,
+		"refresh_token": refresh,
+		"expires_in":    int(accessTokenTTL().Seconds()),
+	})
+}
+
+// Log out: revoke the current access token, the given refresh token and
+// any elevation tokens
+func logoutHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	var payload struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&payload); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+		}
+	}
+	if claims, ok := c.Locals("claims").(jwt.RegisteredClaims); ok {
+		if err := revokeAccessToken(claims); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to revoke token"})
+		}
+	}
+	if err := revokeElevatedTokens(db, u.(User).ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to revoke token"})
+	}
+	if payload.RefreshToken != "" {
+		// scoped to the caller so one user can't revoke another's session
+		if err := db.Model(&RefreshToken{}).
+			Where("token_hash = ? AND user_id = ?", hashToken(payload.RefreshToken), u.(User).ID).
+			Update("revoked", true).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to revoke refresh token"})
+		}
+	}
+	clearSessionCookies(c)
+	return c.SendStatus(fiber.StatusNoContent)
+}
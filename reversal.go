@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// An admin reverses a completed transfer by recording a compensating
+// "reversal" transaction that moves the points back from the recipient, and
+// marking the original reversed. The unique reversal_of index and the
+// completed → reversed transition both stop a transfer being reversed twice.
+const transactionTypeReversal = "reversal"
+
+// reverseTransfer reverses transfer id on behalf of admin and returns the
+// compensating transaction
+func reverseTransfer(id uint, admin User, reason string) (Transaction, error) {
+	var reversal Transaction
+	err := withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		var original Transaction
+		if err := tx.First(&original, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrTransactionNotFound
+			}
+			return fmt.Errorf("find transaction: %w", err)
+		}
+		if original.Type != "transfer" {
+			return ErrNotReversible
+		}
+		if original.Status == "reversed" {
+			return ErrAlreadyReversed
+		}
+		// a deleted sender's row is out of the refund's reach, so the
+		// recipient would be debited and nobody credited
+		var sender User
+		if err := tx.Select("id").First(&sender, original.FromUserID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrReversalSenderDeleted
+			}
+			return fmt.Errorf("find sender: %w", err)
+		}
+		if err := transitionTransaction(tx, &original, "reversed", actorAdmin, admin.ID, reason); err != nil {
+			return err
+		}
+
+		// the recipient may have spent the points already; lock their row
+		// so the balance can't change between the check and the deduction
+		var recipient User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "points").
+			First(&recipient, original.ToUserID).Error; err != nil {
+			return fmt.Errorf("lock recipient: %w", err)
+		}
+		if recipient.Points < original.Amount {
+			return &ReversalShortfallError{Amount: original.Amount, Available: recipient.Points}
+		}
+		res := tx.Model(&User{}).Where("id = ? AND points >= ?", recipient.ID, original.Amount).
+			Update("points", gorm.Expr("points - ?", original.Amount))
+		if res.Error != nil {
+			return fmt.Errorf("deduct points: %w", res.Error)
+		}
+		if res.RowsAffected != 1 {
+			return &ReversalShortfallError{Amount: original.Amount, Available: recipient.Points}
+		}
+		if _, err := consumePointsLots(tx, recipient.ID, original.Amount); err != nil {
+			return err
+		}
+		// the refund opens a new lot rather than reviving the ones spent
+		if err := creditPoints(tx, original.FromUserID, original.Amount); err != nil {
+			return fmt.Errorf("refund points: %w", err)
+		}
+
+		fromAfter, toAfter, err := balancesOf(tx, original.ToUserID, original.FromUserID)
+		if err != nil {
+			return err
+		}
+		reversal = Transaction{
+			FromUserID:       original.ToUserID,
+			ToUserID:         original.FromUserID,
+			Amount:           original.Amount,
+			Type:             transactionTypeReversal,
+			Status:           "completed",
+			ReversalOf:       &original.ID,
+			Description:      fmt.Sprintf("Reversal of transaction #%d", original.ID),
+			FromBalanceAfter: &fromAfter,
+			ToBalanceAfter:   &toAfter,
+		}
+		if err := tx.Create(&reversal).Error; err != nil {
+			return fmt.Errorf("create reversal record: %w", err)
+		}
+		return recordTransactionCreated(tx, &reversal, actorAdmin, admin.ID)
+	})
+	if err != nil {
+		return reversal, fmt.Errorf("reverse transaction %d: %w", id, err)
+	}
+	return reversal, nil
+}
+
+// Reverse a completed transfer, moving the points back to the sender
+func reverseTransactionHandler(c *fiber.Ctx) error {
+	admin := c.Locals("user").(User)
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid id"})
+	}
+	var payload struct {
+		Reason string `json:"reason"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&payload); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+		}
+	}
+	reason := strings.TrimSpace(payload.Reason)
+	if reason == "" {
+		reason = "reversed by admin"
+	}
+
+	reversal, err := reverseTransfer(uint(id), admin, reason)
+	if err != nil {
+		log.Printf("audit: transaction reversal denied txn=%d user=%d ip=%s: %v", id, admin.ID, clientIP(c), err)
+		return writeError(c, err)
+	}
+	log.Printf("audit: transaction reversed txn=%d reversal=%d amount=%d user=%d ip=%s", id, reversal.ID, reversal.Amount, admin.ID, clientIP(c))
+	return c.JSON(fiber.Map{
+		"message":                 "Transaction reversed",
+		"transaction_id":          id,
+		"reversal_transaction_id": reversal.ID,
+		"amount":                  reversal.Amount,
+		"reversed_by":             admin.ID,
+	})
+}
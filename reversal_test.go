@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// sendPoints transfers amount from one member to another through the API
+// and returns the transaction ID
+func sendPoints(t *testing.T, app *fiber.App, from, to User, amount int64) uint {
+	t.Helper()
+	status, body := doJSON(t, app, fiber.MethodPost, "/transfer", tokenFor(t, from),
+		fiber.Map{"to_member_id": to.MemberID, "amount": amount, "pin": testPin})
+	if status != fiber.StatusOK {
+		t.Fatalf("transfer: status %d, body %v", status, body)
+	}
+	return uint(body["transaction_id"].(float64))
+}
+
+// pointsInSystem sums every balance, deleted accounts included
+func pointsInSystem(t *testing.T) int64 {
+	t.Helper()
+	var total int64
+	if err := db.Unscoped().Model(&User{}).Select("COALESCE(SUM(points), 0)").Scan(&total).Error; err != nil {
+		t.Fatal(err)
+	}
+	return total
+}
+
+func TestReverseTransfer(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	admin := createUser(t, 0)
+	sender := createUser(t, 1000)
+	recipient := createUser(t, 0)
+	id := sendPoints(t, app, sender, recipient, 100)
+
+	reversal, err := reverseTransfer(id, admin, "sent by mistake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reversal.ReversalOf == nil || *reversal.ReversalOf != id || reversal.Amount != 100 {
+		t.Errorf("reversal = %+v", reversal)
+	}
+	if got := reloadUser(t, sender).Points; got != 1000 {
+		t.Errorf("sender balance = %d, want 1000", got)
+	}
+	if got := reloadUser(t, recipient).Points; got != 0 {
+		t.Errorf("recipient balance = %d, want 0", got)
+	}
+	if _, err := reverseTransfer(id, admin, "again"); !errors.Is(err, ErrAlreadyReversed) {
+		t.Errorf("second reversal: err = %v, want ErrAlreadyReversed", err)
+	}
+	assertInvariants(t)
+}
+
+func TestReverseTransferFromDeletedSender(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	admin := createUser(t, 0)
+	sender := createUser(t, 1000)
+	recipient := createUser(t, 0)
+	id := sendPoints(t, app, sender, recipient, 100)
+	if err := deleteAccount(sender); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := reverseTransfer(id, admin, "chargeback"); !errors.Is(err, ErrReversalSenderDeleted) {
+		t.Fatalf("err = %v, want ErrReversalSenderDeleted", err)
+	}
+	if got := pointsInSystem(t); got != 1000 {
+		t.Errorf("points in the system = %d, want 1000", got)
+	}
+	if got := reloadUser(t, recipient).Points; got != 100 {
+		t.Errorf("recipient balance = %d, want 100 untouched", got)
+	}
+	var original Transaction
+	if err := db.First(&original, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	if original.Status != "completed" {
+		t.Errorf("original status = %s, want completed", original.Status)
+	}
+	var reversals int64
+	db.Model(&Transaction{}).Where("reversal_of = ?", id).Count(&reversals)
+	if reversals != 0 {
+		t.Errorf("%d reversal records written", reversals)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+// RevokedToken denylists an access token by its jti until it would have
+// expired anyway
+type RevokedToken struct {
+	JTI       string    `gorm:"primaryKey"`
+	ExpiresAt time.Time `gorm:"index;not null"`
+}
+
+const revokedTokenCleanupInterval = time.Hour
+
+// revokeAccessToken denylists the token the claims came from
+func revokeAccessToken(claims jwt.RegisteredClaims) error {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return nil
+	}
+	return db.Save(&RevokedToken{JTI: claims.ID, ExpiresAt: claims.ExpiresAt.Time}).Error
+}
+
+// revokeElevatedTokens denylists every unexpired elevation token issued to
+// userID; they outlive neither a logout nor the password they were granted
+// under
+func revokeElevatedTokens(tx *gorm.DB, userID uint) error {
+	var issued []ElevatedToken
+	if err := tx.Where("user_id = ? AND expires_at > ?", userID, time.Now()).Find(&issued).Error; err != nil {
+		return err
+	}
+	for _, token := range issued {
+		if err := tx.Save(&RevokedToken{JTI: token.JTI, ExpiresAt: token.ExpiresAt}).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Where("user_id = ?", userID).Delete(&ElevatedToken{}).Error
+}
+
+func isTokenRevoked(jti string) (bool, error) {
+	if jti == "" {
+		return false, nil
+	}
+	var count int64
+	if err := db.Model(&RevokedToken{}).Where("jti = ?", jti).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// startRevokedTokenCleanup purges denylist rows and issued elevation tokens
+// past their token's expiry, once now and then every
+// revokedTokenCleanupInterval
+func startRevokedTokenCleanup() {
+	purge := func() {
+		if err := db.Where("expires_at < ?", time.Now()).Delete(&RevokedToken{}).Error; err != nil {
+			log.Printf("purge revoked tokens: %v", err)
+		}
+		if err := db.Where("expires_at < ?", time.Now()).Delete(&ElevatedToken{}).Error; err != nil {
+			log.Printf("purge elevation tokens: %v", err)
+		}
+	}
+	purge()
+	go func() {
+		for range time.Tick(revokedTokenCleanupInterval) {
+			purge()
+		}
+	}()
+}
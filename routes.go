@@ -0,0 +1,336 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+)
+
+// authMode says what a caller must present to reach a route. The zero value
+// is deliberately invalid so a route can't be registered without choosing.
+type authMode int
+
+const (
+	authUnset           authMode = iota
+	authPublic                   // no credentials, or the handler checks its own (e.g. a feed token)
+	authUser                     // access token via jwtMiddleware
+	authElevated                 // access token plus X-Elevated-Token
+	authUserOrService            // access token, or an API key with the route's Scope
+	authPublicOrService          // no credentials, or an API key with the route's Scope
+)
+
+// rateLimitClass is the request limit mountRoutes puts in front of a route
+type rateLimitClass int
+
+const (
+	rateLimitNone      rateLimitClass = iota
+	rateLimitPerIP                    // rateLimitByIP: RATE_LIMIT_MAX per RATE_LIMIT_WINDOW per client IP
+	rateLimitAdmission                // admitTransfer: queued behind TRANSFER_MAX_IN_FLIGHT
+)
+
+// rateLimitNames are the classes as the OpenAPI document's x-rate-limit shows them
+var rateLimitNames = map[rateLimitClass]string{
+	rateLimitPerIP:     "per-ip",
+	rateLimitAdmission: "transfer-admission",
+}
+
+// route is one endpoint: everything the router and the docs need to agree on
+type route struct {
+	Method    string
+	Path      string // Fiber syntax, e.g. /transactions/:id<int>
+	Auth      authMode
+	Role      string // role the user must hold, e.g. admin; empty for any
+	Scope     string // scope an API key must hold, for authUserOrService and authPublicOrService
+	RateLimit rateLimitClass
+	// Errors are the codes of the domain errors the handler answers with;
+	// those implied by Auth, Role, Scope and RateLimit are added for it
+	Errors  []string
+	Use     []fiber.Handler // extra middleware, run after authentication and rate limiting
+	Handler fiber.Handler
+	// Deprecated routes still work but answer with Deprecation and Link
+	// headers pointing at Successor, a route with the same method
+	Deprecated bool
+	Successor  string
+	// Undocumented routes are left out of the OpenAPI document on purpose
+	Undocumented bool
+}
+
+// transferErrors are what transferPoints can refuse a transfer with
+var transferErrors = []string{
+	"CROSS_PARTNER_NOT_ALLOWED", "DAILY_LIMIT_EXCEEDED", "EMAIL_NOT_VERIFIED", "INSUFFICIENT_POINTS", "INVALID_PIN",
+	"INVALID_REQUEST", "LARGE_RELATIVE_TRANSFER", "MEMBER_ID_REQUIRED", "PER_TRANSFER_LIMIT_EXCEEDED", "PIN_LOCKED",
+	"PIN_NOT_SET", "RECIPIENT_NOT_FOUND", "SELF_TRANSFER", "SYNTHETIC_ACCOUNT_MISMATCH",
+}
+
+// appRoutes lists every endpoint the API serves
+func appRoutes() []route {
+	routes := []route{
+		{Method: fiber.MethodGet, Path: "/", Auth: authPublic, Undocumented: true, Handler: func(c *fiber.Ctx) error {
+			return c.JSON(fiber.Map{"message": "Hello World"})
+		}},
+		{Method: fiber.MethodGet, Path: "/healthz", Auth: authPublic, Handler: healthzHandler},
+
+		// accounts and sessions
+		{Method: fiber.MethodPost, Path: "/register", Auth: authPublicOrService, Scope: scopeMembersRegister, RateLimit: rateLimitPerIP, Errors: []string{"WEAK_PASSWORD"}, Handler: registerHandler},
+		{Method: fiber.MethodPost, Path: "/login", Auth: authPublic, RateLimit: rateLimitPerIP, Handler: loginHandler},
+		{Method: fiber.MethodPost, Path: "/login/2fa", Auth: authPublic, Handler: loginTwoFactorHandler},
+		{Method: fiber.MethodPost, Path: "/auth/magic-link", Auth: authPublic, Handler: magicLinkHandler},
+		{Method: fiber.MethodPost, Path: "/auth/magic-login", Auth: authPublic, Handler: magicLoginHandler},
+		{Method: fiber.MethodGet, Path: "/auth/google", Auth: authPublic, Handler: googleLoginHandler},
+		{Method: fiber.MethodGet, Path: "/auth/google/callback", Auth: authPublic, Errors: []string{"ACCOUNT_DELETED", "GOOGLE_ACCOUNT_CONFLICT", "GOOGLE_EMAIL_UNVERIFIED", "GOOGLE_LINK_UNVERIFIED_ACCOUNT"}, Handler: googleCallbackHandler},
+		{Method: fiber.MethodGet, Path: "/verify", Auth: authPublic, Handler: verifyEmailHandler},
+		{Method: fiber.MethodPost, Path: "/verify/resend", Auth: authUser, Handler: resendVerificationHandler},
+		{Method: fiber.MethodPost, Path: "/password/forgot", Auth: authPublic, Handler: forgotPasswordHandler},
+		{Method: fiber.MethodPost, Path: "/password/reset", Auth: authPublic, Errors: []string{"WEAK_PASSWORD"}, Handler: resetPasswordHandler},
+		{Method: fiber.MethodPost, Path: "/password/reset/request", Auth: authPublic, Handler: forgotPasswordHandler},
+		{Method: fiber.MethodPost, Path: "/password/reset/confirm", Auth: authPublic, Errors: []string{"WEAK_PASSWORD"}, Handler: resetPasswordHandler},
+		{Method: fiber.MethodPost, Path: "/auth/refresh", Auth: authPublic, Errors: []string{"INVALID_REFRESH_TOKEN"}, Handler: refreshHandler},
+		{Method: fiber.MethodPost, Path: "/refresh", Auth: authPublic, Errors: []string{"INVALID_REFRESH_TOKEN"}, Handler: refreshHandler},
+		{Method: fiber.MethodPost, Path: "/logout", Auth: authUser, Handler: logoutHandler},
+		{Method: fiber.MethodPost, Path: "/auth/elevate", Auth: authUser, Handler: elevateHandler},
+		{Method: fiber.MethodPost, Path: "/auth/elevate/email-code", Auth: authUser, Errors: []string{"ELEVATE_WITH_PASSWORD"}, Handler: sendElevationCodeHandler},
+
+		// profile and security settings
+		{Method: fiber.MethodGet, Path: "/me", Auth: authUser, Errors: []string{"INVALID_REQUEST"}, Handler: meHandler},
+		{Method: fiber.MethodPut, Path: "/me", Auth: authUser, Errors: []string{"INVALID_REQUEST"}, Handler: updateProfileHandler},
+		{Method: fiber.MethodPatch, Path: "/me", Auth: authUser, Errors: []string{"INVALID_REQUEST"}, Handler: updateProfileHandler},
+		{Method: fiber.MethodDelete, Path: "/me", Auth: authElevated, Handler: deleteAccountHandler},
+		{Method: fiber.MethodPost, Path: "/me/password", Auth: authUser, Errors: []string{"WEAK_PASSWORD"}, Handler: changePasswordHandler},
+		{Method: fiber.MethodPost, Path: "/me/pin", Auth: authElevated, Handler: setPinHandler},
+		{Method: fiber.MethodGet, Path: "/me/logins", Auth: authUser, Handler: loginHistoryHandler},
+		{Method: fiber.MethodPost, Path: "/me/member-id", Auth: authUser, Errors: []string{"INVALID_REQUEST", "MEMBER_ID_ALREADY_SET", "MEMBER_ID_TAKEN"}, Handler: claimMemberIDHandler},
+		{Method: fiber.MethodPost, Path: "/me/2fa/setup", Auth: authElevated, Handler: setupTwoFactorHandler},
+		{Method: fiber.MethodPost, Path: "/me/2fa/enable", Auth: authUser, Handler: enableTwoFactorHandler},
+		{Method: fiber.MethodPost, Path: "/me/2fa/disable", Auth: authElevated, Handler: disableTwoFactorHandler},
+		{Method: fiber.MethodGet, Path: "/me/consents", Auth: authUser, Handler: getConsentsHandler},
+		{Method: fiber.MethodPut, Path: "/me/consents", Auth: authUser, Handler: updateConsentsHandler},
+		{Method: fiber.MethodGet, Path: "/me/consents/history", Auth: authUser, Handler: consentHistoryHandler},
+
+		// delegated access
+		{Method: fiber.MethodPost, Path: "/me/delegates", Auth: authElevated, Errors: []string{"INVALID_REQUEST"}, Handler: createDelegateHandler},
+		{Method: fiber.MethodGet, Path: "/me/delegates", Auth: authUser, Handler: listDelegatesHandler},
+		{Method: fiber.MethodDelete, Path: "/me/delegates/:id", Auth: authUser, Handler: revokeDelegateHandler},
+		{Method: fiber.MethodGet, Path: "/me/delegates/access-log", Auth: authUser, Errors: []string{"INVALID_REQUEST"}, Handler: delegateAccessLogHandler},
+		{Method: fiber.MethodPost, Path: "/delegates/accept", Auth: authUser, Errors: []string{"EMAIL_NOT_VERIFIED"}, Handler: acceptDelegationHandler},
+		{Method: fiber.MethodGet, Path: "/delegated/:owner_member_id/transactions", Auth: authUser, Use: []fiber.Handler{delegationMiddleware()}, Errors: []string{"INVALID_REQUEST"}, Handler: delegatedTransactionsHandler},
+
+		// transfers and transactions
+		{Method: fiber.MethodPost, Path: "/transfer", Auth: authUser, RateLimit: rateLimitAdmission, Errors: slices.Concat(transferErrors, []string{"IDEMPOTENCY_KEY_REUSED"}), Handler: transferHandler},
+		{Method: fiber.MethodPost, Path: "/transfer/confirm", Auth: authUser, RateLimit: rateLimitAdmission, Errors: []string{"CONFIRMATION_EXPIRED", "DAILY_LIMIT_EXCEEDED", "INSUFFICIENT_POINTS", "PER_TRANSFER_LIMIT_EXCEEDED", "TRANSACTION_NOT_FOUND", "TRANSFER_NOT_PENDING"}, Handler: confirmTransferHandler},
+		{Method: fiber.MethodPost, Path: "/transfers/:id<int>/accept", Auth: authUser, RateLimit: rateLimitAdmission, Errors: []string{"TRANSACTION_NOT_FOUND", "TRANSFER_EXPIRED", "TRANSFER_NOT_PENDING"}, Handler: acceptTransferHandler},
+		{Method: fiber.MethodPost, Path: "/transfers/:id<int>/decline", Auth: authUser, RateLimit: rateLimitAdmission, Errors: []string{"TRANSACTION_NOT_FOUND", "TRANSFER_EXPIRED", "TRANSFER_NOT_PENDING"}, Handler: declineTransferHandler},
+		{Method: fiber.MethodPost, Path: "/transfers/:id<int>/cancel", Auth: authUser, RateLimit: rateLimitAdmission, Errors: []string{"NOT_TRANSFER_SENDER", "TRANSACTION_NOT_FOUND", "TRANSFER_NOT_PENDING"}, Handler: cancelTransferHandler},
+		{Method: fiber.MethodGet, Path: "/requests", Auth: authUser, Errors: []string{"INVALID_REQUEST"}, Handler: listPointRequestsHandler},
+		{Method: fiber.MethodPost, Path: "/requests", Auth: authUser, Errors: []string{"CROSS_PARTNER_NOT_ALLOWED", "EMAIL_NOT_VERIFIED", "INVALID_REQUEST", "MEMBER_ID_REQUIRED", "RECIPIENT_NOT_FOUND", "SYNTHETIC_ACCOUNT_MISMATCH"}, Handler: createPointRequestHandler},
+		{Method: fiber.MethodPost, Path: "/requests/:id<int>/pay", Auth: authUser, RateLimit: rateLimitAdmission, Errors: slices.Concat(transferErrors, []string{"NOT_REQUEST_PAYER", "REQUEST_EXPIRED", "REQUEST_NOT_FOUND", "REQUEST_NOT_PENDING"}), Handler: payPointRequestHandler},
+		{Method: fiber.MethodPost, Path: "/requests/:id<int>/decline", Auth: authUser, Errors: []string{"NOT_REQUEST_PAYER", "REQUEST_EXPIRED", "REQUEST_NOT_FOUND", "REQUEST_NOT_PENDING"}, Handler: declinePointRequestHandler},
+		{Method: fiber.MethodPost, Path: "/transfer/from-template/:id", Auth: authUser, RateLimit: rateLimitAdmission, Errors: transferErrors, Handler: transferFromTemplateHandler},
+		{Method: fiber.MethodGet, Path: "/transfer/limit", Auth: authUser, Handler: transferLimitHandler, Deprecated: true, Successor: "/me/limits"},
+		{Method: fiber.MethodGet, Path: "/me/limits", Auth: authUser, Handler: transferLimitHandler},
+		{Method: fiber.MethodGet, Path: "/me/points/expiring", Auth: authUser, Errors: []string{"INVALID_REQUEST"}, Handler: expiringPointsHandler},
+		{Method: fiber.MethodGet, Path: "/transfer/templates", Auth: authUser, Handler: listTemplatesHandler},
+		{Method: fiber.MethodPost, Path: "/transfer/templates", Auth: authUser, Errors: []string{"INVALID_REQUEST"}, Handler: createTemplateHandler},
+		{Method: fiber.MethodGet, Path: "/transfer/templates/:id", Auth: authUser, Handler: getTemplateHandler},
+		{Method: fiber.MethodPut, Path: "/transfer/templates/:id", Auth: authUser, Errors: []string{"INVALID_REQUEST"}, Handler: updateTemplateHandler},
+		{Method: fiber.MethodDelete, Path: "/transfer/templates/:id", Auth: authUser, Handler: deleteTemplateHandler},
+		{Method: fiber.MethodGet, Path: "/transactions/recent", Auth: authUser, Errors: []string{"INVALID_REQUEST"}, Handler: recentTransactionsHandler},
+		{Method: fiber.MethodGet, Path: "/transactions/by-counterparty", Auth: authUser, Errors: []string{"INVALID_REQUEST"}, Handler: counterpartyHandler},
+		{Method: fiber.MethodGet, Path: "/transactions/export", Auth: authUser, Errors: []string{"INVALID_REQUEST"}, Handler: exportTransactionsHandler},
+		{Method: fiber.MethodGet, Path: "/transactions/:id<int>", Auth: authUser, Errors: []string{"INVALID_REQUEST", "TRANSACTION_NOT_FOUND"}, Handler: transactionDetailHandler},
+		{Method: fiber.MethodGet, Path: "/search/user", Auth: authUser, RateLimit: rateLimitPerIP, Handler: searchUserHandler},
+
+		// transaction feed for feed readers; the feed itself takes a feed token
+		{Method: fiber.MethodPost, Path: "/me/feed-token", Auth: authElevated, Handler: createFeedTokenHandler},
+		{Method: fiber.MethodDelete, Path: "/me/feed-token", Auth: authUser, Handler: revokeFeedTokenHandler},
+		{Method: fiber.MethodGet, Path: "/me/feed.atom", Auth: authPublic, Handler: transactionFeedHandler},
+
+		// back office
+		{Method: fiber.MethodGet, Path: "/admin/users", Auth: authUserOrService, Role: roleAdmin, Scope: scopeUsersRead, Errors: []string{"INVALID_REQUEST"}, Handler: adminListUsersHandler},
+		{Method: fiber.MethodPost, Path: "/admin/users/:id<int>/points", Auth: authUser, Role: roleAdmin, Errors: []string{"INVALID_REQUEST", "NEGATIVE_BALANCE", "USER_NOT_FOUND"}, Handler: adjustPointsHandler},
+		{Method: fiber.MethodPost, Path: "/admin/api-keys", Auth: authElevated, Role: roleAdmin, Errors: []string{"INVALID_REQUEST"}, Handler: createAPIKeyHandler},
+		{Method: fiber.MethodGet, Path: "/admin/api-keys", Auth: authUser, Role: roleAdmin, Handler: listAPIKeysHandler},
+		{Method: fiber.MethodDelete, Path: "/admin/api-keys/:id<int>", Auth: authUser, Role: roleAdmin, Handler: revokeAPIKeyHandler},
+		{Method: fiber.MethodPost, Path: "/admin/transactions/:id<int>/reverse", Auth: authUser, Role: roleAdmin, Errors: []string{"ALREADY_REVERSED", "NOT_REVERSIBLE", "REVERSAL_INSUFFICIENT_BALANCE", "SENDER_DELETED", "TRANSACTION_NOT_FOUND"}, Handler: reverseTransactionHandler},
+		{Method: fiber.MethodGet, Path: "/admin/invariants", Auth: authUser, Role: roleAdmin, Handler: invariantReportHandler},
+
+		// docs
+		{Method: fiber.MethodGet, Path: "/swagger/doc.json", Auth: authPublic, Undocumented: true, Handler: swaggerJSON},
+		{Method: fiber.MethodGet, Path: "/swagger", Auth: authPublic, Undocumented: true, Handler: swaggerUI},
+	}
+	if envBool("EXPOSE_METRICS") {
+		routes = append(routes, route{Method: fiber.MethodGet, Path: "/debug/vars", Auth: authPublic, Undocumented: true,
+			Handler: adaptor.HTTPHandler(expvar.Handler())})
+	}
+	return routes
+}
+
+var fiberParamPattern = regexp.MustCompile(`:(\w+)(<[^>]*>)?`)
+
+// openAPIPath converts a Fiber path to OpenAPI syntax: /a/:id<int> → /a/{id}
+func openAPIPath(path string) string {
+	return fiberParamPattern.ReplaceAllString(path, "{$1}")
+}
+
+// errorCodes are the codes of every domain error the route answers with,
+// sorted: its Errors plus those its auth, role, scope and rate limit imply
+func (r route) errorCodes() []string {
+	codes := append([]string{}, r.Errors...)
+	if r.Auth != authPublic && r.Auth != authPublicOrService && r.Method != fiber.MethodGet {
+		codes = append(codes, "CSRF_TOKEN_INVALID") // cookie sessions, see checkCSRF
+	}
+	if r.Auth == authElevated {
+		codes = append(codes, "ELEVATION_REQUIRED")
+	}
+	if r.Role != "" {
+		codes = append(codes, "FORBIDDEN")
+	}
+	if r.Scope != "" {
+		codes = append(codes, "INSUFFICIENT_SCOPE")
+	}
+	switch r.RateLimit {
+	case rateLimitPerIP:
+		codes = append(codes, "RATE_LIMITED")
+	case rateLimitAdmission:
+		codes = append(codes, "OVER_CAPACITY")
+	}
+	sort.Strings(codes)
+	return slices.Compact(codes)
+}
+
+// errorCodePattern finds error codes in response descriptions
+var errorCodePattern = regexp.MustCompile(`\b[A-Z][A-Z0-9]*(?:_[A-Z0-9]+)+\b`)
+
+// validateRoutes rejects a route table with missing metadata, duplicates,
+// unknown error codes, or operation docs that don't match a route or that
+// mention error codes the route doesn't declare
+func validateRoutes(routes []route, docs map[string]interface{}) error {
+	statuses := errorStatuses()
+	seen := map[string]route{}
+	documented := map[string]bool{}
+	for _, r := range routes {
+		key := r.Method + " " + r.Path
+		if r.Method == "" || r.Path == "" || r.Handler == nil {
+			return fmt.Errorf("route %q: method, path and handler are required", key)
+		}
+		if _, dup := seen[key]; dup {
+			return fmt.Errorf("route %q registered twice", key)
+		}
+		seen[key] = r
+		if r.Auth < authPublic || r.Auth > authPublicOrService {
+			return fmt.Errorf("route %q: auth mode not set", key)
+		}
+		if r.Role != "" && (r.Auth == authPublic || r.Auth == authPublicOrService || !knownRoles[r.Role]) {
+			return fmt.Errorf("route %q: role %q needs a known role and an authenticated auth mode", key, r.Role)
+		}
+		if (r.Auth == authUserOrService || r.Auth == authPublicOrService) != (r.Scope != "") || (r.Scope != "" && !knownScopes[r.Scope]) {
+			return fmt.Errorf("route %q: API key routes need exactly one known scope", key)
+		}
+		if _, ok := rateLimitNames[r.RateLimit]; !ok && r.RateLimit != rateLimitNone {
+			return fmt.Errorf("route %q: unknown rate limit class %d", key, r.RateLimit)
+		}
+		for _, code := range r.Errors {
+			if _, ok := statuses[code]; !ok {
+				return fmt.Errorf("route %q: unknown error code %s", key, code)
+			}
+		}
+		if r.Deprecated != (r.Successor != "") {
+			return fmt.Errorf("route %q: a deprecated route needs a successor, and only a deprecated one", key)
+		}
+		if r.Undocumented {
+			continue
+		}
+		documented[strings.ToLower(r.Method)+" "+openAPIPath(r.Path)] = true
+		doc, ok := operationDoc(docs, r)
+		if !ok {
+			return fmt.Errorf("route %q: missing from the operation docs", key)
+		}
+		if _, ok := doc["security"]; ok {
+			return fmt.Errorf("route %q: security comes from the auth mode, not the operation docs", key)
+		}
+		codes := r.errorCodes()
+		responses, _ := doc["responses"].(map[string]interface{})
+		for status, resp := range responses {
+			description, _ := resp.(map[string]interface{})["description"].(string)
+			for _, code := range errorCodePattern.FindAllString(description, -1) {
+				want, known := statuses[code]
+				if !known {
+					continue
+				}
+				if !slices.Contains(codes, code) {
+					return fmt.Errorf("route %q: %s response mentions %s, which the route doesn't declare", key, status, code)
+				}
+				if fmt.Sprint(want) != status {
+					return fmt.Errorf("route %q: %s is answered with %d, not %s", key, code, want, status)
+				}
+			}
+		}
+	}
+	for _, r := range routes {
+		if r.Deprecated {
+			next, ok := seen[r.Method+" "+r.Successor]
+			if !ok || next.Deprecated {
+				return fmt.Errorf("route %q: successor %s isn't a current %s route", r.Method+" "+r.Path, r.Successor, r.Method)
+			}
+		}
+	}
+	for path, item := range docs {
+		for method := range item.(map[string]interface{}) {
+			if !slices.Contains(fiber.DefaultMethods, strings.ToUpper(method)) {
+				continue // path-level fields such as parameters
+			}
+			if !documented[method+" "+path] {
+				return fmt.Errorf("operation docs for %s %s match no documented route", strings.ToUpper(method), path)
+			}
+		}
+	}
+	return nil
+}
+
+// deprecationHeaders marks a deprecated route's responses and links its successor
+func deprecationHeaders(successor string) fiber.Handler {
+	link := fmt.Sprintf("<%s%s>; rel=\"successor-version\"", basePath(), openAPIPath(successor))
+	return func(c *fiber.Ctx) error {
+		c.Set("Deprecation", "true")
+		c.Set(fiber.HeaderLink, link)
+		return c.Next()
+	}
+}
+
+// mountRoutes registers each route with its authentication, role checks and
+// rate limit first
+func mountRoutes(router fiber.Router, routes []route) {
+	for _, r := range routes {
+		var chain []fiber.Handler
+		if r.Deprecated {
+			chain = append(chain, deprecationHeaders(r.Successor))
+		}
+		switch r.Auth {
+		case authUser:
+			chain = append(chain, jwtMiddleware())
+		case authElevated:
+			chain = append(chain, jwtMiddleware(), requireElevation())
+		case authUserOrService:
+			chain = append(chain, userOrServiceAuth(), requireRoleOrScope(r.Role, r.Scope))
+		case authPublicOrService:
+			chain = append(chain, optionalAPIKey(), requireRoleOrScope("", r.Scope))
+		}
+		if r.Role != "" && r.Auth != authUserOrService {
+			chain = append(chain, requireRole(r.Role))
+		}
+		switch r.RateLimit {
+		case rateLimitPerIP:
+			chain = append(chain, rateLimitByIP())
+		case rateLimitAdmission:
+			chain = append(chain, admitTransfer())
+		}
+		chain = append(chain, r.Use...)
+		chain = append(chain, r.Handler)
+		router.Add(r.Method, r.Path, chain...)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func okHandler(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusNoContent) }
+
+// testRoutes is a small valid route table and its operation docs
+func testRoutes() ([]route, map[string]interface{}) {
+	routes := []route{
+		{Method: fiber.MethodGet, Path: "/things/:id<int>", Auth: authUser, Errors: []string{"TRANSACTION_NOT_FOUND"}, Handler: okHandler},
+		{Method: fiber.MethodPost, Path: "/things", Auth: authElevated, Role: roleAdmin, RateLimit: rateLimitPerIP, Handler: okHandler},
+		{Method: fiber.MethodGet, Path: "/old-things", Auth: authPublic, Deprecated: true, Successor: "/things/:id<int>", Handler: okHandler},
+		{Method: fiber.MethodGet, Path: "/hidden", Auth: authPublic, Undocumented: true, Handler: okHandler},
+	}
+	docs := map[string]interface{}{
+		"/things/{id}": map[string]interface{}{
+			"get": map[string]interface{}{"summary": "A thing", "responses": map[string]interface{}{
+				"404": map[string]interface{}{"description": "No such thing (TRANSACTION_NOT_FOUND)"},
+			}},
+		},
+		"/things": map[string]interface{}{
+			"post": map[string]interface{}{"summary": "Make a thing"},
+		},
+		"/old-things": map[string]interface{}{
+			"get": map[string]interface{}{"summary": "Things, the old way"},
+		},
+	}
+	return routes, docs
+}
+
+func TestValidateRoutes(t *testing.T) {
+	routes, docs := testRoutes()
+	if err := validateRoutes(routes, docs); err != nil {
+		t.Fatalf("valid table rejected: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		edit    func(routes []route, docs map[string]interface{}) []route
+		wantErr string
+	}{
+		{"missing handler", func(r []route, d map[string]interface{}) []route { r[0].Handler = nil; return r }, "handler are required"},
+		{"duplicate", func(r []route, d map[string]interface{}) []route { return append(r, r[0]) }, "registered twice"},
+		{"auth unset", func(r []route, d map[string]interface{}) []route { r[0].Auth = authUnset; return r }, "auth mode not set"},
+		{"role on a public route", func(r []route, d map[string]interface{}) []route { r[2].Role = roleAdmin; return r }, "needs a known role"},
+		{"unknown role", func(r []route, d map[string]interface{}) []route { r[1].Role = "owner"; return r }, "needs a known role"},
+		{"scope without API keys", func(r []route, d map[string]interface{}) []route { r[0].Scope = scopeUsersRead; return r }, "exactly one known scope"},
+		{"optional API key without a scope", func(r []route, d map[string]interface{}) []route { r[2].Auth = authPublicOrService; return r }, "exactly one known scope"},
+		{"role on an optional API key route", func(r []route, d map[string]interface{}) []route {
+			r[2].Auth, r[2].Scope, r[2].Role = authPublicOrService, scopeMembersRegister, roleAdmin
+			return r
+		}, "needs a known role"},
+		{"unknown rate limit", func(r []route, d map[string]interface{}) []route { r[0].RateLimit = 99; return r }, "unknown rate limit class"},
+		{"unknown error code", func(r []route, d map[string]interface{}) []route { r[0].Errors = []string{"NO_SUCH_CODE"}; return r }, "unknown error code"},
+		{"deprecated without successor", func(r []route, d map[string]interface{}) []route { r[2].Successor = ""; return r }, "needs a successor"},
+		{"successor without deprecation", func(r []route, d map[string]interface{}) []route { r[2].Deprecated = false; return r }, "needs a successor"},
+		{"missing successor", func(r []route, d map[string]interface{}) []route { r[2].Successor = "/gone"; return r }, "isn't a current GET route"},
+		{"successor with another method", func(r []route, d map[string]interface{}) []route { r[2].Successor = "/things"; return r }, "isn't a current GET route"},
+		{"undocumented route without docs", func(r []route, d map[string]interface{}) []route { delete(d, "/things"); return r }, "missing from the operation docs"},
+		{"docs without a route", func(r []route, d map[string]interface{}) []route {
+			d["/stale"] = map[string]interface{}{"get": map[string]interface{}{}}
+			return r
+		}, "match no documented route"},
+		{"security in the docs", func(r []route, d map[string]interface{}) []route {
+			d["/things"].(map[string]interface{})["post"].(map[string]interface{})["security"] = []map[string][]string{{"bearerAuth": {}}}
+			return r
+		}, "security comes from the auth mode"},
+		{"docs mention an undeclared code", func(r []route, d map[string]interface{}) []route { r[0].Errors = nil; return r }, "which the route doesn't declare"},
+		{"docs put a code under the wrong status", func(r []route, d map[string]interface{}) []route {
+			d["/things/{id}"].(map[string]interface{})["get"].(map[string]interface{})["responses"] = map[string]interface{}{
+				"400": map[string]interface{}{"description": "Bad (TRANSACTION_NOT_FOUND)"},
+			}
+			return r
+		}, "is answered with 404, not 400"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes, docs := testRoutes()
+			err := validateRoutes(tt.edit(routes, docs), docs)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAppRoutesAreValid(t *testing.T) {
+	t.Setenv("EXPOSE_METRICS", "true")
+	if err := validateRoutes(appRoutes(), operationDocs()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSwaggerDocFollowsRoutes(t *testing.T) {
+	doc := swaggerDoc("")
+	statuses := errorStatuses()
+	paths := doc["paths"].(map[string]interface{})
+	for _, r := range appRoutes() {
+		key := r.Method + " " + r.Path
+		item, _ := paths[openAPIPath(r.Path)].(map[string]interface{})
+		op, documented := item[strings.ToLower(r.Method)].(map[string]interface{})
+		if documented == r.Undocumented {
+			t.Errorf("%s: documented = %v", key, documented)
+			continue
+		}
+		if r.Undocumented {
+			continue
+		}
+
+		schemes := map[string]bool{}
+		reqs, _ := op["security"].([]map[string][]string)
+		for _, req := range reqs {
+			for name := range req {
+				schemes[name] = true
+			}
+		}
+		if schemes["bearerAuth"] != (r.Auth != authPublic && r.Auth != authPublicOrService) || schemes["elevatedToken"] != (r.Auth == authElevated) ||
+			schemes["apiKeyAuth"] != (r.Auth == authUserOrService || r.Auth == authPublicOrService) {
+			t.Errorf("%s: security %v doesn't match its auth mode", key, reqs)
+		}
+
+		codes, _ := op["x-error-codes"].([]string)
+		if !slices.Equal(codes, r.errorCodes()) {
+			t.Errorf("%s: x-error-codes %v, want %v", key, codes, r.errorCodes())
+		}
+		responses := op["responses"].(map[string]interface{})
+		for _, code := range codes {
+			if _, ok := responses[fmt.Sprint(statuses[code])]; !ok {
+				t.Errorf("%s: no %d response for %s", key, statuses[code], code)
+			}
+		}
+		if limit, _ := op["x-rate-limit"].(string); limit != rateLimitNames[r.RateLimit] {
+			t.Errorf("%s: x-rate-limit %q", key, limit)
+		}
+		if deprecated, _ := op["deprecated"].(bool); deprecated != r.Deprecated {
+			t.Errorf("%s: deprecated = %v", key, deprecated)
+		}
+
+		params, _ := op["parameters"].([]map[string]interface{})
+		shared, _ := item["parameters"].([]map[string]interface{})
+		for _, m := range fiberParamPattern.FindAllStringSubmatch(r.Path, -1) {
+			if !hasPathParam(params, m[1]) && !hasPathParam(shared, m[1]) {
+				t.Errorf("%s: path parameter %s undocumented", key, m[1])
+			}
+		}
+	}
+}
+
+func TestDeprecatedRoute(t *testing.T) {
+	routes, docs := testRoutes()
+	app := fiber.New()
+	mountRoutes(app, routes)
+
+	resp := doRequest(t, app, fiber.MethodGet, "/old-things", "", nil)
+	if resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Deprecation") != "true" || resp.Header.Get("Link") != `</things/{id}>; rel="successor-version"` {
+		t.Errorf("headers: Deprecation %q, Link %q", resp.Header.Get("Deprecation"), resp.Header.Get("Link"))
+	}
+	if resp := doRequest(t, app, fiber.MethodGet, "/hidden", "", nil); resp.Header.Get("Deprecation") != "" {
+		t.Error("current route marked deprecated")
+	}
+
+	op := openAPIPaths(routes, docs)["/old-things"].(map[string]interface{})["get"].(map[string]interface{})
+	if op["deprecated"] != true || !strings.Contains(op["description"].(string), "use GET /things/{id} instead") {
+		t.Errorf("operation = %v", op)
+	}
+}
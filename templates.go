@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TransferTemplate is a saved transfer the user can trigger with one tap.
+// Unlike a standing order it never runs on its own.
+type TransferTemplate struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	UserID     uint      `json:"-" gorm:"index;not null"`
+	ToMemberID string    `json:"to_member_id" gorm:"not null"`
+	Amount     int64     `json:"amount"`
+	Note       string    `json:"note"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// a template's note becomes the transfer's note, so it has the same limit
+const maxTemplateNoteLength = maxTransferNoteLength
+
+type templatePayload struct {
+	ToMemberID string `json:"to_member_id"`
+	Amount     int64  `json:"amount"`
+	Note       string `json:"note"`
+}
+
+func init() {
+	registerInvariant("transfer_template_orphaned",
+		"transfer templates whose user doesn't exist",
+		`SELECT x.id FROM transfer_templates x LEFT JOIN users u ON u.id = x.user_id WHERE u.id IS NULL`)
+}
+
+// validate checks the template fields and that the recipient exists
+func (p templatePayload) validate(owner User) error {
+	if p.ToMemberID == "" || p.Amount <= 0 {
+		return &ValidationError{Message: "to_member_id and positive amount required"}
+	}
+	if p.ToMemberID == owner.MemberID {
+		return ErrSelfTransfer
+	}
+	if utf8.RuneCountInString(p.Note) > maxTemplateNoteLength {
+		return &ValidationError{Message: fmt.Sprintf("note must be at most %d characters", maxTransferNoteLength)}
+	}
+	_, err := findRecipient(p.ToMemberID)
+	return err
+}
+
+// loadTemplate fetches one of the current user's templates by :id
+func loadTemplate(c *fiber.Ctx, user User) (TransferTemplate, bool) {
+	var tpl TransferTemplate
+	err := db.Where("id = ? AND user_id = ?", c.Params("id"), user.ID).First(&tpl).Error
+	return tpl, err == nil
+}
+
+// List the current user's transfer templates
+func listTemplatesHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+
+	var templates []TransferTemplate
+	if err := db.Where("user_id = ?", user.ID).Order("created_at DESC").Find(&templates).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to fetch templates"})
+	}
+	return c.JSON(fiber.Map{"templates": templates})
+}
+
+// Create a transfer template
+func createTemplateHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+
+	var payload templatePayload
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	if err := payload.validate(user); err != nil {
+		return writeError(c, err)
+	}
+	tpl := TransferTemplate{
+		UserID:     user.ID,
+		ToMemberID: payload.ToMemberID,
+		Amount:     payload.Amount,
+		Note:       payload.Note,
+	}
+	if err := db.Create(&tpl).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create template"})
+	}
+	return c.Status(fiber.StatusCreated).JSON(tpl)
+}
+
+// Get a single transfer template
+func getTemplateHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	tpl, ok := loadTemplate(c, u.(User))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "template not found"})
+	}
+	return c.JSON(tpl)
+}
+
+// Replace a transfer template's values
+func updateTemplateHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+
+	tpl, ok := loadTemplate(c, user)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "template not found"})
+	}
+	var payload templatePayload
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	if err := payload.validate(user); err != nil {
+		return writeError(c, err)
+	}
+	tpl.ToMemberID = payload.ToMemberID
+	tpl.Amount = payload.Amount
+	tpl.Note = payload.Note
+	if err := db.Save(&tpl).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to update template"})
+	}
+	return c.JSON(tpl)
+}
+
+// Delete a transfer template
+func deleteTemplateHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	tpl, ok := loadTemplate(c, u.(User))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "template not found"})
+	}
+	if err := db.Delete(&tpl).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to delete template"})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Execute a transfer using a template's recipient and amount
+func transferFromTemplateHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+
+	tpl, ok := loadTemplate(c, user)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "template not found"})
+	}
+	// the template only fixes recipient and amount; PIN and confirmations
+	// still apply
+	var payload struct {
+		ConfirmLarge bool   `json:"confirm_large"`
+		Pin          string `json:"pin"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&payload); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+		}
+	}
+	return executeTransfer(c, user, transferRequest{
+		ToMemberID:   tpl.ToMemberID,
+		Amount:       tpl.Amount,
+		ConfirmLarge: payload.ConfirmLarge,
+		Pin:          payload.Pin,
+		Note:         tpl.Note,
+	})
+}
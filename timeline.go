@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// TransactionEvent records one status transition of a transaction
+type TransactionEvent struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	TransactionID uint      `json:"transaction_id" gorm:"index;not null"`
+	FromStatus    string    `json:"from_status"`
+	ToStatus      string    `json:"to_status"`
+	Actor         string    `json:"actor"` // user, admin, system
+	ActorID       uint      `json:"actor_id,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Actors recorded on transaction events
+const (
+	actorUser   = "user"
+	actorAdmin  = "admin"
+	actorSystem = "system"
+)
+
+// statusCreated is the implicit state before a transaction's first status
+const statusCreated = "created"
+
+// transactionTransitions is the transaction state machine: the statuses
+// each status may move to. Anything not listed is rejected.
+var transactionTransitions = map[string][]string{
+	statusCreated: {"pending", "flagged", "completed", "failed"},
+	"pending":     {"completed", "failed", "declined", "expired", "cancelled"},
+	"flagged":     {"approved", "failed"},
+	"approved":    {"completed"},
+	"completed":   {"reversed", "disputed"},
+	"disputed":    {"completed", "refunded"},
+	"reversed":    {},
+	"refunded":    {},
+	"failed":      {},
+	"declined":    {},
+	"expired":     {},
+	"cancelled":   {},
+}
+
+// InvalidTransitionError is returned for a status change the state machine forbids
+type InvalidTransitionError struct {
+	From, To string
+}
+
+func init() {
+	registerInvariant("transaction_without_timeline",
+		"transactions with no created event",
+		`SELECT t.id FROM transactions t
+			LEFT JOIN transaction_events e ON e.transaction_id = t.id AND e.from_status = 'created'
+			WHERE e.id IS NULL`)
+	registerInvariant("transaction_event_orphaned",
+		"transaction events whose transaction doesn't exist",
+		`SELECT e.id FROM transaction_events e LEFT JOIN transactions t ON t.id = e.transaction_id WHERE t.id IS NULL`)
+	registerInvariant("transaction_event_actor_missing",
+		"transaction events by a user or admin who doesn't exist",
+		`SELECT e.id FROM transaction_events e LEFT JOIN users u ON u.id = e.actor_id
+			WHERE e.actor IN ('user', 'admin') AND u.id IS NULL`)
+}
+
+func (e *InvalidTransitionError) Error() string {
+	if _, known := transactionTransitions[e.From]; !known {
+		return fmt.Sprintf("unknown transaction status %q", e.From)
+	}
+	return fmt.Sprintf("transaction cannot move from %s to %s", e.From, e.To)
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range transactionTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// recordTransactionCreated writes the initial created → status event for a
+// transaction that was just inserted
+func recordTransactionCreated(tx *gorm.DB, txn *Transaction, actor string, actorID uint) error {
+	if !canTransition(statusCreated, txn.Status) {
+		return &InvalidTransitionError{From: statusCreated, To: txn.Status}
+	}
+	return tx.Create(&TransactionEvent{
+		TransactionID: txn.ID,
+		FromStatus:    statusCreated,
+		ToStatus:      txn.Status,
+		Actor:         actor,
+		ActorID:       actorID,
+	}).Error
+}
+
+// transitionTransaction moves txn to a new status, enforcing the state
+// machine and appending the change to the timeline
+func transitionTransaction(tx *gorm.DB, txn *Transaction, to, actor string, actorID uint, reason string) error {
+	from := txn.Status
+	if !canTransition(from, to) {
+		return &InvalidTransitionError{From: from, To: to}
+	}
+	// guard on the old status so a concurrent transition can't be overwritten
+	res := tx.Model(&Transaction{}).Where("id = ? AND status = ?", txn.ID, from).Update("status", to)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected != 1 {
+		return lostTransition(tx, txn, to)
+	}
+	if err := tx.Create(&TransactionEvent{
+		TransactionID: txn.ID,
+		FromStatus:    from,
+		ToStatus:      to,
+		Actor:         actor,
+		ActorID:       actorID,
+		Reason:        reason,
+	}).Error; err != nil {
+		return err
+	}
+	txn.Status = to
+	return nil
+}
+
+// lostTransition explains why txn couldn't move to its new status: another
+// request changed it first, so report the status it has now
+func lostTransition(tx *gorm.DB, txn *Transaction, to string) error {
+	var current Transaction
+	if err := tx.Select("status").First(&current, txn.ID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrTransactionNotFound
+		}
+		return fmt.Errorf("reload transaction %d: %w", txn.ID, err)
+	}
+	if txn.Status == "pending" {
+		return &TransferNotPendingError{Status: current.Status}
+	}
+	return &InvalidTransitionError{From: current.Status, To: to}
+}
+
+// backfillTransactionEvents gives transactions that predate the timeline a
+// single created → current status event
+func backfillTransactionEvents() {
+	err := db.Exec(`INSERT INTO transaction_events (transaction_id, from_status, to_status, actor, actor_id, reason, created_at)
+		SELECT id, ?, status, ?, 0, 'backfill', created_at FROM transactions
+		WHERE id NOT IN (SELECT transaction_id FROM transaction_events)`, statusCreated, actorSystem).Error
+	if err != nil {
+		log.Fatalf("backfill transaction events failed: %v", err)
+	}
+}
+
+// transactionDetail is a transaction view with its description and timeline
+type transactionDetail struct {
+	transactionView
+	Description string             `json:"description"`
+	Timeline    []TransactionEvent `json:"timeline"`
+}
+
+// Get a single transaction with its status timeline
+func transactionDetailHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+	fields, err := parseFields(c, structFields(transactionDetail{}))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	var txn Transaction
+	if err := db.Where("id = ? AND (from_user_id = ? OR to_user_id = ?)", c.Params("id"), user.ID, user.ID).
+		Preload("FromUser", withDeleted).
+		Preload("ToUser", withDeleted).
+		First(&txn).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return writeError(c, ErrTransactionNotFound)
+		}
+		return writeError(c, err)
+	}
+
+	var events []TransactionEvent
+	if err := db.Where("transaction_id = ?", txn.ID).Order("created_at ASC, id ASC").Find(&events).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to fetch timeline"})
+	}
+
+	resp, err := selectFields(transactionDetail{
+		transactionView: formatTransaction(txn, user.ID),
+		Description:     txn.Description,
+		Timeline:        events,
+	}, fields)
+	if err != nil {
+		return writeError(c, err)
+	}
+	return sendFields(c, fields, resp)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// legalTransitions is the state machine spelled out independently of
+// transactionTransitions, so a change to either shows up here
+var legalTransitions = map[[2]string]bool{
+	{statusCreated, "pending"}:   true,
+	{statusCreated, "flagged"}:   true,
+	{statusCreated, "completed"}: true,
+	{statusCreated, "failed"}:    true,
+	{"pending", "completed"}:     true,
+	{"pending", "failed"}:        true,
+	{"pending", "declined"}:      true,
+	{"pending", "expired"}:       true,
+	{"pending", "cancelled"}:     true,
+	{"flagged", "approved"}:      true,
+	{"flagged", "failed"}:        true,
+	{"approved", "completed"}:    true,
+	{"completed", "reversed"}:    true,
+	{"completed", "disputed"}:    true,
+	{"disputed", "completed"}:    true,
+	{"disputed", "refunded"}:     true,
+}
+
+func TestCanTransition(t *testing.T) {
+	for from := range transactionTransitions {
+		for to := range transactionTransitions {
+			want := legalTransitions[[2]string{from, to}]
+			if got := canTransition(from, to); got != want {
+				t.Errorf("canTransition(%s, %s) = %v, want %v", from, to, got, want)
+			}
+		}
+	}
+	if canTransition("bogus", "completed") || canTransition("pending", "bogus") {
+		t.Error("unknown statuses must not transition")
+	}
+}
+
+// insertTransaction stores a transfer between two fresh users in status
+func insertTransaction(t *testing.T, status string) Transaction {
+	t.Helper()
+	from, to := createUser(t, 0), createUser(t, 0)
+	txn := Transaction{FromUserID: from.ID, ToUserID: to.ID, Amount: 10, Type: "transfer", Status: status}
+	if err := db.Create(&txn).Error; err != nil {
+		t.Fatal(err)
+	}
+	return txn
+}
+
+func TestTransitionTransaction(t *testing.T) {
+	resetDB(t)
+	for from := range transactionTransitions {
+		if from == statusCreated {
+			continue
+		}
+		for to := range transactionTransitions {
+			t.Run(from+"→"+to, func(t *testing.T) {
+				txn := insertTransaction(t, from)
+				err := transitionTransaction(db, &txn, to, actorSystem, 0, "test")
+				var stored Transaction
+				if err := db.First(&stored, txn.ID).Error; err != nil {
+					t.Fatal(err)
+				}
+				var events int64
+				db.Model(&TransactionEvent{}).Where("transaction_id = ? AND from_status = ? AND to_status = ?", txn.ID, from, to).Count(&events)
+
+				if legalTransitions[[2]string{from, to}] {
+					if err != nil {
+						t.Fatalf("legal transition failed: %v", err)
+					}
+					if stored.Status != to || txn.Status != to || events != 1 {
+						t.Errorf("status %s (in memory %s), %d events", stored.Status, txn.Status, events)
+					}
+					return
+				}
+				var invalid *InvalidTransitionError
+				if !errors.As(err, &invalid) || invalid.From != from || invalid.To != to {
+					t.Fatalf("err = %v, want InvalidTransitionError", err)
+				}
+				if stored.Status != from || events != 0 {
+					t.Errorf("illegal transition changed the row: status %s, %d events", stored.Status, events)
+				}
+			})
+		}
+	}
+}
+
+func TestTransitionTransactionLostRace(t *testing.T) {
+	resetDB(t)
+	tests := []struct {
+		name         string
+		seen, actual string // status this request loaded, status in the database
+		to           string
+		want         error
+	}{
+		{"pending transfer confirmed twice", "pending", "completed", "completed", &TransferNotPendingError{Status: "completed"}},
+		{"pending transfer cancelled after acceptance", "pending", "completed", "cancelled", &TransferNotPendingError{Status: "completed"}},
+		{"pending transfer accepted after expiry", "pending", "expired", "completed", &TransferNotPendingError{Status: "expired"}},
+		{"completed transfer reversed twice", "completed", "reversed", "reversed", &InvalidTransitionError{From: "reversed", To: "reversed"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			txn := insertTransaction(t, tt.actual)
+			txn.Status = tt.seen
+			err := transitionTransaction(db, &txn, tt.to, actorSystem, 0, "test")
+			if err == nil || err.Error() != tt.want.Error() || fmt.Sprintf("%T", err) != fmt.Sprintf("%T", tt.want) {
+				t.Fatalf("err = %#v, want %#v", err, tt.want)
+			}
+			if status, body := writeErrorResponse(t, err); status != fiber.StatusConflict {
+				t.Errorf("response: status %d, body %s", status, body)
+			}
+		})
+	}
+
+	gone := Transaction{ID: 1 << 30, Status: "pending"}
+	if err := transitionTransaction(db, &gone, "completed", actorSystem, 0, "test"); !errors.Is(err, ErrTransactionNotFound) {
+		t.Errorf("missing transaction: err = %v", err)
+	}
+}
+
+// writeErrorResponse returns the status and body writeError answers err with
+func writeErrorResponse(t *testing.T, err error) (int, string) {
+	t.Helper()
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error { return writeError(c, err) })
+	resp, testErr := app.Test(httptest.NewRequest(fiber.MethodGet, "/", nil), -1)
+	if testErr != nil {
+		t.Fatal(testErr)
+	}
+	defer resp.Body.Close()
+	var body [512]byte
+	n, _ := resp.Body.Read(body[:])
+	return resp.StatusCode, string(body[:n])
+}
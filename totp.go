@@ -0,0 +1,379 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+// Two-factor login with RFC 6238 TOTP (SHA-1, 6 digits, 30s steps). The
+// shared secret is stored AES-GCM encrypted on the user. While 2FA is on,
+// a correct password only earns a short-lived mfa_token that /login/2fa
+// exchanges, together with a code, for real tokens.
+const (
+	totpStep          = 30 * time.Second
+	totpDigits        = 6
+	totpSkewSteps     = 1 // accept one step either side for clock drift
+	totpIssuer        = "LBK Points"
+	mfaTokenTTL       = 5 * time.Minute
+	mfaAudience       = "mfa"
+	recoveryCodeCount = 10
+)
+
+var mfaLoginLimiter = newAttemptLimiter(5, 15*time.Minute)
+
+// RecoveryCode is a single-use backup for a lost authenticator
+type RecoveryCode struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index;not null"`
+	CodeHash  string `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+func init() {
+	registerInvariant("recovery_code_orphaned",
+		"2FA recovery codes whose user doesn't exist",
+		`SELECT x.id FROM recovery_codes x LEFT JOIN users u ON u.id = x.user_id WHERE u.id IS NULL`)
+}
+
+// totpCode computes the code for secret at the given step counter
+func totpCode(secret []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP returns the step code matches within the skew window, or -1
+func matchTOTP(secret []byte, code string, now time.Time) int64 {
+	current := now.Unix() / int64(totpStep.Seconds())
+	for d := int64(-totpSkewSteps); d <= totpSkewSteps; d++ {
+		if hmac.Equal([]byte(totpCode(secret, current+d)), []byte(code)) {
+			return current + d
+		}
+	}
+	return -1
+}
+
+// totpKey is the AES-256 key for secrets at rest: TOTP_ENCRYPTION_KEY, or
+// derived from the JWT secret when unset
+func totpKey() []byte {
+	material := os.Getenv("TOTP_ENCRYPTION_KEY")
+	if material == "" {
+		material = "totp:" + jwtSecret()
+	}
+	sum := sha256.Sum256([]byte(material))
+	return sum[:]
+}
+
+func encryptTOTPSecret(secret []byte) (string, error) {
+	block, err := aes.NewCipher(totpKey())
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, secret, nil)), nil
+}
+
+func decryptTOTPSecret(stored string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(totpKey())
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < gcm.NonceSize() {
+		return nil, errors.New("totp secret too short")
+	}
+	return gcm.Open(nil, raw[:gcm.NonceSize()], raw[gcm.NonceSize():], nil)
+}
+
+// newRecoveryCodes returns fresh codes formatted xxxxx-xxxxx
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		token, err := randomToken()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = token[:5] + "-" + token[5:10]
+	}
+	return codes, nil
+}
+
+// verifySecondFactor accepts a current TOTP code (each step only once) or
+// an unused recovery code
+func verifySecondFactor(user User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits {
+		secret, err := decryptTOTPSecret(user.TOTPSecret)
+		if err != nil {
+			return false, fmt.Errorf("decrypt totp secret: %w", err)
+		}
+		step := matchTOTP(secret, code, time.Now())
+		if step < 0 {
+			return false, nil
+		}
+		// the step guard makes a code single-use even within its window
+		res := db.Model(&User{}).Where("id = ? AND totp_last_step < ?", user.ID, step).Update("totp_last_step", step)
+		return res.RowsAffected == 1, res.Error
+	}
+	res := db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, hashToken(strings.ToLower(code))).
+		Update("used_at", time.Now())
+	if res.RowsAffected == 1 {
+		log.Printf("audit: 2fa recovery code used user=%d", user.ID)
+	}
+	return res.RowsAffected == 1, res.Error
+}
+
+func generateMFAToken(userID uint) (string, error) {
+	claims := jwt.RegisteredClaims{
+		Issuer:    jwtIssuer(),
+		Subject:   fmt.Sprint(userID),
+		Audience:  jwt.ClaimStrings{mfaAudience},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(mfaTokenTTL)),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(jwtSecret()))
+}
+
+// loginResponse finishes a first-factor login: real tokens, or an MFA
+// challenge when the user has 2FA on
+func loginResponse(user User) (fiber.Map, error) {
+	if !user.TOTPEnabled {
+		return issueTokens(user.ID)
+	}
+	token, err := generateMFAToken(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return fiber.Map{
+		"mfa_required": true,
+		"mfa_token":    token,
+		"expires_in":   int(mfaTokenTTL.Seconds()),
+	}, nil
+}
+
+// Exchange an mfa_token and a TOTP or recovery code for tokens
+func loginTwoFactorHandler(c *fiber.Ctx) error {
+	var payload struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	if payload.MFAToken == "" || payload.Code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "mfa_token and code required"})
+	}
+	var claims jwt.RegisteredClaims
+	tok, err := jwt.ParseWithClaims(payload.MFAToken, &claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method")
+		}
+		return []byte(jwtSecret()), nil
+	})
+	if err != nil || !tok.Valid || !claims.VerifyAudience(mfaAudience, true) || !claims.VerifyIssuer(jwtIssuer(), true) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid or expired mfa_token"})
+	}
+	var user User
+	if err := db.First(&user, claims.Subject).Error; err != nil || !user.TOTPEnabled {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid or expired mfa_token"})
+	}
+	if !mfaLoginLimiter.Allow(fmt.Sprint(user.ID)) {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "too many requests"})
+	}
+	ok, err := verifySecondFactor(user, payload.Code)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to verify code"})
+	}
+	if !ok {
+		log.Printf("audit: 2fa login denied user=%d ip=%s", user.ID, clientIP(c))
+		recordLogin(c, user.ID, loginMethodTwoFactor, "invalid_code")
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid code"})
+	}
+	tokens, err := issueTokens(user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate token"})
+	}
+	recordLogin(c, user.ID, loginMethodTwoFactor, "")
+	return sendLoginTokens(c, tokens)
+}
+
+// Start 2FA setup: a new secret (not active until confirmed) and recovery codes
+func setupTwoFactorHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+	if user.TOTPEnabled {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "two-factor authentication is already enabled"})
+	}
+
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate secret"})
+	}
+	encrypted, err := encryptTOTPSecret(secret)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate secret"})
+	}
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate recovery codes"})
+	}
+	err = withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		if err := tx.Model(&User{}).Where("id = ?", user.ID).
+			Updates(map[string]interface{}{"totp_secret": encrypted, "totp_last_step": 0}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		for _, code := range codes {
+			if err := tx.Create(&RecoveryCode{UserID: user.ID, CodeHash: hashToken(code)}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to start two-factor setup"})
+	}
+
+	encodedSecret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+	params := url.Values{}
+	params.Set("secret", encodedSecret)
+	params.Set("issuer", totpIssuer)
+	params.Set("digits", strconv.Itoa(totpDigits))
+	params.Set("period", strconv.Itoa(int(totpStep.Seconds())))
+	uri := "otpauth://totp/" + url.PathEscape(totpIssuer+":"+user.Email) + "?" + params.Encode()
+	return c.JSON(fiber.Map{
+		"secret":         encodedSecret,
+		"otpauth_uri":    uri,
+		"recovery_codes": codes,
+	})
+}
+
+// Turn 2FA on by proving the authenticator app produces valid codes
+func enableTwoFactorHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+	var payload struct {
+		Code string `json:"code"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	if user.TOTPEnabled {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "two-factor authentication is already enabled"})
+	}
+	if user.TOTPSecret == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "call /me/2fa/setup first"})
+	}
+	// only an authenticator code proves the setup worked, not a recovery code
+	if len(strings.TrimSpace(payload.Code)) != totpDigits {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid code"})
+	}
+	ok, err := verifySecondFactor(user, payload.Code)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to verify code"})
+	}
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid code"})
+	}
+	if err := db.Model(&User{}).Where("id = ?", user.ID).Update("totp_enabled", true).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to enable two-factor authentication"})
+	}
+	log.Printf("audit: 2fa enabled user=%d ip=%s", user.ID, clientIP(c))
+	return c.JSON(fiber.Map{"message": "two-factor authentication enabled"})
+}
+
+// Turn 2FA off; the route needs elevation, and both the password (if the
+// account has one) and a current code
+func disableTwoFactorHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+	var payload struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	if (hasPassword(user) && payload.Password == "") || payload.Code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "password and code required"})
+	}
+	if !user.TOTPEnabled {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "two-factor authentication is not enabled"})
+	}
+	if !mfaLoginLimiter.Allow(fmt.Sprint(user.ID)) {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "too many requests"})
+	}
+	if !passwordConfirmed(user, payload.Password) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid credentials"})
+	}
+	ok, err := verifySecondFactor(user, payload.Code)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to verify code"})
+	}
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid credentials"})
+	}
+	err = withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		if err := tx.Model(&User{}).Where("id = ?", user.ID).
+			Updates(map[string]interface{}{"totp_enabled": false, "totp_secret": "", "totp_last_step": 0}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&RecoveryCode{}).Error
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to disable two-factor authentication"})
+	}
+	log.Printf("audit: 2fa disabled user=%d ip=%s", user.ID, clientIP(c))
+	return c.JSON(fiber.Map{"message": "two-factor authentication disabled"})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// enableTOTP turns 2FA on for user and returns the shared secret
+func enableTOTP(t *testing.T, user User) []byte {
+	t.Helper()
+	secret := []byte("12345678901234567890")
+	encrypted, err := encryptTOTPSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&User{}).Where("id = ?", user.ID).
+		Updates(map[string]interface{}{"totp_secret": encrypted, "totp_enabled": true, "totp_last_step": 0}).Error; err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+// totpCodeAt is the code for the step offset steps from now; each step is
+// accepted once, so a test using several codes moves forward through them
+func totpCodeAt(secret []byte, offset int64) string {
+	return totpCode(secret, time.Now().Unix()/int64(totpStep.Seconds())+offset)
+}
+
+func TestDisableTwoFactorRequiresElevation(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	user := createUser(t, 0)
+	secret := enableTOTP(t, user)
+	token := tokenFor(t, user)
+
+	status, body := doJSON(t, app, fiber.MethodPost, "/me/2fa/disable", token,
+		fiber.Map{"password": testPassword, "code": totpCodeAt(secret, 0)})
+	if status != fiber.StatusUnauthorized || errorCodeOf(body) != "ELEVATION_REQUIRED" {
+		t.Fatalf("without elevation: status %d, body %v", status, body)
+	}
+	if !reloadUser(t, user).TOTPEnabled {
+		t.Fatal("2FA disabled without elevation")
+	}
+
+	status, body = doJSON(t, app, fiber.MethodPost, "/me/2fa/disable", token,
+		fiber.Map{"password": testPassword, "code": totpCodeAt(secret, 0)}, elevationHeader, elevatedTokenFor(t, user))
+	if status != fiber.StatusOK {
+		t.Fatalf("with elevation: status %d, body %v", status, body)
+	}
+	if reloadUser(t, user).TOTPEnabled {
+		t.Error("2FA still enabled")
+	}
+}
+
+func TestElevateWithTwoFactor(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	user := createUser(t, 0)
+	secret := enableTOTP(t, user)
+	token := tokenFor(t, user)
+
+	tests := []struct {
+		name    string
+		payload fiber.Map
+		want    int
+	}{
+		{"password only", fiber.Map{"password": testPassword}, fiber.StatusBadRequest},
+		{"wrong code", fiber.Map{"password": testPassword, "code": "000000"}, fiber.StatusUnauthorized},
+		{"wrong password", fiber.Map{"password": "wrong", "code": totpCodeAt(secret, -1)}, fiber.StatusUnauthorized},
+		{"password and code", fiber.Map{"password": testPassword, "code": totpCodeAt(secret, 0)}, fiber.StatusOK},
+		{"replayed code", fiber.Map{"password": testPassword, "code": totpCodeAt(secret, 0)}, fiber.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := doJSON(t, app, fiber.MethodPost, "/auth/elevate", token, tt.payload)
+			if status != tt.want {
+				t.Fatalf("status %d, want %d, body %v", status, tt.want, body)
+			}
+			if tt.want == fiber.StatusOK && body["elevated_token"] == nil {
+				t.Errorf("no elevated_token in %v", body)
+			}
+		})
+	}
+}
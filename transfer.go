@@ -0,0 +1,423 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// transferRequest is the input to a points transfer
+type transferRequest struct {
+	ToMemberID   string `json:"to_member_id"`
+	Amount       int64  `json:"amount"`
+	ConfirmLarge bool   `json:"confirm_large"`
+	SendAll      bool   `json:"send_all"`
+	// RequireAccept holds the points until the recipient accepts, see accept.go
+	RequireAccept bool   `json:"require_accept"`
+	Pin           string `json:"pin"`
+	Note          string `json:"note"` // optional memo shown to both members
+
+	// Idempotency stores the response with the transfer, see idempotency.go
+	Idempotency *idempotencyClaim `json:"-"`
+	// Fulfils is the point request this transfer pays, see pointrequest.go
+	Fulfils *PointRequest `json:"-"`
+}
+
+// maxTransferNoteLength caps a transfer note, in characters
+const maxTransferNoteLength = 200
+
+// sanitizeNote strips control characters (including newlines) and
+// surrounding whitespace from a transfer note
+func sanitizeNote(note string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, note))
+}
+
+// transferResult is what a transfer committed. A Pending transfer has
+// moved no points yet and waits for /transfer/confirm; an
+// AwaitingAcceptance one holds them until the recipient accepts.
+type transferResult struct {
+	Transaction        Transaction
+	Recipient          User
+	Remaining          int64 // sender's balance after commit
+	Pending            bool
+	AwaitingAcceptance bool
+}
+
+func init() {
+	registerInvariant("transactions_missing_user",
+		"transactions whose sender or recipient doesn't exist (adjustments and expiries have no sender)",
+		`SELECT t.id FROM transactions t
+			LEFT JOIN users f ON f.id = t.from_user_id
+			LEFT JOIN users r ON r.id = t.to_user_id
+			WHERE (f.id IS NULL AND t.type NOT IN ('adjustment', 'expiry')) OR r.id IS NULL`)
+	// an admin adjustment with allow_negative may leave a balance below
+	// zero on purpose; only a balance lower than any such adjustment left
+	// it at is a violation
+	registerInvariant("negative_balance",
+		"users with a negative points balance no allow_negative adjustment accounts for",
+		`SELECT u.id FROM users u
+			WHERE u.points < 0 AND NOT EXISTS (
+				SELECT 1 FROM transactions t
+				WHERE t.to_user_id = u.id AND t.type = 'adjustment' AND t.allow_negative
+					AND t.to_balance_after <= u.points)`)
+	// a transaction's points moved when it first completed, which for a
+	// confirmed pending transfer is later than its ID suggests. The sender
+	// of a transfer awaiting acceptance pays when it's created and is
+	// refunded if it's declined or expires, see accept.go.
+	registerInvariant("balance_after_mismatch",
+		"users whose latest recorded balance_after differs from their balance",
+		`SELECT latest.user_id FROM (
+				SELECT s.user_id, s.balance_after,
+					ROW_NUMBER() OVER (PARTITION BY s.user_id ORDER BY s.moved_at DESC) AS rn
+				FROM (
+					SELECT t.from_user_id AS user_id, t.from_balance_after AS balance_after, MIN(e.id) AS moved_at
+						FROM transactions t JOIN transaction_events e ON e.transaction_id = t.id AND e.to_status = 'completed'
+						WHERE t.from_balance_after IS NOT NULL AND NOT t.accept_required
+						GROUP BY t.id, t.from_user_id, t.from_balance_after
+					UNION ALL
+					SELECT t.from_user_id, t.from_balance_after, MAX(e.id)
+						FROM transactions t JOIN transaction_events e ON e.transaction_id = t.id AND e.to_status IN ('pending', 'declined', 'expired', 'cancelled')
+						WHERE t.from_balance_after IS NOT NULL AND t.accept_required
+						GROUP BY t.id, t.from_user_id, t.from_balance_after
+					UNION ALL
+					SELECT t.to_user_id, t.to_balance_after, MIN(e.id)
+						FROM transactions t JOIN transaction_events e ON e.transaction_id = t.id AND e.to_status = 'completed'
+						WHERE t.to_balance_after IS NOT NULL
+						GROUP BY t.id, t.to_user_id, t.to_balance_after
+				) s
+			) latest JOIN users u ON u.id = latest.user_id
+			WHERE latest.rn = 1 AND latest.balance_after <> u.points`)
+}
+
+// largeTransferFraction is the share of the balance above which a transfer
+// needs confirm_large (LARGE_TRANSFER_FRACTION, default 0.8)
+func largeTransferFraction() float64 {
+	if s := os.Getenv("LARGE_TRANSFER_FRACTION"); s != "" {
+		if f, err := strconv.ParseFloat(s, 64); err == nil && f > 0 && f <= 1 {
+			return f
+		}
+	}
+	return 0.8
+}
+
+func isLargeRelativeTransfer(amount, balance int64) bool {
+	if balance <= 0 {
+		return false
+	}
+	return float64(amount) > largeTransferFraction()*float64(balance)
+}
+
+// allowCrossPartner reports whether members may transact across partner
+// programs (ALLOW_CROSS_PARTNER=true)
+func allowCrossPartner() bool {
+	return envBool("ALLOW_CROSS_PARTNER")
+}
+
+// findRecipient looks up a transfer recipient by member ID
+func findRecipient(memberID string) (User, error) {
+	var user User
+	err := db.Where("member_id = ?", memberID).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return user, ErrRecipientNotFound
+	}
+	if err != nil {
+		return user, fmt.Errorf("find recipient: %w", err)
+	}
+	return user, nil
+}
+
+// transferEligibility returns the error any transfer from fromUser to
+// toUser would fail with right now, whatever the amount, or nil if one can
+// go through. It applies transferPoints' checks that don't need an amount
+// or PIN, so search results can say up front whether to offer a transfer.
+func transferEligibility(fromUser, toUser User) error {
+	switch {
+	case !fromUser.EmailVerified:
+		return ErrEmailNotVerified
+	case fromUser.MemberID == "":
+		return ErrMemberIDRequired
+	case fromUser.PinHash == "":
+		return ErrPinNotSet
+	case fromUser.PinLockedUntil != nil && fromUser.PinLockedUntil.After(time.Now()):
+		return ErrPinLocked
+	case fromUser.Points <= 0:
+		return ErrInsufficientPoints
+	case toUser.IsSynthetic != fromUser.IsSynthetic:
+		return ErrSyntheticMismatch
+	case !allowCrossPartner() && toUser.PartnerID != fromUser.PartnerID:
+		return ErrCrossPartner
+	}
+	// the smallest possible transfer only fails once today's limit is used up
+	return checkTransferLimits(db, fromUser, 1)
+}
+
+// transferPoints validates and performs a transfer from fromUser. Every
+// entry point that moves points between members goes through here so
+// limits and checks apply uniformly. Failures are domain errors.
+func transferPoints(fromUser User, req transferRequest) (*transferResult, error) {
+	// "send all" transfers the whole balance
+	if req.SendAll {
+		req.Amount = fromUser.Points
+	}
+
+	if !fromUser.EmailVerified {
+		return nil, ErrEmailNotVerified
+	}
+
+	if fromUser.MemberID == "" {
+		return nil, ErrMemberIDRequired
+	}
+
+	if req.ToMemberID == "" || req.Amount <= 0 {
+		return nil, &ValidationError{Message: "to_member_id and positive amount required"}
+	}
+	req.Note = sanitizeNote(req.Note)
+	if utf8.RuneCountInString(req.Note) > maxTransferNoteLength {
+		tooLong := fmt.Sprintf("must be at most %d characters", maxTransferNoteLength)
+		return nil, &ValidationError{Message: "note " + tooLong, Fields: map[string]string{"note": tooLong}}
+	}
+
+	if req.ToMemberID == fromUser.MemberID {
+		return nil, ErrSelfTransfer
+	}
+
+	if err := verifyTransferPin(fromUser, req.Pin); err != nil {
+		return nil, err
+	}
+
+	// Check if sender has enough points
+	if fromUser.Points < req.Amount {
+		return nil, ErrInsufficientPoints
+	}
+
+	// Unusually large share of the balance needs explicit confirmation
+	if !req.SendAll && !req.ConfirmLarge && isLargeRelativeTransfer(req.Amount, fromUser.Points) {
+		return nil, &LargeRelativeTransferError{Percentage: req.Amount * 100 / fromUser.Points}
+	}
+
+	toUser, err := findRecipient(req.ToMemberID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Smoke-test accounts only ever transact among themselves
+	if toUser.IsSynthetic != fromUser.IsSynthetic {
+		return nil, ErrSyntheticMismatch
+	}
+
+	// Transfers stay within a partner program unless explicitly allowed
+	if !allowCrossPartner() && toUser.PartnerID != fromUser.PartnerID {
+		return nil, ErrCrossPartner
+	}
+
+	// The recipient accepts before the points are theirs, when asked to or
+	// above TRANSFER_ACCEPT_THRESHOLD; this replaces the sender's confirmation.
+	// Paying a point request skips both: the recipient asked for the amount,
+	// and paying it is the sender's confirmation.
+	if req.Fulfils == nil && requiresAcceptance(req) {
+		return createHeldTransfer(fromUser, toUser, req)
+	}
+
+	// Large transfers wait for an explicit confirmation before points move
+	if req.Fulfils == nil && req.Amount > transferConfirmThreshold() {
+		return createPendingTransfer(fromUser, toUser, req)
+	}
+
+	// Move the points and record the transaction atomically
+	result := &transferResult{Recipient: toUser}
+	err = withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		if err := movePoints(tx, fromUser, toUser.ID, req.Amount); err != nil {
+			return err
+		}
+		// Read back both balances as they will be committed
+		fromAfter, toAfter, err := balancesOf(tx, fromUser.ID, toUser.ID)
+		if err != nil {
+			return err
+		}
+		result.Remaining = fromAfter
+
+		// Create transaction record
+		result.Transaction = Transaction{
+			FromUserID:       fromUser.ID,
+			ToUserID:         toUser.ID,
+			Amount:           req.Amount,
+			Type:             "transfer",
+			Status:           "completed",
+			Description:      fmt.Sprintf("Transfer to %s %s", toUser.FirstName, toUser.LastName),
+			Note:             req.Note,
+			FromBalanceAfter: &fromAfter,
+			ToBalanceAfter:   &toAfter,
+		}
+		if err := tx.Create(&result.Transaction).Error; err != nil {
+			return fmt.Errorf("create transaction record: %w", err)
+		}
+		if err := recordTransactionCreated(tx, &result.Transaction, actorUser, fromUser.ID); err != nil {
+			return fmt.Errorf("record transaction event: %w", err)
+		}
+		if err := req.Fulfils.fulfil(tx, result.Transaction); err != nil {
+			return err
+		}
+		status, body := transferResponse(result)
+		return req.Idempotency.store(tx, status, body)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("transfer from user %d: %w", fromUser.ID, err)
+	}
+	return result, nil
+}
+
+// balanceOf reads userID's balance as tx sees it
+func balanceOf(tx *gorm.DB, userID uint) (int64, error) {
+	var balance int64
+	if err := tx.Model(&User{}).Where("id = ?", userID).Select("points").Scan(&balance).Error; err != nil {
+		return 0, fmt.Errorf("read balance of user %d: %w", userID, err)
+	}
+	return balance, nil
+}
+
+// balancesOf reads both parties' balances as tx sees them
+func balancesOf(tx *gorm.DB, fromUserID, toUserID uint) (fromAfter, toAfter int64, err error) {
+	if fromAfter, err = balanceOf(tx, fromUserID); err != nil {
+		return 0, 0, err
+	}
+	if toAfter, err = balanceOf(tx, toUserID); err != nil {
+		return 0, 0, err
+	}
+	return fromAfter, toAfter, nil
+}
+
+// movePoints moves amount from fromUser to toUserID inside tx, re-checking
+// the balance and daily limit under a lock on the sender's row
+func movePoints(tx *gorm.DB, fromUser User, toUserID uint, amount int64) error {
+	if _, err := debitPoints(tx, fromUser, amount); err != nil {
+		return err
+	}
+	return creditPoints(tx, toUserID, amount)
+}
+
+// debitPoints takes amount off fromUser's balance inside tx after checking
+// it and their transfer limits under a lock on their row, and returns what
+// it took from each of their points lots
+func debitPoints(tx *gorm.DB, fromUser User, amount int64) ([]lotTake, error) {
+	// Lock the sender's row and re-check the balance so concurrent
+	// transfers can't overdraw it (no-op lock on SQLite, which
+	// serializes writers anyway)
+	var sender User
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "points").
+		First(&sender, fromUser.ID).Error; err != nil {
+		return nil, fmt.Errorf("lock sender: %w", err)
+	}
+	if sender.Points < amount {
+		return nil, ErrInsufficientPoints
+	}
+	// summed under the sender lock so concurrent transfers can't both
+	// squeeze under the limit
+	if err := checkTransferLimits(tx, fromUser, amount); err != nil {
+		return nil, err
+	}
+
+	// Deduct points from sender; the balance guard in the UPDATE itself
+	// holds even where the locking read above isn't enforced
+	res := tx.Model(&User{}).Where("id = ? AND points >= ?", fromUser.ID, amount).
+		Update("points", gorm.Expr("points - ?", amount))
+	if res.Error != nil {
+		return nil, fmt.Errorf("deduct points: %w", res.Error)
+	}
+	if res.RowsAffected != 1 {
+		return nil, ErrInsufficientPoints
+	}
+	return consumePointsLots(tx, fromUser.ID, amount)
+}
+
+// creditPoints adds amount to toUserID's balance inside tx
+func creditPoints(tx *gorm.DB, toUserID uint, amount int64) error {
+	// if the account vanished since it was looked up, fail rather than
+	// deduct points that land nowhere
+	res := tx.Model(&User{}).Where("id = ?", toUserID).
+		Update("points", gorm.Expr("points + ?", amount))
+	if res.Error != nil {
+		return fmt.Errorf("add points: %w", res.Error)
+	}
+	if res.RowsAffected != 1 {
+		return ErrRecipientNotFound
+	}
+	return openPointsLot(tx, toUserID, amount)
+}
+
+// Transfer points handler
+func transferHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	fromUser := u.(User)
+
+	var payload transferRequest
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+	}
+	// a retry may re-enter the PIN, and the hash shouldn't hold it anyway
+	hashed := payload
+	hashed.Pin = ""
+	claim, record, err := claimIdempotencyKey(c, fromUser.ID, hashed)
+	if err != nil {
+		return writeError(c, err)
+	}
+	if record != nil {
+		return claim.replay(c, record)
+	}
+	payload.Idempotency = claim
+	return executeTransfer(c, fromUser, payload)
+}
+
+// executeTransfer runs transferPoints and writes the HTTP response
+func executeTransfer(c *fiber.Ctx, fromUser User, req transferRequest) error {
+	result, err := transferPoints(fromUser, req)
+	if err != nil {
+		// a concurrent request with the same key may have stored its
+		// response first, rolling this one back
+		if req.Idempotency != nil {
+			if record, _ := req.Idempotency.existing(); record != nil {
+				return req.Idempotency.replay(c, record)
+			}
+		}
+		return writeError(c, err)
+	}
+	status, body := transferResponse(result)
+	return c.Status(status).JSON(body)
+}
+
+// transferResponse is the status and body reporting a transfer's result
+func transferResponse(result *transferResult) (int, fiber.Map) {
+	if result.Pending {
+		return fiber.StatusAccepted, pendingTransferResponse(result)
+	}
+	if result.AwaitingAcceptance {
+		return fiber.StatusAccepted, heldTransferResponse(result)
+	}
+	return fiber.StatusOK, fiber.Map{
+		"message":            "Transfer successful",
+		"transaction_id":     result.Transaction.ID,
+		"remaining_points":   result.Remaining,
+		"transferred_amount": result.Transaction.Amount,
+		"recipient": fiber.Map{
+			"member_id":  result.Recipient.MemberID,
+			"first_name": result.Recipient.FirstName,
+			"last_name":  result.Recipient.LastName,
+		},
+	}
+}
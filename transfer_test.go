@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+func TestConcurrentTransfersNeverOverdraw(t *testing.T) {
+	resetDB(t)
+	const (
+		transfers = 100
+		amount    = 15
+		balance   = 1000
+	)
+	alice := createUser(t, balance)
+	bob := createUser(t, 0)
+
+	// every transfer starts from the same stale snapshot of alice, as
+	// concurrent requests authenticated at the same moment would
+	var wg sync.WaitGroup
+	errs := make(chan error, transfers)
+	for range transfers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := transferPoints(alice, transferRequest{ToMemberID: bob.MemberID, Amount: amount, Pin: testPin})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, ErrInsufficientPoints):
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if want := balance / amount; succeeded != want {
+		t.Errorf("%d transfers succeeded, want %d", succeeded, want)
+	}
+
+	aliceAfter, bobAfter := reloadUser(t, alice).Points, reloadUser(t, bob).Points
+	if aliceAfter < 0 || bobAfter < 0 {
+		t.Fatalf("negative balance: alice %d, bob %d", aliceAfter, bobAfter)
+	}
+	if aliceAfter != balance-int64(succeeded*amount) || aliceAfter+bobAfter != balance {
+		t.Errorf("balances alice %d, bob %d after %d transfers of %d", aliceAfter, bobAfter, succeeded, amount)
+	}
+	var recorded int64
+	db.Model(&Transaction{}).Where("from_user_id = ? AND status = ?", alice.ID, "completed").Count(&recorded)
+	if recorded != int64(succeeded) {
+		t.Errorf("%d transactions recorded for %d transfers", recorded, succeeded)
+	}
+	assertInvariants(t)
+}
+
+func TestConcurrentTransfersAndAdjustments(t *testing.T) {
+	resetDB(t)
+	const (
+		operations = 50
+		transfer   = 20
+		credit     = 10
+		debit      = -30
+		balance    = 600
+	)
+	alice := createUser(t, balance)
+	bob := createUser(t, 0)
+	admin := createUser(t, 0)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	transferred, adjusted := 0, int64(0)
+	for i := range operations {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			switch i % 3 {
+			case 0:
+				_, err := transferPoints(alice, transferRequest{ToMemberID: bob.MemberID, Amount: transfer, Pin: testPin})
+				if err != nil && !errors.Is(err, ErrInsufficientPoints) {
+					t.Errorf("transfer: %v", err)
+				}
+				if err == nil {
+					mu.Lock()
+					transferred++
+					mu.Unlock()
+				}
+			default:
+				delta := int64(credit)
+				if i%3 == 2 {
+					delta = debit
+				}
+				_, _, err := adjustPoints(alice.ID, delta, "concurrency test", false, admin)
+				var negative *NegativeBalanceError
+				if err != nil && !errors.As(err, &negative) {
+					t.Errorf("adjust %d: %v", delta, err)
+				}
+				if err == nil {
+					mu.Lock()
+					adjusted += delta
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	aliceAfter, bobAfter := reloadUser(t, alice).Points, reloadUser(t, bob).Points
+	if aliceAfter < 0 || bobAfter < 0 {
+		t.Fatalf("negative balance: alice %d, bob %d", aliceAfter, bobAfter)
+	}
+	if want := balance - int64(transferred*transfer) + adjusted; aliceAfter != want {
+		t.Errorf("alice has %d, want %d after %d transfers and %+d adjusted", aliceAfter, want, transferred, adjusted)
+	}
+	if want := int64(transferred * transfer); bobAfter != want {
+		t.Errorf("bob has %d, want %d", bobAfter, want)
+	}
+	assertInvariants(t)
+}
+
+func TestTransferToVanishedRecipient(t *testing.T) {
+	resetDB(t)
+	alice := createUser(t, 100)
+	bob := createUser(t, 0)
+	if err := db.Delete(&User{}, bob.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	err := withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		return movePoints(tx, alice, bob.ID, 40)
+	})
+	if !errors.Is(err, ErrRecipientNotFound) {
+		t.Fatalf("err = %v, want ErrRecipientNotFound", err)
+	}
+	if got := reloadUser(t, alice).Points; got != 100 {
+		t.Errorf("sender balance = %d, want 100", got)
+	}
+}
+
+func TestTransferNoteRoundTrip(t *testing.T) {
+	resetDB(t)
+	app := newTestApp(t)
+	sender := createUser(t, 1000)
+	recipient := createUser(t, 0)
+	token := tokenFor(t, sender)
+	// 200 characters but far more bytes: Thai with its vowel marks, and emoji
+	longest := strings.Repeat("สวัสดี", 30) + strings.Repeat("🎉", 20)
+
+	for _, tc := range []struct {
+		name, note, stored string
+	}{
+		{"200 characters", longest, longest},
+		{"200 characters once trimmed", "  " + longest + "\n", longest},
+		{"whitespace only", " \t\n\u3000 ", ""},
+		{"control characters", "ค่า\x00กาแฟ\r\n☕\u0007", "ค่ากาแฟ☕"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			status, body := doJSON(t, app, fiber.MethodPost, "/transfer", token,
+				fiber.Map{"to_member_id": recipient.MemberID, "amount": 1, "pin": testPin, "note": tc.note})
+			if status != fiber.StatusOK {
+				t.Fatalf("status %d, body %v", status, body)
+			}
+			id := body["transaction_id"].(float64)
+
+			status, body = doJSON(t, app, fiber.MethodGet, fmt.Sprintf("/transactions/%v", id), token, nil)
+			if status != fiber.StatusOK || body["note"] != tc.stored {
+				t.Errorf("detail: status %d, note %q, want %q", status, body["note"], tc.stored)
+			}
+			status, body = doJSON(t, app, fiber.MethodGet, "/transactions/recent?page_size=1", tokenFor(t, recipient), nil)
+			if status != fiber.StatusOK {
+				t.Fatalf("recent: status %d, body %v", status, body)
+			}
+			if list := body["transactions"].([]interface{}); len(list) != 1 || list[0].(map[string]interface{})["note"] != tc.stored {
+				t.Errorf("recipient's history = %v, want note %q", list, tc.stored)
+			}
+		})
+	}
+
+	status, body := doJSON(t, app, fiber.MethodPost, "/transfer", token,
+		fiber.Map{"to_member_id": recipient.MemberID, "amount": 1, "pin": testPin, "note": longest + "!"})
+	if status != fiber.StatusBadRequest || errorCodeOf(body) != "INVALID_REQUEST" {
+		t.Errorf("201 characters: status %d, body %v", status, body)
+	}
+	if fields, _ := body["fields"].(map[string]interface{}); fields["note"] == nil {
+		t.Errorf("201 characters: fields = %v, want note explained", body["fields"])
+	}
+	if got := reloadUser(t, sender).Points; got != 996 {
+		t.Errorf("sender balance = %d, want 996 after four transfers", got)
+	}
+}
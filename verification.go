@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// VerificationToken proves the holder received mail at the user's address
+type VerificationToken struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"index;not null"`
+	TokenHash string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+const verificationTTL = 24 * time.Hour
+
+var verificationResendLimiter = newAttemptLimiter(3, 15*time.Minute)
+
+func init() {
+	registerInvariant("verification_token_orphaned",
+		"verification tokens whose user doesn't exist",
+		`SELECT x.id FROM verification_tokens x LEFT JOIN users u ON u.id = x.user_id WHERE u.id IS NULL`)
+}
+
+// createVerificationToken stores a new token for user and returns the
+// verification link to email
+func createVerificationToken(tx *gorm.DB, c *fiber.Ctx, user User) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	if err := tx.Create(&VerificationToken{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(verificationTTL),
+	}).Error; err != nil {
+		return "", err
+	}
+	return externalURL(c, "/verify?token="+token), nil
+}
+
+func sendVerificationEmail(user User, link string) error {
+	body := fmt.Sprintf("Hi %s,\n\nConfirm your email address to start transferring points. The link expires in 24 hours.\n\n%s",
+		user.FirstName, link)
+	return mailer.Send(user.Email, "Confirm your LBK email address", body)
+}
+
+// markEmailVerified records that the user has shown they control their
+// email address
+func markEmailVerified(tx *gorm.DB, userID uint) error {
+	return tx.Model(&User{}).Where("id = ?", userID).Update("email_verified", true).Error
+}
+
+// Send a new verification email to the current user
+func resendVerificationHandler(c *fiber.Ctx) error {
+	u := c.Locals("user")
+	if u == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	user := u.(User)
+
+	if user.EmailVerified {
+		return c.JSON(fiber.Map{"message": "email already verified"})
+	}
+	if !verificationResendLimiter.Allow(fmt.Sprint(user.ID)) {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "too many requests"})
+	}
+	link, err := createVerificationToken(db, c, user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create verification token"})
+	}
+	if err := sendVerificationEmail(user, link); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to send verification email"})
+	}
+	return c.JSON(fiber.Map{"message": "verification email sent"})
+}
+
+// Confirm an email address from the emailed link
+func verifyEmailHandler(c *fiber.Ctx) error {
+	token := c.Query("token")
+	if token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "token required"})
+	}
+	invalid := false
+	err := withinTx(func(tx *gorm.DB, hooks *txHooks) error {
+		now := time.Now()
+		res := tx.Model(&VerificationToken{}).
+			Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashToken(token), now).
+			Update("used_at", now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 1 {
+			invalid = true
+			return nil
+		}
+		var vt VerificationToken
+		if err := tx.Where("token_hash = ?", hashToken(token)).First(&vt).Error; err != nil {
+			return err
+		}
+		return markEmailVerified(tx, vt.UserID)
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to verify email"})
+	}
+	if invalid {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid or expired verification link"})
+	}
+	return c.JSON(fiber.Map{"message": "email verified"})
+}
+
+// queueVerificationEmail creates a token inside tx and sends the email once
+// the transaction commits; a failed send is logged, the user can resend
+func queueVerificationEmail(tx *gorm.DB, hooks *txHooks, c *fiber.Ctx, user User) error {
+	link, err := createVerificationToken(tx, c, user)
+	if err != nil {
+		return err
+	}
+	hooks.AfterCommit(func() {
+		if err := sendVerificationEmail(user, link); err != nil {
+			log.Printf("send verification email to user %d: %v", user.ID, err)
+		}
+	})
+	return nil
+}